@@ -5,7 +5,9 @@ import (
 	"net"
 )
 
-func Copy(dst io.Writer, src *ReaderV) (n int64, err error) {
+// Copy copies src to dst until an error occurs. If progress is not nil,
+// it is called with the number of bytes of each write.
+func Copy(dst io.Writer, src *ReaderV, progress func(n int64)) (n int64, err error) {
 	for {
 		var buffers net.Buffers
 		buffers, err = src.ReadVectorized()
@@ -18,6 +20,9 @@ func Copy(dst io.Writer, src *ReaderV) (n int64, err error) {
 		written, err = buffers.WriteTo(dst)
 
 		PutMulti(buffers)
+		if progress != nil && written > 0 {
+			progress(written)
+		}
 		if err != nil {
 			return
 		}
@@ -0,0 +1,107 @@
+package rate
+
+import (
+	"sync"
+	"time"
+)
+
+// Bucket is a token bucket refilled at a constant rate.
+// The zero value is not usable, use NewBucket.
+type Bucket struct {
+	mutex  sync.Mutex
+	rate   float64 // tokens per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewBucket creates a full bucket holding at most burst tokens
+// and refilled with rate tokens per second.
+func NewBucket(rate, burst float64) *Bucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &Bucket{
+		rate:   rate,
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+func (b *Bucket) refillLocked(now time.Time) {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens += elapsed * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	b.last = now
+}
+
+// Allow takes one token if available.
+func (b *Bucket) Allow() bool {
+	return b.AllowN(1)
+}
+
+// AllowN takes n tokens if available.
+func (b *Bucket) AllowN(n float64) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.refillLocked(time.Now())
+	if b.tokens < n {
+		return false
+	}
+	b.tokens -= n
+	return true
+}
+
+// full reports whether the bucket has refilled completely, so it can be dropped.
+func (b *Bucket) full(now time.Time) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.refillLocked(now)
+	return b.tokens >= b.burst
+}
+
+// KeyedLimiter keeps one bucket per key, such as per client IP.
+// Buckets that have refilled completely are dropped from time to time.
+type KeyedLimiter struct {
+	rate    float64
+	burst   float64
+	mutex   sync.Mutex
+	buckets map[string]*Bucket
+	swept   time.Time
+}
+
+// NewKeyedLimiter creates a limiter giving each key rate tokens per second
+// and a burst of burst tokens.
+func NewKeyedLimiter(rate, burst float64) *KeyedLimiter {
+	return &KeyedLimiter{
+		rate:    rate,
+		burst:   burst,
+		buckets: make(map[string]*Bucket),
+		swept:   time.Now(),
+	}
+}
+
+// Allow takes one token from the bucket of key if available.
+func (l *KeyedLimiter) Allow(key string) bool {
+	now := time.Now()
+	l.mutex.Lock()
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = NewBucket(l.rate, l.burst)
+		l.buckets[key] = bucket
+	}
+	if now.Sub(l.swept) > time.Minute {
+		l.swept = now
+		for k, b := range l.buckets {
+			if b != bucket && b.full(now) {
+				delete(l.buckets, k)
+			}
+		}
+	}
+	l.mutex.Unlock()
+	return bucket.Allow()
+}
@@ -0,0 +1,76 @@
+package rate
+
+import "time"
+
+// Take removes n tokens, going into debt if there are not enough,
+// and returns how long to wait until the debt is paid back.
+func (b *Bucket) Take(n float64) time.Duration {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.refillLocked(time.Now())
+	b.tokens -= n
+	if b.tokens >= 0 || b.rate <= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// Shaper limits the speed of a stream by a chain of buckets counting bytes,
+// such as the buckets of a player, of a service and of the whole proxy.
+// Streams pay for what they have sent and then wait, so no goroutine or
+// timer is needed. A nil Shaper does not limit anything.
+type Shaper struct {
+	buckets []*Bucket
+	chunk   int64
+}
+
+const (
+	minChunk = 4 * 1024
+	maxChunk = 32 * 1024
+)
+
+// NewShaper creates a shaper taking from all non-nil buckets.
+// It returns nil if there are none.
+func NewShaper(buckets ...*Bucket) *Shaper {
+	s := &Shaper{chunk: maxChunk}
+	for _, b := range buckets {
+		if b == nil {
+			continue
+		}
+		s.buckets = append(s.buckets, b)
+		if burst := int64(b.burst); burst < s.chunk {
+			s.chunk = burst
+		}
+	}
+	if len(s.buckets) == 0 {
+		return nil
+	}
+	if s.chunk < minChunk {
+		s.chunk = minChunk
+	}
+	return s
+}
+
+// Chunk returns how many bytes to send at most before calling Wait.
+func (s *Shaper) Chunk() int64 {
+	if s == nil {
+		return maxChunk
+	}
+	return s.chunk
+}
+
+// Wait pays for n bytes sent and sleeps until every bucket allows more.
+func (s *Shaper) Wait(n int64) {
+	if s == nil || n <= 0 {
+		return
+	}
+	var wait time.Duration
+	for _, b := range s.buckets {
+		if w := b.Take(float64(n)); w > wait {
+			wait = w
+		}
+	}
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
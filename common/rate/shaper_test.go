@@ -0,0 +1,98 @@
+package rate
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBucket_Take(t *testing.T) {
+	b := NewBucket(1000, 500)
+	for _, tt := range []struct {
+		n        float64
+		wantWait time.Duration // roughly, the bucket refills meanwhile
+	}{
+		{n: 200},
+		{n: 300}, // emptied
+		{n: 100, wantWait: 100 * time.Millisecond}, // in debt
+		{n: 400, wantWait: 500 * time.Millisecond}, // deeper in debt
+	} {
+		got := b.Take(tt.n)
+		if got > tt.wantWait || got < tt.wantWait-20*time.Millisecond {
+			t.Errorf("take %v: wait %v, want %v", tt.n, got, tt.wantWait)
+		}
+	}
+
+	// a bucket without a rate never makes anyone wait
+	if got := NewBucket(0, 1).Take(100); got != 0 {
+		t.Errorf("wait %v without a rate, want 0", got)
+	}
+}
+
+func TestNewShaper(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		buckets   []*Bucket
+		wantNil   bool
+		wantChunk int64
+	}{
+		{name: "none", wantNil: true},
+		{name: "only nil", buckets: []*Bucket{nil, nil}, wantNil: true},
+		{name: "large bursts", buckets: []*Bucket{NewBucket(1, 1<<20)}, wantChunk: maxChunk},
+		{name: "smallest burst", buckets: []*Bucket{nil, NewBucket(1, 1<<20), NewBucket(1, 10000)}, wantChunk: 10000},
+		{name: "tiny burst", buckets: []*Bucket{NewBucket(1, 100)}, wantChunk: minChunk},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewShaper(tt.buckets...)
+			if (s == nil) != tt.wantNil {
+				t.Fatalf("shaper %v, want nil %v", s, tt.wantNil)
+			}
+			if s == nil {
+				return
+			}
+			if s.Chunk() != tt.wantChunk {
+				t.Errorf("chunk %d, want %d", s.Chunk(), tt.wantChunk)
+			}
+		})
+	}
+
+	var s *Shaper
+	if s.Chunk() != maxChunk {
+		t.Errorf("chunk %d of a nil shaper, want %d", s.Chunk(), maxChunk)
+	}
+	s.Wait(1 << 30) // doesn't limit anything
+}
+
+func TestShaper_Wait(t *testing.T) {
+	// a player, the service and the whole proxy, the service being the slowest
+	player := NewBucket(100000, 10000)
+	service := NewBucket(20000, 10000)
+	global := NewBucket(1000000, 1000000)
+	s1 := NewShaper(player, service, global)
+	s2 := NewShaper(NewBucket(100000, 10000), service, global)
+
+	// within the bursts
+	start := time.Now()
+	s1.Wait(5000)
+	s2.Wait(5000)
+	if elapsed := time.Since(start); elapsed > 20*time.Millisecond {
+		t.Fatalf("waited %v within the bursts", elapsed)
+	}
+
+	// every bucket pays, and the slowest one sets the pace: the shared
+	// service bucket is 2000 bytes in debt, which takes 100ms at 20000/s,
+	// while the player's is still within its burst
+	start = time.Now()
+	s1.Wait(2000)
+	if elapsed := time.Since(start); elapsed < 80*time.Millisecond || elapsed > 300*time.Millisecond {
+		t.Errorf("waited %v for the service bucket, want about 100ms", elapsed)
+	}
+	if player.Take(0) != 0 {
+		t.Error("the player's bucket is in debt")
+	}
+	global.mutex.Lock()
+	tokens := global.tokens
+	global.mutex.Unlock()
+	if tokens > 1000000-12000+1000 {
+		t.Errorf("the proxy's bucket has %v tokens left, want it charged 12000", tokens)
+	}
+}
@@ -0,0 +1,177 @@
+package set
+
+import (
+	"math/bits"
+	"net/netip"
+	"strings"
+)
+
+// PrefixSet is a set of IP prefixes backed by a path-compressed binary trie.
+// IPv4 prefixes are stored in the IPv4-mapped IPv6 space, so IPv4 addresses
+// and their IPv4-mapped IPv6 forms match the same entries.
+type PrefixSet struct {
+	root *prefixNode
+	size int
+}
+
+type prefixNode struct {
+	key   uint128
+	bits  int
+	leaf  bool
+	child [2]*prefixNode
+}
+
+type uint128 struct {
+	hi, lo uint64
+}
+
+func (u uint128) bit(i int) int {
+	if i < 64 {
+		return int(u.hi>>(63-i)) & 1
+	}
+	return int(u.lo>>(127-i)) & 1
+}
+
+func (u uint128) masked(n int) uint128 {
+	switch {
+	case n <= 0:
+		return uint128{}
+	case n < 64:
+		return uint128{u.hi &^ (^uint64(0) >> n), 0}
+	case n < 128:
+		return uint128{u.hi, u.lo &^ (^uint64(0) >> (n - 64))}
+	default:
+		return u
+	}
+}
+
+func commonPrefixLen(a, b uint128) int {
+	if x := a.hi ^ b.hi; x != 0 {
+		return bits.LeadingZeros64(x)
+	}
+	return 64 + bits.LeadingZeros64(a.lo^b.lo)
+}
+
+func addrKey(addr netip.Addr) uint128 {
+	b := addr.As16()
+	var u uint128
+	for i := 0; i < 8; i++ {
+		u.hi = u.hi<<8 | uint64(b[i])
+		u.lo = u.lo<<8 | uint64(b[i+8])
+	}
+	return u
+}
+
+func prefixKey(p netip.Prefix) (uint128, int) {
+	n := p.Bits()
+	if p.Addr().Is4() {
+		n += 96
+	}
+	return addrKey(p.Addr()).masked(n), n
+}
+
+// ParsePrefix parses a CIDR prefix or a single IP address.
+// A single address is treated as a host prefix (/32 or /128).
+func ParsePrefix(s string) (netip.Prefix, bool) {
+	s = strings.TrimSpace(s)
+	if strings.IndexByte(s, '/') >= 0 {
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return netip.Prefix{}, false
+		}
+		if p.Addr().Is4In6() && p.Bits() >= 96 {
+			p = netip.PrefixFrom(p.Addr().Unmap(), p.Bits()-96)
+		}
+		return p.Masked(), true
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, false
+	}
+	addr = addr.Unmap().WithZone("")
+	return netip.PrefixFrom(addr, addr.BitLen()), true
+}
+
+// NewPrefixSetFromSlice builds a PrefixSet from the entries of slice that are
+// IP addresses or CIDR prefixes. Other entries are skipped.
+func NewPrefixSetFromSlice(slice []string) *PrefixSet {
+	s := new(PrefixSet)
+	for _, item := range slice {
+		if p, ok := ParsePrefix(item); ok {
+			s.Add(p)
+		}
+	}
+	return s
+}
+
+// Len returns the number of distinct prefixes in the set.
+func (s *PrefixSet) Len() int {
+	return s.size
+}
+
+// Add inserts a prefix into the set.
+func (s *PrefixSet) Add(p netip.Prefix) {
+	if !p.IsValid() {
+		return
+	}
+	key, n := prefixKey(p)
+	node := &s.root
+	for {
+		current := *node
+		if current == nil {
+			*node = &prefixNode{key: key, bits: n, leaf: true}
+			s.size++
+			return
+		}
+		common := commonPrefixLen(current.key, key)
+		if common > current.bits {
+			common = current.bits
+		}
+		if common > n {
+			common = n
+		}
+		if common == current.bits {
+			if n == current.bits {
+				if !current.leaf {
+					current.leaf = true
+					s.size++
+				}
+				return
+			}
+			node = &current.child[key.bit(current.bits)]
+			continue
+		}
+		// split current at the first differing bit
+		split := &prefixNode{key: key.masked(common), bits: common}
+		split.child[current.key.bit(common)] = current
+		if common == n {
+			split.leaf = true
+		} else {
+			split.child[key.bit(common)] = &prefixNode{key: key, bits: n, leaf: true}
+		}
+		*node = split
+		s.size++
+		return
+	}
+}
+
+// Contains reports whether addr is covered by any prefix in the set.
+func (s *PrefixSet) Contains(addr netip.Addr) bool {
+	if s == nil || !addr.IsValid() {
+		return false
+	}
+	key := addrKey(addr.Unmap())
+	for node := s.root; node != nil; {
+		if node.bits > 0 && commonPrefixLen(node.key, key) < node.bits {
+			return false
+		}
+		if node.leaf {
+			return true
+		}
+		if node.bits >= 128 {
+			return false
+		}
+		node = node.child[key.bit(node.bits)]
+	}
+	return false
+}
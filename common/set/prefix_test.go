@@ -0,0 +1,85 @@
+package set
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"testing"
+
+	"github.com/zhangyunhao116/fastrand"
+)
+
+func TestPrefixSet_Contains(t *testing.T) {
+	s := NewPrefixSetFromSlice([]string{
+		"192.168.1.0/24",
+		"10.0.0.1",
+		"2001:db8:1:2::/64",
+		"::ffff:172.16.0.0/108", // IPv4-mapped form of 172.16.0.0/12
+		"not an address",
+	})
+	if s.Len() != 4 {
+		t.Fatalf("unexpected set size %d", s.Len())
+	}
+	for addr, want := range map[string]bool{
+		"192.168.1.1":           true,
+		"192.168.1.255":         true,
+		"192.168.2.1":           false,
+		"10.0.0.1":              true,
+		"10.0.0.2":              false,
+		"::ffff:192.168.1.20":   true,
+		"::ffff:10.0.0.1":       true,
+		"172.31.255.1":          true,
+		"172.32.0.1":            false,
+		"2001:db8:1:2::1":       true,
+		"2001:db8:1:2:ffff::1":  true,
+		"2001:db8:1:3::1":       false,
+		"::c0a8:101":            false, // IPv4-compatible, not IPv4-mapped
+		"fe80::1":               false,
+		"2001:db8:1:2::1%eth0":  true,
+		"::ffff:192.168.200.10": false,
+	} {
+		if got := s.Contains(netip.MustParseAddr(addr)); got != want {
+			t.Errorf("Contains(%s) = %v, want %v", addr, got, want)
+		}
+	}
+}
+
+func TestPrefixSet_Overlapping(t *testing.T) {
+	s := new(PrefixSet)
+	for _, p := range []string{"10.1.2.3", "10.0.0.0/8", "10.1.0.0/16", "10.0.0.0/8", "0.0.0.0/0"} {
+		prefix, ok := ParsePrefix(p)
+		if !ok {
+			t.Fatalf("failed to parse %s", p)
+		}
+		s.Add(prefix)
+	}
+	if s.Len() != 4 {
+		t.Fatalf("unexpected set size %d", s.Len())
+	}
+	if !s.Contains(netip.MustParseAddr("8.8.8.8")) {
+		t.Error("0.0.0.0/0 should match any IPv4 address")
+	}
+	if s.Contains(netip.MustParseAddr("2001:db8::1")) {
+		t.Error("0.0.0.0/0 should not match IPv6 addresses")
+	}
+}
+
+func BenchmarkPrefixSet_Contains(b *testing.B) {
+	const ElementNum = 200000
+	s := new(PrefixSet)
+	addrs := make([]netip.Addr, 0, ElementNum)
+	for i := 0; i < ElementNum; i++ {
+		var a [4]byte
+		binary.BigEndian.PutUint32(a[:], fastrand.Uint32())
+		addr := netip.AddrFrom4(a)
+		addrs = append(addrs, addr)
+		s.Add(netip.PrefixFrom(addr, 24+int(fastrand.Int31n(9))).Masked())
+	}
+	target := addrs[fastrand.Int31n(ElementNum)]
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if !s.Contains(target) {
+			b.Fatal("target element not found")
+		}
+	}
+}
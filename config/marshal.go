@@ -10,7 +10,13 @@ type configMainTemp struct {
 	Services []*ConfigProxyService
 	Configuration *Configure
 	TrafficLimiter *TrafficLimiterConfig
+	GeoIP    *GeoIPConfig `json:",omitempty"`
 	Lists    map[string][]string
+	ListSources map[string]*ListSource `json:",omitempty"`
+	AutoBan     *AutoBanConfig         `json:",omitempty"`
+
+	DuplicateSessions *DuplicateSessionConfig `json:",omitempty"`
+	IPBinding         *IPBindingConfig        `json:",omitempty"`
 }
 
 var (
@@ -34,7 +40,13 @@ func (c *configMain) MarshalJSON() ([]byte, error) {
 			Services: c.Services,
 			Configuration: c.Configuration,
 			TrafficLimiter: c.TrafficLimiter,
+			GeoIP:    c.GeoIP,
 			Lists:    list,
+			ListSources: c.ListSources,
+			AutoBan:     c.AutoBan,
+
+			DuplicateSessions: c.DuplicateSessions,
+			IPBinding:         c.IPBinding,
 		},
 	)
 }
@@ -44,23 +56,38 @@ func (c *configMain) UnmarshalJSON(data []byte) (err error) {
 		Services: c.Services,
 		Configuration: c.Configuration,
 		TrafficLimiter: c.TrafficLimiter,
+		GeoIP:    c.GeoIP,
 	}
 	err = json.Unmarshal(data, &configTemp)
 	if err != nil {
 		return err
 	}
+	if err = configTemp.TrafficLimiter.validate(); err != nil {
+		return err
+	}
+	if err = configTemp.DuplicateSessions.validate(); err != nil {
+		return err
+	}
 	// log.Println("Lists:", configTemp.Lists)
 	if l := len(configTemp.Lists); l == 0 { // if nothing in Lists
 		c.Lists = map[string]set.StringSet{} // empty map
+		c.IPLists = map[string]*set.PrefixSet{}
 	} else {
 		c.Lists = make(map[string]set.StringSet, l) // map size init
+		c.IPLists = make(map[string]*set.PrefixSet, l)
 		for k, v := range configTemp.Lists {
 			// log.Println("List: Loading", k, "value:", v)
 			c.Lists[k] = set.NewStringSetFromSlice(v)
+			c.IPLists[k] = set.NewPrefixSetFromSlice(v)
 		}
 	}
 	c.Services = configTemp.Services
 	c.Configuration = configTemp.Configuration
 	c.TrafficLimiter = configTemp.TrafficLimiter
+	c.GeoIP = configTemp.GeoIP
+	c.ListSources = configTemp.ListSources
+	c.AutoBan = configTemp.AutoBan
+	c.DuplicateSessions = configTemp.DuplicateSessions
+	c.IPBinding = configTemp.IPBinding
 	return nil
 }
@@ -9,7 +9,20 @@ type configMain struct {
 	Services []*ConfigProxyService
 	Configuration *Configure
 	TrafficLimiter *TrafficLimiterConfig
+	GeoIP    *GeoIPConfig `json:",omitempty"`
 	Lists    map[string]set.StringSet
+	// ListSources defines lists loaded from files or URLs, which are refreshed
+	// without restarting services.
+	ListSources map[string]*ListSource
+	// IPLists holds the IP addresses and CIDR prefixes found in Lists.
+	IPLists map[string]*set.PrefixSet
+	// AutoBan temporarily bans abusive client IPs, disabled when nil.
+	AutoBan *AutoBanConfig
+	// DuplicateSessions decides what happens when a player who is already
+	// online logs in again, through any service. Unlimited when nil.
+	DuplicateSessions *DuplicateSessionConfig
+	// IPBinding limits the addresses each player may log in from. Disabled when nil.
+	IPBinding *IPBindingConfig
 }
 
 type ConfigProxyService struct {
@@ -20,23 +33,113 @@ type ConfigProxyService struct {
 	Flow          string
 
 	IPAccess      access                   `json:",omitempty"`
+	GeoIPAccess   geoIPAccess              `json:",omitempty"`
+	// Rules is an ordered access policy, the first matching rule wins.
+	// IPAccess and Minecraft.NameAccess are turned into rules placed before these ones.
+	Rules         []*Rule                  `json:",omitempty"`
+	Limits        ConnLimits               `json:",omitempty"`
+	TrafficPlan   string                   `json:",omitempty"` // default plan of the service, over TrafficLimiter.DefaultPlan
+	Bandwidth     BandwidthLimit           `json:",omitempty"` // speed of all connections of the service together
+	Accounting    TrafficAccounting        `json:",omitempty"` // who the traffic of the service is counted to
 	Minecraft     minecraft                `json:",omitempty"`
 	TLSSniffing   tlsSniffing              `json:",omitempty"`
 	SocketOptions *outbound2.SocketOptions `json:",omitempty"`
 	Outbound      outbound                 `json:",omitempty"`
 }
 
+// Rule matches when every condition set in Match is satisfied,
+// and a list of values matches when any of them does.
+type Rule struct {
+	Name   string `json:",omitempty"` // shown in logs
+	Match  RuleMatch
+	Action RuleAction
+}
+
+type RuleMatch struct {
+	IPs          []string `json:",omitempty"` // IPs or CIDR prefixes
+	IPListTags   []string `json:",omitempty"` // the client IP is in one of these lists
+	NameListTags []string `json:",omitempty"` // the player name is in one of these lists
+	ListAPI      string   `json:",omitempty"` // 'hit' or 'miss'
+
+	// Patterns are matched case-insensitively. A pattern is exact unless it has
+	// '*' or '?' wildcards, or starts with 'suffix:', 'contains:' or 'regex:'.
+	PlayerNames []string `json:",omitempty"`
+	Hostnames   []string `json:",omitempty"`
+
+	ProtocolMin int      `json:",omitempty"`
+	ProtocolMax int      `json:",omitempty"`
+	TimeFrom    string   `json:",omitempty"` // 'HH:MM' local time, may wrap around midnight
+	TimeTo      string   `json:",omitempty"`
+	ModLoaders  []string `json:",omitempty"` // 'vanilla', 'forge', 'fml', 'fml2', 'fml3'
+
+	Invert bool `json:",omitempty"` // the rule matches when the conditions don't
+}
+
+type RuleAction struct {
+	// Type is one of 'allow', 'deny', 'maintenance', 'joke', 'reset',
+	// 'route' and 'ratelimit'.
+	Type string
+
+	// Message is the kick message template of 'deny', 'maintenance' and 'ratelimit'.
+	// Placeholders: {player} {ip} {service} {rule}
+	Message string `json:",omitempty"`
+
+	Target string `json:",omitempty"` // 'host:port' for 'route'
+
+	// 'ratelimit' lets a client IP through RatePerMinute times per minute with
+	// bursts of Burst, and continues to the next rule. Beyond that it denies.
+	RatePerMinute float64 `json:",omitempty"`
+	Burst         float64 `json:",omitempty"`
+}
+
+// ConnLimits are checked as soon as a connection is accepted,
+// except the status and login rates which need the Minecraft handshake.
+// Rates are per client IP, and zero values mean no limit.
+type ConnLimits struct {
+	MaxConnections      int `json:",omitempty"` // for the whole service
+	MaxConnectionsPerIP int `json:",omitempty"`
+
+	ConnectionsPerMinute float64 `json:",omitempty"`
+	ConnectionBurst      float64 `json:",omitempty"` // defaults to the per-minute rate
+	StatusPerMinute      float64 `json:",omitempty"`
+	StatusBurst          float64 `json:",omitempty"`
+	LoginsPerMinute      float64 `json:",omitempty"`
+	LoginBurst           float64 `json:",omitempty"`
+}
+
 type access struct {
 	Mode     string   // 'accept' or 'deny' or empty
 	ListTags []string `json:",omitempty"`
 }
 
+type geoIPAccess struct {
+	Mode      string   // 'allow' or 'block' or empty
+	Countries []string `json:",omitempty"` // ISO 3166-1 alpha-2 codes
+	ASNs      []uint   `json:",omitempty"`
+
+	// AllowUnknown admits addresses missing from the databases in 'allow' mode.
+	AllowUnknown bool `json:",omitempty"`
+
+	// Action is 'reset' (default) to reset the connection, or 'kick' to
+	// disconnect Minecraft logins with KickMessage.
+	// Placeholders: {player} {ip} {country} {asn} {service}
+	Action      string `json:",omitempty"`
+	KickMessage string `json:",omitempty"`
+}
+
 type minecraft struct {
 	EnableHostnameRewrite bool
 	RewrittenHostname     string `json:",omitempty"`
 
 	EnableHostnameAccess bool
-	HostnameAccess       string `json:",omitempty"`
+	HostnameAccess       string   `json:",omitempty"` // matched as 'contains:' for compatibility
+	AllowedHostnames     []string `json:",omitempty"` // patterns, as in RuleMatch
+
+	// Clients connecting with a hostname that isn't allowed are shown
+	// WrongHostnameMotd in the server list, and kicked with WrongHostnameKickMessage.
+	// Placeholders: {player} {hostname} {ip} {service}
+	WrongHostnameMotd        string `json:",omitempty"`
+	WrongHostnameKickMessage string `json:",omitempty"`
 
 	OnlineCount onlineCount
 
@@ -44,6 +147,8 @@ type minecraft struct {
 
 	NameAccess access `json:",omitempty"`
 
+	FirstJoin firstJoin `json:",omitempty"`
+
 	EnableAnyDest   bool          `json:",omitempty"`
 	AnyDestSettings configAnyDest `json:",omitempty"`
 
@@ -52,6 +157,20 @@ type minecraft struct {
 	MotdDescription string
 }
 
+// firstJoin shows a notice to players joining a service for the first time
+// and lets them in when they come back.
+type firstJoin struct {
+	Enable          *bool `json:",omitempty"` // enabled when absent
+	KeyByIP         bool  `json:",omitempty"` // track name+IP instead of name only
+	RejoinWindowSec int64 `json:",omitempty"` // 0 accepts a rejoin at any time
+	ExpiryDays      int   `json:",omitempty"` // forget players not seen for this long, 0 never
+}
+
+// Enabled reports whether the notice is shown, which it is unless disabled.
+func (f *firstJoin) Enabled() bool {
+	return f.Enable == nil || *f.Enable
+}
+
 type onlineCount struct {
 	Max            int
 	Online         int32
@@ -82,14 +201,217 @@ type outbound struct {
 
 type Configure struct {
 	ListAPI        string
+	ListAPIOptions *ListAPIOptions `json:",omitempty"`
 	Header         string
 	ContactName    string
 	ContactLink    string
 	WebLogPort     uint16 `json:",omitempty"`
+	// WebAPIToken is required as 'Authorization: Bearer <token>' by the traffic
+	// endpoints of the web log server, which are disabled while it is empty.
+	WebAPIToken string `json:",omitempty"`
+}
+
+// ListAPIOptions controls how the ListAPI is queried.
+// Zero values fall back to the defaults documented on each field.
+type ListAPIOptions struct {
+	TimeoutMs           int `json:",omitempty"` // per request, default 3000
+	Retries             int `json:",omitempty"` // extra attempts after the first one, default 2, -1 disables
+	RetryBackoffMs      int `json:",omitempty"` // doubled after each attempt, default 200
+	BreakerThreshold    int `json:",omitempty"` // consecutive failed lookups before the breaker opens, default 5
+	BreakerCooldownSec  int `json:",omitempty"` // default 30
+	CacheTTLSec         int `json:",omitempty"` // positive results, default 300
+	NegativeCacheTTLSec int `json:",omitempty"` // negative results, default 60
+
+	// FailurePolicy decides what happens to a login while the ListAPI is unavailable.
+	// 'open' admits the player, 'closed' (default) rejects it.
+	FailurePolicy string `json:",omitempty"`
+
+	// Version 1 (default) sends ?playerName= and expects the name echoed back.
+	// Version 2 sends the player name, client IP, service name and hostname,
+	// and expects a JSON decision.
+	Version    int    `json:",omitempty"`
+	Method     string `json:",omitempty"` // 'GET' (default) or 'POST', version 2 only
+	AuthHeader string `json:",omitempty"` // default 'Authorization'
+	AuthToken  string `json:",omitempty"`
+	HMACSecret string `json:",omitempty"` // signs requests with X-NoDelay-Signature
 }
 
 type TrafficLimiterConfig struct {
 	EnableTrafficLimit      bool
-	TrafficLimitMB          int64  `json:"omitempty"`
-	TrafficLimitKickMessage string `json:"omitempty"`
-}
\ No newline at end of file
+	TrafficLimitMB          int64  `json:",omitempty"` // limit of the 'default' plan, default 1024
+	TrafficLimitKickMessage string `json:",omitempty"`
+	// PlaytimeKickMessage is shown to players out of playtime, with the
+	// placeholders {player}, {playtime}, {limit}, {remaining} and {reset}.
+	PlaytimeKickMessage string `json:",omitempty"`
+	// Timezone is the IANA name of the zone resets happen in, the local zone when empty.
+	Timezone string `json:",omitempty"`
+	// RetentionDays is how long the records of players not seen are kept,
+	// 7 days when 0, forever when negative.
+	RetentionDays int `json:",omitempty"`
+	// The reset schedule of the 'default' plan and of plans without their own Period.
+	ResetSchedule
+	// Bandwidth is the speed of all connections of the proxy together. It applies,
+	// like the bandwidth of services and plans, even without EnableTrafficLimit.
+	Bandwidth BandwidthLimit `json:",omitempty"`
+	// PlayerBandwidth is the speed of each player of the 'default' plan
+	// and of plans without their own Bandwidth.
+	PlayerBandwidth BandwidthLimit `json:",omitempty"`
+	// History records the traffic of players on each service by hour and by day.
+	History TrafficHistoryConfig `json:",omitempty"`
+	// Notifications report the players reaching thresholds of their quota.
+	Notifications TrafficNotifyConfig `json:",omitempty"`
+
+	// Plans are named quotas. A plan named 'default' overrides TrafficLimitMB.
+	Plans map[string]*TrafficPlan `json:",omitempty"`
+	// DefaultPlan applies to players without another plan, 'default' when empty.
+	DefaultPlan string `json:",omitempty"`
+	// PlanLists assign plans to the players in lists, the first matching list wins.
+	PlanLists []*TrafficPlanList `json:",omitempty"`
+	// PlayerPlans assign plans to single players, over PlanLists.
+	PlayerPlans map[string]string `json:",omitempty"`
+}
+
+type TrafficPlan struct {
+	// LimitMB limits upload and download together, UploadLimitMB and DownloadLimitMB
+	// each direction. Zero limits are not applied, and LimitMB defaults to
+	// TrafficLimitMB if none is set.
+	LimitMB         int64          `json:",omitempty"`
+	UploadLimitMB   int64          `json:",omitempty"`
+	DownloadLimitMB int64          `json:",omitempty"`
+	Unlimited       bool           `json:",omitempty"`
+	Bandwidth       BandwidthLimit `json:",omitempty"` // speed of each player of the plan
+	// Prepaid plans do not reset the traffic: players use the balance of their
+	// top-ups, which expire after CreditExpiryDays if set. LowBalanceMB is the
+	// balance under which a warning is raised. The playtime still resets.
+	Prepaid          bool  `json:",omitempty"`
+	CreditExpiryDays int   `json:",omitempty"`
+	LowBalanceMB     int64 `json:",omitempty"`
+	// PlaytimeLimitMin is the time players may play in each period of the
+	// plan, in minutes, not limited when zero.
+	PlaytimeLimitMin int64 `json:",omitempty"`
+	ResetSchedule
+	// Scope is 'shared' (default) to count the traffic of all services together,
+	// or 'service' to give the player a separate quota on each service.
+	Scope string `json:",omitempty"`
+}
+
+// ResetSchedule tells when the traffic used by players is reset.
+type ResetSchedule struct {
+	// Period is 'daily' (default), 'weekly', 'monthly', 'rolling' to count
+	// the traffic of the last RollingDays days, or 'never' for a lifetime quota.
+	Period       string `json:",omitempty"`
+	ResetWeekday string `json:",omitempty"` // day of weekly resets, 'Monday' by default
+	ResetDay     int    `json:",omitempty"` // day of monthly resets, 1 by default; the last day of shorter months
+	RollingDays  int    `json:",omitempty"` // 30 by default
+}
+
+// TrafficAccounting tells who the traffic of a connection is counted to,
+// the identity used in place of the player name for plans, quotas and stats.
+type TrafficAccounting struct {
+	// Identity is 'player', 'sni' (the server name of TLS connections), 'ip'
+	// or 'cidr' (the network of the client IP). By default it's 'player' on
+	// Minecraft services, 'sni' on TLS sniffing services and 'ip' on others.
+	// Connections without the identity, such as non-TLS ones, count to their IP.
+	Identity   string `json:",omitempty"`
+	IPv4Prefix int    `json:",omitempty"` // for 'cidr', 24 by default
+	IPv6Prefix int    `json:",omitempty"` // for 'cidr', 64 by default
+}
+
+// BandwidthLimit is a speed limit. Upload is from the players to the servers.
+// Zero rates are not limited, and bursts default to one second of the rate.
+type BandwidthLimit struct {
+	UploadKBps      float64 `json:",omitempty"`
+	DownloadKBps    float64 `json:",omitempty"`
+	UploadBurstKB   float64 `json:",omitempty"`
+	DownloadBurstKB float64 `json:",omitempty"`
+}
+
+type TrafficHistoryConfig struct {
+	Disabled   bool `json:",omitempty"`
+	HourlyDays int  `json:",omitempty"` // how long hourly usage is kept, 7 days by default
+	DailyDays  int  `json:",omitempty"` // how long daily usage is kept, 400 days by default
+}
+
+// TrafficNotifyConfig raises an event, once per period, when the usage of
+// a player reaches each of the Thresholds (percentages of their quota), and
+// when the balance of a prepaid player falls under its LowBalanceMB.
+// Events are logged and posted to the Webhooks.
+type TrafficNotifyConfig struct {
+	Thresholds []float64        `json:",omitempty"` // 80, 95 and 100 by default
+	Webhooks   []*WebhookConfig `json:",omitempty"`
+	MaxRetries int              `json:",omitempty"` // retries of a failed delivery, 5 by default
+	QueueSize  int              `json:",omitempty"` // deliveries waiting per webhook, 1000 by default
+}
+
+// WebhookConfig is an HTTP endpoint receiving events as JSON POST requests.
+// With an HMACSecret, requests carry the same signature headers as ListAPI.
+type WebhookConfig struct {
+	URL        string
+	HMACSecret string `json:",omitempty"`
+	AuthHeader string `json:",omitempty"` // e.g. 'Authorization'
+	AuthToken  string `json:",omitempty"`
+	TimeoutMs  int    `json:",omitempty"` // 5000 by default
+}
+
+type TrafficPlanList struct {
+	ListTag string
+	Plan    string
+}
+
+// GeoIPConfig points at MaxMind-format (.mmdb) databases.
+// Both files are reloaded automatically when they change.
+type GeoIPConfig struct {
+	CountryDatabase string `json:",omitempty"`
+	ASNDatabase     string `json:",omitempty"`
+}
+
+// ListSource is an external list with one entry per line.
+// Empty lines and lines starting with '#' are ignored.
+type ListSource struct {
+	Type               string // 'file' or 'http'
+	Path               string `json:",omitempty"` // for 'file', watched for changes
+	URL                string `json:",omitempty"` // for 'http'
+	RefreshIntervalSec int    `json:",omitempty"` // for 'http', default 300
+	// CachePath keeps the last good copy of an 'http' list, loaded before the
+	// first fetch. Default ListSource.<name>.txt in the working directory.
+	CachePath string `json:",omitempty"`
+}
+
+// AutoBanConfig bans a client IP for a while when it commits too many
+// violations (malformed packets, rejected logins, excessive status pings,
+// handshake timeouts) within a sliding window. Zero values take the defaults.
+type AutoBanConfig struct {
+	WindowSec          int   `json:",omitempty"` // default 60
+	Threshold          int   `json:",omitempty"` // violations in the window that trigger a ban, default 10
+	PingThreshold      int   `json:",omitempty"` // status requests in the window before they count as violations, default 30
+	HandshakeTimeoutMs int   `json:",omitempty"` // time allowed to complete handshake and login start, default 10000
+	BanSec             int64 `json:",omitempty"` // first ban, doubled on each repeat offence, default 300
+	MaxBanSec          int64 `json:",omitempty"` // default 86400
+	ForgetSec          int64 `json:",omitempty"` // repeat offences are forgotten after this long, default 86400
+}
+
+// DuplicateSessionConfig applies to sessions with the same player name,
+// or the same UUID when the client sends it.
+type DuplicateSessionConfig struct {
+	// Mode is 'reject' to reject a second login, 'kick-old' to close the oldest
+	// session instead, or 'allow' to accept up to MaxSessions sessions and reject
+	// further logins. Default 'reject'.
+	Mode        string
+	MaxSessions int `json:",omitempty"` // for 'allow' and 'kick-old', default 1
+
+	// KickMessage is shown to rejected logins.
+	// Placeholders: {player} {service} {ip} {sessions}
+	KickMessage string `json:",omitempty"`
+}
+
+// IPBindingConfig binds each player to the first addresses they log in from,
+// across all services, and rejects logins from further addresses.
+type IPBindingConfig struct {
+	MaxIPs     int  `json:",omitempty"` // default 3
+	ByPrefix   bool `json:",omitempty"` // count /24 (IPv4) and /64 (IPv6) networks instead of addresses
+	WindowDays int  `json:",omitempty"` // addresses unused for this long are forgotten, 0 never
+
+	// KickMessage is shown to rejected logins.
+	// Placeholders: {player} {ip} {service} {max}
+	KickMessage string `json:",omitempty"`
+}
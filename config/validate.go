@@ -0,0 +1,63 @@
+package config
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// validate brings the settings of the traffic limiter into a canonical form
+// and rejects the values it doesn't know, which would otherwise be mistaken
+// for the defaults.
+func (t *TrafficLimiterConfig) validate() error {
+	if t == nil {
+		return nil
+	}
+	if err := t.ResetSchedule.validate(); err != nil {
+		return fmt.Errorf("TrafficLimiter: %w", err)
+	}
+	names := make([]string, 0, len(t.Plans))
+	for name := range t.Plans {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if plan := t.Plans[name]; plan != nil {
+			if err := plan.ResetSchedule.validate(); err != nil {
+				return fmt.Errorf("TrafficLimiter: plan %s: %w", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// validate brings Mode into a canonical form, 'reject' when it is empty, and
+// rejects the modes it doesn't know, which would otherwise allow every login.
+func (d *DuplicateSessionConfig) validate() error {
+	if d == nil {
+		return nil
+	}
+	mode := strings.ToLower(strings.TrimSpace(d.Mode))
+	switch mode {
+	case "":
+		mode = "reject"
+	case "reject", "kick-old", "allow":
+	default:
+		return fmt.Errorf("DuplicateSessions: unknown Mode %q, want 'reject', 'kick-old' or 'allow'", d.Mode)
+	}
+	if d.MaxSessions < 0 {
+		return fmt.Errorf("DuplicateSessions: negative MaxSessions %d", d.MaxSessions)
+	}
+	d.Mode = mode
+	return nil
+}
+
+func (s *ResetSchedule) validate() error {
+	period := strings.ToLower(strings.TrimSpace(s.Period))
+	switch period {
+	case "", "daily", "weekly", "monthly", "rolling", "never":
+		s.Period = period
+		return nil
+	}
+	return fmt.Errorf("unknown Period %q, want 'daily', 'weekly', 'monthly', 'rolling' or 'never'", s.Period)
+}
@@ -0,0 +1,98 @@
+package config
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestValidate_Period(t *testing.T) {
+	for _, tt := range []struct {
+		name       string
+		config     string
+		wantPeriod string // of the global schedule, then of the plan 'vip'
+		wantErr    string
+	}{
+		{name: "default", config: `{"TrafficLimiter": {}}`},
+		{name: "no traffic limiter", config: `{}`},
+		{name: "lower case", config: `{"TrafficLimiter": {"Period": "weekly"}}`, wantPeriod: "weekly"},
+		{name: "capitalized", config: `{"TrafficLimiter": {"Period": "Monthly"}}`, wantPeriod: "monthly"},
+		{name: "upper case with spaces", config: `{"TrafficLimiter": {"Period": " ROLLING "}}`, wantPeriod: "rolling"},
+		{
+			name:       "plan",
+			config:     `{"TrafficLimiter": {"Plans": {"vip": {"Period": "Never"}}}}`,
+			wantPeriod: "never",
+		},
+		{name: "unknown", config: `{"TrafficLimiter": {"Period": "yearly"}}`, wantErr: `TrafficLimiter: unknown Period "yearly"`},
+		{name: "misspelt", config: `{"TrafficLimiter": {"Period": "dialy"}}`, wantErr: `unknown Period "dialy"`},
+		{
+			name:    "unknown in a plan",
+			config:  `{"TrafficLimiter": {"Plans": {"vip": {"Period": "fortnightly"}}}}`,
+			wantErr: `plan vip: unknown Period "fortnightly"`,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var c configMain
+			err := json.Unmarshal([]byte(tt.config), &c)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.TrafficLimiter == nil {
+				return
+			}
+			period := c.TrafficLimiter.Period
+			if plan := c.TrafficLimiter.Plans["vip"]; plan != nil {
+				period = plan.Period
+			}
+			if period != tt.wantPeriod {
+				t.Errorf("period %q, want %q", period, tt.wantPeriod)
+			}
+		})
+	}
+}
+
+func TestValidate_DuplicateSessions(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		config   string
+		wantMode string
+		wantErr  string
+	}{
+		{name: "disabled", config: `{}`},
+		{name: "default", config: `{"DuplicateSessions": {}}`, wantMode: "reject"},
+		{name: "reject", config: `{"DuplicateSessions": {"Mode": "reject"}}`, wantMode: "reject"},
+		{name: "allow", config: `{"DuplicateSessions": {"Mode": "allow", "MaxSessions": 2}}`, wantMode: "allow"},
+		{name: "kick-old", config: `{"DuplicateSessions": {"Mode": "kick-old"}}`, wantMode: "kick-old"},
+		{name: "upper case", config: `{"DuplicateSessions": {"Mode": " Kick-Old "}}`, wantMode: "kick-old"},
+		{name: "underscore", config: `{"DuplicateSessions": {"Mode": "kick_old"}}`, wantErr: `DuplicateSessions: unknown Mode "kick_old"`},
+		{name: "unknown", config: `{"DuplicateSessions": {"Mode": "deny"}}`, wantErr: `unknown Mode "deny"`},
+		{name: "negative", config: `{"DuplicateSessions": {"Mode": "allow", "MaxSessions": -1}}`, wantErr: "negative MaxSessions"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var c configMain
+			err := json.Unmarshal([]byte(tt.config), &c)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var mode string
+			if c.DuplicateSessions != nil {
+				mode = c.DuplicateSessions.Mode
+			}
+			if mode != tt.wantMode {
+				t.Errorf("mode %q, want %q", mode, tt.wantMode)
+			}
+		})
+	}
+}
@@ -1,10 +1,11 @@
 module github.com/InRaining/NoDelay
 
-go 1.18
+go 1.19
 
 require (
 	github.com/fatih/color v1.16.0
 	github.com/fsnotify/fsnotify v1.6.0
+	github.com/oschwald/maxminddb-golang v1.12.0
 	github.com/zhangyunhao116/fastrand v0.3.0
 	golang.org/x/sys v0.16.0
 )
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -16,6 +17,7 @@ import (
 	"github.com/InRaining/NoDelay/config"
 	"github.com/InRaining/NoDelay/console"
 	"github.com/InRaining/NoDelay/service"
+	"github.com/InRaining/NoDelay/service/access"
 	"github.com/InRaining/NoDelay/service/traffic"
 	"github.com/InRaining/NoDelay/version"
 	"github.com/InRaining/NoDelay/service/web"
@@ -26,12 +28,22 @@ import (
 
 var (
 	trafficLimiter traffic.TrafficLimiterInterface
+	trafficHistory *traffic.History
+	firstJoinStore *access.FirstJoinStore
+	banStore       *access.BanStore
+	bindingStore   *access.IPBindingStore
+	controlServer  *traffic.ControlServer
+	dataLock       *traffic.DataLock
 	webLogger      *web.Logger
 )
 
 const authURL = "https://bind.hln.asia/NoDelay/NoDelay.php"
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "traffic" {
+		os.Exit(runTrafficCommand(os.Args[2:]))
+	}
+
 	webLogger = web.NewLogger(color.Output)
     log.SetOutput(webLogger)
 	color.Output = webLogger
@@ -82,6 +94,10 @@ func checkAuth() bool {
 
 func startup() error {
 	config.LoadConfig()
+	access.LoadGeoIP()
+	access.StartListSources()
+	access.ConfigureAutoBan()
+	traffic.ConfigureNotifications()
 
 	web.StartWebServer()
 
@@ -91,7 +107,27 @@ func startup() error {
             return fmt.Errorf("failed to create Traffic Table: %w", err)
         }
     }
+	lock, err := traffic.LockData("TrafficTable.json")
+	if err != nil {
+		return fmt.Errorf("failed to lock traffic data: %w", err)
+	}
+	dataLock = lock
 	initTrafficLimiter()
+	if server, err := traffic.ServeControl(traffic.ControlSocket, trafficLimiter); err != nil {
+		log.Println(color.HiYellowString("Traffic commands are not available: %v", err))
+	} else {
+		controlServer = server
+	}
+
+	firstJoinStore = access.NewFirstJoinStore("FirstJoin.json")
+	access.SetGlobalFirstJoinStore(firstJoinStore)
+
+	banStore = access.NewBanStore("Bans.json")
+	access.SetGlobalBanStore(banStore)
+
+	// kept next to the traffic data
+	bindingStore = access.NewIPBindingStore("IPBindings.json")
+	access.SetGlobalIPBindingStore(bindingStore)
 
 	service.Listeners = make([]net.Listener, 0, len(config.Config.Services))
 
@@ -104,6 +140,60 @@ func startup() error {
 	return nil
 }
 
+// runTrafficCommand runs 'NoDelay traffic ...' in the running NoDelay, or on
+// the traffic data when none is running, and returns the exit code.
+func runTrafficCommand(args []string) int {
+	// the output of the command is kept apart from the logs
+	log.SetOutput(os.Stderr)
+	color.Output = os.Stderr
+
+	err := traffic.CallControl(traffic.ControlSocket, args, os.Stdout)
+	if errors.Is(err, traffic.ErrNoControl) {
+		// only while no NoDelay uses the data, even one without a control socket
+		lock, lockErr := traffic.LockData("TrafficTable.json")
+		if lockErr != nil {
+			fmt.Fprintln(os.Stderr, color.HiRedString("NoDelay is running but does not take commands, refusing to change the traffic data offline: %v", lockErr))
+			return 1
+		}
+		defer lock.Unlock() //nolint:errcheck
+
+		if _, statErr := os.Stat("TrafficTable.json"); statErr != nil {
+			fmt.Fprintln(os.Stderr, color.HiRedString("No NoDelay is running and there is no traffic data: %v", statErr))
+			return 1
+		}
+		if _, statErr := os.Stat("NoDelay.json"); statErr == nil {
+			// for the plans and timezone of the records
+			config.LoadConfig()
+		}
+		if len(args) > 0 && args[0] == "binding" {
+			store := access.NewIPBindingStore("IPBindings.json")
+			access.SetGlobalIPBindingStore(store)
+			defer store.Close()
+		}
+		if len(args) > 0 && args[0] == "ban" {
+			store := access.NewBanStore("Bans.json")
+			access.SetGlobalBanStore(store)
+			defer store.Close()
+		}
+		if len(args) > 0 && args[0] == "history" {
+			traffic.SetGlobalHistory(traffic.NewReadOnlyHistory("TrafficHistory.json"))
+		}
+		var limiter *traffic.TrafficLimiter
+		if traffic.ReadOnlyCommand(args) {
+			limiter = traffic.NewReadOnlyTrafficLimiter("TrafficTable.json")
+		} else {
+			limiter = traffic.NewTrafficLimiter("TrafficTable.json")
+		}
+		err = traffic.RunCommand(limiter, args, os.Stdout)
+		limiter.Close()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, color.HiRedString("Error: %v", err))
+		return 1
+	}
+	return 0
+}
+
 func waitForShutdown() {
 	osSignals := make(chan os.Signal, 1)
 	signal.Notify(osSignals, os.Interrupt, syscall.SIGTERM)
@@ -115,6 +205,8 @@ func initTrafficLimiter() {
 	limiter := traffic.NewTrafficLimiter("TrafficTable.json")
 	trafficLimiter = limiter
 	traffic.SetGlobalTrafficLimiter(limiter)
+	trafficHistory = traffic.NewHistory("TrafficHistory.json")
+	traffic.SetGlobalHistory(trafficHistory)
 	color.HiGreen("Traffic limiter initialized.")
 	go startTrafficStatsDisplay()
 }
@@ -147,17 +239,32 @@ func displayTrafficStats() {
 	sort.Strings(players)
 
 	color.HiCyan("\n---------- Current Traffic Usage Stats (%s) ----------", time.Now().Format("15:04:05"))
-	color.HiCyan("%-16s %-12s %-12s %-10s", "Player", "Used", "Limit", "Usage")
-	color.White("---------------------------------------------------------")
+	color.HiCyan("%-24s %-10s %-12s %-12s %-12s %-12s %-10s %-14s %-16s",
+		"Player", "Plan", "Upload", "Download", "Total", "Limit", "Usage", "Playtime", "Next Reset")
+	color.White("-------------------------------------------------------------------------------------------------------------------------")
 
 	for _, player := range players {
 		stat := stats[player]
-		usedMB := float64(stat.UsedBytes) / (1024 * 1024)
-		limitMB := float64(stat.LimitMB)
+		// the limit is the most used of the total, upload and download limits
+		_, limitMB, percentage, reset := trafficLimiter.GetUserInfo(player, 0)
 
-		var percentage float64
-		if limitMB > 0 {
-			percentage = (usedMB / limitMB) * 100
+		plan := stat.Plan
+		if plan == "" {
+			plan = traffic.DefaultPlanName
+		}
+		limit := fmt.Sprintf("%9.0f MB", limitMB)
+		if stat.Unlimited {
+			limit = fmt.Sprintf("%12s", "unlimited")
+		} else if balance, prepaid := trafficLimiter.GetBalance(player); prepaid {
+			limit = fmt.Sprintf("%4.0f MB left", balance)
+		}
+		playtime := fmt.Sprintf("%dm", stat.PlaytimeSeconds/60)
+		if stat.PlaytimeLimitMin > 0 {
+			playtime += fmt.Sprintf("/%dm", stat.PlaytimeLimitMin)
+		}
+		nextReset := "never"
+		if !reset.IsZero() {
+			nextReset = reset.Format("2006-01-02 15:04")
 		}
 
 		var statusColor func(format string, a ...interface{}) string
@@ -170,24 +277,50 @@ func displayTrafficStats() {
 			statusColor = color.HiGreenString
 		}
 
-		fmt.Println(statusColor("%-16s %8.2f MB %8.0f MB %9.1f%%",
-			player, usedMB, limitMB, percentage))
+		fmt.Println(statusColor("%-24s %-10s %9.2f MB %9.2f MB %9.2f MB %s %9.1f%% %-14s %s",
+			player, plan,
+			float64(stat.UploadBytes)/(1024*1024),
+			float64(stat.DownloadBytes)/(1024*1024),
+			float64(stat.UsedBytes)/(1024*1024),
+			limit, percentage, playtime, nextReset))
+	}
+	color.White("-------------------------------------------------------------------------------------------------------------------------")
+
+	if trafficHistory != nil {
+		from, resolution := traffic.TopPeriodStart("day", time.Now())
+		top := trafficHistory.Top(traffic.HistoryQuery{From: from, Resolution: resolution}, 5)
+		if len(top) > 0 {
+			color.HiCyan("Top players of the last 24 hours:")
+			for i, entry := range top {
+				color.HiCyan("%2d. %-24s %9.2f MB (Upload %.2f MB, Download %.2f MB)", i+1, entry.Player,
+					float64(entry.TotalBytes)/(1024*1024),
+					float64(entry.UploadBytes)/(1024*1024),
+					float64(entry.DownloadBytes)/(1024*1024))
+			}
+		}
 	}
-	color.White("---------------------------------------------------------\n")
+	fmt.Println()
+}
+
+// startServices starts the services of the current config,
+// and returns the function stopping them.
+func startServices() context.CancelFunc {
+	ctx, cancel := context.WithCancel(context.Background())
+	service.ExecuteServices(ctx)
+	return cancel
 }
 
 func monitorConfig(watcher *fsnotify.Watcher) {
 	defer watcher.Close()
 
-	ctx, cancel := context.WithCancel(context.Background())
-	service.ExecuteServices(ctx)
+	cancel := startServices()
+	defer func() { cancel() }()
 
-	if err := watcher.Add("NoDelay.json"); err != nil {
-		log.Println(color.HiRedString("Failed to watch config file: %v", err))
+	// The directory is watched, since the files may be replaced by renaming,
+	// as NoDelay does when saving the traffic data.
+	if err := watcher.Add("."); err != nil {
+		log.Println(color.HiRedString("Failed to watch config directory: %v", err))
 	}
-    if err := watcher.Add("TrafficTable.json"); err != nil {
-        log.Println(color.HiRedString("Failed to watch traffic data file: %v", err))
-    }
 
 	reloadSignal := make(chan os.Signal, 1)
 	signal.Notify(reloadSignal, syscall.SIGHUP)
@@ -197,6 +330,10 @@ func monitorConfig(watcher *fsnotify.Watcher) {
     configReloadTimer.Stop()
     trafficReloadTimer := time.NewTimer(time.Hour)
     trafficReloadTimer.Stop()
+    bindingReloadTimer := time.NewTimer(time.Hour)
+    bindingReloadTimer.Stop()
+    banReloadTimer := time.NewTimer(time.Hour)
+    banReloadTimer.Stop()
 
     for {
         select {
@@ -207,12 +344,16 @@ func monitorConfig(watcher *fsnotify.Watcher) {
             if !ok {
                 return
             }
-            if event.Has(fsnotify.Write) {
+            if event.Has(fsnotify.Write) || event.Has(fsnotify.Create) {
                 switch event.Name {
                 case "NoDelay.json":
                     configReloadTimer.Reset(100 * time.Millisecond)
                 case "TrafficTable.json":
                     trafficReloadTimer.Reset(100 * time.Millisecond)
+                case "IPBindings.json":
+                    bindingReloadTimer.Reset(100 * time.Millisecond)
+                case "Bans.json":
+                    banReloadTimer.Reset(100 * time.Millisecond)
                 }
             }
 
@@ -222,6 +363,12 @@ func monitorConfig(watcher *fsnotify.Watcher) {
         case <-trafficReloadTimer.C:
             goto reloadTraffic
 
+        case <-bindingReloadTimer.C:
+            bindingStore.ReloadData()
+
+        case <-banReloadTimer.C:
+            banStore.ReloadData()
+
         case err, ok := <-watcher.Errors:
             if !ok {
                 return
@@ -235,11 +382,16 @@ func monitorConfig(watcher *fsnotify.Watcher) {
 			log.Println(color.HiMagentaString("File change detected, reloading configuration..."))
 			if config.LoadLists(true) {
 				log.Println(color.HiMagentaString("Lists reloaded successfully."))
+				access.LoadGeoIP()
+				access.StartListSources()
+				access.ConfigureAutoBan()
+				traffic.ConfigureNotifications()
+				banStore.ReloadData()
+				bindingStore.ReloadData()
 				cancel()
 				service.CleanupServices()
 				service.Listeners = make([]net.Listener, 0, len(config.Config.Services))
-				ctx, cancel = context.WithCancel(context.Background())
-				service.ExecuteServices(ctx)
+				cancel = startServices()
 			} else {
 				log.Println(color.HiRedString("Failed to reload config."))
 			}
@@ -257,11 +409,30 @@ func cleanup() {
 	color.HiYellow("Shutting down services...")
 	service.CleanupServices()
 
+	if controlServer != nil {
+		controlServer.Close()
+	}
 	if trafficLimiter != nil {
 		color.HiYellow("Saving traffic data...")
 		trafficLimiter.Close()
 		color.HiGreen("Traffic data saved.")
 	}
+	if dataLock != nil {
+		dataLock.Unlock() //nolint:errcheck
+	}
+	if trafficHistory != nil {
+		trafficHistory.Close()
+	}
+
+	if firstJoinStore != nil {
+		firstJoinStore.Close()
+	}
+	if banStore != nil {
+		banStore.Close()
+	}
+	if bindingStore != nil {
+		bindingStore.Close()
+	}
 
 	color.HiGreen("Services have been shut down.")
 
@@ -0,0 +1,299 @@
+package access
+
+import (
+	"fmt"
+	"log"
+	"net/netip"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/InRaining/NoDelay/config"
+
+	"github.com/fatih/color"
+)
+
+// Violations counted by the abuse tracker.
+const (
+	ViolationMalformedPacket  = "malformed packet"
+	ViolationRejectedLogin    = "rejected login"
+	ViolationExcessivePing    = "excessive pings"
+	ViolationHandshakeTimeout = "handshake timeout"
+)
+
+// AutoBan is an IP banned by the abuse tracker.
+type AutoBan struct {
+	IP       string `json:"ip"`
+	Reason   string `json:"reason"` // the violation that triggered the ban
+	Offences int    `json:"offences"`
+	Until    int64  `json:"until"` // unix seconds
+}
+
+type offender struct {
+	violations []time.Time // within the window
+	pings      []time.Time
+	offences   int
+	lastBan    time.Time
+	until      time.Time
+	reason     string
+}
+
+// AbuseTracker counts violations per client IP and bans the IPs
+// exceeding the threshold, for longer each time they do it again.
+type AbuseTracker struct {
+	settings         config.AutoBanConfig
+	window           time.Duration
+	handshakeTimeout time.Duration
+	mutex            sync.Mutex
+	offenders        map[netip.Addr]*offender
+	reported         int // active bans last logged
+	stopChan         chan struct{}
+}
+
+// NewAbuseTracker creates a tracker and starts cleaning it up periodically.
+func NewAbuseTracker(settings config.AutoBanConfig) *AbuseTracker {
+	t := &AbuseTracker{
+		offenders: make(map[netip.Addr]*offender),
+		stopChan:  make(chan struct{}),
+	}
+	t.apply(settings)
+	go t.autoCleanup()
+	return t
+}
+
+// apply sets the settings, filling in the defaults.
+func (t *AbuseTracker) apply(settings config.AutoBanConfig) {
+	if settings.WindowSec <= 0 {
+		settings.WindowSec = 60
+	}
+	if settings.Threshold <= 0 {
+		settings.Threshold = 10
+	}
+	if settings.PingThreshold <= 0 {
+		settings.PingThreshold = 30
+	}
+	if settings.HandshakeTimeoutMs <= 0 {
+		settings.HandshakeTimeoutMs = 10000
+	}
+	if settings.BanSec <= 0 {
+		settings.BanSec = 300
+	}
+	if settings.MaxBanSec <= 0 {
+		settings.MaxBanSec = 86400
+	}
+	if settings.MaxBanSec < settings.BanSec {
+		settings.MaxBanSec = settings.BanSec
+	}
+	if settings.ForgetSec <= 0 {
+		settings.ForgetSec = 86400
+	}
+	t.mutex.Lock()
+	t.settings = settings
+	t.window = time.Duration(settings.WindowSec) * time.Second
+	t.handshakeTimeout = time.Duration(settings.HandshakeTimeoutMs) * time.Millisecond
+	t.mutex.Unlock()
+}
+
+// prune drops the times older than the window.
+func prune(times []time.Time, since time.Time) []time.Time {
+	i := 0
+	for i < len(times) && times[i].Before(since) {
+		i++
+	}
+	return append(times[:0], times[i:]...)
+}
+
+func (t *AbuseTracker) offenderLocked(addr netip.Addr) *offender {
+	o, ok := t.offenders[addr]
+	if !ok {
+		o = new(offender)
+		t.offenders[addr] = o
+	}
+	return o
+}
+
+// Report counts a violation of the client at addr.
+func (t *AbuseTracker) Report(addr netip.Addr, violation string) {
+	addr = addr.Unmap()
+	now := time.Now()
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.reportLocked(t.offenderLocked(addr), addr, violation, now)
+}
+
+func (t *AbuseTracker) reportLocked(o *offender, addr netip.Addr, violation string, now time.Time) {
+	if now.Before(o.until) {
+		return // already banned
+	}
+	o.violations = append(prune(o.violations, now.Add(-t.window)), now)
+	if len(o.violations) < t.settings.Threshold {
+		return
+	}
+
+	if now.Sub(o.lastBan) > time.Duration(t.settings.ForgetSec)*time.Second {
+		o.offences = 0
+	}
+	o.offences++
+	duration := t.settings.BanSec
+	for i := 1; i < o.offences && duration < t.settings.MaxBanSec; i++ {
+		duration *= 2
+	}
+	if duration > t.settings.MaxBanSec {
+		duration = t.settings.MaxBanSec
+	}
+	o.violations = o.violations[:0]
+	o.lastBan = now
+	o.until = now.Add(time.Duration(duration) * time.Second)
+	o.reason = violation
+	log.Println(color.HiRedString("Auto-banned %s for %v after %d violations (%s), offence #%d.",
+		addr, time.Duration(duration)*time.Second, t.settings.Threshold, violation, o.offences))
+}
+
+// ReportStatusRequest counts a status request of the client at addr,
+// which is a violation once there have been too many in the window.
+func (t *AbuseTracker) ReportStatusRequest(addr netip.Addr) {
+	addr = addr.Unmap()
+	now := time.Now()
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	o := t.offenderLocked(addr)
+	o.pings = append(prune(o.pings, now.Add(-t.window)), now)
+	if len(o.pings) > t.settings.PingThreshold {
+		t.reportLocked(o, addr, ViolationExcessivePing, now)
+	}
+}
+
+// Banned reports whether the client at addr is banned.
+func (t *AbuseTracker) Banned(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	o, ok := t.offenders[addr]
+	return ok && time.Now().Before(o.until)
+}
+
+// HandshakeTimeout returns the time allowed to complete the handshake.
+func (t *AbuseTracker) HandshakeTimeout() time.Duration {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.handshakeTimeout
+}
+
+// List returns the bans in effect, the longest first.
+func (t *AbuseTracker) List() []AutoBan {
+	now := time.Now()
+	t.mutex.Lock()
+	bans := make([]AutoBan, 0)
+	for addr, o := range t.offenders {
+		if now.Before(o.until) {
+			bans = append(bans, AutoBan{
+				IP:       addr.String(),
+				Reason:   o.reason,
+				Offences: o.offences,
+				Until:    o.until.Unix(),
+			})
+		}
+	}
+	t.mutex.Unlock()
+	sort.Slice(bans, func(i, j int) bool { return bans[i].Until > bans[j].Until })
+	return bans
+}
+
+func (t *AbuseTracker) autoCleanup() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			t.cleanup()
+		case <-t.stopChan:
+			return
+		}
+	}
+}
+
+// cleanup forgets the clients with nothing left to remember and lists
+// the active bans in the log when their number has changed.
+func (t *AbuseTracker) cleanup() {
+	now := time.Now()
+	t.mutex.Lock()
+	forget := time.Duration(t.settings.ForgetSec) * time.Second
+	active := 0
+	for addr, o := range t.offenders {
+		o.violations = prune(o.violations, now.Add(-t.window))
+		o.pings = prune(o.pings, now.Add(-t.window))
+		if len(o.violations) == 0 && len(o.pings) == 0 && now.Sub(o.lastBan) > forget {
+			delete(t.offenders, addr)
+		} else if now.Before(o.until) {
+			active++
+		}
+	}
+	changed := active != t.reported
+	t.reported = active
+	t.mutex.Unlock()
+
+	if !changed {
+		return
+	}
+	bans := t.List()
+	if len(bans) == 0 {
+		log.Println(color.HiYellowString("No active auto-bans."))
+		return
+	}
+	entries := make([]string, 0, len(bans))
+	for _, ban := range bans {
+		entries = append(entries, fmt.Sprintf("%s (%s, until %s)",
+			ban.IP, ban.Reason, time.Unix(ban.Until, 0).Format("2006-01-02 15:04:05")))
+	}
+	log.Println(color.HiYellowString("Active auto-bans (%d): %s", len(bans), strings.Join(entries, ", ")))
+}
+
+// Close stops the periodic cleanup.
+func (t *AbuseTracker) Close() {
+	close(t.stopChan)
+}
+
+var globalAbuseTracker atomic.Pointer[AbuseTracker]
+
+// ConfigureAutoBan applies the AutoBan settings of the current configuration.
+// Bans in effect are kept as long as auto-ban stays enabled.
+func ConfigureAutoBan() {
+	old := globalAbuseTracker.Load()
+	settings := config.Config.AutoBan
+	switch {
+	case old != nil && settings != nil:
+		old.apply(*settings)
+	case settings != nil:
+		globalAbuseTracker.Store(NewAbuseTracker(*settings))
+	case old != nil:
+		globalAbuseTracker.Store(nil)
+		old.Close()
+	}
+}
+
+// GetAbuseTracker returns the tracker in use, or nil when auto-ban is disabled.
+func GetAbuseTracker() *AbuseTracker {
+	return globalAbuseTracker.Load()
+}
+
+// ReportViolation counts a violation of the client at addr if auto-ban is enabled.
+func ReportViolation(addr netip.Addr, violation string) {
+	if t := globalAbuseTracker.Load(); t != nil {
+		t.Report(addr, violation)
+	}
+}
+
+// ReportStatusRequest counts a status request of the client at addr if auto-ban is enabled.
+func ReportStatusRequest(addr netip.Addr) {
+	if t := globalAbuseTracker.Load(); t != nil {
+		t.ReportStatusRequest(addr)
+	}
+}
+
+// CheckAutoBanned reports whether the client at addr is auto-banned.
+func CheckAutoBanned(addr netip.Addr) bool {
+	t := globalAbuseTracker.Load()
+	return t != nil && t.Banned(addr)
+}
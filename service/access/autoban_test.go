@@ -0,0 +1,99 @@
+package access
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/InRaining/NoDelay/config"
+)
+
+func TestAbuseTracker_Escalation(t *testing.T) {
+	tracker := NewAbuseTracker(config.AutoBanConfig{
+		WindowSec: 60,
+		Threshold: 3,
+		BanSec:    60,
+		MaxBanSec: 200,
+		ForgetSec: 3600,
+	})
+	defer tracker.Close()
+	addr := netip.MustParseAddr("192.0.2.1")
+	start := time.Now()
+
+	for _, tt := range []struct {
+		at        int // seconds since start
+		wantUntil int // end of the ban, 0 when not banned
+	}{
+		{at: 0},
+		{at: 10},
+		{at: 65}, // the first one left the window
+		{at: 68, wantUntil: 128},
+		{at: 100, wantUntil: 128}, // not counted while banned
+		{at: 140},                 // expired
+		{at: 141},
+		{at: 142, wantUntil: 262}, // twice as long
+		{at: 270},
+		{at: 271},
+		{at: 272, wantUntil: 472}, // four times as long, capped
+		{at: 4000},                // forgotten after ForgetSec
+		{at: 4001},
+		{at: 4002, wantUntil: 4062},
+	} {
+		now := start.Add(time.Duration(tt.at) * time.Second)
+		tracker.mutex.Lock()
+		o := tracker.offenderLocked(addr)
+		tracker.reportLocked(o, addr, ViolationRejectedLogin, now)
+		var until int
+		if now.Before(o.until) {
+			until = int(o.until.Sub(start) / time.Second)
+		}
+		tracker.mutex.Unlock()
+		if until != tt.wantUntil {
+			t.Fatalf("at %ds: banned until %ds, want %ds", tt.at, until, tt.wantUntil)
+		}
+	}
+}
+
+func TestAbuseTracker_Pings(t *testing.T) {
+	tracker := NewAbuseTracker(config.AutoBanConfig{Threshold: 1, PingThreshold: 2})
+	defer tracker.Close()
+	addr := netip.MustParseAddr("::ffff:192.0.2.1")
+
+	for i, want := range []bool{false, false, true} {
+		tracker.ReportStatusRequest(addr)
+		if got := tracker.Banned(addr.Unmap()); got != want {
+			t.Fatalf("after %d pings banned %v, want %v", i+1, got, want)
+		}
+	}
+	bans := tracker.List()
+	if len(bans) != 1 || bans[0].IP != "192.0.2.1" || bans[0].Reason != ViolationExcessivePing || bans[0].Offences != 1 {
+		t.Fatalf("unexpected bans %+v", bans)
+	}
+	if tracker.Banned(netip.MustParseAddr("192.0.2.2")) {
+		t.Fatal("another client is banned")
+	}
+}
+
+func TestAbuseTracker_Cleanup(t *testing.T) {
+	tracker := NewAbuseTracker(config.AutoBanConfig{Threshold: 1, ForgetSec: 1})
+	defer tracker.Close()
+	banned := netip.MustParseAddr("192.0.2.1")
+	expired := netip.MustParseAddr("192.0.2.2")
+	tracker.Report(banned, ViolationMalformedPacket)
+	tracker.mutex.Lock()
+	tracker.offenders[expired] = &offender{lastBan: time.Now().Add(-time.Hour), until: time.Now().Add(-time.Minute)}
+	tracker.mutex.Unlock()
+
+	tracker.cleanup()
+	tracker.mutex.Lock()
+	_, keptBanned := tracker.offenders[banned]
+	_, keptExpired := tracker.offenders[expired]
+	reported := tracker.reported
+	tracker.mutex.Unlock()
+	if !keptBanned || keptExpired {
+		t.Fatalf("kept the banned client %v and the expired one %v, want only the banned one", keptBanned, keptExpired)
+	}
+	if reported != 1 {
+		t.Fatalf("%d active bans reported, want 1", reported)
+	}
+}
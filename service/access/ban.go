@@ -0,0 +1,351 @@
+package access
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/InRaining/NoDelay/common/set"
+
+	"github.com/fatih/color"
+)
+
+const (
+	BanTypeName = "name"
+	BanTypeUUID = "uuid"
+	BanTypeIP   = "ip" // a single address or a CIDR prefix
+)
+
+// Ban is a single entry of the ban store.
+type Ban struct {
+	Type    string `json:"type"`
+	Value   string `json:"value"`
+	Reason  string `json:"reason,omitempty"`
+	Issuer  string `json:"issuer,omitempty"`
+	Created int64  `json:"created"`
+	Expires int64  `json:"expires,omitempty"` // unix seconds, 0 means permanent
+
+	prefix netip.Prefix
+}
+
+// Remaining returns how long the ban lasts from now.
+// It returns a negative value for permanent bans.
+func (b *Ban) Remaining() time.Duration {
+	if b.Expires == 0 {
+		return -1
+	}
+	return time.Until(time.Unix(b.Expires, 0))
+}
+
+func (b *Ban) expired(now int64) bool {
+	return b.Expires != 0 && now >= b.Expires
+}
+
+// normalize validates the ban and brings its value into a canonical form.
+func (b *Ban) normalize() error {
+	b.Type = strings.ToLower(b.Type)
+	switch b.Type {
+	case BanTypeName:
+		b.Value = strings.ToLower(b.Value)
+	case BanTypeUUID:
+		b.Value = strings.ToLower(strings.ReplaceAll(b.Value, "-", ""))
+		if len(b.Value) != 32 {
+			return fmt.Errorf("bad UUID %q", b.Value)
+		}
+	case BanTypeIP:
+		p, ok := set.ParsePrefix(b.Value)
+		if !ok {
+			return fmt.Errorf("bad IP or CIDR %q", b.Value)
+		}
+		b.prefix = p
+		if p.IsSingleIP() {
+			b.Value = p.Addr().String()
+		} else {
+			b.Value = p.String()
+		}
+	default:
+		return fmt.Errorf("unknown ban type %q", b.Type)
+	}
+	if b.Value == "" {
+		return errors.New("empty ban value")
+	}
+	return nil
+}
+
+// BanStore keeps bans persistently and removes them when they expire.
+type BanStore struct {
+	dataFile string
+	bans     map[string]*Ban   // key: type + value
+	prefixes []*Ban            // IP bans covering more than one address
+	lastHash [sha256.Size]byte // of the file as last read or written
+	mutex    sync.RWMutex
+	stopChan chan struct{}
+}
+
+// NewBanStore loads the bans from dataFile and starts the expiry cleanup.
+func NewBanStore(dataFile string) *BanStore {
+	bs := &BanStore{
+		dataFile: dataFile,
+		bans:     make(map[string]*Ban),
+		stopChan: make(chan struct{}),
+	}
+	bs.loadData()
+	go bs.autoCleanup()
+	return bs
+}
+
+// ReloadData reloads the bans from file if it has changed since the store
+// last read or wrote it, picking up manual edits.
+func (bs *BanStore) ReloadData() {
+	bs.loadData()
+}
+
+func (bs *BanStore) loadData() {
+	data, err := os.ReadFile(bs.dataFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Error reading ban data file: %v", err)
+		}
+		return
+	}
+	hash := sha256.Sum256(data)
+	bs.mutex.RLock()
+	unchanged := hash == bs.lastHash
+	bs.mutex.RUnlock()
+	if unchanged {
+		return
+	}
+
+	var bans []*Ban
+	if err = json.Unmarshal(data, &bans); err != nil {
+		log.Printf("Error parsing ban data: %v", err)
+		return
+	}
+
+	now := time.Now().Unix()
+	m := make(map[string]*Ban, len(bans))
+	for _, ban := range bans {
+		if err := ban.normalize(); err != nil {
+			log.Printf("Skipping invalid ban entry: %v", err)
+			continue
+		}
+		if !ban.expired(now) {
+			m[ban.Type+"\x00"+ban.Value] = ban
+		}
+	}
+
+	bs.mutex.Lock()
+	bs.bans = m
+	bs.rebuildPrefixesLocked()
+	bs.lastHash = hash
+	bs.mutex.Unlock()
+	log.Printf("Loaded %d bans", len(m))
+}
+
+func (bs *BanStore) rebuildPrefixesLocked() {
+	bs.prefixes = bs.prefixes[:0]
+	for _, ban := range bs.bans {
+		if ban.Type == BanTypeIP && !ban.prefix.IsSingleIP() {
+			bs.prefixes = append(bs.prefixes, ban)
+		}
+	}
+}
+
+func (bs *BanStore) saveData() {
+	bs.mutex.Lock()
+	bans := make([]*Ban, 0, len(bs.bans))
+	for _, ban := range bs.bans {
+		bans = append(bans, ban)
+	}
+	data, err := json.MarshalIndent(bans, "", "  ")
+	bs.lastHash = sha256.Sum256(data)
+	bs.mutex.Unlock()
+	if err != nil {
+		log.Printf("Error marshaling ban data: %v", err)
+		return
+	}
+
+	tmpFile := bs.dataFile + ".tmp"
+	if err = os.WriteFile(tmpFile, data, 0644); err == nil {
+		err = os.Rename(tmpFile, bs.dataFile)
+	}
+	if err != nil {
+		log.Printf("Error saving ban data: %v", err)
+	}
+}
+
+func (bs *BanStore) autoCleanup() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			bs.cleanup()
+		case <-bs.stopChan:
+			return
+		}
+	}
+}
+
+func (bs *BanStore) cleanup() {
+	// edits not reloaded yet would be lost when saving
+	bs.loadData()
+	now := time.Now().Unix()
+	removed := 0
+	bs.mutex.Lock()
+	for key, ban := range bs.bans {
+		if ban.expired(now) {
+			delete(bs.bans, key)
+			removed++
+		}
+	}
+	if removed > 0 {
+		bs.rebuildPrefixesLocked()
+	}
+	bs.mutex.Unlock()
+
+	if removed > 0 {
+		color.HiCyan("Removed %d expired bans.", removed)
+		bs.saveData()
+	}
+}
+
+// Add adds or replaces a ban. A zero Created is set to now.
+func (bs *BanStore) Add(ban Ban) error {
+	if err := ban.normalize(); err != nil {
+		return err
+	}
+	if ban.Created == 0 {
+		ban.Created = time.Now().Unix()
+	}
+	bs.loadData()
+	bs.mutex.Lock()
+	bs.bans[ban.Type+"\x00"+ban.Value] = &ban
+	bs.rebuildPrefixesLocked()
+	bs.mutex.Unlock()
+	bs.saveData()
+	return nil
+}
+
+// Remove lifts a ban. It reports whether the ban existed.
+func (bs *BanStore) Remove(banType, value string) bool {
+	ban := Ban{Type: banType, Value: value}
+	if ban.normalize() != nil {
+		return false
+	}
+	key := ban.Type + "\x00" + ban.Value
+	bs.loadData()
+	bs.mutex.Lock()
+	_, exists := bs.bans[key]
+	delete(bs.bans, key)
+	bs.rebuildPrefixesLocked()
+	bs.mutex.Unlock()
+	if exists {
+		bs.saveData()
+	}
+	return exists
+}
+
+// List returns all bans that are still in effect.
+func (bs *BanStore) List() []Ban {
+	now := time.Now().Unix()
+	bs.mutex.RLock()
+	defer bs.mutex.RUnlock()
+	bans := make([]Ban, 0, len(bs.bans))
+	for _, ban := range bs.bans {
+		if !ban.expired(now) {
+			bans = append(bans, *ban)
+		}
+	}
+	return bans
+}
+
+func (bs *BanStore) find(banType, value string) *Ban {
+	bs.mutex.RLock()
+	defer bs.mutex.RUnlock()
+	ban, ok := bs.bans[banType+"\x00"+value]
+	if !ok || ban.expired(time.Now().Unix()) {
+		return nil
+	}
+	return ban
+}
+
+// CheckName returns the ban on a player name, or nil.
+func (bs *BanStore) CheckName(playerName string) *Ban {
+	return bs.find(BanTypeName, strings.ToLower(playerName))
+}
+
+// CheckUUID returns the ban on a player UUID, or nil.
+func (bs *BanStore) CheckUUID(uuid string) *Ban {
+	return bs.find(BanTypeUUID, strings.ToLower(strings.ReplaceAll(uuid, "-", "")))
+}
+
+// CheckIP returns the ban covering addr, or nil.
+func (bs *BanStore) CheckIP(addr netip.Addr) *Ban {
+	addr = addr.Unmap().WithZone("")
+	if ban := bs.find(BanTypeIP, addr.String()); ban != nil {
+		return ban
+	}
+	now := time.Now().Unix()
+	bs.mutex.RLock()
+	defer bs.mutex.RUnlock()
+	for _, ban := range bs.prefixes {
+		if ban.prefix.Contains(addr) && !ban.expired(now) {
+			return ban
+		}
+	}
+	return nil
+}
+
+// Close stops the expiry cleanup and saves the bans.
+func (bs *BanStore) Close() {
+	close(bs.stopChan)
+	bs.saveData()
+	color.HiGreen("Ban data saved.")
+}
+
+var globalBanStore *BanStore
+
+// SetGlobalBanStore sets the store used by the ban checks.
+func SetGlobalBanStore(store *BanStore) {
+	globalBanStore = store
+}
+
+// GetGlobalBanStore returns the store used by the ban checks, which may be nil.
+func GetGlobalBanStore() *BanStore {
+	return globalBanStore
+}
+
+// CheckBannedIP returns the ban covering addr, or nil.
+// It is checked on accept for the services without Minecraft handling.
+func CheckBannedIP(addr netip.Addr) *Ban {
+	if globalBanStore == nil {
+		return nil
+	}
+	return globalBanStore.CheckIP(addr)
+}
+
+// CheckBannedPlayer returns the ban on a player's IP, name or UUID, or nil.
+// uuid may be empty when the client didn't send it.
+func CheckBannedPlayer(addr netip.Addr, playerName, uuid string) *Ban {
+	if globalBanStore == nil {
+		return nil
+	}
+	if ban := globalBanStore.CheckIP(addr); ban != nil {
+		return ban
+	}
+	if ban := globalBanStore.CheckName(playerName); ban != nil {
+		return ban
+	}
+	if uuid != "" {
+		return globalBanStore.CheckUUID(uuid)
+	}
+	return nil
+}
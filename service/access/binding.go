@@ -0,0 +1,292 @@
+package access
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"log"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/InRaining/NoDelay/config"
+
+	"github.com/fatih/color"
+)
+
+// IPBinding is an address, or a network, a player has logged in from.
+type IPBinding struct {
+	Address   string `json:"address"`
+	FirstSeen int64  `json:"first_seen"`
+	LastSeen  int64  `json:"last_seen"`
+}
+
+// PlayerIPBindings are the addresses bound to a player.
+type PlayerIPBindings struct {
+	PlayerName string       `json:"player_name"`
+	Bindings   []*IPBinding `json:"bindings"`
+}
+
+// IPBindingStore keeps the IP bindings of players persistently.
+type IPBindingStore struct {
+	dataFile string
+	players  map[string]*PlayerIPBindings // key: lower case player name
+	dirty    bool
+	lastHash [sha256.Size]byte // of the file as last read or written
+	mutex    sync.Mutex
+	stopChan chan struct{}
+}
+
+// NewIPBindingStore loads the bindings from dataFile and starts saving them periodically.
+func NewIPBindingStore(dataFile string) *IPBindingStore {
+	st := &IPBindingStore{
+		dataFile: dataFile,
+		players:  make(map[string]*PlayerIPBindings),
+		stopChan: make(chan struct{}),
+	}
+	st.loadData()
+	go st.autoSave()
+	return st
+}
+
+// ReloadData reloads the bindings from file if it has changed since the store
+// last read or wrote it, picking up manual edits.
+func (st *IPBindingStore) ReloadData() {
+	st.loadData()
+}
+
+func (st *IPBindingStore) loadData() {
+	data, err := os.ReadFile(st.dataFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Error reading IP binding data file: %v", err)
+		}
+		return
+	}
+	hash := sha256.Sum256(data)
+	st.mutex.Lock()
+	unchanged := hash == st.lastHash
+	st.mutex.Unlock()
+	if unchanged {
+		return
+	}
+
+	var players []*PlayerIPBindings
+	if err = json.Unmarshal(data, &players); err != nil {
+		log.Printf("Error parsing IP binding data: %v", err)
+		return
+	}
+
+	m := make(map[string]*PlayerIPBindings, len(players))
+	for _, player := range players {
+		m[strings.ToLower(player.PlayerName)] = player
+	}
+	st.mutex.Lock()
+	st.players = m
+	st.dirty = false
+	st.lastHash = hash
+	st.mutex.Unlock()
+	log.Printf("Loaded IP bindings of %d players", len(m))
+}
+
+func (st *IPBindingStore) saveData() {
+	st.mutex.Lock()
+	if !st.dirty {
+		st.mutex.Unlock()
+		return
+	}
+	players := make([]*PlayerIPBindings, 0, len(st.players))
+	for _, player := range st.players {
+		players = append(players, player)
+	}
+	data, err := json.MarshalIndent(players, "", "  ")
+	st.dirty = false
+	st.lastHash = sha256.Sum256(data)
+	st.mutex.Unlock()
+	if err != nil {
+		log.Printf("Error marshaling IP binding data: %v", err)
+		return
+	}
+
+	tmpFile := st.dataFile + ".tmp"
+	if err = os.WriteFile(tmpFile, data, 0644); err == nil {
+		err = os.Rename(tmpFile, st.dataFile)
+	}
+	if err != nil {
+		log.Printf("Error saving IP binding data: %v", err)
+	}
+}
+
+func (st *IPBindingStore) autoSave() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			st.saveData()
+		case <-st.stopChan:
+			return
+		}
+	}
+}
+
+// bindingAddress returns the address, or the network, addr is bound as.
+func bindingAddress(addr netip.Addr, byPrefix bool) string {
+	addr = addr.Unmap().WithZone("")
+	if !byPrefix {
+		return addr.String()
+	}
+	bits := 64
+	if addr.Is4() {
+		bits = 24
+	}
+	return netip.PrefixFrom(addr, bits).Masked().String()
+}
+
+// Reserve binds addr to the player, or refreshes the binding, if addr is
+// bound to the player or there is room left to bind it, and reports whether
+// the player may log in from addr. Checking and binding under one lock keeps
+// concurrent logins from going over the limit. A login that fails later gives
+// the address back with release, which does nothing if addr was bound before.
+func (st *IPBindingStore) Reserve(settings *config.IPBindingConfig, playerName string, addr netip.Addr) (release func(), ok bool) {
+	address := bindingAddress(addr, settings.ByPrefix)
+	now := time.Now().Unix()
+
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	player := st.playerLocked(settings, playerName, now)
+	if player == nil {
+		player = &PlayerIPBindings{PlayerName: playerName}
+		st.players[strings.ToLower(playerName)] = player
+	}
+	for _, binding := range player.Bindings {
+		if binding.Address == address {
+			// coarse, so that the file isn't rewritten for every login
+			if now-binding.LastSeen > 3600 {
+				binding.LastSeen = now
+				st.dirty = true
+			}
+			return func() {}, true
+		}
+	}
+	if len(player.Bindings) >= maxIPs(settings) {
+		return nil, false
+	}
+	binding := &IPBinding{Address: address, FirstSeen: now, LastSeen: now}
+	player.Bindings = append(player.Bindings, binding)
+	st.dirty = true
+	return func() { st.unbind(playerName, binding) }, true
+}
+
+// unbind removes a binding added by Reserve, unless it is gone already.
+func (st *IPBindingStore) unbind(playerName string, binding *IPBinding) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	key := strings.ToLower(playerName)
+	player, ok := st.players[key]
+	if !ok {
+		return
+	}
+	for i, b := range player.Bindings {
+		if b == binding {
+			player.Bindings = append(player.Bindings[:i], player.Bindings[i+1:]...)
+			if len(player.Bindings) == 0 {
+				delete(st.players, key)
+			}
+			st.dirty = true
+			return
+		}
+	}
+}
+
+func maxIPs(settings *config.IPBindingConfig) int {
+	if settings.MaxIPs <= 0 {
+		return 3
+	}
+	return settings.MaxIPs
+}
+
+// playerLocked returns the bindings of a player, or nil, without those
+// not used within the window.
+func (st *IPBindingStore) playerLocked(settings *config.IPBindingConfig, playerName string, now int64) *PlayerIPBindings {
+	player, ok := st.players[strings.ToLower(playerName)]
+	if !ok {
+		return nil
+	}
+	if settings.WindowDays > 0 {
+		cutoff := now - int64(settings.WindowDays)*24*3600
+		bindings := player.Bindings[:0]
+		for _, binding := range player.Bindings {
+			if binding.LastSeen >= cutoff {
+				bindings = append(bindings, binding)
+			}
+		}
+		if len(bindings) != len(player.Bindings) {
+			player.Bindings = bindings
+			st.dirty = true
+		}
+	}
+	return player
+}
+
+// Get returns the addresses bound to a player.
+func (st *IPBindingStore) Get(playerName string) []IPBinding {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	player, ok := st.players[strings.ToLower(playerName)]
+	if !ok {
+		return nil
+	}
+	bindings := make([]IPBinding, 0, len(player.Bindings))
+	for _, binding := range player.Bindings {
+		bindings = append(bindings, *binding)
+	}
+	return bindings
+}
+
+// Reset removes the bindings of a player, letting them log in from new addresses.
+// It reports whether the player had any.
+func (st *IPBindingStore) Reset(playerName string) bool {
+	st.mutex.Lock()
+	key := strings.ToLower(playerName)
+	_, exists := st.players[key]
+	delete(st.players, key)
+	if exists {
+		st.dirty = true
+	}
+	st.mutex.Unlock()
+	if exists {
+		st.saveData()
+	}
+	return exists
+}
+
+// Close saves the bindings and stops the background saving.
+func (st *IPBindingStore) Close() {
+	close(st.stopChan)
+	st.saveData()
+	color.HiGreen("IP binding data saved.")
+}
+
+var globalIPBindingStore *IPBindingStore
+
+// SetGlobalIPBindingStore sets the store used by ReserveIPBinding.
+func SetGlobalIPBindingStore(store *IPBindingStore) {
+	globalIPBindingStore = store
+}
+
+// GetGlobalIPBindingStore returns the store used by ReserveIPBinding, which may be nil.
+func GetGlobalIPBindingStore() *IPBindingStore {
+	return globalIPBindingStore
+}
+
+// ReserveIPBinding binds addr to the player if they may log in from it,
+// see IPBindingStore.Reserve. It always succeeds when IP binding is disabled.
+func ReserveIPBinding(playerName string, addr netip.Addr) (release func(), ok bool) {
+	settings := config.Config.IPBinding
+	if settings == nil || globalIPBindingStore == nil {
+		return func() {}, true
+	}
+	return globalIPBindingStore.Reserve(settings, playerName, addr)
+}
@@ -0,0 +1,106 @@
+package access
+
+import (
+	"fmt"
+	"net/netip"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/InRaining/NoDelay/config"
+)
+
+func TestIPBindingStore_Reserve(t *testing.T) {
+	settings := &config.IPBindingConfig{MaxIPs: 2}
+	st := NewIPBindingStore(filepath.Join(t.TempDir(), "IPBindings.json"))
+	defer st.Close()
+	addr := func(s string) netip.Addr { return netip.MustParseAddr(s) }
+
+	for _, tt := range []struct {
+		name    string
+		addr    string
+		release bool // as if the dial failed
+		want    bool
+		wantIPs int
+	}{
+		{name: "first address", addr: "192.0.2.1", want: true, wantIPs: 1},
+		{name: "failed login", addr: "192.0.2.2", release: true, want: true, wantIPs: 1},
+		{name: "second address", addr: "192.0.2.2", want: true, wantIPs: 2},
+		{name: "third address", addr: "192.0.2.3", wantIPs: 2},
+		{name: "bound address", addr: "192.0.2.1", want: true, wantIPs: 2},
+		{name: "failed login from a bound address", addr: "::ffff:192.0.2.1", release: true, want: true, wantIPs: 2},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			release, ok := st.Reserve(settings, "Steve", addr(tt.addr))
+			if ok != tt.want {
+				t.Fatalf("reserved %v, want %v", ok, tt.want)
+			}
+			if ok && tt.release {
+				release()
+			}
+			if got := len(st.Get("steve")); got != tt.wantIPs {
+				t.Errorf("%d addresses bound, want %d", got, tt.wantIPs)
+			}
+		})
+	}
+
+	// a release after the bindings were reset leaves the new ones alone
+	release, _ := st.Reserve(settings, "Alex", addr("198.51.100.1"))
+	st.Reset("Alex")
+	st.Reserve(settings, "Alex", addr("198.51.100.1"))
+	release()
+	if got := st.Get("Alex"); len(got) != 1 {
+		t.Errorf("bindings %+v after a stale release, want one", got)
+	}
+}
+
+func TestIPBindingStore_ReserveConcurrent(t *testing.T) {
+	settings := &config.IPBindingConfig{MaxIPs: 3}
+	st := NewIPBindingStore(filepath.Join(t.TempDir(), "IPBindings.json"))
+	defer st.Close()
+
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	accepted := 0
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if _, ok := st.Reserve(settings, "Steve", netip.MustParseAddr(fmt.Sprintf("192.0.2.%d", i+1))); ok {
+				mutex.Lock()
+				accepted++
+				mutex.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+	if accepted != 3 || len(st.Get("Steve")) != 3 {
+		t.Errorf("%d logins accepted and %d addresses bound, want 3", accepted, len(st.Get("Steve")))
+	}
+}
+
+func TestIPBindingStore_Window(t *testing.T) {
+	settings := &config.IPBindingConfig{MaxIPs: 1, WindowDays: 30, ByPrefix: true}
+	st := NewIPBindingStore(filepath.Join(t.TempDir(), "IPBindings.json"))
+	defer st.Close()
+
+	if _, ok := st.Reserve(settings, "Steve", netip.MustParseAddr("192.0.2.1")); !ok {
+		t.Fatal("first address rejected")
+	}
+	if _, ok := st.Reserve(settings, "Steve", netip.MustParseAddr("192.0.2.200")); !ok {
+		t.Error("address in the same /24 rejected")
+	}
+	if _, ok := st.Reserve(settings, "Steve", netip.MustParseAddr("198.51.100.1")); ok {
+		t.Error("another network accepted")
+	}
+	st.mutex.Lock()
+	st.players["steve"].Bindings[0].LastSeen = time.Now().AddDate(0, 0, -31).Unix()
+	st.mutex.Unlock()
+	if _, ok := st.Reserve(settings, "Steve", netip.MustParseAddr("198.51.100.1")); !ok {
+		t.Error("another network rejected after the old one was forgotten")
+	}
+	if got := st.Get("Steve"); len(got) != 1 || got[0].Address != "198.51.100.0/24" {
+		t.Errorf("bindings %+v, want only 198.51.100.0/24", got)
+	}
+}
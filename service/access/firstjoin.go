@@ -0,0 +1,196 @@
+package access
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/InRaining/NoDelay/config"
+
+	"github.com/fatih/color"
+)
+
+// FirstJoinRecord remembers when a player has been seen on a service.
+type FirstJoinRecord struct {
+	Service    string `json:"service"`
+	PlayerName string `json:"player_name"`
+	IP         string `json:"ip,omitempty"`
+	FirstSeen  int64  `json:"first_seen"`
+	LastSeen   int64  `json:"last_seen"`
+	Returned   bool   `json:"returned"` // has come back after the first-join notice
+}
+
+// FirstJoinStore keeps first-join records persistently.
+type FirstJoinStore struct {
+	dataFile string
+	records  map[string]*FirstJoinRecord
+	dirty    bool
+	mutex    sync.Mutex
+	stopChan chan struct{}
+}
+
+// NewFirstJoinStore loads the records from dataFile and starts saving them periodically.
+func NewFirstJoinStore(dataFile string) *FirstJoinStore {
+	st := &FirstJoinStore{
+		dataFile: dataFile,
+		records:  make(map[string]*FirstJoinRecord),
+		stopChan: make(chan struct{}),
+	}
+	st.loadData()
+	go st.autoSave()
+	return st
+}
+
+func firstJoinKey(service, playerName, ip string) string {
+	return service + "\x00" + playerName + "\x00" + ip
+}
+
+func (st *FirstJoinStore) loadData() {
+	data, err := os.ReadFile(st.dataFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Error reading first-join data file: %v", err)
+		}
+		return
+	}
+
+	var records []*FirstJoinRecord
+	if err = json.Unmarshal(data, &records); err != nil {
+		log.Printf("Error parsing first-join data: %v", err)
+		return
+	}
+
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	for _, record := range records {
+		st.records[firstJoinKey(record.Service, record.PlayerName, record.IP)] = record
+	}
+	log.Printf("Loaded first-join data for %d players", len(st.records))
+}
+
+func (st *FirstJoinStore) saveData() {
+	st.mutex.Lock()
+	if !st.dirty {
+		st.mutex.Unlock()
+		return
+	}
+	records := make([]*FirstJoinRecord, 0, len(st.records))
+	for _, record := range st.records {
+		records = append(records, record)
+	}
+	data, err := json.MarshalIndent(records, "", "  ")
+	st.dirty = false
+	st.mutex.Unlock()
+	if err != nil {
+		log.Printf("Error marshaling first-join data: %v", err)
+		return
+	}
+
+	// write to a temporary file first so that a crash can't leave a truncated file
+	tmpFile := st.dataFile + ".tmp"
+	if err = os.WriteFile(tmpFile, data, 0644); err == nil {
+		err = os.Rename(tmpFile, st.dataFile)
+	}
+	if err != nil {
+		log.Printf("Error saving first-join data: %v", err)
+	}
+}
+
+func (st *FirstJoinStore) autoSave() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			st.cleanup()
+			st.saveData()
+		case <-st.stopChan:
+			return
+		}
+	}
+}
+
+// cleanup removes the records that have expired under their service settings.
+func (st *FirstJoinStore) cleanup() {
+	expiry := make(map[string]int64, len(config.Config.Services))
+	for _, s := range config.Config.Services {
+		if s.Minecraft.FirstJoin.ExpiryDays > 0 {
+			expiry[s.Name] = int64(s.Minecraft.FirstJoin.ExpiryDays) * 24 * 3600
+		}
+	}
+
+	now := time.Now().Unix()
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	for key, record := range st.records {
+		if ttl, ok := expiry[record.Service]; ok && now-record.LastSeen > ttl {
+			delete(st.records, key)
+			st.dirty = true
+		}
+	}
+}
+
+// Check records a login and reports whether it is the first join of the player.
+func (st *FirstJoinStore) Check(s *config.ConfigProxyService, playerName, ip string) bool {
+	settings := &s.Minecraft.FirstJoin
+	if !settings.KeyByIP {
+		ip = ""
+	}
+	key := firstJoinKey(s.Name, playerName, ip)
+	now := time.Now().Unix()
+
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	st.dirty = true
+
+	record, exists := st.records[key]
+	if exists && settings.ExpiryDays > 0 && now-record.LastSeen > int64(settings.ExpiryDays)*24*3600 {
+		exists = false
+	}
+	if !exists {
+		st.records[key] = &FirstJoinRecord{
+			Service:    s.Name,
+			PlayerName: playerName,
+			IP:         ip,
+			FirstSeen:  now,
+			LastSeen:   now,
+		}
+		return true
+	}
+
+	record.LastSeen = now
+	if !record.Returned {
+		if settings.RejoinWindowSec > 0 && now-record.FirstSeen > settings.RejoinWindowSec {
+			// came back too late, show the notice again
+			record.FirstSeen = now
+			return true
+		}
+		record.Returned = true
+	}
+	return false
+}
+
+// Close saves the records and stops the background saving.
+func (st *FirstJoinStore) Close() {
+	close(st.stopChan)
+	st.saveData()
+	color.HiGreen("First-join data saved.")
+}
+
+var globalFirstJoinStore *FirstJoinStore
+
+// SetGlobalFirstJoinStore sets the store used by IsFirstTime.
+func SetGlobalFirstJoinStore(store *FirstJoinStore) {
+	globalFirstJoinStore = store
+}
+
+// IsFirstTime reports whether this is the first time playerName joins the service.
+// It always returns false when first-join tracking is disabled for the service.
+func IsFirstTime(s *config.ConfigProxyService, playerName, ip string) bool {
+	if !s.Minecraft.FirstJoin.Enabled() || globalFirstJoinStore == nil {
+		return false
+	}
+	return globalFirstJoinStore.Check(s, playerName, ip)
+}
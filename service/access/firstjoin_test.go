@@ -0,0 +1,64 @@
+package access
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/InRaining/NoDelay/config"
+)
+
+func TestFirstJoinStore_ConcurrentCheck(t *testing.T) {
+	st := NewFirstJoinStore(filepath.Join(t.TempDir(), "FirstJoin.json"))
+	defer st.Close()
+
+	for _, keyByIP := range []bool{false, true} {
+		s := &config.ConfigProxyService{Name: fmt.Sprintf("service-%v", keyByIP)}
+		s.Minecraft.FirstJoin.KeyByIP = keyByIP
+
+		const players, logins = 8, 50
+		var first [players]atomic.Int32
+		var wg sync.WaitGroup
+		for i := 0; i < players; i++ {
+			for j := 0; j < logins; j++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					if st.Check(s, fmt.Sprintf("player%d", i), "192.0.2.1") {
+						first[i].Add(1)
+					}
+				}(i)
+			}
+		}
+		// saving while checking must not race with the logins
+		for j := 0; j < 10; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				st.cleanup()
+				st.saveData()
+			}()
+		}
+		wg.Wait()
+
+		for i := range first {
+			if n := first[i].Load(); n != 1 {
+				t.Errorf("KeyByIP=%v: player%d got the first-join notice %d times, want once", keyByIP, i, n)
+			}
+			if st.Check(s, fmt.Sprintf("player%d", i), "192.0.2.1") {
+				t.Errorf("KeyByIP=%v: player%d got the notice again after coming back", keyByIP, i)
+			}
+		}
+	}
+
+	// the records survive a restart
+	st.saveData()
+	reloaded := NewFirstJoinStore(st.dataFile)
+	defer reloaded.Close()
+	s := &config.ConfigProxyService{Name: "service-false"}
+	if reloaded.Check(s, "player0", "") {
+		t.Error("player0 got the notice again after a restart")
+	}
+}
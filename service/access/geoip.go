@@ -0,0 +1,242 @@
+package access
+
+import (
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/InRaining/NoDelay/config"
+
+	"github.com/fatih/color"
+	"github.com/fsnotify/fsnotify"
+	"github.com/oschwald/maxminddb-golang"
+)
+
+const (
+	GeoIPActionReset = "reset"
+	GeoIPActionKick  = "kick"
+)
+
+// GeoIPRecord is what the databases know about an address.
+type GeoIPRecord struct {
+	Country      string
+	ASN          uint
+	Organization string
+}
+
+type geoIPData struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	ASN          uint   `maxminddb:"autonomous_system_number"`
+	Organization string `maxminddb:"autonomous_system_organization"`
+}
+
+type geoIPDatabase struct {
+	path   string
+	reader atomic.Pointer[maxminddb.Reader]
+}
+
+func (d *geoIPDatabase) load() {
+	// The whole file is read into memory instead of using mmap, so a reader
+	// being swapped out can still be used by lookups that are in flight.
+	data, err := os.ReadFile(d.path)
+	if err != nil {
+		log.Println(color.HiRedString("GeoIP: Failed to read database %s: %v", d.path, err))
+		return
+	}
+	reader, err := maxminddb.FromBytes(data)
+	if err != nil {
+		log.Println(color.HiRedString("GeoIP: Failed to load database %s: %v", d.path, err))
+		return
+	}
+	d.reader.Store(reader)
+	log.Println(color.HiYellowString("GeoIP: Loaded %s (%s, built %s).", d.path, reader.Metadata.DatabaseType,
+		time.Unix(int64(reader.Metadata.BuildEpoch), 0).Format("2006-01-02")))
+}
+
+func (d *geoIPDatabase) lookup(ip net.IP, data *geoIPData) bool {
+	if d == nil {
+		return false
+	}
+	reader := d.reader.Load()
+	if reader == nil {
+		return false
+	}
+	offset, err := reader.LookupOffset(ip)
+	if err != nil || offset == maxminddb.NotFound {
+		return false
+	}
+	return reader.Decode(offset, data) == nil
+}
+
+type geoIPService struct {
+	country *geoIPDatabase
+	asn     *geoIPDatabase
+	watcher *fsnotify.Watcher
+}
+
+var (
+	geoIP     atomic.Pointer[geoIPService]
+	geoIPLock sync.Mutex
+)
+
+// LoadGeoIP opens the databases in the current configuration and watches them
+// for changes. It does nothing if the database paths have not changed.
+func LoadGeoIP() {
+	geoIPLock.Lock()
+	defer geoIPLock.Unlock()
+
+	var countryPath, asnPath string
+	if c := config.Config.GeoIP; c != nil {
+		countryPath, asnPath = c.CountryDatabase, c.ASNDatabase
+	}
+	old := geoIP.Load()
+	if old != nil && old.path(old.country) == countryPath && old.path(old.asn) == asnPath {
+		return
+	}
+	if old != nil && old.watcher != nil {
+		old.watcher.Close()
+	}
+	if countryPath == "" && asnPath == "" {
+		geoIP.Store(nil)
+		return
+	}
+
+	g := new(geoIPService)
+	if countryPath != "" {
+		g.country = &geoIPDatabase{path: countryPath}
+		g.country.load()
+	}
+	if asnPath != "" {
+		if asnPath == countryPath {
+			g.asn = g.country
+		} else {
+			g.asn = &geoIPDatabase{path: asnPath}
+			g.asn.load()
+		}
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Println(color.HiRedString("GeoIP: Failed to create file watcher: %v", err))
+	} else {
+		g.watcher = watcher
+		// watch the directories, since database updates usually replace the file
+		for _, d := range []*geoIPDatabase{g.country, g.asn} {
+			if d != nil {
+				if err := watcher.Add(filepath.Dir(d.path)); err != nil {
+					log.Println(color.HiRedString("GeoIP: Failed to watch %s: %v", d.path, err))
+				}
+			}
+		}
+		go g.watch()
+	}
+	geoIP.Store(g)
+}
+
+func (g *geoIPService) path(d *geoIPDatabase) string {
+	if d == nil {
+		return ""
+	}
+	return d.path
+}
+
+func (g *geoIPService) watch() {
+	timers := make(map[*geoIPDatabase]*time.Timer)
+	for {
+		select {
+		case event, ok := <-g.watcher.Events:
+			if !ok {
+				return
+			}
+			if !event.Has(fsnotify.Write) && !event.Has(fsnotify.Create) && !event.Has(fsnotify.Rename) {
+				continue
+			}
+			for _, d := range []*geoIPDatabase{g.country, g.asn} {
+				if d == nil || filepath.Clean(event.Name) != filepath.Clean(d.path) {
+					continue
+				}
+				// wait for the writer to finish
+				if t, ok := timers[d]; ok {
+					t.Reset(time.Second)
+				} else {
+					timers[d] = time.AfterFunc(time.Second, d.load)
+				}
+			}
+		case err, ok := <-g.watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Println(color.HiRedString("GeoIP: Error while watching databases: %v", err))
+		}
+	}
+}
+
+// LookupGeoIP returns the country and ASN of addr.
+// ok is false if neither database knows the address.
+func LookupGeoIP(addr netip.Addr) (record GeoIPRecord, ok bool) {
+	g := geoIP.Load()
+	if g == nil {
+		return
+	}
+	ip := net.IP(addr.Unmap().AsSlice())
+	var data geoIPData
+	if g.country.lookup(ip, &data) {
+		record.Country = strings.ToUpper(data.Country.ISOCode)
+		ok = record.Country != ""
+	}
+	if g.asn != g.country {
+		data = geoIPData{}
+		g.asn.lookup(ip, &data)
+	}
+	if data.ASN != 0 {
+		record.ASN = data.ASN
+		record.Organization = data.Organization
+		ok = true
+	}
+	return
+}
+
+// CheckGeoIP applies the GeoIP access rule of a service to addr.
+// It returns false if the address should be rejected.
+func CheckGeoIP(s *config.ConfigProxyService, addr netip.Addr) (bool, GeoIPRecord) {
+	rule := &s.GeoIPAccess
+	if rule.Mode == DefaultMode {
+		return true, GeoIPRecord{}
+	}
+	record, ok := LookupGeoIP(addr)
+	if !ok {
+		return rule.Mode != AllowMode || rule.AllowUnknown, record
+	}
+
+	hit := false
+	for _, country := range rule.Countries {
+		if strings.EqualFold(country, record.Country) {
+			hit = true
+			break
+		}
+	}
+	if !hit && record.ASN != 0 {
+		for _, asn := range rule.ASNs {
+			if asn == record.ASN {
+				hit = true
+				break
+			}
+		}
+	}
+
+	switch rule.Mode {
+	case AllowMode:
+		return hit, record
+	case BlockMode:
+		return !hit, record
+	}
+	return true, record
+}
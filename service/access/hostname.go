@@ -0,0 +1,44 @@
+package access
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// HostnameStats counts the clients of a service turned away for their hostname.
+type HostnameStats struct {
+	WrongHostname int64 // hostnames not allowed
+	RawIP         int64 // IP addresses used as hostname, mostly scanners
+}
+
+type hostnameCounters struct {
+	wrongHostname atomic.Int64
+	rawIP         atomic.Int64
+}
+
+var hostnameStats sync.Map // service name -> *hostnameCounters
+
+// RecordWrongHostname counts a client of service rejected for its hostname,
+// and returns how many such clients of the same kind there have been.
+func RecordWrongHostname(service string, rawIP bool) int64 {
+	v, _ := hostnameStats.LoadOrStore(service, new(hostnameCounters))
+	counters := v.(*hostnameCounters)
+	if rawIP {
+		return counters.rawIP.Add(1)
+	}
+	return counters.wrongHostname.Add(1)
+}
+
+// GetHostnameStats returns the counters of every service.
+func GetHostnameStats() map[string]HostnameStats {
+	stats := make(map[string]HostnameStats)
+	hostnameStats.Range(func(key, value any) bool {
+		counters := value.(*hostnameCounters)
+		stats[key.(string)] = HostnameStats{
+			WrongHostname: counters.wrongHostname.Load(),
+			RawIP:         counters.rawIP.Load(),
+		}
+		return true
+	})
+	return stats
+}
@@ -0,0 +1,144 @@
+package access
+
+import (
+	"net/netip"
+	"sync"
+	"sync/atomic"
+
+	"github.com/InRaining/NoDelay/common/rate"
+	"github.com/InRaining/NoDelay/config"
+)
+
+// Reasons for rejecting a connection counted by ConnLimiter.
+const (
+	LimitServiceConnections = "service_connections"
+	LimitIPConnections      = "ip_connections"
+	LimitIPConnectionRate   = "ip_connection_rate"
+	LimitStatusRate         = "status_rate"
+	LimitLoginRate          = "login_rate"
+)
+
+// ConnLimiter enforces the connection limits of a service.
+type ConnLimiter struct {
+	settings config.ConnLimits
+	active   atomic.Int32
+
+	perIPMutex sync.Mutex
+	perIP      map[netip.Addr]int
+
+	connRate   *rate.KeyedLimiter
+	statusRate *rate.KeyedLimiter
+	loginRate  *rate.KeyedLimiter
+
+	rejections sync.Map // reason -> *atomic.Int64
+}
+
+var connLimiters sync.Map // service name -> *ConnLimiter
+
+func newKeyedLimiter(perMinute, burst float64) *rate.KeyedLimiter {
+	if perMinute <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = perMinute
+	}
+	return rate.NewKeyedLimiter(perMinute/60, burst)
+}
+
+// NewConnLimiter creates the limiter of a service,
+// replacing the one of a previous run of the service.
+func NewConnLimiter(service string, settings config.ConnLimits) *ConnLimiter {
+	l := &ConnLimiter{
+		settings:   settings,
+		perIP:      make(map[netip.Addr]int),
+		connRate:   newKeyedLimiter(settings.ConnectionsPerMinute, settings.ConnectionBurst),
+		statusRate: newKeyedLimiter(settings.StatusPerMinute, settings.StatusBurst),
+		loginRate:  newKeyedLimiter(settings.LoginsPerMinute, settings.LoginBurst),
+	}
+	connLimiters.Store(service, l)
+	return l
+}
+
+func (l *ConnLimiter) reject(reason string) string {
+	v, _ := l.rejections.LoadOrStore(reason, new(atomic.Int64))
+	v.(*atomic.Int64).Add(1)
+	return reason
+}
+
+// Acquire checks a new connection from addr against the service cap,
+// the per-IP cap and the per-IP connection rate. It returns the reason
+// if the connection is rejected, otherwise release must be called when
+// the connection ends.
+func (l *ConnLimiter) Acquire(addr netip.Addr) (release func(), reason string) {
+	addr = addr.Unmap()
+	if l.connRate != nil && !l.connRate.Allow(addr.String()) {
+		return nil, l.reject(LimitIPConnectionRate)
+	}
+	active := l.active.Add(1)
+	if max := l.settings.MaxConnections; max > 0 && int(active) > max {
+		l.active.Add(-1)
+		return nil, l.reject(LimitServiceConnections)
+	}
+	if max := l.settings.MaxConnectionsPerIP; max > 0 {
+		l.perIPMutex.Lock()
+		if l.perIP[addr] >= max {
+			l.perIPMutex.Unlock()
+			l.active.Add(-1)
+			return nil, l.reject(LimitIPConnections)
+		}
+		l.perIP[addr]++
+		l.perIPMutex.Unlock()
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.active.Add(-1)
+			if l.settings.MaxConnectionsPerIP > 0 {
+				l.perIPMutex.Lock()
+				if l.perIP[addr]--; l.perIP[addr] <= 0 {
+					delete(l.perIP, addr)
+				}
+				l.perIPMutex.Unlock()
+			}
+		})
+	}, ""
+}
+
+// AllowStatus checks the status request rate of addr.
+func (l *ConnLimiter) AllowStatus(addr netip.Addr) bool {
+	if l.statusRate == nil || l.statusRate.Allow(addr.Unmap().String()) {
+		return true
+	}
+	l.reject(LimitStatusRate)
+	return false
+}
+
+// AllowLogin checks the login rate of addr.
+func (l *ConnLimiter) AllowLogin(addr netip.Addr) bool {
+	if l.loginRate == nil || l.loginRate.Allow(addr.Unmap().String()) {
+		return true
+	}
+	l.reject(LimitLoginRate)
+	return false
+}
+
+// Rejections returns how many connections were rejected for each reason.
+func (l *ConnLimiter) Rejections() map[string]int64 {
+	counts := make(map[string]int64)
+	l.rejections.Range(func(key, value any) bool {
+		counts[key.(string)] = value.(*atomic.Int64).Load()
+		return true
+	})
+	return counts
+}
+
+// GetLimitStats returns the rejection counts of every service.
+func GetLimitStats() map[string]map[string]int64 {
+	stats := make(map[string]map[string]int64)
+	connLimiters.Range(func(key, value any) bool {
+		stats[key.(string)] = value.(*ConnLimiter).Rejections()
+		return true
+	})
+	return stats
+}
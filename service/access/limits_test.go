@@ -0,0 +1,84 @@
+package access
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/InRaining/NoDelay/config"
+)
+
+func TestConnLimiter_Acquire(t *testing.T) {
+	l := NewConnLimiter("test", config.ConnLimits{MaxConnections: 3, MaxConnectionsPerIP: 2})
+	steve := netip.MustParseAddr("192.0.2.1")
+	alex := netip.MustParseAddr("::ffff:192.0.2.2")
+	notch := netip.MustParseAddr("192.0.2.3")
+
+	var releases []func()
+	for _, tt := range []struct {
+		name string
+		addr netip.Addr
+		want string
+	}{
+		{name: "first", addr: steve},
+		{name: "second from the IP", addr: steve},
+		{name: "third from the IP", addr: steve, want: LimitIPConnections},
+		{name: "another IP", addr: alex},
+		{name: "over the service cap", addr: notch, want: LimitServiceConnections},
+	} {
+		release, reason := l.Acquire(tt.addr)
+		if reason != tt.want {
+			t.Fatalf("%s: reason %q, want %q", tt.name, reason, tt.want)
+		}
+		if release != nil {
+			releases = append(releases, release)
+		}
+	}
+
+	// a connection rejected by a later check gives its slot back at once,
+	// and releasing it twice doesn't free another slot
+	releases[0]()
+	releases[0]()
+	if _, reason := l.Acquire(notch); reason != "" {
+		t.Fatalf("reason %q after a release, want none", reason)
+	}
+	if _, reason := l.Acquire(notch); reason != LimitServiceConnections {
+		t.Fatalf("reason %q after a double release, want %q", reason, LimitServiceConnections)
+	}
+	for _, release := range releases[1:] {
+		release()
+	}
+	if _, reason := l.Acquire(steve); reason != "" {
+		t.Fatalf("reason %q after all were released, want none", reason)
+	}
+
+	want := map[string]int64{LimitIPConnections: 1, LimitServiceConnections: 2}
+	got := l.Rejections()
+	if len(got) != len(want) || got[LimitIPConnections] != 1 || got[LimitServiceConnections] != 2 {
+		t.Errorf("rejections %v, want %v", got, want)
+	}
+}
+
+func TestConnLimiter_Rates(t *testing.T) {
+	l := NewConnLimiter("test", config.ConnLimits{ConnectionsPerMinute: 2, StatusPerMinute: 1, LoginsPerMinute: 60, LoginBurst: 1})
+	steve := netip.MustParseAddr("192.0.2.1")
+
+	for i, want := range []string{"", "", LimitIPConnectionRate} {
+		release, reason := l.Acquire(steve)
+		if reason != want {
+			t.Fatalf("connection %d: reason %q, want %q", i+1, reason, want)
+		}
+		if release != nil {
+			// released right away, as if rejected by a later check: still counted
+			release()
+		}
+	}
+	if _, reason := l.Acquire(netip.MustParseAddr("192.0.2.2")); reason != "" {
+		t.Errorf("another IP limited: %q", reason)
+	}
+	if !l.AllowStatus(steve) || l.AllowStatus(steve) {
+		t.Error("want one status request allowed")
+	}
+	if !l.AllowLogin(steve) || l.AllowLogin(steve) {
+		t.Error("want one login allowed by the burst")
+	}
+}
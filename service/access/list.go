@@ -2,8 +2,6 @@ package access
 
 import (
 	"fmt"
-	"io/ioutil"
-	"net/http"
 
 	"github.com/InRaining/NoDelay/common/set"
 	"github.com/InRaining/NoDelay/config"
@@ -14,31 +12,25 @@ func GetTargetList(listName string) (set.StringSet, error) {
 	if ok {
 		return set, nil
 	}
+	if snapshot, ok := getListSource(listName); ok {
+		return snapshot.names, nil
+	}
 	return nil, fmt.Errorf("list %q not found", listName)
 }
 
-func IsWhitelist(playerName string) (bool, error) {
-	resp, err := http.Get(config.Config.Configuration.ListAPI + "?playerName=" + playerName)
-	if err != nil {
-		return false, fmt.Errorf("failed to make HTTP request: %w", err)
-	}
-	defer resp.Body.Close()
-
-	bytes, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return false, fmt.Errorf("failed to read HTTP response body: %w", err)
+// GetTargetIPList returns the IP addresses and CIDR prefixes of a list.
+func GetTargetIPList(listName string) (*set.PrefixSet, error) {
+	if _, ok := config.Config.Lists[listName]; !ok {
+		if snapshot, ok := getListSource(listName); ok {
+			return snapshot.prefixes, nil
+		}
+		return nil, fmt.Errorf("list %q not found", listName)
 	}
-
-	return playerName == string(bytes), nil
+	// a list without any IP entry has no prefix set when it came from the default config
+	return config.Config.IPLists[listName], nil
 }
 
-var accessedPlayers = make(map[string]bool)
-
-func IsFirstTime(playerName string) bool {
-	_, exists := accessedPlayers[playerName]
-	if !exists {
-		accessedPlayers[playerName] = true
-		return true
-	}
-	return false
+// QueryListAPI asks the ListAPI about a login and returns its full decision.
+func QueryListAPI(req ListAPIRequest) (ListAPIDecision, error) {
+	return GetListAPIClient().Lookup(req)
 }
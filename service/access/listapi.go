@@ -0,0 +1,377 @@
+package access
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/InRaining/NoDelay/config"
+
+	"github.com/fatih/color"
+	"github.com/zhangyunhao116/fastrand"
+)
+
+const (
+	FailOpen   = "open"
+	FailClosed = "closed"
+
+	listAPIMaxBodySize = 4 << 10
+)
+
+// ErrListAPIUnavailable is returned when the ListAPI can't give an answer,
+// either because every attempt failed or because the circuit breaker is open.
+var ErrListAPIUnavailable = errors.New("list API unavailable")
+
+// ListAPIRequest describes the login being checked.
+// Only PlayerName is sent by protocol version 1.
+type ListAPIRequest struct {
+	Version    int    `json:"version"`
+	PlayerName string `json:"playerName"`
+	ClientIP   string `json:"clientIP,omitempty"`
+	Service    string `json:"service,omitempty"`
+	Hostname   string `json:"hostname,omitempty"`
+}
+
+// ListAPIDecision is the answer of the ListAPI for a player.
+type ListAPIDecision struct {
+	Allow          bool   `json:"allow"`
+	Reason         string `json:"reason,omitempty"`
+	Expires        int64  `json:"expires,omitempty"`        // unix seconds, 0 means no expiry
+	TrafficLimitMB int64  `json:"trafficLimitMB,omitempty"` // 0 keeps the configured limit
+	Target         string `json:"target,omitempty"`         // 'host:port' of the backend to use
+}
+
+// Expired reports whether the access granted by the decision has run out.
+func (d *ListAPIDecision) Expired() bool {
+	return d.Expires > 0 && time.Now().Unix() >= d.Expires
+}
+
+type listAPIResult struct {
+	decision ListAPIDecision
+	expires  time.Time
+}
+
+type listAPICall struct {
+	done     chan struct{}
+	decision ListAPIDecision
+	err      error
+}
+
+// ListAPIClient queries the external ListAPI with timeouts, retries,
+// a circuit breaker, result caching and request coalescing.
+type ListAPIClient struct {
+	endpoint string
+	raw      config.ListAPIOptions // as configured, used to detect changes
+	options  config.ListAPIOptions // with defaults applied
+	client   *http.Client
+
+	mutex     sync.Mutex
+	cache     map[string]listAPIResult
+	calls     map[string]*listAPICall
+	failures  int
+	openUntil time.Time
+	probing   bool // a request is checking whether the API is back
+}
+
+// NewListAPIClient creates a client for the given endpoint.
+// options may be nil.
+func NewListAPIClient(endpoint string, options *config.ListAPIOptions) *ListAPIClient {
+	c := &ListAPIClient{
+		endpoint: endpoint,
+		cache:    make(map[string]listAPIResult),
+		calls:    make(map[string]*listAPICall),
+	}
+	if options != nil {
+		c.raw = *options
+	}
+	c.options = c.raw
+	if c.options.TimeoutMs <= 0 {
+		c.options.TimeoutMs = 3000
+	}
+	if c.options.Retries < 0 {
+		c.options.Retries = 0
+	} else if c.options.Retries == 0 {
+		c.options.Retries = 2
+	}
+	if c.options.RetryBackoffMs <= 0 {
+		c.options.RetryBackoffMs = 200
+	}
+	if c.options.BreakerThreshold <= 0 {
+		c.options.BreakerThreshold = 5
+	}
+	if c.options.BreakerCooldownSec <= 0 {
+		c.options.BreakerCooldownSec = 30
+	}
+	if c.options.CacheTTLSec <= 0 {
+		c.options.CacheTTLSec = 300
+	}
+	if c.options.NegativeCacheTTLSec <= 0 {
+		c.options.NegativeCacheTTLSec = 60
+	}
+	if c.options.FailurePolicy == "" {
+		c.options.FailurePolicy = FailClosed
+	}
+	if c.options.Version <= 0 {
+		c.options.Version = 1
+	}
+	c.options.Method = strings.ToUpper(c.options.Method)
+	if c.options.Method == "" || c.options.Version == 1 {
+		c.options.Method = http.MethodGet
+	}
+	if c.options.AuthHeader == "" {
+		c.options.AuthHeader = "Authorization"
+	}
+	c.client = &http.Client{Timeout: time.Duration(c.options.TimeoutMs) * time.Millisecond}
+	return c
+}
+
+// FailOpen reports whether players should be admitted while the API is unavailable.
+func (c *ListAPIClient) FailOpen() bool {
+	return c.options.FailurePolicy == FailOpen
+}
+
+// Version returns the ListAPI protocol version in use.
+func (c *ListAPIClient) Version() int {
+	return c.options.Version
+}
+
+// Lookup asks the ListAPI about the login described by req.
+// Concurrent lookups of the same request share one HTTP request.
+func (c *ListAPIClient) Lookup(req ListAPIRequest) (ListAPIDecision, error) {
+	req.Version = c.options.Version
+	if req.Version == 1 {
+		req.ClientIP, req.Service, req.Hostname = "", "", ""
+	}
+	key := req.PlayerName + "\x00" + req.ClientIP + "\x00" + req.Service + "\x00" + req.Hostname
+
+	now := time.Now()
+	c.mutex.Lock()
+	if result, ok := c.cache[key]; ok {
+		if now.Before(result.expires) {
+			c.mutex.Unlock()
+			return result.decision, nil
+		}
+		delete(c.cache, key)
+	}
+	if call, ok := c.calls[key]; ok {
+		c.mutex.Unlock()
+		<-call.done
+		return call.decision, call.err
+	}
+	// once the cooldown is over, a single request probes the API
+	// while the others keep failing until it is answered
+	probe := false
+	if c.failures >= c.options.BreakerThreshold {
+		if now.Before(c.openUntil) || c.probing {
+			c.mutex.Unlock()
+			return ListAPIDecision{}, ErrListAPIUnavailable
+		}
+		c.probing, probe = true, true
+	}
+	call := &listAPICall{done: make(chan struct{})}
+	c.calls[key] = call
+	c.mutex.Unlock()
+
+	call.decision, call.err = c.fetchWithRetry(&req)
+
+	c.mutex.Lock()
+	delete(c.calls, key)
+	if probe {
+		c.probing = false
+	}
+	if call.err == nil {
+		c.failures = 0
+		ttl := c.options.NegativeCacheTTLSec
+		if call.decision.Allow {
+			ttl = c.options.CacheTTLSec
+		}
+		expires := time.Now().Add(time.Duration(ttl) * time.Second)
+		if call.decision.Expires > 0 && call.decision.Expires < expires.Unix() {
+			expires = time.Unix(call.decision.Expires, 0)
+		}
+		c.cache[key] = listAPIResult{
+			decision: call.decision,
+			expires:  expires,
+		}
+		if len(c.cache) > 4096 {
+			c.sweepLocked()
+		}
+	} else if !errors.As(call.err, new(temporaryError)) {
+		// a 4xx status or a bad response: the API is up, but the request was refused
+		c.failures = 0
+	} else {
+		c.failures++
+		if c.failures >= c.options.BreakerThreshold {
+			c.openUntil = time.Now().Add(time.Duration(c.options.BreakerCooldownSec) * time.Second)
+			log.Println(color.HiRedString("ListAPI: circuit breaker opened for %ds after %d consecutive failures: %v",
+				c.options.BreakerCooldownSec, c.failures, call.err))
+		}
+	}
+	c.mutex.Unlock()
+	close(call.done)
+
+	return call.decision, call.err
+}
+
+func (c *ListAPIClient) sweepLocked() {
+	now := time.Now()
+	for name, result := range c.cache {
+		if !now.Before(result.expires) {
+			delete(c.cache, name)
+		}
+	}
+}
+
+// temporaryError is a failure worth retrying: a network error or a 5xx status.
+// Only these count toward the circuit breaker.
+type temporaryError struct {
+	error
+}
+
+func (e temporaryError) Unwrap() error {
+	return e.error
+}
+
+func (c *ListAPIClient) fetchWithRetry(req *ListAPIRequest) (decision ListAPIDecision, err error) {
+	backoff := time.Duration(c.options.RetryBackoffMs) * time.Millisecond
+	for attempt := 0; ; attempt++ {
+		decision, err = c.fetch(req)
+		if err == nil {
+			return
+		}
+		var temporary temporaryError
+		if !errors.As(err, &temporary) {
+			return ListAPIDecision{}, fmt.Errorf("%w: %v", ErrListAPIUnavailable, err)
+		}
+		if attempt >= c.options.Retries {
+			// still temporary, so that it counts toward the circuit breaker
+			return ListAPIDecision{}, temporaryError{fmt.Errorf("%w: %v", ErrListAPIUnavailable, err)}
+		}
+		// add up to 50% jitter so that retries from many logins don't line up
+		time.Sleep(backoff + time.Duration(fastrand.Int63n(int64(backoff)/2+1)))
+		backoff *= 2
+	}
+}
+
+func (c *ListAPIClient) fetch(req *ListAPIRequest) (ListAPIDecision, error) {
+	target, err := url.Parse(c.endpoint)
+	if err != nil {
+		return ListAPIDecision{}, fmt.Errorf("bad ListAPI address: %w", err)
+	}
+
+	var (
+		body    []byte
+		payload string
+	)
+	if c.options.Method == http.MethodPost {
+		body, err = json.Marshal(req)
+		if err != nil {
+			return ListAPIDecision{}, err
+		}
+		payload = string(body)
+	} else {
+		query := target.Query()
+		query.Set("playerName", req.PlayerName)
+		if req.Version > 1 {
+			query.Set("version", strconv.Itoa(req.Version))
+			query.Set("clientIP", req.ClientIP)
+			query.Set("service", req.Service)
+			query.Set("hostname", req.Hostname)
+		}
+		target.RawQuery = query.Encode()
+		payload = target.RawQuery
+	}
+
+	httpReq, err := http.NewRequest(c.options.Method, target.String(), bytes.NewReader(body))
+	if err != nil {
+		return ListAPIDecision{}, fmt.Errorf("failed to create HTTP request: %w", err)
+	}
+	if body != nil {
+		httpReq.Header.Set("Content-Type", "application/json")
+	}
+	if c.options.AuthToken != "" {
+		httpReq.Header.Set(c.options.AuthHeader, c.options.AuthToken)
+	}
+	if c.options.HMACSecret != "" {
+		// signature = hex(HMAC-SHA256(secret, timestamp + "\n" + method + "\n" + payload)),
+		// where payload is the JSON body for POST or the raw query for GET
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		mac := hmac.New(sha256.New, []byte(c.options.HMACSecret))
+		mac.Write([]byte(timestamp + "\n" + c.options.Method + "\n" + payload))
+		httpReq.Header.Set("X-NoDelay-Timestamp", timestamp)
+		httpReq.Header.Set("X-NoDelay-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := c.client.Do(httpReq)
+	if err != nil {
+		return ListAPIDecision{}, temporaryError{fmt.Errorf("failed to make HTTP request: %w", err)}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("unexpected HTTP status: %s", resp.Status)
+		if resp.StatusCode >= 500 {
+			err = temporaryError{err}
+		}
+		return ListAPIDecision{}, err
+	}
+
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, listAPIMaxBodySize))
+	if err != nil {
+		return ListAPIDecision{}, temporaryError{fmt.Errorf("failed to read HTTP response body: %w", err)}
+	}
+
+	var decision ListAPIDecision
+	if req.Version == 1 {
+		decision.Allow = req.PlayerName == strings.TrimSpace(string(respBody))
+		return decision, nil
+	}
+	if err = json.Unmarshal(respBody, &decision); err != nil {
+		return ListAPIDecision{}, fmt.Errorf("bad ListAPI response: %w", err)
+	}
+	if decision.Target != "" {
+		if _, _, err = net.SplitHostPort(decision.Target); err != nil {
+			return ListAPIDecision{}, fmt.Errorf("bad target in ListAPI response: %w", err)
+		}
+	}
+	return decision, nil
+}
+
+var (
+	listAPIClient     *ListAPIClient
+	listAPIClientLock sync.Mutex
+)
+
+// GetListAPIClient returns the shared client for the current configuration,
+// rebuilding it after the ListAPI settings have been changed by a reload.
+func GetListAPIClient() *ListAPIClient {
+	listAPIClientLock.Lock()
+	defer listAPIClientLock.Unlock()
+
+	var (
+		endpoint string
+		options  config.ListAPIOptions
+	)
+	if c := config.Config.Configuration; c != nil {
+		endpoint = c.ListAPI
+		if c.ListAPIOptions != nil {
+			options = *c.ListAPIOptions
+		}
+	}
+	if listAPIClient == nil || listAPIClient.endpoint != endpoint || listAPIClient.raw != options {
+		listAPIClient = NewListAPIClient(endpoint, &options)
+	}
+	return listAPIClient
+}
@@ -0,0 +1,215 @@
+package access
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/InRaining/NoDelay/config"
+)
+
+// newListAPI starts a stand-in ListAPI answering with the statuses in turn,
+// the last one repeated, and a JSON decision allowing everyone for 200.
+func newListAPI(t *testing.T, delay time.Duration, statuses ...int) (*httptest.Server, *atomic.Int32) {
+	var count atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := int(count.Add(1))
+		time.Sleep(delay)
+		status := statuses[len(statuses)-1]
+		if n <= len(statuses) {
+			status = statuses[n-1]
+		}
+		if status != http.StatusOK {
+			w.WriteHeader(status)
+			return
+		}
+		json.NewEncoder(w).Encode(&ListAPIDecision{Allow: true, Reason: r.URL.Query().Get("playerName")}) //nolint:errcheck
+	}))
+	t.Cleanup(server.Close)
+	return server, &count
+}
+
+func TestListAPIClient_Retries(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		statuses  []int
+		retries   int
+		wantErr   bool
+		wantCalls int32
+	}{
+		{name: "ok", statuses: []int{200}, retries: 2, wantCalls: 1},
+		{name: "5xx retried", statuses: []int{503, 502, 200}, retries: 2, wantCalls: 3},
+		{name: "5xx out of retries", statuses: []int{500}, retries: 2, wantErr: true, wantCalls: 3},
+		{name: "4xx not retried", statuses: []int{403, 200}, retries: 2, wantErr: true, wantCalls: 1},
+		{name: "404 not retried", statuses: []int{404, 200}, retries: 2, wantErr: true, wantCalls: 1},
+		{name: "retries disabled", statuses: []int{503, 200}, retries: -1, wantErr: true, wantCalls: 1},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			server, count := newListAPI(t, 0, tt.statuses...)
+			c := NewListAPIClient(server.URL, &config.ListAPIOptions{
+				Version:        2,
+				Retries:        tt.retries,
+				RetryBackoffMs: 1,
+			})
+			decision, err := c.Lookup(ListAPIRequest{PlayerName: "Steve"})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, ErrListAPIUnavailable) {
+				t.Errorf("error %v is not ErrListAPIUnavailable", err)
+			}
+			if err == nil && (!decision.Allow || decision.Reason != "Steve") {
+				t.Errorf("unexpected decision %+v", decision)
+			}
+			if got := count.Load(); got != tt.wantCalls {
+				t.Errorf("%d requests, want %d", got, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestListAPIClient_Cache(t *testing.T) {
+	server, count := newListAPI(t, 0, 200)
+	c := NewListAPIClient(server.URL, &config.ListAPIOptions{Version: 2})
+
+	for _, tt := range []struct {
+		req       ListAPIRequest
+		wantCalls int32
+	}{
+		{ListAPIRequest{PlayerName: "Steve", ClientIP: "192.0.2.1"}, 1},
+		{ListAPIRequest{PlayerName: "Steve", ClientIP: "192.0.2.1"}, 1}, // cached
+		{ListAPIRequest{PlayerName: "Steve", ClientIP: "192.0.2.2"}, 2}, // another login
+		{ListAPIRequest{PlayerName: "Alex", ClientIP: "192.0.2.1"}, 3},
+		{ListAPIRequest{PlayerName: "Alex", ClientIP: "192.0.2.1"}, 3},
+	} {
+		if _, err := c.Lookup(tt.req); err != nil {
+			t.Fatal(err)
+		}
+		if got := count.Load(); got != tt.wantCalls {
+			t.Fatalf("%+v: %d requests, want %d", tt.req, got, tt.wantCalls)
+		}
+	}
+}
+
+func TestListAPIClient_Coalescing(t *testing.T) {
+	server, count := newListAPI(t, 100*time.Millisecond, 200)
+	c := NewListAPIClient(server.URL, &config.ListAPIOptions{Version: 2})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if decision, err := c.Lookup(ListAPIRequest{PlayerName: "Steve"}); err != nil || !decision.Allow {
+				t.Errorf("decision %+v, error %v", decision, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if got := count.Load(); got != 1 {
+		t.Fatalf("%d requests for concurrent lookups, want 1", got)
+	}
+}
+
+func TestListAPIClient_Breaker(t *testing.T) {
+	server, count := newListAPI(t, 0, 500, 500, 500, 200)
+	c := NewListAPIClient(server.URL, &config.ListAPIOptions{
+		Version:            2,
+		Retries:            -1,
+		BreakerThreshold:   3,
+		BreakerCooldownSec: 1,
+	})
+	lookup := func(name string) error {
+		_, err := c.Lookup(ListAPIRequest{PlayerName: name})
+		return err
+	}
+
+	for i, name := range []string{"a", "b", "c"} {
+		if err := lookup(name); err == nil {
+			t.Fatalf("lookup %d succeeded, want a failure", i)
+		}
+	}
+	// open: failing without asking the API
+	if err := lookup("d"); !errors.Is(err, ErrListAPIUnavailable) || count.Load() != 3 {
+		t.Fatalf("error %v after %d requests, want ErrListAPIUnavailable after 3", err, count.Load())
+	}
+
+	// half-open: a single probe, the other lookups fail meanwhile
+	c.mutex.Lock()
+	c.openUntil = time.Now()
+	c.probing = true
+	c.mutex.Unlock()
+	if err := lookup("e"); !errors.Is(err, ErrListAPIUnavailable) || count.Load() != 3 {
+		t.Fatalf("error %v after %d requests while probing, want ErrListAPIUnavailable after 3", err, count.Load())
+	}
+	c.mutex.Lock()
+	c.probing = false
+	c.mutex.Unlock()
+
+	if err := lookup("f"); err != nil {
+		t.Fatalf("probe failed: %v", err)
+	}
+	if err := lookup("g"); err != nil || count.Load() != 5 {
+		t.Fatalf("error %v after %d requests once closed, want none after 5", err, count.Load())
+	}
+}
+
+func TestListAPIClient_BreakerReopens(t *testing.T) {
+	server, count := newListAPI(t, 0, 500)
+	c := NewListAPIClient(server.URL, &config.ListAPIOptions{
+		Version:            2,
+		Retries:            -1,
+		BreakerThreshold:   2,
+		BreakerCooldownSec: 60,
+	})
+	for _, name := range []string{"a", "b"} {
+		c.Lookup(ListAPIRequest{PlayerName: name}) //nolint:errcheck
+	}
+	c.mutex.Lock()
+	c.openUntil = time.Now()
+	c.mutex.Unlock()
+
+	// the failed probe opens the breaker for another cooldown
+	c.Lookup(ListAPIRequest{PlayerName: "c"}) //nolint:errcheck
+	if _, err := c.Lookup(ListAPIRequest{PlayerName: "d"}); !errors.Is(err, ErrListAPIUnavailable) || count.Load() != 3 {
+		t.Fatalf("error %v after %d requests, want ErrListAPIUnavailable after 3", err, count.Load())
+	}
+}
+
+func TestListAPIClient_BreakerCounts(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		statuses []int
+		wantOpen bool
+	}{
+		{name: "5xx", statuses: []int{500, 503, 502}, wantOpen: true},
+		{name: "4xx", statuses: []int{403, 404, 400}},
+		{name: "4xx between 5xx", statuses: []int{500, 500, 404, 500, 500}},
+		{name: "5xx after 4xx", statuses: []int{404, 500, 500, 500}, wantOpen: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			server, count := newListAPI(t, 0, tt.statuses...)
+			c := NewListAPIClient(server.URL, &config.ListAPIOptions{
+				Version:            2,
+				Retries:            -1,
+				BreakerThreshold:   3,
+				BreakerCooldownSec: 60,
+			})
+			for i := range tt.statuses {
+				if _, err := c.Lookup(ListAPIRequest{PlayerName: string(rune('a' + i))}); !errors.Is(err, ErrListAPIUnavailable) {
+					t.Fatalf("lookup %d: error %v, want ErrListAPIUnavailable", i, err)
+				}
+			}
+			c.Lookup(ListAPIRequest{PlayerName: "Steve"}) //nolint:errcheck
+			open := count.Load() == int32(len(tt.statuses))
+			if open != tt.wantOpen {
+				t.Errorf("breaker open %v, want %v", open, tt.wantOpen)
+			}
+		})
+	}
+}
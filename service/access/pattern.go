@@ -0,0 +1,72 @@
+package access
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Pattern is a compiled case-insensitive string pattern.
+type Pattern func(s string) bool
+
+// CompilePattern compiles a pattern. It is an exact match unless it contains
+// '*' or '?' wildcards, or starts with 'suffix:', 'contains:' or 'regex:'.
+func CompilePattern(pattern string) (Pattern, error) {
+	switch {
+	case strings.HasPrefix(pattern, "regex:"):
+		re, err := regexp.Compile("(?i)" + strings.TrimPrefix(pattern, "regex:"))
+		if err != nil {
+			return nil, fmt.Errorf("bad pattern %q: %w", pattern, err)
+		}
+		return re.MatchString, nil
+
+	case strings.HasPrefix(pattern, "suffix:"):
+		suffix := strings.ToLower(strings.TrimPrefix(pattern, "suffix:"))
+		return func(s string) bool {
+			return strings.HasSuffix(strings.ToLower(s), suffix)
+		}, nil
+
+	case strings.HasPrefix(pattern, "contains:"):
+		sub := strings.ToLower(strings.TrimPrefix(pattern, "contains:"))
+		return func(s string) bool {
+			return strings.Contains(strings.ToLower(s), sub)
+		}, nil
+
+	case strings.ContainsAny(pattern, "*?"):
+		pattern = strings.ToLower(pattern)
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("bad pattern %q: %w", pattern, err)
+		}
+		return func(s string) bool {
+			ok, _ := path.Match(pattern, strings.ToLower(s))
+			return ok
+		}, nil
+
+	default:
+		return func(s string) bool {
+			return strings.EqualFold(s, pattern)
+		}, nil
+	}
+}
+
+// CompilePatterns compiles a list of patterns into one that matches
+// when any of them does.
+func CompilePatterns(patterns []string) (Pattern, error) {
+	compiled := make([]Pattern, 0, len(patterns))
+	for _, pattern := range patterns {
+		p, err := CompilePattern(pattern)
+		if err != nil {
+			return nil, err
+		}
+		compiled = append(compiled, p)
+	}
+	return func(s string) bool {
+		for _, p := range compiled {
+			if p(s) {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
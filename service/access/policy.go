@@ -0,0 +1,422 @@
+package access
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/InRaining/NoDelay/common/rate"
+	"github.com/InRaining/NoDelay/common/set"
+	"github.com/InRaining/NoDelay/config"
+)
+
+// Phases of a connection, each one knowing more about the client.
+const (
+	PhaseConnection = iota // client IP
+	PhaseHandshake         // + hostname, protocol version and mod loader
+	PhaseLogin             // + player name and ListAPI result
+)
+
+const (
+	ActionAllow       = "allow"
+	ActionDeny        = "deny"
+	ActionMaintenance = "maintenance"
+	ActionJoke        = "joke"
+	ActionReset       = "reset"
+	ActionRoute       = "route"
+	ActionRateLimit   = "ratelimit"
+)
+
+const (
+	ListAPIHit  = "hit"
+	ListAPIMiss = "miss"
+)
+
+// ConnInfo describes a connection as far as it is known.
+type ConnInfo struct {
+	IP         netip.Addr
+	Hostname   string // without FML suffix
+	ModLoader  string
+	Protocol   int
+	PlayerName string
+	ListAPIHit bool
+	ListAPIErr error // set when the ListAPI is unavailable
+}
+
+// ParseHandshakeHostname splits the hostname of a Minecraft handshake
+// from the suffix appended by Forge, and tells which mod loader sent it.
+func ParseHandshakeHostname(raw string) (hostname string, modLoader string) {
+	hostname, suffix, found := strings.Cut(raw, "\x00")
+	hostname = strings.TrimSuffix(hostname, ".") // fully qualified form
+	if !found {
+		return hostname, "vanilla"
+	}
+	switch suffix = strings.TrimSuffix(suffix, "\x00"); suffix {
+	case "FML":
+		return hostname, "fml"
+	case "FML2":
+		return hostname, "fml2"
+	case "FML3":
+		return hostname, "fml3"
+	default:
+		return hostname, strings.ToLower(suffix)
+	}
+}
+
+// CompiledRule is a rule ready to be evaluated.
+type CompiledRule struct {
+	config.Rule
+	Label string // rule name, or the action in upper case
+
+	phase      int
+	ipLists    []string
+	nameLists  []string
+	names      Pattern
+	hostnames  Pattern
+	modLoaders []string
+	timeFrom   int // minutes since midnight, -1 when unset
+	timeTo     int
+	prefixes   *set.PrefixSet
+	limiter    *rate.KeyedLimiter
+}
+
+// Policy is the ordered rule chain of a service.
+type Policy struct {
+	rules       []*CompiledRule
+	usesListAPI bool
+	hostnames   Pattern // allowed hostnames, nil when not restricted
+}
+
+// Verdict is the progress of a connection through a policy.
+type Verdict struct {
+	Rule *CompiledRule // the matched rule, nil if none matched (yet)
+	next int
+}
+
+var unavailableRule = &CompiledRule{
+	Rule:  config.Rule{Name: "UNAVAILABLE", Action: config.RuleAction{Type: ActionDeny}},
+	Label: "UNAVAILABLE",
+}
+
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("bad time %q, want HH:MM", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func compileRule(rule *config.Rule, isMinecraft bool) (*CompiledRule, error) {
+	r := &CompiledRule{
+		Rule:     *rule,
+		Label:    rule.Name,
+		timeFrom: -1,
+		timeTo:   -1,
+	}
+	if r.Label == "" {
+		r.Label = strings.ToUpper(rule.Action.Type)
+	}
+	m := &rule.Match
+
+	if len(m.IPs) != 0 {
+		r.prefixes = new(set.PrefixSet)
+		for _, ip := range m.IPs {
+			p, ok := set.ParsePrefix(ip)
+			if !ok {
+				return nil, fmt.Errorf("bad IP or CIDR %q", ip)
+			}
+			r.prefixes.Add(p)
+		}
+	}
+	for _, tag := range m.IPListTags {
+		if _, err := GetTargetIPList(tag); err != nil {
+			return nil, err
+		}
+	}
+	r.ipLists = m.IPListTags
+	for _, tag := range m.NameListTags {
+		if _, err := GetTargetList(tag); err != nil {
+			return nil, err
+		}
+	}
+	r.nameLists = m.NameListTags
+	if m.TimeFrom != "" || m.TimeTo != "" {
+		var err error
+		if r.timeFrom, err = parseClock(m.TimeFrom); err != nil {
+			return nil, err
+		}
+		if r.timeTo, err = parseClock(m.TimeTo); err != nil {
+			return nil, err
+		}
+	}
+
+	var err error
+	if len(m.Hostnames) != 0 || m.ProtocolMin != 0 || m.ProtocolMax != 0 || len(m.ModLoaders) != 0 {
+		r.phase = PhaseHandshake
+		if r.hostnames, err = CompilePatterns(m.Hostnames); err != nil {
+			return nil, err
+		}
+		for _, loader := range m.ModLoaders {
+			r.modLoaders = append(r.modLoaders, strings.ToLower(loader))
+		}
+	}
+	if len(m.PlayerNames) != 0 || len(m.NameListTags) != 0 || m.ListAPI != "" {
+		r.phase = PhaseLogin
+		if r.names, err = CompilePatterns(m.PlayerNames); err != nil {
+			return nil, err
+		}
+	}
+	switch m.ListAPI {
+	case "", ListAPIHit, ListAPIMiss:
+	default:
+		return nil, fmt.Errorf("bad ListAPI condition %q", m.ListAPI)
+	}
+	if r.phase > PhaseConnection && !isMinecraft {
+		return nil, errors.New("hostname, protocol, mod loader and player conditions need Minecraft handling")
+	}
+
+	switch rule.Action.Type {
+	case ActionAllow, ActionDeny, ActionMaintenance, ActionJoke, ActionReset:
+	case ActionRoute:
+		if _, _, err := net.SplitHostPort(rule.Action.Target); err != nil {
+			return nil, fmt.Errorf("bad route target %q: %w", rule.Action.Target, err)
+		}
+	case ActionRateLimit:
+		if rule.Action.RatePerMinute <= 0 {
+			return nil, errors.New("RatePerMinute must be positive for ratelimit")
+		}
+		burst := rule.Action.Burst
+		if burst < 1 {
+			burst = rule.Action.RatePerMinute
+		}
+		r.limiter = rate.NewKeyedLimiter(rule.Action.RatePerMinute/60, burst)
+	default:
+		return nil, fmt.Errorf("unknown action %q", rule.Action.Type)
+	}
+	return r, nil
+}
+
+// presetRules turns the access modes of a service into rules.
+func presetRules(s *config.ConfigProxyService, isMinecraft bool) []*config.Rule {
+	var rules []*config.Rule
+	switch s.IPAccess.Mode {
+	case AllowMode:
+		rules = append(rules, &config.Rule{
+			Name:   "IP-" + strings.ToUpper(AllowMode),
+			Match:  config.RuleMatch{IPListTags: s.IPAccess.ListTags, Invert: true},
+			Action: config.RuleAction{Type: ActionReset},
+		})
+	case BlockMode:
+		rules = append(rules, &config.Rule{
+			Name:   "IP-" + strings.ToUpper(BlockMode),
+			Match:  config.RuleMatch{IPListTags: s.IPAccess.ListTags},
+			Action: config.RuleAction{Type: ActionReset},
+		})
+	case DownMode, JokeMode:
+		rules = append(rules, &config.Rule{
+			Name:   "IP-" + strings.ToUpper(s.IPAccess.Mode),
+			Action: config.RuleAction{Type: ActionReset},
+		})
+	}
+	if !isMinecraft {
+		return rules
+	}
+
+	// protocol version 1 of the ListAPI only tells whether the player is listed,
+	// while later versions give the verdict for both modes
+	versioned := GetListAPIClient().Version() > 1
+	switch s.Minecraft.NameAccess.Mode {
+	case AllowMode:
+		rules = append(rules, &config.Rule{
+			Name:   "DENY",
+			Match:  config.RuleMatch{ListAPI: ListAPIMiss},
+			Action: config.RuleAction{Type: ActionDeny},
+		})
+	case BlockMode:
+		listAPI := ListAPIHit
+		if versioned {
+			listAPI = ListAPIMiss
+		}
+		rules = append(rules, &config.Rule{
+			Name:   "REJECT",
+			Match:  config.RuleMatch{ListAPI: listAPI},
+			Action: config.RuleAction{Type: ActionDeny},
+		})
+	case JokeMode:
+		rules = append(rules, &config.Rule{
+			Name:   "JOKE",
+			Match:  config.RuleMatch{PlayerNames: []string{"*"}},
+			Action: config.RuleAction{Type: ActionJoke},
+		})
+	case DownMode:
+		rules = append(rules, &config.Rule{
+			Name:   "DOWN",
+			Match:  config.RuleMatch{PlayerNames: []string{"*"}},
+			Action: config.RuleAction{Type: ActionMaintenance},
+		})
+	}
+	return rules
+}
+
+// CompilePolicy builds the rule chain of a service from its access modes and Rules,
+// along with its hostname access.
+func CompilePolicy(s *config.ConfigProxyService, isMinecraft bool) (*Policy, error) {
+	p := new(Policy)
+	if isMinecraft && s.Minecraft.EnableHostnameAccess {
+		patterns := s.Minecraft.AllowedHostnames
+		if s.Minecraft.HostnameAccess != "" {
+			patterns = append(patterns[:len(patterns):len(patterns)], "contains:"+s.Minecraft.HostnameAccess)
+		}
+		if len(patterns) == 0 {
+			return nil, errors.New("EnableHostnameAccess needs AllowedHostnames")
+		}
+		var err error
+		if p.hostnames, err = CompilePatterns(patterns); err != nil {
+			return nil, fmt.Errorf("hostname access: %w", err)
+		}
+	}
+	for i, rule := range append(presetRules(s, isMinecraft), s.Rules...) {
+		r, err := compileRule(rule, isMinecraft)
+		if err != nil {
+			return nil, fmt.Errorf("rule %d (%s): %w", i, rule.Name, err)
+		}
+		if rule.Match.ListAPI != "" {
+			p.usesListAPI = true
+		}
+		p.rules = append(p.rules, r)
+	}
+	return p, nil
+}
+
+// HostnameAllowed reports whether clients may connect with hostname,
+// which has its FML suffix removed.
+func (p *Policy) HostnameAllowed(hostname string) bool {
+	return p.hostnames == nil || p.hostnames(hostname)
+}
+
+// UsesListAPI reports whether any rule depends on the ListAPI.
+func (p *Policy) UsesListAPI() bool {
+	return p.usesListAPI
+}
+
+// Evaluate continues evaluating the rules from where v stopped,
+// with what is known about the connection in the given phase.
+// If final is true, rules needing a later phase are skipped instead of
+// stopping the evaluation, since that information will never be known.
+func (p *Policy) Evaluate(info *ConnInfo, phase int, final bool, v Verdict) Verdict {
+	if v.Rule != nil {
+		return v
+	}
+	for i := v.next; i < len(p.rules); i++ {
+		r := p.rules[i]
+		if r.phase > phase {
+			if final {
+				continue
+			}
+			return Verdict{next: i}
+		}
+		matched, unavailable := r.match(info)
+		if unavailable {
+			return Verdict{Rule: unavailableRule, next: i + 1}
+		}
+		if !matched {
+			continue
+		}
+		if r.limiter != nil && r.limiter.Allow(info.IP.String()) {
+			continue
+		}
+		return Verdict{Rule: r, next: i + 1}
+	}
+	return Verdict{next: len(p.rules)}
+}
+
+func (r *CompiledRule) match(info *ConnInfo) (matched bool, unavailable bool) {
+	m := &r.Match
+	matched = true
+	switch {
+	case r.prefixes != nil && !r.prefixes.Contains(info.IP):
+		matched = false
+	case len(r.ipLists) != 0 && !r.inIPLists(info.IP):
+		matched = false
+	case r.timeFrom >= 0 && !r.inTime(time.Now()):
+		matched = false
+	case len(m.Hostnames) != 0 && !r.hostnames(info.Hostname):
+		matched = false
+	case m.ProtocolMin != 0 && info.Protocol < m.ProtocolMin,
+		m.ProtocolMax != 0 && info.Protocol > m.ProtocolMax:
+		matched = false
+	case len(r.modLoaders) != 0 && !r.matchModLoader(info.ModLoader):
+		matched = false
+	case len(m.PlayerNames) != 0 && !r.names(info.PlayerName):
+		matched = false
+	case len(r.nameLists) != 0 && !r.inNameLists(info.PlayerName):
+		matched = false
+	}
+	if matched && m.ListAPI != "" {
+		if info.ListAPIErr != nil {
+			if !GetListAPIClient().FailOpen() {
+				return false, true
+			}
+			// resolve in the player's favour
+			admits := r.Action.Type == ActionAllow || r.Action.Type == ActionRoute
+			return admits != m.Invert, false
+		}
+		matched = info.ListAPIHit == (m.ListAPI == ListAPIHit)
+	}
+	return matched != m.Invert, false
+}
+
+func (r *CompiledRule) inIPLists(ip netip.Addr) bool {
+	for _, tag := range r.ipLists {
+		if list, err := GetTargetIPList(tag); err == nil && list.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *CompiledRule) inNameLists(name string) bool {
+	for _, tag := range r.nameLists {
+		if list, err := GetTargetList(tag); err == nil && list.Has(name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *CompiledRule) inTime(now time.Time) bool {
+	minutes := now.Hour()*60 + now.Minute()
+	if r.timeFrom <= r.timeTo {
+		return minutes >= r.timeFrom && minutes < r.timeTo
+	}
+	return minutes >= r.timeFrom || minutes < r.timeTo
+}
+
+func (r *CompiledRule) matchModLoader(loader string) bool {
+	for _, l := range r.modLoaders {
+		if l == loader || l == "forge" && strings.HasPrefix(loader, "fml") {
+			return true
+		}
+	}
+	return false
+}
+
+// Target returns the backend address of a 'route' rule.
+func (r *CompiledRule) Target() (string, uint16, bool) {
+	if r.Action.Type != ActionRoute {
+		return "", 0, false
+	}
+	host, portStr, err := net.SplitHostPort(r.Action.Target)
+	if err != nil {
+		return "", 0, false
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return "", 0, false
+	}
+	return host, uint16(port), true
+}
@@ -0,0 +1,360 @@
+package access
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/InRaining/NoDelay/common/set"
+	"github.com/InRaining/NoDelay/config"
+)
+
+// withLists makes the given lists available to the rules, along with the
+// ListAPI protocol version, for the duration of the test.
+func withLists(t *testing.T, listAPIVersion int, lists map[string][]string) {
+	saved := config.Config
+	t.Cleanup(func() { config.Config = saved })
+	config.Config.Configuration = &config.Configure{ListAPIOptions: &config.ListAPIOptions{Version: listAPIVersion}}
+	config.Config.Lists = make(map[string]set.StringSet, len(lists))
+	config.Config.IPLists = make(map[string]*set.PrefixSet, len(lists))
+	for tag, entries := range lists {
+		config.Config.Lists[tag] = set.NewStringSetFromSlice(entries)
+		config.Config.IPLists[tag] = set.NewPrefixSetFromSlice(entries)
+	}
+}
+
+// evaluate runs info through every phase of p and returns the label of
+// the matched rule, or "" when none matched.
+func evaluate(p *Policy, info *ConnInfo) string {
+	var v Verdict
+	for phase := PhaseConnection; phase <= PhaseLogin; phase++ {
+		v = p.Evaluate(info, phase, phase == PhaseLogin, v)
+	}
+	if v.Rule == nil {
+		return ""
+	}
+	return v.Rule.Label
+}
+
+func TestPolicy_Evaluate(t *testing.T) {
+	withLists(t, 2, map[string][]string{
+		"staff":  {"Notch", "jeb_"},
+		"office": {"198.51.100.0/24"},
+	})
+	steve := ConnInfo{
+		IP:         netip.MustParseAddr("192.0.2.1"),
+		Hostname:   "play.example.com",
+		ModLoader:  "fml2",
+		Protocol:   763,
+		PlayerName: "Steve",
+	}
+	with := func(change func(info *ConnInfo)) ConnInfo {
+		info := steve
+		change(&info)
+		return info
+	}
+
+	for _, tt := range []struct {
+		name  string
+		rules []*config.Rule
+		info  ConnInfo
+		want  string
+	}{
+		{
+			name: "no rules",
+			info: steve,
+		},
+		{
+			name:  "IP matched",
+			rules: []*config.Rule{{Match: config.RuleMatch{IPs: []string{"192.0.2.0/24"}}, Action: config.RuleAction{Type: ActionDeny}}},
+			info:  steve,
+			want:  "DENY",
+		},
+		{
+			name:  "IP not matched",
+			rules: []*config.Rule{{Match: config.RuleMatch{IPs: []string{"10.0.0.1"}}, Action: config.RuleAction{Type: ActionDeny}}},
+			info:  steve,
+		},
+		{
+			name:  "inverted",
+			rules: []*config.Rule{{Match: config.RuleMatch{IPs: []string{"10.0.0.1"}, Invert: true}, Action: config.RuleAction{Type: ActionDeny}}},
+			info:  steve,
+			want:  "DENY",
+		},
+		{
+			name:  "IP list",
+			rules: []*config.Rule{{Name: "office", Match: config.RuleMatch{IPListTags: []string{"office"}}, Action: config.RuleAction{Type: ActionAllow}}},
+			info:  with(func(info *ConnInfo) { info.IP = netip.MustParseAddr("198.51.100.7") }),
+			want:  "office",
+		},
+		{
+			name: "first match wins",
+			rules: []*config.Rule{
+				{Name: "staff", Match: config.RuleMatch{NameListTags: []string{"staff"}}, Action: config.RuleAction{Type: ActionAllow}},
+				{Name: "everyone", Match: config.RuleMatch{PlayerNames: []string{"*"}}, Action: config.RuleAction{Type: ActionMaintenance}},
+			},
+			info: with(func(info *ConnInfo) { info.PlayerName = "Notch" }),
+			want: "staff",
+		},
+		{
+			name: "falls through",
+			rules: []*config.Rule{
+				{Name: "staff", Match: config.RuleMatch{NameListTags: []string{"staff"}}, Action: config.RuleAction{Type: ActionAllow}},
+				{Name: "everyone", Match: config.RuleMatch{PlayerNames: []string{"*"}}, Action: config.RuleAction{Type: ActionMaintenance}},
+			},
+			info: steve,
+			want: "everyone",
+		},
+		{
+			name: "earlier phase doesn't jump the chain",
+			rules: []*config.Rule{
+				{Name: "Steve", Match: config.RuleMatch{PlayerNames: []string{"steve"}}, Action: config.RuleAction{Type: ActionAllow}},
+				{Name: "all", Action: config.RuleAction{Type: ActionReset}},
+			},
+			info: steve,
+			want: "Steve",
+		},
+		{
+			name:  "hostname pattern",
+			rules: []*config.Rule{{Match: config.RuleMatch{Hostnames: []string{"suffix:.example.com"}}, Action: config.RuleAction{Type: ActionRoute, Target: "127.0.0.1:25566"}}},
+			info:  steve,
+			want:  "ROUTE",
+		},
+		{
+			name:  "protocol below the range",
+			rules: []*config.Rule{{Match: config.RuleMatch{ProtocolMin: 764}, Action: config.RuleAction{Type: ActionDeny}}},
+			info:  steve,
+		},
+		{
+			name:  "protocol outside the range",
+			rules: []*config.Rule{{Match: config.RuleMatch{ProtocolMin: 47, ProtocolMax: 340, Invert: true}, Action: config.RuleAction{Type: ActionDeny}}},
+			info:  steve,
+			want:  "DENY",
+		},
+		{
+			name:  "protocol in the range",
+			rules: []*config.Rule{{Match: config.RuleMatch{ProtocolMin: 47, ProtocolMax: 763, Invert: true}, Action: config.RuleAction{Type: ActionDeny}}},
+			info:  steve,
+		},
+		{
+			name:  "forge matches every FML version",
+			rules: []*config.Rule{{Match: config.RuleMatch{ModLoaders: []string{"Forge"}}, Action: config.RuleAction{Type: ActionJoke}}},
+			info:  steve,
+			want:  "JOKE",
+		},
+		{
+			name:  "vanilla isn't forge",
+			rules: []*config.Rule{{Match: config.RuleMatch{ModLoaders: []string{"forge"}}, Action: config.RuleAction{Type: ActionJoke}}},
+			info:  with(func(info *ConnInfo) { info.ModLoader = "vanilla" }),
+		},
+		{
+			name:  "ListAPI hit",
+			rules: []*config.Rule{{Match: config.RuleMatch{ListAPI: ListAPIHit}, Action: config.RuleAction{Type: ActionAllow}}},
+			info:  with(func(info *ConnInfo) { info.ListAPIHit = true }),
+			want:  "ALLOW",
+		},
+		{
+			name:  "ListAPI miss",
+			rules: []*config.Rule{{Match: config.RuleMatch{ListAPI: ListAPIMiss}, Action: config.RuleAction{Type: ActionDeny}}},
+			info:  steve,
+			want:  "DENY",
+		},
+		{
+			name:  "ListAPI unavailable",
+			rules: []*config.Rule{{Match: config.RuleMatch{ListAPI: ListAPIMiss}, Action: config.RuleAction{Type: ActionAllow}}},
+			info:  with(func(info *ConnInfo) { info.ListAPIErr = ErrListAPIUnavailable }),
+			want:  "UNAVAILABLE",
+		},
+		{
+			name:  "ListAPI unavailable without the rule",
+			rules: []*config.Rule{{Match: config.RuleMatch{IPs: []string{"10.0.0.1"}, ListAPI: ListAPIMiss}, Action: config.RuleAction{Type: ActionAllow}}},
+			info:  with(func(info *ConnInfo) { info.ListAPIErr = ErrListAPIUnavailable }),
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := CompilePolicy(&config.ConfigProxyService{Rules: tt.rules}, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			info := tt.info
+			if got := evaluate(p, &info); got != tt.want {
+				t.Errorf("matched %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPolicy_EvaluatePhases(t *testing.T) {
+	withLists(t, 2, nil)
+	p, err := CompilePolicy(&config.ConfigProxyService{Rules: []*config.Rule{
+		{Name: "names", Match: config.RuleMatch{PlayerNames: []string{"Steve"}}, Action: config.RuleAction{Type: ActionDeny}},
+		{Name: "IPs", Match: config.RuleMatch{IPs: []string{"192.0.2.1"}}, Action: config.RuleAction{Type: ActionReset}},
+	}}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := &ConnInfo{IP: netip.MustParseAddr("192.0.2.1")}
+
+	// the name rule waits for the login, holding back the IP rule behind it
+	v := p.Evaluate(info, PhaseConnection, false, Verdict{})
+	if v.Rule != nil {
+		t.Fatalf("matched %s before the login", v.Rule.Label)
+	}
+	info.PlayerName = "Alex"
+	if v = p.Evaluate(info, PhaseLogin, true, v); v.Rule == nil || v.Rule.Label != "IPs" {
+		t.Fatalf("verdict %+v at login, want IPs", v)
+	}
+	// a verdict is final
+	info.PlayerName = "Steve"
+	if v = p.Evaluate(info, PhaseLogin, true, v); v.Rule.Label != "IPs" {
+		t.Fatalf("verdict changed to %s", v.Rule.Label)
+	}
+
+	// when the connection ends early, later rules are skipped
+	if v = p.Evaluate(info, PhaseConnection, true, Verdict{}); v.Rule == nil || v.Rule.Label != "IPs" {
+		t.Fatalf("verdict %+v for a final connection phase, want IPs", v)
+	}
+}
+
+func TestPolicy_RateLimit(t *testing.T) {
+	withLists(t, 2, nil)
+	p, err := CompilePolicy(&config.ConfigProxyService{Rules: []*config.Rule{
+		{Action: config.RuleAction{Type: ActionRateLimit, RatePerMinute: 1, Burst: 2}},
+	}}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []string{"", "", "RATELIMIT"} {
+		if got := evaluate(p, &ConnInfo{IP: netip.MustParseAddr("192.0.2.1")}); got != want {
+			t.Fatalf("connection %d matched %q, want %q", i, got, want)
+		}
+	}
+	if got := evaluate(p, &ConnInfo{IP: netip.MustParseAddr("192.0.2.2")}); got != "" {
+		t.Fatalf("another client matched %q", got)
+	}
+}
+
+func TestPolicy_Presets(t *testing.T) {
+	lists := map[string][]string{
+		"banned":  {"203.0.113.0/24"},
+		"friends": {"Steve"},
+	}
+	banned := netip.MustParseAddr("203.0.113.9")
+	other := netip.MustParseAddr("192.0.2.1")
+
+	for _, tt := range []struct {
+		name      string
+		version   int // ListAPI protocol version
+		ipMode    string
+		nameMode  string
+		rules     []*config.Rule
+		minecraft bool
+		info      ConnInfo
+		want      string
+	}{
+		{name: "IP block, listed", ipMode: BlockMode, info: ConnInfo{IP: banned}, want: "IP-BLOCK"},
+		{name: "IP block, not listed", ipMode: BlockMode, info: ConnInfo{IP: other}},
+		{name: "IP allow, listed", ipMode: AllowMode, info: ConnInfo{IP: banned}},
+		{name: "IP allow, not listed", ipMode: AllowMode, info: ConnInfo{IP: other}, want: "IP-ALLOW"},
+		{name: "IP down", ipMode: DownMode, info: ConnInfo{IP: other}, want: "IP-DOWN"},
+		{name: "IP joke", ipMode: JokeMode, info: ConnInfo{IP: other}, want: "IP-JOKE"},
+		{name: "no name access without Minecraft", nameMode: DownMode, info: ConnInfo{IP: other}},
+		{name: "name down", nameMode: DownMode, minecraft: true, info: ConnInfo{IP: other, PlayerName: "Steve"}, want: "DOWN"},
+		{name: "name joke", nameMode: JokeMode, minecraft: true, info: ConnInfo{IP: other, PlayerName: "Steve"}, want: "JOKE"},
+		{name: "name allow, listed", version: 2, nameMode: AllowMode, minecraft: true, info: ConnInfo{IP: other, ListAPIHit: true}},
+		{name: "name allow, not listed", version: 2, nameMode: AllowMode, minecraft: true, info: ConnInfo{IP: other}, want: "DENY"},
+		{name: "name block, version 1 hit", version: 1, nameMode: BlockMode, minecraft: true, info: ConnInfo{IP: other, ListAPIHit: true}, want: "REJECT"},
+		{name: "name block, version 1 miss", version: 1, nameMode: BlockMode, minecraft: true, info: ConnInfo{IP: other}},
+		{name: "name block, version 2 allowed", version: 2, nameMode: BlockMode, minecraft: true, info: ConnInfo{IP: other, ListAPIHit: true}},
+		{name: "name block, version 2 denied", version: 2, nameMode: BlockMode, minecraft: true, info: ConnInfo{IP: other}, want: "REJECT"},
+		{
+			name:      "presets before rules",
+			ipMode:    BlockMode,
+			nameMode:  DownMode,
+			rules:     []*config.Rule{{Name: "friends", Match: config.RuleMatch{NameListTags: []string{"friends"}}, Action: config.RuleAction{Type: ActionAllow}}},
+			minecraft: true,
+			info:      ConnInfo{IP: other, PlayerName: "Steve"},
+			want:      "DOWN",
+		},
+		{
+			name:      "IP preset before name preset",
+			ipMode:    BlockMode,
+			nameMode:  DownMode,
+			minecraft: true,
+			info:      ConnInfo{IP: banned, PlayerName: "Steve"},
+			want:      "IP-BLOCK",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			withLists(t, tt.version, lists)
+			s := &config.ConfigProxyService{Rules: tt.rules}
+			s.IPAccess.Mode = tt.ipMode
+			s.IPAccess.ListTags = []string{"banned"}
+			s.Minecraft.NameAccess.Mode = tt.nameMode
+			p, err := CompilePolicy(s, tt.minecraft)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := tt.minecraft && (tt.nameMode == AllowMode || tt.nameMode == BlockMode); p.UsesListAPI() != want {
+				t.Errorf("UsesListAPI is %v", p.UsesListAPI())
+			}
+			info := tt.info
+			if got := evaluate(p, &info); got != tt.want {
+				t.Errorf("matched %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompilePolicy_Errors(t *testing.T) {
+	withLists(t, 2, map[string][]string{"staff": {"Notch"}})
+	for _, tt := range []struct {
+		name      string
+		rule      config.Rule
+		minecraft bool
+	}{
+		{"bad IP", config.Rule{Match: config.RuleMatch{IPs: []string{"300.0.0.1"}}, Action: config.RuleAction{Type: ActionDeny}}, true},
+		{"unknown list", config.Rule{Match: config.RuleMatch{NameListTags: []string{"nobody"}}, Action: config.RuleAction{Type: ActionDeny}}, true},
+		{"bad time", config.Rule{Match: config.RuleMatch{TimeFrom: "25:00", TimeTo: "06:00"}, Action: config.RuleAction{Type: ActionDeny}}, true},
+		{"bad ListAPI condition", config.Rule{Match: config.RuleMatch{ListAPI: "maybe"}, Action: config.RuleAction{Type: ActionDeny}}, true},
+		{"player condition without Minecraft", config.Rule{Match: config.RuleMatch{PlayerNames: []string{"Steve"}}, Action: config.RuleAction{Type: ActionDeny}}, false},
+		{"bad route target", config.Rule{Action: config.RuleAction{Type: ActionRoute, Target: "example.com"}}, true},
+		{"ratelimit without rate", config.Rule{Action: config.RuleAction{Type: ActionRateLimit}}, true},
+		{"unknown action", config.Rule{Action: config.RuleAction{Type: "drop"}}, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			rule := tt.rule
+			_, err := CompilePolicy(&config.ConfigProxyService{Rules: []*config.Rule{&rule}}, tt.minecraft)
+			if err == nil {
+				t.Fatal("compiled without an error")
+			}
+		})
+	}
+}
+
+func TestPolicy_HostnameAllowed(t *testing.T) {
+	s := &config.ConfigProxyService{}
+	s.Minecraft.EnableHostnameAccess = true
+	if _, err := CompilePolicy(s, true); err == nil {
+		t.Fatal("compiled EnableHostnameAccess without hostnames")
+	}
+	s.Minecraft.AllowedHostnames = []string{"play.example.com", "*.example.net"}
+	s.Minecraft.HostnameAccess = "legacy"
+	p, err := CompilePolicy(s, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for hostname, want := range map[string]bool{
+		"play.example.com":   true,
+		"PLAY.example.com":   true,
+		"mc.example.net":     true,
+		"example.com":        false,
+		"legacy.example.org": true,
+	} {
+		if got := p.HostnameAllowed(hostname); got != want {
+			t.Errorf("HostnameAllowed(%q) = %v, want %v", hostname, got, want)
+		}
+	}
+	if p, _ = CompilePolicy(s, false); !p.HostnameAllowed("anything") {
+		t.Error("hostname restricted without Minecraft handling")
+	}
+}
@@ -0,0 +1,95 @@
+package access
+
+import (
+	"log"
+	"net/netip"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/InRaining/NoDelay/config"
+
+	"github.com/fatih/color"
+)
+
+const (
+	SessionModeReject  = "reject"
+	SessionModeKickOld = "kick-old"
+	SessionModeAllow   = "allow"
+)
+
+// Session is a player logged in through any service.
+type Session struct {
+	Service    string
+	PlayerName string
+	UUID       string // empty when the client didn't send it
+	IP         netip.Addr
+	Started    time.Time
+
+	close func()
+}
+
+var (
+	sessions      = map[*Session]struct{}{}
+	sessionsMutex sync.Mutex
+)
+
+// sameSessionsLocked returns the sessions of the same player, the oldest first.
+func sameSessionsLocked(playerName, uuid string) []*Session {
+	var same []*Session
+	for s := range sessions {
+		if strings.EqualFold(s.PlayerName, playerName) || uuid != "" && s.UUID == uuid {
+			same = append(same, s)
+		}
+	}
+	sort.Slice(same, func(i, j int) bool { return same[i].Started.Before(same[j].Started) })
+	return same
+}
+
+// StartSession registers a new session according to the DuplicateSessions policy.
+// closeFn forcibly ends the session when a later login replaces it.
+// It returns ok false with the number of sessions of the player if the login
+// is rejected, otherwise end must be called when the session ends.
+func StartSession(session *Session, closeFn func()) (end func(), ok bool, online int) {
+	session.UUID = strings.ToLower(strings.ReplaceAll(session.UUID, "-", ""))
+	session.Started = time.Now()
+	session.close = closeFn
+
+	var kicked []*Session
+	sessionsMutex.Lock()
+	if settings := config.Config.DuplicateSessions; settings != nil {
+		max := settings.MaxSessions
+		if max <= 0 || settings.Mode == SessionModeReject {
+			max = 1
+		}
+		same := sameSessionsLocked(session.PlayerName, session.UUID)
+		if len(same) >= max {
+			if settings.Mode != SessionModeKickOld {
+				sessionsMutex.Unlock()
+				return nil, false, len(same)
+			}
+			kicked = same[:len(same)-max+1]
+			for _, s := range kicked {
+				delete(sessions, s)
+			}
+		}
+	}
+	sessions[session] = struct{}{}
+	sessionsMutex.Unlock()
+
+	for _, s := range kicked {
+		log.Println(color.HiYellowString("Service %s : Closing the session of %s from %s, replaced by a new login from %s on service %s.",
+			s.Service, s.PlayerName, s.IP, session.IP, session.Service))
+		s.close()
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			sessionsMutex.Lock()
+			delete(sessions, session)
+			sessionsMutex.Unlock()
+		})
+	}, true, 0
+}
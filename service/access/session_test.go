@@ -0,0 +1,100 @@
+package access
+
+import (
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/InRaining/NoDelay/config"
+)
+
+func TestStartSession(t *testing.T) {
+	saved := config.Config.DuplicateSessions
+	defer func() { config.Config.DuplicateSessions = saved }()
+
+	for _, tt := range []struct {
+		name        string
+		mode        string
+		maxSessions int
+		logins      []string // player names, with "/uuid" when the client sent it
+		wantOK      []bool
+		wantClosed  []bool // sessions closed by later logins
+	}{
+		{
+			name:       "reject",
+			mode:       SessionModeReject,
+			logins:     []string{"Steve", "steve", "Alex"},
+			wantOK:     []bool{true, false, true},
+			wantClosed: []bool{false, false, false},
+		},
+		{
+			name:        "reject ignores MaxSessions",
+			mode:        SessionModeReject,
+			maxSessions: 3,
+			logins:      []string{"Steve", "Steve"},
+			wantOK:      []bool{true, false},
+			wantClosed:  []bool{false, false},
+		},
+		{
+			name:       "reject by UUID",
+			mode:       SessionModeReject,
+			logins:     []string{"Steve/069a79f4-44e9-4726-a5be-fca90e38aaf5", "Steve2/069a79f444e94726a5befca90e38aaf5"},
+			wantOK:     []bool{true, false},
+			wantClosed: []bool{false, false},
+		},
+		{
+			name:        "allow",
+			mode:        SessionModeAllow,
+			maxSessions: 2,
+			logins:      []string{"Steve", "Steve", "Steve", "Alex"},
+			wantOK:      []bool{true, true, false, true},
+			wantClosed:  []bool{false, false, false, false},
+		},
+		{
+			name:       "kick-old",
+			mode:       SessionModeKickOld,
+			logins:     []string{"Steve", "Alex", "Steve"},
+			wantOK:     []bool{true, true, true},
+			wantClosed: []bool{true, false, false},
+		},
+		{
+			name:        "kick-old keeps MaxSessions",
+			mode:        SessionModeKickOld,
+			maxSessions: 2,
+			logins:      []string{"Steve", "Steve", "Steve", "Steve"},
+			wantOK:      []bool{true, true, true, true},
+			wantClosed:  []bool{true, true, false, false},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			config.Config.DuplicateSessions = &config.DuplicateSessionConfig{Mode: tt.mode, MaxSessions: tt.maxSessions}
+			closed := make([]bool, len(tt.logins))
+			var ends []func()
+			for i, login := range tt.logins {
+				name, uuid, _ := strings.Cut(login, "/")
+				session := &Session{Service: "lobby", PlayerName: name, UUID: uuid, IP: netip.MustParseAddr("192.0.2.1")}
+				i := i
+				end, ok, _ := StartSession(session, func() { closed[i] = true })
+				if ok != tt.wantOK[i] {
+					t.Errorf("login %d of %s accepted %v, want %v", i, login, ok, tt.wantOK[i])
+				}
+				if ok {
+					ends = append(ends, end)
+				}
+			}
+			for i := range closed {
+				if closed[i] != tt.wantClosed[i] {
+					t.Errorf("session %d closed %v, want %v", i, closed[i], tt.wantClosed[i])
+				}
+			}
+			for _, end := range ends {
+				end()
+			}
+			sessionsMutex.Lock()
+			defer sessionsMutex.Unlock()
+			if len(sessions) != 0 {
+				t.Errorf("%d sessions left after they all ended", len(sessions))
+			}
+		})
+	}
+}
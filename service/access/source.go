@@ -0,0 +1,284 @@
+package access
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/InRaining/NoDelay/common/set"
+	"github.com/InRaining/NoDelay/config"
+
+	"github.com/fatih/color"
+	"github.com/fsnotify/fsnotify"
+)
+
+const (
+	ListSourceFile = "file"
+	ListSourceHTTP = "http"
+
+	listSourceMaxSize = 64 << 20
+)
+
+type listSnapshot struct {
+	names    set.StringSet
+	prefixes *set.PrefixSet
+}
+
+// listSource keeps the last good copy of an external list.
+type listSource struct {
+	name     string
+	settings config.ListSource
+	current  atomic.Pointer[listSnapshot]
+	etag     string
+	stopChan chan struct{}
+}
+
+var (
+	listSources     = map[string]*listSource{}
+	listSourcesLock sync.RWMutex
+)
+
+// StartListSources starts loading the list sources in the current configuration.
+// Sources whose settings haven't changed keep running with their current content.
+func StartListSources() {
+	listSourcesLock.Lock()
+	for name, src := range listSources {
+		if settings, ok := config.Config.ListSources[name]; !ok || *settings != src.settings {
+			close(src.stopChan)
+			delete(listSources, name)
+		}
+	}
+	started := make([]*listSource, 0, len(config.Config.ListSources))
+	for name, settings := range config.Config.ListSources {
+		if _, ok := listSources[name]; ok {
+			continue
+		}
+		if _, ok := config.Config.Lists[name]; ok {
+			log.Println(color.HiRedString("List source %s: a list with the same name exists in Lists, the source is ignored.", name))
+			continue
+		}
+		if settings.Type != ListSourceFile && settings.Type != ListSourceHTTP {
+			log.Println(color.HiRedString("List source %s: unknown type %q.", name, settings.Type))
+			continue
+		}
+		src := &listSource{
+			name:     name,
+			settings: *settings,
+			stopChan: make(chan struct{}),
+		}
+		src.current.Store(&listSnapshot{names: set.StringSet{}, prefixes: new(set.PrefixSet)})
+		listSources[name] = src
+		started = append(started, src)
+	}
+	listSourcesLock.Unlock()
+
+	// load outside the lock, so that lookups of other lists aren't blocked
+	for _, src := range started {
+		switch src.settings.Type {
+		case ListSourceFile:
+			src.refreshFile()
+			go src.watchFile()
+		case ListSourceHTTP:
+			// with a copy from the last run, fetched in the background so that
+			// a slow server doesn't hold up the start; without one the first
+			// fetch is waited for, so that the list isn't served empty
+			cached := src.loadCache()
+			if !cached {
+				src.refreshHTTP()
+			}
+			go src.pollHTTP(cached)
+		}
+	}
+}
+
+func getListSource(name string) (*listSnapshot, bool) {
+	listSourcesLock.RLock()
+	src, ok := listSources[name]
+	listSourcesLock.RUnlock()
+	if !ok {
+		return nil, false
+	}
+	return src.current.Load(), true
+}
+
+func (src *listSource) store(data []byte, from string) error {
+	entries := make([]string, 0, 64)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		entries = append(entries, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	src.current.Store(&listSnapshot{
+		names:    set.NewStringSetFromSlice(entries),
+		prefixes: set.NewPrefixSetFromSlice(entries),
+	})
+	log.Println(color.HiYellowString("List source %s: loaded %d entries from %s.", src.name, len(entries), from))
+	return nil
+}
+
+func (src *listSource) failed(err error) {
+	log.Println(color.HiRedString("List source %s: refresh failed, keeping %d entries: %v",
+		src.name, len(src.current.Load().names), err))
+}
+
+func (src *listSource) refreshFile() {
+	data, err := os.ReadFile(src.settings.Path)
+	if err == nil {
+		err = src.store(data, src.settings.Path)
+	}
+	if err != nil {
+		src.failed(err)
+	}
+}
+
+func (src *listSource) watchFile() {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		src.failed(fmt.Errorf("failed to create file watcher: %w", err))
+		return
+	}
+	defer watcher.Close()
+	// watch the directory, since editors often replace the file
+	if err = watcher.Add(filepath.Dir(src.settings.Path)); err != nil {
+		src.failed(fmt.Errorf("failed to watch file: %w", err))
+		return
+	}
+
+	path := filepath.Clean(src.settings.Path)
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if filepath.Clean(event.Name) == path &&
+				(event.Has(fsnotify.Write) || event.Has(fsnotify.Create) || event.Has(fsnotify.Rename)) {
+				timer.Reset(200 * time.Millisecond)
+			}
+		case <-timer.C:
+			src.refreshFile()
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			src.failed(err)
+		case <-src.stopChan:
+			return
+		}
+	}
+}
+
+func (src *listSource) cachePath() string {
+	if src.settings.CachePath != "" {
+		return src.settings.CachePath
+	}
+	return "ListSource." + url.PathEscape(src.name) + ".txt"
+}
+
+// loadCache loads the copy of the list saved by the last good fetch.
+// It reports whether there was one.
+func (src *listSource) loadCache() bool {
+	data, err := os.ReadFile(src.cachePath())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			src.failed(err)
+		}
+		return false
+	}
+	if err = src.store(data, src.cachePath()); err != nil {
+		src.failed(err)
+		return false
+	}
+	return true
+}
+
+func (src *listSource) saveCache(data []byte) {
+	tmpFile := src.cachePath() + ".tmp"
+	err := os.WriteFile(tmpFile, data, 0644)
+	if err == nil {
+		err = os.Rename(tmpFile, src.cachePath())
+	}
+	if err != nil {
+		log.Println(color.HiRedString("List source %s: failed to save the copy: %v", src.name, err))
+	}
+}
+
+func (src *listSource) pollHTTP(refreshNow bool) {
+	interval := time.Duration(src.settings.RefreshIntervalSec) * time.Second
+	if interval <= 0 {
+		interval = 5 * time.Minute
+	}
+	if refreshNow {
+		src.refreshHTTP()
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			src.refreshHTTP()
+		case <-src.stopChan:
+			return
+		}
+	}
+}
+
+var listSourceHTTPClient = &http.Client{Timeout: 30 * time.Second}
+
+func (src *listSource) refreshHTTP() {
+	req, err := http.NewRequest(http.MethodGet, src.settings.URL, nil)
+	if err != nil {
+		src.failed(err)
+		return
+	}
+	if src.etag != "" {
+		req.Header.Set("If-None-Match", src.etag)
+	}
+	resp, err := listSourceHTTPClient.Do(req)
+	if err != nil {
+		src.failed(err)
+		return
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		return
+	case http.StatusOK:
+	default:
+		src.failed(fmt.Errorf("unexpected HTTP status: %s", resp.Status))
+		return
+	}
+	// one byte over the limit tells a list too large from one just fitting
+	data, err := io.ReadAll(io.LimitReader(resp.Body, listSourceMaxSize+1))
+	if err == nil && len(data) > listSourceMaxSize {
+		err = fmt.Errorf("list larger than %d MB", listSourceMaxSize>>20)
+	}
+	if err == nil {
+		err = src.store(data, src.settings.URL)
+	}
+	if err != nil {
+		src.failed(err)
+		return
+	}
+	src.etag = resp.Header.Get("ETag")
+	src.saveCache(data)
+}
@@ -0,0 +1,203 @@
+package access
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/InRaining/NoDelay/config"
+)
+
+// withListSources starts the given list sources and stops them at the end of the test.
+func withListSources(t *testing.T, sources map[string]*config.ListSource) {
+	saved := config.Config
+	t.Cleanup(func() {
+		config.Config.ListSources = nil
+		StartListSources()
+		config.Config = saved
+	})
+	config.Config.Lists = nil
+	config.Config.ListSources = sources
+	StartListSources()
+}
+
+func TestListSource_File(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blocked.txt")
+	if err := os.WriteFile(path, []byte("Steve\n# a comment\n\n  192.0.2.0/24  \n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	withListSources(t, map[string]*config.ListSource{"blocked": {Type: ListSourceFile, Path: path}})
+
+	names, err := GetTargetList("blocked")
+	if err != nil {
+		t.Fatal(err)
+	}
+	prefixes, _ := GetTargetIPList("blocked")
+	if !names.Has("Steve") || names.Has("# a comment") || len(names) != 2 {
+		t.Fatalf("names %v, want Steve and the prefix", names)
+	}
+	if !prefixes.Contains(netip.MustParseAddr("192.0.2.7")) || prefixes.Contains(netip.MustParseAddr("198.51.100.1")) {
+		t.Fatal("wrong prefixes")
+	}
+
+	// picked up by the watcher, which may not be watching yet at the first write
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if err := os.WriteFile(path, []byte("Alex\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(300 * time.Millisecond)
+		if names, _ = GetTargetList("blocked"); names.Has("Alex") {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("names %v after the edit, want Alex", names)
+		}
+	}
+	if names.Has("Steve") {
+		t.Errorf("names %v after the edit, want only Alex", names)
+	}
+
+	// a file gone keeps the last good copy
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	listSources["blocked"].refreshFile()
+	if names, _ = GetTargetList("blocked"); !names.Has("Alex") {
+		t.Errorf("names %v after a failed refresh, want Alex", names)
+	}
+}
+
+// listServer serves a list with an ETag, or fails with status when it is set.
+type listServer struct {
+	mutex       sync.Mutex
+	body        string
+	etag        string
+	status      int
+	requests    int
+	notModified int
+}
+
+func (s *listServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.requests++
+	if s.status != 0 {
+		w.WriteHeader(s.status)
+		return
+	}
+	if r.Header.Get("If-None-Match") == s.etag {
+		s.notModified++
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("ETag", s.etag)
+	w.Write([]byte(s.body)) //nolint:errcheck
+}
+
+func (s *listServer) set(body, etag string, status int) {
+	s.mutex.Lock()
+	s.body, s.etag, s.status = body, etag, status
+	s.mutex.Unlock()
+}
+
+func TestListSource_HTTP(t *testing.T) {
+	server := &listServer{body: "Steve\nNotch\n", etag: `"v1"`}
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+	cache := filepath.Join(t.TempDir(), "vip.txt")
+	sources := map[string]*config.ListSource{
+		"vip": {Type: ListSourceHTTP, URL: ts.URL, RefreshIntervalSec: 3600, CachePath: cache},
+	}
+	withListSources(t, sources)
+	src := listSources["vip"]
+
+	// without a copy the first fetch is waited for
+	names, _ := GetTargetList("vip")
+	if !names.Has("Steve") || !names.Has("Notch") {
+		t.Fatalf("names %v on start, want Steve and Notch", names)
+	}
+	if data, err := os.ReadFile(cache); err != nil || string(data) != "Steve\nNotch\n" {
+		t.Fatalf("copy %q, %v", data, err)
+	}
+
+	for _, tt := range []struct {
+		name      string
+		body      string
+		etag      string
+		status    int
+		wantNames []string
+		wantSwap  bool
+	}{
+		{name: "not modified", body: "Alex\n", etag: `"v1"`, wantNames: []string{"Steve", "Notch"}},
+		{name: "modified", body: "Alex\n", etag: `"v2"`, wantNames: []string{"Alex"}, wantSwap: true},
+		{name: "server error", status: http.StatusInternalServerError, wantNames: []string{"Alex"}},
+		{name: "not found", status: http.StatusNotFound, wantNames: []string{"Alex"}},
+		{name: "emptied", body: "# nobody\n", etag: `"v3"`, wantSwap: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			server.set(tt.body, tt.etag, tt.status)
+			before := src.current.Load()
+			beforeLen := len(before.names)
+			src.refreshHTTP()
+			after := src.current.Load()
+			if (after != before) != tt.wantSwap {
+				t.Errorf("swapped %v, want %v", after != before, tt.wantSwap)
+			}
+			if len(before.names) != beforeLen {
+				t.Error("the previous snapshot was changed in place")
+			}
+			if len(after.names) != len(tt.wantNames) {
+				t.Errorf("names %v, want %v", after.names, tt.wantNames)
+			}
+			for _, name := range tt.wantNames {
+				if !after.names.Has(name) {
+					t.Errorf("names %v, want %v", after.names, tt.wantNames)
+				}
+			}
+		})
+	}
+	server.mutex.Lock()
+	if server.notModified != 1 {
+		t.Errorf("%d not modified responses, want 1", server.notModified)
+	}
+	server.mutex.Unlock()
+
+	// a restart serves the copy while the server is down
+	server.set("", "", http.StatusServiceUnavailable)
+	if err := os.WriteFile(cache, []byte("Alex\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config.Config.ListSources = nil
+	StartListSources()
+	config.Config.ListSources = sources
+	StartListSources()
+	if names, _ = GetTargetList("vip"); !names.Has("Alex") {
+		t.Errorf("names %v after the restart, want Alex from the copy", names)
+	}
+}
+
+func TestListSource_HTTPUnreachable(t *testing.T) {
+	server := &listServer{status: http.StatusBadGateway}
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+	withListSources(t, map[string]*config.ListSource{
+		"vip": {Type: ListSourceHTTP, URL: ts.URL, RefreshIntervalSec: 3600, CachePath: filepath.Join(t.TempDir(), "vip.txt")},
+	})
+
+	// no copy and no answer: the list is empty, but it exists
+	names, err := GetTargetList("vip")
+	if err != nil || len(names) != 0 {
+		t.Fatalf("names %v, %v, want an empty list", names, err)
+	}
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	if server.requests != 1 {
+		t.Errorf("%d requests before serving, want 1", server.requests)
+	}
+}
@@ -12,6 +12,7 @@ import (
 	"github.com/InRaining/NoDelay/outbound"
 	"github.com/InRaining/NoDelay/outbound/socks"
 	"github.com/InRaining/NoDelay/service/access"
+	"github.com/InRaining/NoDelay/service/traffic"
 	"github.com/InRaining/NoDelay/service/transfer"
 
 	"github.com/fatih/color"
@@ -24,8 +25,10 @@ func StartNewService(ctx context.Context, s *config.ConfigProxyService) {
 	var (
 		isTLSHandleNeeded = s.TLSSniffing.RejectNonTLS ||
 			s.TLSSniffing.RejectIfNonMatch ||
-			len(s.TLSSniffing.SNIAllowListTags) != 0
+			len(s.TLSSniffing.SNIAllowListTags) != 0 ||
+			s.Accounting.Identity == traffic.IdentitySNI
 		isMinecraftHandleNeeded = s.Minecraft.EnableHostnameRewrite ||
+			s.Minecraft.EnableHostnameAccess ||
 			s.Minecraft.EnableAnyDest ||
 			s.Minecraft.MotdDescription != "" && s.Minecraft.MotdDescription != config.DefaultMotd ||
 			s.Minecraft.MotdFavicon != ""
@@ -33,6 +36,9 @@ func StartNewService(ctx context.Context, s *config.ConfigProxyService) {
 	if isTLSHandleNeeded && isMinecraftHandleNeeded {
 		log.Panic(color.HiRedString("Service %s: The current version can't handle TLS and Minecraft at the same time.", s.Name))
 	}
+	if err := traffic.ValidateAccounting(s.Accounting); err != nil {
+		log.Panic(color.HiRedString("Service %s: %s", s.Name, err.Error()))
+	}
 	flowType := getFlowType(s.Flow)
 	if flowType == -1 {
 		log.Panic(color.HiRedString("Service %s: Unknown flow type '%s'.", s.Name, s.Flow))
@@ -55,7 +61,7 @@ func StartNewService(ctx context.Context, s *config.ConfigProxyService) {
 			log.Panic(color.HiRedString("Service %s: ListTags can't be null when access control enabled.", s.Name))
 		}
 		for _, tag := range s.IPAccess.ListTags {
-			if _, err = access.GetTargetList(tag); err != nil {
+			if _, err = access.GetTargetIPList(tag); err != nil {
 				log.Panic(color.HiRedString("Service %s: %s", s.Name, err.Error()))
 			}
 		}
@@ -63,6 +69,27 @@ func StartNewService(ctx context.Context, s *config.ConfigProxyService) {
 		log.Panicf("Unknown access control mode: %s", s.IPAccess.Mode)
 	}
 
+	// check GeoIP access settings
+	switch s.GeoIPAccess.Mode {
+	case access.DefaultMode:
+	case access.AllowMode, access.BlockMode:
+		if config.Config.GeoIP == nil {
+			log.Panic(color.HiRedString("Service %s: GeoIP databases must be configured when GeoIP access control enabled.", s.Name))
+		}
+		switch s.GeoIPAccess.Action {
+		case "", access.GeoIPActionReset:
+		case access.GeoIPActionKick:
+			if !isMinecraftHandleNeeded {
+				log.Panic(color.HiRedString("Service %s: GeoIP kick action requires Minecraft handling.", s.Name))
+			}
+		default:
+			log.Panicf("Unknown GeoIP access action: %s", s.GeoIPAccess.Action)
+		}
+	default:
+		log.Panicf("Unknown GeoIP access control mode: %s", s.GeoIPAccess.Mode)
+	}
+	isGeoIPResetNeeded := s.GeoIPAccess.Mode != access.DefaultMode && s.GeoIPAccess.Action != access.GeoIPActionKick
+
 	// load Minecraft player name access lists
 	if isMinecraftHandleNeeded {
 		switch s.Minecraft.NameAccess.Mode {
@@ -81,6 +108,11 @@ func StartNewService(ctx context.Context, s *config.ConfigProxyService) {
 		}
 	}
 
+	policy, err := access.CompilePolicy(s, isMinecraftHandleNeeded)
+	if err != nil {
+		log.Panic(color.HiRedString("Service %s: Bad access rules: %v", s.Name, err))
+	}
+
 	out := outbound.NewSystemOutbound(s.SocketOptions)
 	switch s.Outbound.Type {
 	case "socks", "socks5", "socks4a", "socks4":
@@ -97,6 +129,8 @@ func StartNewService(ctx context.Context, s *config.ConfigProxyService) {
 		IsTLSHandleNeeded:       isTLSHandleNeeded,
 		IsMinecraftHandleNeeded: isMinecraftHandleNeeded,
 		FlowType:                flowType,
+		Policy:                  policy,
+		Limiter:                 access.NewConnLimiter(s.Name, s.Limits),
 	}
 	for {
 		conn, err := listen.Accept()
@@ -107,35 +141,44 @@ func StartNewService(ctx context.Context, s *config.ConfigProxyService) {
 		default:
 			log.Panic(color.HiRedString("Service %s: Unexpected error when listening: %v", s.Name, err))
 		}
-		if s.IPAccess.Mode != access.DefaultMode {
-			// https://stackoverflow.com/questions/29687102/how-do-i-get-a-network-clients-ip-converted-to-a-string-in-golang
-			ip := conn.RemoteAddr().(*net.TCPAddr).IP.String()
-			hit := false
-			for _, list := range s.IPAccess.ListTags {
-				if hit = common.Must(access.GetTargetList(list)).Has(ip); hit {
-					break
-				}
-			}
-			switch s.IPAccess.Mode {
-			case access.AllowMode:
-				if !hit {
-					forciblyCloseTCP(conn)
-					continue
-				}
-			case access.BlockMode:
-				if hit {
-					forciblyCloseTCP(conn)
-					continue
-				}
-			case access.DownMode:
-					forciblyCloseTCP(conn)
-					continue
-			case access.JokeMode:
-					forciblyCloseTCP(conn)
-					continue
+		// limits come first, so that a flood is turned away before the other checks;
+		// the slot is released again when a later check rejects the connection
+		release, reason := options.Limiter.Acquire(conn.RemoteAddr().(*net.TCPAddr).AddrPort().Addr())
+		if reason != "" {
+			forciblyCloseTCP(conn)
+			continue
+		}
+		if access.CheckAutoBanned(conn.RemoteAddr().(*net.TCPAddr).AddrPort().Addr()) {
+			release()
+			forciblyCloseTCP(conn)
+			continue
+		}
+		ctx := new(transfer.ConnContext).Init()
+		ctx.OnClose(release)
+		// rules needing the handshake or the login can only be evaluated by the Minecraft handler
+		ctx.Verdict = policy.Evaluate(&access.ConnInfo{
+			IP: conn.RemoteAddr().(*net.TCPAddr).AddrPort().Addr(),
+		}, access.PhaseConnection, !isMinecraftHandleNeeded, ctx.Verdict)
+		if rule := ctx.Verdict.Rule; rule != nil && (rule.Action.Type == access.ActionReset ||
+			!isMinecraftHandleNeeded && rule.Action.Type != access.ActionAllow && rule.Action.Type != access.ActionRoute) {
+			release()
+			forciblyCloseTCP(conn)
+			continue
+		}
+		// Minecraft services kick banned players with the reason after the handshake
+		if !isMinecraftHandleNeeded && access.CheckBannedIP(conn.RemoteAddr().(*net.TCPAddr).AddrPort().Addr()) != nil {
+			release()
+			forciblyCloseTCP(conn)
+			continue
+		}
+		if isGeoIPResetNeeded {
+			if ok, _ := access.CheckGeoIP(s, conn.RemoteAddr().(*net.TCPAddr).AddrPort().Addr()); !ok {
+				release()
+				forciblyCloseTCP(conn)
+				continue
 			}
 		}
-		go newConnReceiver(s, conn.(*net.TCPConn), options)
+		go newConnReceiver(s, ctx, conn.(*net.TCPConn), options)
 	}
 }
 
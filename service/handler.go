@@ -9,6 +9,7 @@ import (
 	"github.com/InRaining/NoDelay/config"
 	"github.com/InRaining/NoDelay/service/minecraft"
 	"github.com/InRaining/NoDelay/service/tls"
+	"github.com/InRaining/NoDelay/service/traffic"
 	"github.com/InRaining/NoDelay/service/transfer"
 
 	"github.com/fatih/color"
@@ -20,16 +21,20 @@ var (
 )
 
 func newConnReceiver(s *config.ConfigProxyService,
+	ctx *transfer.ConnContext,
 	conn *net.TCPConn,
 	options *transfer.Options,
 ) {
-	ctx := new(transfer.ConnContext).Init()
 	log.Println("Service", s.Name, ":", ctx.ColoredID, GreenPlus, conn.RemoteAddr().String())
+	defer ctx.Close()
 	defer log.Println("Service", s.Name, ":", ctx.ColoredID, RedMinus, conn.RemoteAddr().String(), ctx)
-	var remote net.Conn
+	var (
+		remote net.Conn
+		domain string
+	)
 
 	if options.IsTLSHandleNeeded {
-		remote, ctx.Err = tls.NewConnHandler(s, conn, options.Out)
+		remote, domain, ctx.Err = tls.NewConnHandler(s, conn, options.Out)
 		if ctx.Err != nil {
 			conn.Close()
 			return
@@ -43,15 +48,80 @@ func newConnReceiver(s *config.ConfigProxyService,
 	}
 
 	if remote == nil {
+		targetAddress, targetPort := s.TargetAddress, s.TargetPort
+		if rule := ctx.Verdict.Rule; rule != nil {
+			if host, port, ok := rule.Target(); ok {
+				targetAddress, targetPort = host, port
+				ctx.AttachInfo("Target=" + rule.Action.Target)
+			}
+		}
 		var err error
-		remote, err = options.Out.Dial("tcp", net.JoinHostPort(s.TargetAddress, strconv.FormatInt(int64(s.TargetPort), 10)))
+		remote, err = options.Out.Dial("tcp", net.JoinHostPort(targetAddress, strconv.FormatInt(int64(targetPort), 10)))
 		if err != nil {
 			ctx.Err = common.Cause("failed to dial to target server: ", err)
 			conn.Close()
 			return
 		}
 	}
+	if !options.IsMinecraftHandleNeeded && s.Accounting.Identity != "" {
+		if ctx.Err = accountConn(s, ctx, conn, remote, domain); ctx.Err != nil {
+			conn.Close()
+			remote.Close()
+			return
+		}
+	}
+	if !ctx.Upload.Shaped() && !ctx.Download.Shaped() {
+		// connections without a player are only shaped by the service and globally
+		var release func()
+		ctx.Upload.Shaper, ctx.Download.Shaper, release = traffic.Shapers(s, "", nil)
+		ctx.OnClose(release)
+	}
 	options.OnlineCount.Add(1)
 	defer options.OnlineCount.Add(-1)
-	transfer.SimpleTransfer(conn, remote, options.FlowType)
+	transfer.SimpleTransfer(conn, remote, options.FlowType, ctx.Upload, ctx.Download)
+}
+
+// accountConn counts the traffic of a connection without a player to the
+// identity of its client, as the Minecraft handler does for players, and
+// rejects the connection when the identity is out of quota. Services only
+// account their connections when they set an accounting identity, and
+// playtime limits only apply to players.
+func accountConn(s *config.ConfigProxyService,
+	ctx *transfer.ConnContext,
+	conn *net.TCPConn,
+	remote net.Conn,
+	domain string,
+) error {
+	identity := traffic.Identity(s, traffic.Peer{
+		SNI:  domain,
+		Addr: conn.RemoteAddr().(*net.TCPAddr).AddrPort().Addr(),
+	})
+	if identity == "" {
+		return nil
+	}
+	ctx.AttachInfo("Account=" + identity)
+
+	plan := traffic.ResolvePlan(s, identity)
+	var key string
+	if settings := config.Config.TrafficLimiter; settings != nil && settings.EnableTrafficLimit {
+		key = traffic.PrepareAccount(s, identity, plan)
+		if !traffic.CheckTrafficLimit(key, 0) {
+			return minecraft.ErrTrafficLimitExceeded
+		}
+	}
+
+	var release func()
+	ctx.Upload.Shaper, ctx.Download.Shaper, release = traffic.Shapers(s, identity, &plan)
+	ctx.OnClose(release)
+	if key == "" {
+		return nil
+	}
+
+	meter := traffic.NewMeter(key, identity, s.Name, 0, func() {
+		conn.Close()
+		remote.Close()
+	})
+	ctx.Upload.Meter, ctx.Download.Meter = meter.Upload(), meter.Download()
+	ctx.OnClose(meter.Close)
+	return nil
 }
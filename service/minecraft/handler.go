@@ -1,12 +1,17 @@
 package minecraft
 
 import (
+	"encoding/hex"
 	"errors"
+	"fmt"
+	"io"
 	"log"
 	"math"
 	"net"
+	"net/netip"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/InRaining/NoDelay/common"
 	"github.com/InRaining/NoDelay/common/buf"
@@ -28,22 +33,191 @@ var (
 	ErrRejectedLoginPlayerNumberLimitExceeded = errors.New("rejected due to player number limit exceeded")
 	ErrBadPlayerName                          = errors.New("rejected due to bad player name")
 	ErrTrafficLimitExceeded                   = errors.New("traffic limit exceeded")
+	ErrPlaytimeLimitExceeded                  = errors.New("playtime limit exceeded")
+	ErrRejectedLoginGeoIP                     = errors.New("rejected by GeoIP access control")
+	ErrRejectedLoginBanned                    = errors.New("rejected due to ban")
+	ErrRejectedLoginWrongHostname             = errors.New("rejected due to wrong hostname")
+	ErrRejectedLoginFirstJoin                 = errors.New("shown first join notice")
+	ErrRejectedAccessRule                     = errors.New("rejected by access rule")
+	ErrBadPacket                              = errors.New("bad packet")
+	ErrRateLimited                            = errors.New("rejected due to rate limit")
+	ErrRejectedLoginDuplicateSession          = errors.New("rejected due to duplicate session")
+	ErrRejectedLoginIPBinding                 = errors.New("rejected due to IP binding")
 )
 
-func badPacketPanicRecover(s *config.ConfigProxyService) {
+func badPacketPanicRecover(s *config.ConfigProxyService, c net.Conn) {
 	// Non-Minecraft packet which uses `go-mc` packet scan method may cause panic.
 	// So a panic handler is needed.
 	if err := recover(); err != nil {
 		log.Print(color.HiRedString("Service %s : Bad Minecraft packet was received: %v", s.Name, err))
+		access.ReportViolation(c.RemoteAddr().(*net.TCPAddr).AddrPort().Addr(), access.ViolationMalformedPacket)
 	}
 }
 
+// badPacket marks err as caused by a malformed packet,
+// unless the client has just gone away or timed out.
+func badPacket(err error) error {
+	var netErr net.Error
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.As(err, &netErr) {
+		return err
+	}
+	return fmt.Errorf("%w: %v", ErrBadPacket, err)
+}
+
+// dialError is a failure to reach the backend, which is not the fault of the client.
+type dialError struct {
+	error
+}
+
+func (e dialError) Unwrap() error {
+	return e.error
+}
+
+// violationOf tells which violation the error of a connection counts as for auto-ban, if any.
+// Only the timeouts of the client count, those of the backend being no violation.
+func violationOf(err error) string {
+	var (
+		netErr  net.Error
+		dialErr dialError
+	)
+	switch {
+	case errors.Is(err, ErrBadPacket), errors.Is(err, ErrBadPlayerName):
+		return access.ViolationMalformedPacket
+	case errors.Is(err, ErrRejectedLoginAccessControl),
+		errors.Is(err, ErrRejectedLoginBanned),
+		errors.Is(err, ErrRejectedLoginGeoIP),
+		errors.Is(err, ErrRejectedLoginWrongHostname),
+		errors.Is(err, ErrRejectedLoginIPBinding),
+		errors.Is(err, ErrRejectedAccessRule):
+		return access.ViolationRejectedLogin
+	case errors.As(err, &dialErr):
+		return ""
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return access.ViolationHandshakeTimeout
+	}
+	return ""
+}
+
+// kickLogin sends a login disconnect packet with msg and closes the connection.
+func kickLogin(c net.Conn, conn mcprotocol.Conn, buffer *buf.Buffer, msg mcprotocol.Message) error {
+	msgBytes, err := msg.MarshalJSON()
+	if err != nil {
+		return err
+	}
+
+	buffer.Reset(mcprotocol.MaxVarIntLen)
+	common.Must0(mcprotocol.WriteToPacket(buffer,
+		byte(0x00), // Client bound : Disconnect (login)
+		mcprotocol.VarInt(len(msgBytes)),
+	))
+	err = conn.WriteVectorizedPacket(buffer, msgBytes)
+	if err != nil {
+		return err
+	}
+
+	c.(*net.TCPConn).SetLinger(10) //nolint:errcheck
+	c.Close()
+	return nil
+}
+
+// parseLoginStartUUID extracts the player UUID from the part of a Login Start packet
+// after the player name. It returns an empty string if no UUID is present.
+func parseLoginStartUUID(protocol int, rest []byte) string {
+	if protocol < 764 {
+		// has UUID (boolean) + UUID
+		if len(rest) < 17 || rest[0] != 1 {
+			return ""
+		}
+		rest = rest[1:]
+	}
+	if len(rest) < 16 {
+		return ""
+	}
+	return hex.EncodeToString(rest[:16])
+}
+
+// respondStatus answers a status request with motd and handles the ping that follows.
+// It returns ErrSuccessfullyHandledMOTDRequest once done.
+func respondStatus(s *config.ConfigProxyService, conn mcprotocol.Conn, buffer *buf.Buffer, motd []byte) error {
+	// Server bound : Status Request
+	// Must read, but not used (and also nothing included in it)
+	//buffer.Reset(mcprotocol.MaxVarIntLen)
+	err := conn.ReadLimitedPacket(buffer, 1)
+	if err != nil {
+		return badPacket(err)
+	}
+
+	// send custom MOTD
+	motdLen := len(motd)
+
+	buffer.Reset(mcprotocol.MaxVarIntLen)
+	common.Must0(mcprotocol.WriteToPacket(buffer,
+		byte(0x00), // Client bound : Status Response
+		mcprotocol.VarInt(motdLen),
+	))
+	err = conn.WriteVectorizedPacket(buffer, motd)
+	if err != nil {
+		return err
+	}
+
+	// handle ping request
+	buffer.Reset(mcprotocol.MaxVarIntLen)
+	switch s.Minecraft.PingMode {
+	case pingModeDisconnect:
+	case pingMode0ms:
+		err = mcprotocol.WriteToPacket(buffer,
+			byte(0x01),           // Client bound : Ping Response
+			int64(math.MaxInt64), // this makes no sense but only a number
+		)
+		if err != nil {
+			return err
+		}
+		err = conn.WritePacket(buffer)
+		if err != nil {
+			return err
+		}
+	default:
+		err = conn.ReadLimitedPacket(buffer, 9)
+		if err != nil {
+			return badPacket(err)
+		}
+		err = conn.WritePacket(buffer)
+		if err != nil {
+			return err
+		}
+	}
+
+	conn.Close()
+	return ErrSuccessfullyHandledMOTDRequest
+}
+
 func NewConnHandler(s *config.ConfigProxyService,
 	ctx *transfer.ConnContext,
 	c net.Conn,
 	options *transfer.Options,
 ) (net.Conn, error) {
-	defer badPacketPanicRecover(s)
+	tracker := access.GetAbuseTracker()
+	if tracker == nil {
+		return handleConn(s, ctx, c, options)
+	}
+
+	c.SetReadDeadline(time.Now().Add(tracker.HandshakeTimeout())) //nolint:errcheck
+	remote, err := handleConn(s, ctx, c, options)
+	if violation := violationOf(err); violation != "" {
+		tracker.Report(c.RemoteAddr().(*net.TCPAddr).AddrPort().Addr(), violation)
+	}
+	if err == nil {
+		c.SetReadDeadline(time.Time{}) //nolint:errcheck
+	}
+	return remote, err
+}
+
+func handleConn(s *config.ConfigProxyService,
+	ctx *transfer.ConnContext,
+	c net.Conn,
+	options *transfer.Options,
+) (net.Conn, error) {
+	defer badPacketPanicRecover(s, c)
 	buffer := buf.NewSize(256)
 	defer buffer.Release()
 	buffer.Reset(mcprotocol.MaxVarIntLen)
@@ -51,7 +225,7 @@ func NewConnHandler(s *config.ConfigProxyService,
 	conn := mcprotocol.StreamConn(c)
 	err := conn.ReadLimitedPacket(buffer, 250)
 	if err != nil {
-		return nil, err
+		return nil, badPacket(err)
 	}
 
 	var packetID mcprotocol.VarInt
@@ -64,12 +238,46 @@ func NewConnHandler(s *config.ConfigProxyService,
 	)
 	err = mcprotocol.Scan(buffer, &packetID, &protocol, &hostname, &port, &nextState)
 	if err != nil {
-		return nil, err
+		return nil, badPacket(err)
+	}
+	connHostname, modLoader := access.ParseHandshakeHostname(hostname)
+	info := &access.ConnInfo{
+		IP:        c.RemoteAddr().(*net.TCPAddr).AddrPort().Addr(),
+		Hostname:  connHostname,
+		ModLoader: modLoader,
+		Protocol:  int(protocol),
+	}
+	ctx.Verdict = options.Policy.Evaluate(info, access.PhaseHandshake, false, ctx.Verdict)
+	if rule := ctx.Verdict.Rule; rule != nil {
+		// status requests are only turned away by resetting them
+		if rule.Action.Type == access.ActionReset ||
+			nextState == 1 && rule.Action.Type == access.ActionRateLimit {
+			c.(*net.TCPConn).SetLinger(0) //nolint:errcheck
+			return nil, fmt.Errorf("%w %s", ErrRejectedAccessRule, rule.Label)
+		}
 	}
-	if s.Minecraft.EnableHostnameAccess {
-		if !strings.Contains(hostname, s.Minecraft.HostnameAccess) {
-			c.(*net.TCPConn).SetLinger(0)
-			return nil, errors.New("hostname is not allowed")
+	if nextState == 1 { // status, counted and limited whatever the hostname
+		access.ReportStatusRequest(info.IP)
+		if !options.Limiter.AllowStatus(info.IP) {
+			c.(*net.TCPConn).SetLinger(0) //nolint:errcheck
+			return nil, ErrRateLimited
+		}
+	}
+	wrongHostname := !options.Policy.HostnameAllowed(connHostname)
+	if wrongHostname {
+		_, ipErr := netip.ParseAddr(connHostname)
+		rawIP := ipErr == nil
+		count := access.RecordWrongHostname(s.Name, rawIP)
+		if rawIP {
+			log.Print(color.HiYellowString("Service %s : %s Scanner %s connected by raw IP %s (%d so far)",
+				s.Name, ctx.ColoredID, c.RemoteAddr(), connHostname, count))
+		} else {
+			log.Printf("Service %s : %s Wrong hostname %q from %s (%d so far)",
+				s.Name, ctx.ColoredID, connHostname, c.RemoteAddr(), count)
+		}
+		ctx.AttachInfo("WrongHostname=" + connHostname)
+		if nextState == 1 {
+			return nil, respondStatus(s, conn, buffer, generateWrongHostnameMOTD(int(protocol), s, options))
 		}
 	}
 	if nextState == 1 { // status
@@ -77,7 +285,7 @@ func NewConnHandler(s *config.ConfigProxyService,
 			// directly proxy MOTD from server
 			remote, err := options.Out.Dial("tcp", net.JoinHostPort(s.TargetAddress, strconv.FormatInt(int64(s.TargetPort), 10)))
 			if err != nil {
-				return nil, err
+				return nil, dialError{err}
 			}
 
 			buffer.Rewind(mcprotocol.MaxVarIntLen)
@@ -88,63 +296,17 @@ func NewConnHandler(s *config.ConfigProxyService,
 
 			return remote, nil
 		} else {
-			// Server bound : Status Request
-			// Must read, but not used (and also nothing included in it)
-			//buffer.Reset(mcprotocol.MaxVarIntLen)
-			err = conn.ReadLimitedPacket(buffer, 1)
-			if err != nil {
-				return nil, err
-			}
-
-			// send custom MOTD
-			motd := generateMOTD(int(protocol), s, options)
-			motdLen := len(motd)
-
-			buffer.Reset(mcprotocol.MaxVarIntLen)
-			common.Must0(mcprotocol.WriteToPacket(buffer,
-				byte(0x00), // Client bound : Status Response
-				mcprotocol.VarInt(motdLen),
-			))
-			err = conn.WriteVectorizedPacket(buffer, motd)
-			if err != nil {
-				return nil, err
-			}
-
-			// handle ping request
-			buffer.Reset(mcprotocol.MaxVarIntLen)
-			switch s.Minecraft.PingMode {
-			case pingModeDisconnect:
-			case pingMode0ms:
-				err = mcprotocol.WriteToPacket(buffer,
-					byte(0x01),           // Client bound : Ping Response
-					int64(math.MaxInt64), // this makes no sense but only a number
-				)
-				if err != nil {
-					return nil, err
-				}
-				err = conn.WritePacket(buffer)
-				if err != nil {
-					return nil, err
-				}
-			default:
-				err = conn.ReadLimitedPacket(buffer, 9)
-				if err != nil {
-					return nil, err
-				}
-				err = conn.WritePacket(buffer)
-				if err != nil {
-					return nil, err
-				}
-			}
-
-			conn.Close()
-			return nil, ErrSuccessfullyHandledMOTDRequest
+			return nil, respondStatus(s, conn, buffer, generateMOTD(int(protocol), s, options))
 		}
 	}
 	// else: login
+	if !options.Limiter.AllowLogin(info.IP) {
+		c.(*net.TCPConn).SetLinger(0) //nolint:errcheck
+		return nil, ErrRateLimited
+	}
 
 	// Server bound : Login Start
-	// We only read its packet length and the player name, ignoring the rest part.
+	// We only read its packet length, the player name and the player UUID (if any), ignoring the rest part.
 	// Unread part would be sent to target during the copy stage.
 	// The reason for doing this is that this packet format has been modified many times in the history,
 	// so it would take a lot of code to make it all compatible. So why not just forward it?
@@ -152,17 +314,19 @@ func NewConnHandler(s *config.ConfigProxyService,
 	buffer.Reset(mcprotocol.MaxVarIntLen)
 	loginStartLen, _, err := mcprotocol.ReadVarIntFrom(c)
 	if err != nil {
-		return nil, err
+		return nil, badPacket(err)
 	}
-	_, _, err = mcprotocol.ReadVarIntFrom(c) // skip packet ID
+	_, packetIDLen, err := mcprotocol.ReadVarIntFrom(c) // skip packet ID
 	if err != nil {
-		return nil, err
+		return nil, badPacket(err)
 	}
 	var playerName string
+	var loginStartRest []byte // the part after the player name, if it has been read
+	var playerUUID string
 	{
-		playerNameLen, _, err := mcprotocol.ReadVarIntFrom(c)
+		playerNameLen, playerNameLenLen, err := mcprotocol.ReadVarIntFrom(c)
 		if err != nil {
-			return nil, err
+			return nil, badPacket(err)
 		}
 		if playerNameLen > 16 || playerNameLen <= 0 {
 			return nil, ErrBadPlayerName
@@ -172,32 +336,100 @@ func NewConnHandler(s *config.ConfigProxyService,
 			return nil, err
 		}
 		playerName = string(buffer.Bytes())
+
+		// Since 1.19.3 (761) an optional UUID follows the name,
+		// and since 1.20.2 (764) the UUID is always sent.
+		restLen := int64(loginStartLen) - packetIDLen - playerNameLenLen - int64(playerNameLen)
+		if protocol >= 761 && restLen > 0 && restLen <= 17 {
+			loginStartRest = make([]byte, restLen)
+			if _, err = io.ReadFull(c, loginStartRest); err != nil {
+				return nil, err
+			}
+			playerUUID = parseLoginStartUUID(int(protocol), loginStartRest)
+		}
 	}
 
-	if config.Config.TrafficLimiter.EnableTrafficLimit && !traffic.CheckTrafficLimitByPlayer(s, playerName) {
-        used, limit, percentage := traffic.GetUserTrafficInfoByPlayer(playerName)
-        log.Printf("Service %s : %s Player %s rejected due to traffic limit. Usage: %.2f/%.0f MB (%.1f%%)",
-            s.Name, ctx.ColoredID, playerName, used, limit, percentage)
+	if wrongHostname {
+		if err := kickLogin(c, conn, buffer, generateWrongHostnameMessage(s, playerName, connHostname, info.IP)); err != nil {
+			return nil, err
+		}
+		return nil, ErrRejectedLoginWrongHostname
+	}
 
-        msg, err := generateTrafficLimitExceededMessage(s, playerName).MarshalJSON()
-        if err != nil {
-            return nil, err
-        }
+	if ban := access.CheckBannedPlayer(c.RemoteAddr().(*net.TCPAddr).AddrPort().Addr(), playerName, playerUUID); ban != nil {
+		log.Printf("Service %s : %s Banned player %s rejected: %s %s (%s)",
+			s.Name, ctx.ColoredID, playerName, ban.Type, ban.Value, ban.Reason)
+		if err := kickLogin(c, conn, buffer, generateBanMessage(s, playerName, ban)); err != nil {
+			return nil, err
+		}
+		return nil, ErrRejectedLoginBanned
+	}
 
-        buffer.Reset(mcprotocol.MaxVarIntLen)
-        common.Must0(mcprotocol.WriteToPacket(buffer,
-            byte(0x00), // Client bound : Disconnect (login)
-            mcprotocol.VarInt(len(msg)),
-        ))
-        err = conn.WriteVectorizedPacket(buffer, msg)
-        if err != nil {
-            return nil, err
-        }
+	if s.GeoIPAccess.Mode != access.DefaultMode && s.GeoIPAccess.Action == access.GeoIPActionKick {
+		addr := c.RemoteAddr().(*net.TCPAddr).AddrPort().Addr()
+		if ok, record := access.CheckGeoIP(s, addr); !ok {
+			log.Printf("Service %s : %s Player %s rejected by GeoIP access control: country=%s asn=%d",
+				s.Name, ctx.ColoredID, playerName, record.Country, record.ASN)
+			if err := kickLogin(c, conn, buffer, generateGeoIPKickMessage(s, playerName, addr, record)); err != nil {
+				return nil, err
+			}
+			return nil, ErrRejectedLoginGeoIP
+		}
+	}
+
+	// The ListAPI is asked first, since its decision may override
+	// the traffic limit and the target backend of this player.
+	var (
+		decision    access.ListAPIDecision
+		decisionErr error
+	)
+	if options.Policy.UsesListAPI() {
+		decision, decisionErr = access.QueryListAPI(access.ListAPIRequest{
+			PlayerName: playerName,
+			ClientIP:   c.RemoteAddr().(*net.TCPAddr).IP.String(),
+			Service:    s.Name,
+			Hostname:   connHostname,
+		})
+		if decisionErr != nil {
+			if !errors.Is(decisionErr, access.ErrListAPIUnavailable) {
+				return nil, decisionErr
+			}
+			log.Printf("Service %s : %s Failed to query ListAPI for %s: %v", s.Name, ctx.ColoredID, playerName, decisionErr)
+		}
+	}
 
-        c.(*net.TCPConn).SetLinger(10) //nolint:errcheck
-        c.Close()
-        return nil, ErrTrafficLimitExceeded
-    }
+	trafficIdentity := traffic.Identity(s, traffic.Peer{
+		PlayerName: playerName,
+		Addr:       c.RemoteAddr().(*net.TCPAddr).AddrPort().Addr(),
+	})
+	trafficPlan := traffic.ResolvePlan(s, trafficIdentity)
+	// the limit given by the ListAPI only applies to this connection,
+	// the record of the player keeps the limit of their plan
+	trafficLimitMB := decision.TrafficLimitMB
+	var trafficKey string
+	if config.Config.TrafficLimiter.EnableTrafficLimit {
+		trafficKey = traffic.PrepareAccount(s, trafficIdentity, trafficPlan)
+	}
+
+	if config.Config.TrafficLimiter.EnableTrafficLimit && !traffic.CheckTrafficLimit(trafficKey, trafficLimitMB) {
+		used, limit, percentage, _ := traffic.GetUserTrafficInfo(trafficKey, trafficLimitMB)
+		log.Printf("Service %s : %s Player %s rejected due to traffic limit. Usage: %.2f/%.0f MB (%.1f%%)",
+			s.Name, ctx.ColoredID, playerName, used, limit, percentage)
+		if err := kickLogin(c, conn, buffer, generateTrafficLimitExceededMessage(s, playerName, trafficKey, trafficLimitMB)); err != nil {
+			return nil, err
+		}
+		return nil, ErrTrafficLimitExceeded
+	}
+
+	if config.Config.TrafficLimiter.EnableTrafficLimit && !traffic.CheckPlaytimeLimit(trafficKey) {
+		played, limit, _ := traffic.GetUserPlaytime(trafficKey)
+		log.Printf("Service %s : %s Player %s rejected due to playtime limit. Played: %s/%s",
+			s.Name, ctx.ColoredID, playerName, played.Round(time.Second), limit)
+		if err := kickLogin(c, conn, buffer, generatePlaytimeExceededMessage(s, playerName, trafficKey)); err != nil {
+			return nil, err
+		}
+		return nil, ErrPlaytimeLimitExceeded
+	}
 
 	if s.Minecraft.OnlineCount.EnableMaxLimit && s.Minecraft.OnlineCount.Max <= int(options.OnlineCount.Load()) {
 		log.Printf("Service %s : %s Rejected a new Minecraft player login request due to online player number limit: %s", s.Name, ctx.ColoredID, playerName)
@@ -221,78 +453,86 @@ func NewConnHandler(s *config.ConfigProxyService,
 		return nil, ErrRejectedLoginPlayerNumberLimitExceeded
 	}
 
-		accessibility := "DEFAULT"
-		if access.IsFirstTime(playerName) {
-			accessibility = "NEW" 
-		} else {
-		if s.Minecraft.NameAccess.Mode != access.DefaultMode {
-			hit, err := access.IsWhitelist(playerName)
-			if err != nil {
-				return nil, err
-			}
-			switch s.Minecraft.NameAccess.Mode {
-			case access.AllowMode:
-				if hit {
-					accessibility = "ALLOW"
-				} else {
-					accessibility = "DENY"
-				}
-			case access.BlockMode:
-				if hit {
-					accessibility = "REJECT"
-				} else {
-					accessibility = "PASS"
-				}
-			case access.JokeMode:
-					accessibility = "JOKE"
-			case access.DownMode:
-					accessibility = "DOWN"
-			}
+	accessibility := "DEFAULT"
+	if access.IsFirstTime(s, playerName, info.IP.Unmap().String()) {
+		accessibility = "NEW"
+	} else {
+		info.PlayerName = playerName
+		info.ListAPIHit = decision.Allow && !decision.Expired()
+		info.ListAPIErr = decisionErr
+		ctx.Verdict = options.Policy.Evaluate(info, access.PhaseLogin, true, ctx.Verdict)
+		if rule := ctx.Verdict.Rule; rule != nil {
+			accessibility = rule.Label
 		}
 	}
 
 	log.Printf("Service %s : %s New Minecraft player logged in: %s [%s]", s.Name, ctx.ColoredID, playerName, accessibility)
 	ctx.AttachInfo("PlayerName=" + playerName)
-	if accessibility == "DENY" || accessibility == "REJECT" || accessibility == "NEW" || 
-	   	accessibility == "JOKE" || accessibility == "DOWN" {
-			var msg []byte
-			var err error
-		
-			switch accessibility {
-			case "DENY", "REJECT":
-				msg, err = generateKickMessage(s, playerName).MarshalJSON()
-			case "NEW":
-				msg, err = generateNewMessage(s, playerName).MarshalJSON()
-			case "JOKE":
-				msg, err = generateJokeMessage(s, playerName).MarshalJSON()
-			case "DOWN":
-				msg, err = generateDownMessage(s, playerName).MarshalJSON()
-			}
-		
-			if err != nil {
-				return nil, err
-			}
-		
-			buffer.Reset(mcprotocol.MaxVarIntLen)
-			common.Must0(mcprotocol.WriteToPacket(buffer,
-				byte(0x00), // Client bound : Disconnect (login)
-				mcprotocol.VarInt(len(msg)),
-			))
-			err = conn.WriteVectorizedPacket(buffer, msg)
-			if err != nil {
-				return nil, err
-			}
-
-			c.(*net.TCPConn).SetLinger(10) //nolint:errcheck
+	if accessibility == "NEW" {
+		if err := kickLogin(c, conn, buffer, generateNewMessage(s, playerName)); err != nil {
+			return nil, err
+		}
+		return nil, ErrRejectedLoginFirstJoin
+	}
+	rule := ctx.Verdict.Rule
+	if rule != nil && rule.Action.Type != access.ActionAllow && rule.Action.Type != access.ActionRoute {
+		if rule.Action.Type == access.ActionReset {
+			c.(*net.TCPConn).SetLinger(0) //nolint:errcheck
 			c.Close()
 			return nil, ErrRejectedLoginAccessControl
+		}
+		if err := kickLogin(c, conn, buffer, generateRuleMessage(s, playerName, info.IP, rule, decision.Reason)); err != nil {
+			return nil, err
+		}
+		return nil, ErrRejectedLoginAccessControl
+	}
+
+	releaseBinding, ok := access.ReserveIPBinding(playerName, info.IP)
+	if !ok {
+		log.Printf("Service %s : %s Rejected %s logging in from an address not bound to the player: %s",
+			s.Name, ctx.ColoredID, playerName, info.IP)
+		if err := kickLogin(c, conn, buffer, generateIPBindingMessage(s, playerName, info.IP)); err != nil {
+			return nil, err
+		}
+		return nil, ErrRejectedLoginIPBinding
 	}
-	
-	
-	remote, err := options.Out.Dial("tcp", net.JoinHostPort(s.TargetAddress, strconv.FormatInt(int64(s.TargetPort), 10)))
+
+	endSession, ok, online := access.StartSession(&access.Session{
+		Service:    s.Name,
+		PlayerName: playerName,
+		UUID:       playerUUID,
+		IP:         info.IP,
+	}, func() { c.Close() })
+	if !ok {
+		releaseBinding()
+		log.Printf("Service %s : %s Rejected a duplicate login of %s, %d sessions online", s.Name, ctx.ColoredID, playerName, online)
+		if err := kickLogin(c, conn, buffer, generateDuplicateSessionMessage(s, playerName, info.IP, online)); err != nil {
+			return nil, err
+		}
+		return nil, ErrRejectedLoginDuplicateSession
+	}
+	ctx.OnClose(endSession)
+
+	targetAddress, targetPort := s.TargetAddress, s.TargetPort
+	if decision.Target != "" {
+		host, portStr, _ := net.SplitHostPort(decision.Target) // validated by the ListAPI client
+		if port, err := strconv.ParseUint(portStr, 10, 16); err == nil {
+			targetAddress, targetPort = host, uint16(port)
+			ctx.AttachInfo("Target=" + decision.Target)
+		}
+	}
+	if rule != nil {
+		if host, port, ok := rule.Target(); ok {
+			targetAddress, targetPort = host, port
+			ctx.AttachInfo("Target=" + rule.Action.Target)
+		}
+	}
+	remote, err := options.Out.Dial("tcp", net.JoinHostPort(targetAddress, strconv.FormatInt(int64(targetPort), 10)))
 	if err != nil {
+		// so that failed logins don't take up the addresses of the player
+		releaseBinding()
 		conn.Close()
-		return nil, common.Cause("failed to dial to target server: ", err)
+		return nil, dialError{common.Cause("failed to dial to target server: ", err)}
 	}
 	remoteMC := mcprotocol.StreamConn(remote)
 
@@ -309,7 +549,7 @@ func NewConnHandler(s *config.ConfigProxyService,
 				}
 				return s.Minecraft.RewrittenHostname
 			}(),
-			s.TargetPort,
+			targetPort,
 			byte(2),
 		)
 	} else {
@@ -339,14 +579,27 @@ func NewConnHandler(s *config.ConfigProxyService,
 		return nil, err
 	}
 	mcprotocol.AppendPacketLength(buffer, int(loginStartLen))
+	buffer.Write(loginStartRest) //nolint:errcheck
 	_, err = remote.Write(buffer.Bytes())
 	if err != nil {
 		return nil, err
 	}
 
-    if config.Config.TrafficLimiter.EnableTrafficLimit {
-        return traffic.NewAccurateTrafficMonitorConn(remote, playerName, s), nil
-    }
+	var releaseShapers func()
+	ctx.Upload.Shaper, ctx.Download.Shaper, releaseShapers = traffic.Shapers(s, trafficIdentity, &trafficPlan)
+	ctx.OnClose(releaseShapers)
+
+	// counted by the copy loop, so that the remote is not wrapped and can splice
+	meter := traffic.NewMeter(trafficKey, trafficIdentity, s.Name, trafficLimitMB, func() {
+		c.Close()
+		remote.Close()
+	})
+	ctx.Upload.Meter, ctx.Download.Meter = meter.Upload(), meter.Download()
+	ctx.OnClose(meter.Close)
+	ctx.OnClose(traffic.TrackPlaytime(trafficKey, func() {
+		c.Close()
+		remote.Close()
+	}))
 
 	return remote, nil
 }
@@ -0,0 +1,38 @@
+package minecraft
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/InRaining/NoDelay/common"
+	"github.com/InRaining/NoDelay/service/access"
+)
+
+func TestViolationOf(t *testing.T) {
+	timeout := &net.OpError{Op: "read", Net: "tcp", Err: os.ErrDeadlineExceeded}
+	for _, tt := range []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"none", nil, ""},
+		{"client gone", io.EOF, ""},
+		{"bad packet", badPacket(errors.New("bad VarInt")), access.ViolationMalformedPacket},
+		{"bad player name", ErrBadPlayerName, access.ViolationMalformedPacket},
+		{"banned", ErrRejectedLoginBanned, access.ViolationRejectedLogin},
+		{"access rule", fmt.Errorf("%w %s", ErrRejectedAccessRule, "DENY"), access.ViolationRejectedLogin},
+		{"IP binding", ErrRejectedLoginIPBinding, access.ViolationRejectedLogin},
+		{"traffic limit", ErrTrafficLimitExceeded, ""},
+		{"handshake timeout", timeout, access.ViolationHandshakeTimeout},
+		{"backend down", dialError{common.Cause("failed to dial to target server: ", timeout)}, ""},
+		{"status backend down", dialError{timeout}, ""},
+	} {
+		if got := violationOf(tt.err); got != tt.want {
+			t.Errorf("%s: violation %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
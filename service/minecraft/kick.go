@@ -2,15 +2,27 @@ package minecraft
 
 import (
 	"fmt"
+	"net/netip"
+	"strconv"
 	"time"
 	"strings"
 
 	"github.com/InRaining/NoDelay/common/mcprotocol"
 	"github.com/InRaining/NoDelay/config"
+	"github.com/InRaining/NoDelay/service/access"
 	"github.com/InRaining/NoDelay/service/traffic"
 )
 
-func generateKickMessage(s *config.ConfigProxyService, name string) mcprotocol.Message {
+// generateTemplateMessage fills the placeholders of a configured kick message.
+// replacements are pairs of placeholder and value, as in strings.NewReplacer.
+func generateTemplateMessage(template string, replacements ...string) mcprotocol.Message {
+	return mcprotocol.Message{Text: strings.NewReplacer(replacements...).Replace(template)}
+}
+
+func generateKickMessage(s *config.ConfigProxyService, name string, reason string) mcprotocol.Message {
+	if reason == "" {
+		reason = "你的连接可能未经处理，或者你没有权限加入此服务器。"
+	}
 	return mcprotocol.Message{
 		Color: mcprotocol.White,
 		Extra: []mcprotocol.Message{
@@ -20,7 +32,7 @@ func generateKickMessage(s *config.ConfigProxyService, name string) mcprotocol.M
 
 			{Text: "您无法加入当前服务器！\n"},
 			{Text: "理由: "},
-			{Color: mcprotocol.LightPurple, Text: "你的连接可能未经处理，或者你没有权限加入此服务器。\n"},
+			{Color: mcprotocol.LightPurple, Text: reason + "\n"},
 			{Text: "请联系管理员寻求帮助！\n\n"},
 
 			{
@@ -39,6 +51,69 @@ func generateKickMessage(s *config.ConfigProxyService, name string) mcprotocol.M
 	}
 }
 
+// generateRuleMessage returns the kick message of a matched access rule.
+func generateRuleMessage(s *config.ConfigProxyService, name string, addr netip.Addr, rule *access.CompiledRule, reason string) mcprotocol.Message {
+	if rule.Action.Message != "" {
+		return generateTemplateMessage(rule.Action.Message,
+			"{player}", name,
+			"{ip}", addr.Unmap().String(),
+			"{service}", s.Name,
+			"{rule}", rule.Label,
+		)
+	}
+	switch rule.Action.Type {
+	case access.ActionMaintenance:
+		return generateDownMessage(s, name)
+	case access.ActionJoke:
+		return generateJokeMessage(s, name)
+	case access.ActionRateLimit:
+		return generateKickMessage(s, name, "登录过于频繁，请稍后再试。")
+	default:
+		return generateKickMessage(s, name, reason)
+	}
+}
+
+func generateWrongHostnameMessage(s *config.ConfigProxyService, name, hostname string, addr netip.Addr) mcprotocol.Message {
+	if s.Minecraft.WrongHostnameKickMessage != "" {
+		return generateTemplateMessage(s.Minecraft.WrongHostnameKickMessage,
+			"{player}", name,
+			"{hostname}", hostname,
+			"{ip}", addr.Unmap().String(),
+			"{service}", s.Name,
+		)
+	}
+	return generateKickMessage(s, name, "请使用正确的服务器地址连接。")
+}
+
+func generateDuplicateSessionMessage(s *config.ConfigProxyService, name string, addr netip.Addr, online int) mcprotocol.Message {
+	if settings := config.Config.DuplicateSessions; settings != nil && settings.KickMessage != "" {
+		return generateTemplateMessage(settings.KickMessage,
+			"{player}", name,
+			"{service}", s.Name,
+			"{ip}", addr.Unmap().String(),
+			"{sessions}", strconv.Itoa(online),
+		)
+	}
+	return generateKickMessage(s, name, "该账号已在其他地方登录。")
+}
+
+func generateIPBindingMessage(s *config.ConfigProxyService, name string, addr netip.Addr) mcprotocol.Message {
+	settings := config.Config.IPBinding
+	max := settings.MaxIPs
+	if max <= 0 {
+		max = 3
+	}
+	if settings.KickMessage != "" {
+		return generateTemplateMessage(settings.KickMessage,
+			"{player}", name,
+			"{ip}", addr.Unmap().String(),
+			"{service}", s.Name,
+			"{max}", strconv.Itoa(max),
+		)
+	}
+	return generateKickMessage(s, name, fmt.Sprintf("该账号最多只能在%d个地址登录，请联系管理员重置。", max))
+}
+
 func generatePlayerNumberLimitExceededMessage(s *config.ConfigProxyService, name string) mcprotocol.Message {
 	return mcprotocol.Message{
 		Color: mcprotocol.White,
@@ -140,8 +215,9 @@ func generateDownMessage(s *config.ConfigProxyService, name string) mcprotocol.M
 	}
 }
 
-func generateTrafficLimitExceededMessage(s *config.ConfigProxyService, name string) mcprotocol.Message {
-    used, limit, percentage := traffic.GetUserTrafficInfoByPlayer(name)
+func generateTrafficLimitExceededMessage(s *config.ConfigProxyService, name, key string, limitMB int64) mcprotocol.Message {
+    used, limit, percentage, nextReset := traffic.GetUserTrafficInfo(key, limitMB)
+    balance, prepaid := traffic.GetUserBalance(key)
 
     if config.Config.TrafficLimiter.TrafficLimitKickMessage != "" {
         message := config.Config.TrafficLimiter.TrafficLimitKickMessage
@@ -149,25 +225,40 @@ func generateTrafficLimitExceededMessage(s *config.ConfigProxyService, name stri
         message = strings.ReplaceAll(message, "{used}", fmt.Sprintf("%.2f", used))
         message = strings.ReplaceAll(message, "{limit}", fmt.Sprintf("%.0f", limit))
         message = strings.ReplaceAll(message, "{percentage}", fmt.Sprintf("%.1f", percentage))
+        message = strings.ReplaceAll(message, "{reset}", formatResetTime(nextReset))
+        message = strings.ReplaceAll(message, "{balance}", fmt.Sprintf("%.2f", balance))
         return mcprotocol.Message{Text: message}
     }
 
+    usage := []mcprotocol.Message{
+            {Color: mcprotocol.Gray, Text: "已使用: "},
+            {Color: mcprotocol.Yellow, Text: fmt.Sprintf("%.2f MB ", used)},
+            {Color: mcprotocol.Gray, Text: "/ "},
+            {Color: mcprotocol.Green, Text: fmt.Sprintf("%.0f MB ", limit)},
+            {Color: mcprotocol.White, Text: fmt.Sprintf("(%.1f%%)\n", percentage)},
+            {Color: mcprotocol.Gray, Text: "重置时间: "},
+            {Color: mcprotocol.Yellow, Text: formatResetTime(nextReset) + "\n"},
+    }
+    reason := "流量已耗尽！\n"
+    if prepaid {
+        reason = "流量余额不足！\n"
+        usage = []mcprotocol.Message{
+            {Color: mcprotocol.Gray, Text: "剩余余额: "},
+            {Color: mcprotocol.Yellow, Text: fmt.Sprintf("%.2f MB\n", balance)},
+        }
+    }
+
     return mcprotocol.Message{
         Color: mcprotocol.White,
-        Extra: []mcprotocol.Message{
+        Extra: append(append([]mcprotocol.Message{
 			{Bold: true, Color: mcprotocol.Yellow, Text: fmt.Sprintf("%s", config.Config.Configuration.Header)},
 			{Text: " ‖ "},
 			{Bold: true, Color: mcprotocol.Gold, Text: "已拒绝服务\n"},
 
 			{Text: "您无法加入当前服务器！\n"},
 			{Text: "理由: "},
-			{Color: mcprotocol.LightPurple, Text: "流量已耗尽！\n"},
-
-            {Color: mcprotocol.Gray, Text: "已使用: "},
-            {Color: mcprotocol.Yellow, Text: fmt.Sprintf("%.2f MB ", used)},
-            {Color: mcprotocol.Gray, Text: "/ "},
-            {Color: mcprotocol.Green, Text: fmt.Sprintf("%.0f MB ", limit)},
-            {Color: mcprotocol.White, Text: fmt.Sprintf("(%.1f%%)\n", percentage)},
+			{Color: mcprotocol.LightPurple, Text: reason},
+        }, usage...), []mcprotocol.Message{
 			{Text: "请联系管理员寻求帮助！\n\n"},
 			{
 				Color: mcprotocol.Gray,
@@ -181,6 +272,133 @@ func generateTrafficLimitExceededMessage(s *config.ConfigProxyService, name stri
 				Text: fmt.Sprintf("%s", config.Config.Configuration.ContactLink),
 				// ClickEvent: chat.OpenURL("http://qm.qq.com/cgi-bin/qm/qr?_wv=1027&k=eV_W6FV6hkjbeA35MNJ2lulA7M67JMig&authKey=E5hHr6NTSJ9u9z7eurOavBW9U6tE94P1EazZSGMGV71LCjsfvgMt0kXRaXyaDF4d&noverify=0&group_code=666259678"),
 			},
-        },
+        }...),
     }
 }
+
+func generatePlaytimeExceededMessage(s *config.ConfigProxyService, name, key string) mcprotocol.Message {
+	played, limit, nextReset := traffic.GetUserPlaytime(key)
+	remaining := limit - played
+	if remaining < 0 {
+		remaining = 0
+	}
+
+	if config.Config.TrafficLimiter.PlaytimeKickMessage != "" {
+		return generateTemplateMessage(config.Config.TrafficLimiter.PlaytimeKickMessage,
+			"{player}", name,
+			"{playtime}", formatRemaining(played),
+			"{limit}", formatRemaining(limit),
+			"{remaining}", formatRemaining(remaining),
+			"{reset}", formatResetTime(nextReset),
+		)
+	}
+
+	return mcprotocol.Message{
+		Color: mcprotocol.White,
+		Extra: []mcprotocol.Message{
+			{Bold: true, Color: mcprotocol.Yellow, Text: fmt.Sprintf("%s", config.Config.Configuration.Header)},
+			{Text: " ‖ "},
+			{Bold: true, Color: mcprotocol.Gold, Text: "已拒绝服务\n"},
+
+			{Text: "您无法加入当前服务器！\n"},
+			{Text: "理由: "},
+			{Color: mcprotocol.LightPurple, Text: "游戏时长已用完！\n"},
+			{Color: mcprotocol.Gray, Text: "已游玩: "},
+			{Color: mcprotocol.Yellow, Text: formatRemaining(played) + " "},
+			{Color: mcprotocol.Gray, Text: "/ "},
+			{Color: mcprotocol.Green, Text: formatRemaining(limit) + "\n"},
+			{Color: mcprotocol.Gray, Text: "剩余时长: "},
+			{Color: mcprotocol.Yellow, Text: formatRemaining(remaining) + "\n"},
+			{Color: mcprotocol.Gray, Text: "重置时间: "},
+			{Color: mcprotocol.Yellow, Text: formatResetTime(nextReset) + "\n"},
+			{Text: "请联系管理员寻求帮助！\n\n"},
+			{
+				Color: mcprotocol.Gray,
+				Text: fmt.Sprintf("时间戳: %d | 玩家名称: %s | 服务节点: %s\n",
+					time.Now().UnixMilli(), name, s.Name),
+			},
+			{Text: fmt.Sprintf("%s", config.Config.Configuration.ContactName)},
+			{Text: ":"},
+			{
+				Color: mcprotocol.Blue, UnderLined: true,
+				Text: fmt.Sprintf("%s", config.Config.Configuration.ContactLink),
+			},
+		},
+	}
+}
+
+func generateGeoIPKickMessage(s *config.ConfigProxyService, name string, addr netip.Addr, record access.GeoIPRecord) mcprotocol.Message {
+	if s.GeoIPAccess.KickMessage != "" {
+		return generateTemplateMessage(s.GeoIPAccess.KickMessage,
+			"{player}", name,
+			"{ip}", addr.Unmap().String(),
+			"{country}", record.Country,
+			"{asn}", strconv.FormatUint(uint64(record.ASN), 10),
+			"{service}", s.Name,
+		)
+	}
+	return generateKickMessage(s, name, "你所在的地区或网络无法使用此服务。")
+}
+
+// formatResetTime formats the next traffic reset for kick messages.
+func formatResetTime(t time.Time) string {
+	if t.IsZero() {
+		return "不重置"
+	}
+	return t.Format("2006-01-02 15:04 MST")
+}
+
+// formatRemaining formats a duration for kick messages.
+func formatRemaining(d time.Duration) string {
+	if d < 0 {
+		return "永久"
+	}
+	d = d.Round(time.Minute)
+	days := d / (24 * time.Hour)
+	d -= days * 24 * time.Hour
+	hours := d / time.Hour
+	d -= hours * time.Hour
+	minutes := d / time.Minute
+	switch {
+	case days > 0:
+		return fmt.Sprintf("%d天%d小时%d分钟", days, hours, minutes)
+	case hours > 0:
+		return fmt.Sprintf("%d小时%d分钟", hours, minutes)
+	default:
+		return fmt.Sprintf("%d分钟", minutes)
+	}
+}
+
+func generateBanMessage(s *config.ConfigProxyService, name string, ban *access.Ban) mcprotocol.Message {
+	reason := ban.Reason
+	if reason == "" {
+		reason = "你已被封禁。"
+	}
+	return mcprotocol.Message{
+		Color: mcprotocol.White,
+		Extra: []mcprotocol.Message{
+			{Bold: true, Color: mcprotocol.Yellow, Text: fmt.Sprintf("%s", config.Config.Configuration.Header)},
+			{Text: " ‖ "},
+			{Bold: true, Color: mcprotocol.Red, Text: "已拒绝服务\n"},
+
+			{Text: "你已被禁止加入当前服务器！\n"},
+			{Text: "理由: "},
+			{Color: mcprotocol.LightPurple, Text: reason + "\n"},
+			{Text: "剩余时间: "},
+			{Color: mcprotocol.Yellow, Text: formatRemaining(ban.Remaining()) + "\n"},
+			{Text: "如有异议请联系管理员！\n\n"},
+
+			{
+				Color: mcprotocol.Gray,
+				Text: fmt.Sprintf("时间戳: %d | 玩家名称: %s | 服务节点: %s\n",
+					time.Now().UnixMilli(), name, s.Name),
+			},
+			{Text: fmt.Sprintf("%s", config.Config.Configuration.ContactName)},
+			{Text: ":"},
+			{
+				Color: mcprotocol.Blue, UnderLined: true,
+				Text: fmt.Sprintf("%s", config.Config.Configuration.ContactLink),
+			},
+		},
+	}
+}
@@ -25,6 +25,19 @@ type motdObject struct {
 }
 
 func generateMOTD(protocolVersion int, s *config.ConfigProxyService, options *transfer.Options) []byte {
+	return buildMOTD(protocolVersion, s, options, s.Minecraft.MotdDescription)
+}
+
+// generateWrongHostnameMOTD is shown to clients listing the server with a hostname that isn't allowed.
+func generateWrongHostnameMOTD(protocolVersion int, s *config.ConfigProxyService, options *transfer.Options) []byte {
+	description := s.Minecraft.WrongHostnameMotd
+	if description == "" {
+		description = "请使用正确的服务器地址连接"
+	}
+	return buildMOTD(protocolVersion, s, options, description)
+}
+
+func buildMOTD(protocolVersion int, s *config.ConfigProxyService, options *transfer.Options, description string) []byte {
 	online := s.Minecraft.OnlineCount.Online
 	if online < 0 {
 		online = options.OnlineCount.Load()
@@ -50,7 +63,7 @@ func generateMOTD(protocolVersion int, s *config.ConfigProxyService, options *tr
 		Description: struct {
 			Text string `json:"text"`
 		}{
-			Text: s.Minecraft.MotdDescription,
+			Text: description,
 		},
 		Favicon: s.Minecraft.MotdFavicon,
 	})
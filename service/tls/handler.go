@@ -12,22 +12,25 @@ import (
 	"github.com/InRaining/NoDelay/service/access"
 )
 
+// NewConnHandler sniffs the server name of a TLS connection and dials the
+// server it goes to. domain is empty for non-TLS connections.
 func NewConnHandler(s *config.ConfigProxyService,
 	c net.Conn,
 	out outbound.Outbound,
-) (net.Conn, error) {
+) (remote net.Conn, domain string, err error) {
 	header, buf, err := SniffAndRecordTLS(c)
 	if err != nil {
 		if err == ErrNotTLS {
 			if s.TLSSniffing.RejectNonTLS {
 				buf.Reset()
-				return nil, err
+				return nil, "", err
 			}
-			return dialAndWrite(s, buf, out)
+			remote, err = dialAndWrite(s, buf, out)
+			return remote, "", err
 		}
-		return nil, err
+		return nil, "", err
 	}
-	domain := header.Domain()
+	domain = header.Domain()
 	hit := false
 	for _, list := range s.TLSSniffing.SNIAllowListTags {
 		if hit = common.Must(access.GetTargetList(list)).Has(domain); hit {
@@ -37,20 +40,21 @@ func NewConnHandler(s *config.ConfigProxyService,
 	if !hit {
 		if s.TLSSniffing.RejectIfNonMatch {
 			buf.Reset()
-			return nil, errors.New("")
+			return nil, domain, errors.New("")
 		}
-		return dialAndWrite(s, buf, out)
+		remote, err = dialAndWrite(s, buf, out)
+		return remote, domain, err
 	}
 	defer buf.Reset()
-	remote, err := out.Dial("tcp", net.JoinHostPort(domain, strconv.FormatInt(int64(s.TargetPort), 10)))
+	remote, err = out.Dial("tcp", net.JoinHostPort(domain, strconv.FormatInt(int64(s.TargetPort), 10)))
 	if err != nil {
-		return nil, err
+		return nil, domain, err
 	}
 	_, err = buf.WriteTo(remote)
 	if err != nil {
-		return nil, err
+		return nil, domain, err
 	}
-	return remote, nil
+	return remote, domain, nil
 }
 
 func dialAndWrite(s *config.ConfigProxyService, buffer *bytes.Buffer, out outbound.Outbound) (net.Conn, error) {
@@ -0,0 +1,458 @@
+package traffic
+
+import (
+    "encoding/csv"
+    "encoding/json"
+    "errors"
+    "flag"
+    "fmt"
+    "io"
+    "sort"
+    "strconv"
+    "strings"
+    "text/tabwriter"
+    "time"
+
+    "github.com/InRaining/NoDelay/service/access"
+)
+
+// CommandUsage describes the admin commands run by RunCommand.
+const CommandUsage = `Usage: NoDelay traffic <command> [arguments]
+
+Commands:
+  list                                  list the accounts and their usage
+  show <account>                        show the record of an account
+  set-limit <account> <MB>              override the traffic limit of an account
+  reset <account> | --all               reset the usage of an account or of all
+  cleanup --older-than <age>            remove the accounts not seen for age, e.g. 30d or 12h
+  export [--format json|csv]            write all the records
+  topup [--expires <date>] <account> <MB> <reference>
+                                        add to the balance of a prepaid account
+  binding reset <player>                remove the IP bindings of a player
+  ban list                              list the bans in effect
+  ban add [--reason <text>] [--for <age> | --expires <date>] name|uuid|ip <value>
+                                        ban a player name, UUID, or IP or CIDR
+  ban remove name|uuid|ip <value>       lift a ban
+  history [--player <account>] [--service <name>] [--from <time>] [--to <time>]
+          [--resolution hourly|daily] [--format json|csv]
+                                        write the traffic history by hour or by day
+`
+
+// ErrUsage is returned by RunCommand for bad commands and arguments.
+var ErrUsage = errors.New("bad command, see 'NoDelay traffic help'")
+
+// ReadOnlyCommand reports whether the admin command of args leaves the traffic data as is.
+func ReadOnlyCommand(args []string) bool {
+    if len(args) == 0 {
+        return true
+    }
+    switch args[0] {
+    case "help", "-h", "--help", "list", "show", "export", "binding", "ban", "history":
+        return true
+    }
+    return false
+}
+
+// RunCommand runs an admin command on a limiter, writing its output to w.
+func RunCommand(limiter TrafficLimiterInterface, args []string, w io.Writer) error {
+    if len(args) == 0 {
+        fmt.Fprint(w, CommandUsage)
+        return ErrUsage
+    }
+    flags := flag.NewFlagSet(args[0], flag.ContinueOnError)
+    flags.SetOutput(w)
+
+    switch args[0] {
+    case "help", "-h", "--help":
+        fmt.Fprint(w, CommandUsage)
+        return nil
+
+    case "list":
+        if err := flags.Parse(args[1:]); err != nil || flags.NArg() != 0 {
+            return ErrUsage
+        }
+        return listAccounts(limiter, w)
+
+    case "show":
+        if err := flags.Parse(args[1:]); err != nil || flags.NArg() != 1 {
+            return ErrUsage
+        }
+        return showAccount(limiter, flags.Arg(0), w)
+
+    case "set-limit":
+        if err := flags.Parse(args[1:]); err != nil || flags.NArg() != 2 {
+            return ErrUsage
+        }
+        limitMB, err := strconv.ParseInt(flags.Arg(1), 10, 64)
+        if err != nil || limitMB <= 0 {
+            return fmt.Errorf("bad limit '%s'", flags.Arg(1))
+        }
+        limiter.SetUserLimit(flags.Arg(0), limitMB)
+        fmt.Fprintf(w, "Set the traffic limit of %s to %d MB.\n", flags.Arg(0), limitMB)
+        return nil
+
+    case "reset":
+        all := flags.Bool("all", false, "reset all the accounts")
+        if err := flags.Parse(args[1:]); err != nil || *all == (flags.NArg() == 1) || flags.NArg() > 1 {
+            return ErrUsage
+        }
+        if !*all {
+            if !limiter.ResetUserTraffic(flags.Arg(0)) {
+                return fmt.Errorf("no account %s", flags.Arg(0))
+            }
+            fmt.Fprintf(w, "Reset the traffic of %s.\n", flags.Arg(0))
+            return nil
+        }
+        count := 0
+        for key := range limiter.GetAllUsersStats() {
+            if limiter.ResetUserTraffic(key) {
+                count++
+            }
+        }
+        fmt.Fprintf(w, "Reset the traffic of %d accounts.\n", count)
+        return nil
+
+    case "cleanup":
+        olderThan := flags.String("older-than", "", "age of the accounts to remove, e.g. 30d or 12h")
+        if err := flags.Parse(args[1:]); err != nil || flags.NArg() != 0 || *olderThan == "" {
+            return ErrUsage
+        }
+        age, err := parseAge(*olderThan)
+        if err != nil {
+            return err
+        }
+        before := len(limiter.GetAllUsersStats())
+        limiter.CleanupOldData(time.Now().Add(-age).Unix())
+        fmt.Fprintf(w, "Removed %d accounts not seen for %s.\n", before-len(limiter.GetAllUsersStats()), *olderThan)
+        return nil
+
+    case "export":
+        format := flags.String("format", "json", "'json' or 'csv'")
+        if err := flags.Parse(args[1:]); err != nil || flags.NArg() != 0 {
+            return ErrUsage
+        }
+        switch *format {
+        case "json":
+            encoder := json.NewEncoder(w)
+            encoder.SetIndent("", "  ")
+            return encoder.Encode(limiter.GetAllUsersStats())
+        case "csv":
+            return writeAccountsCSV(limiter.GetAllUsersStats(), w)
+        default:
+            return fmt.Errorf("unknown format '%s'", *format)
+        }
+
+    case "topup":
+        expires := flags.String("expires", "", "expiry of the credit: unix time, RFC 3339 or a date")
+        if err := flags.Parse(args[1:]); err != nil || flags.NArg() != 3 {
+            return ErrUsage
+        }
+        amountMB, err := strconv.ParseInt(flags.Arg(1), 10, 64)
+        if err != nil {
+            return fmt.Errorf("bad amount '%s'", flags.Arg(1))
+        }
+        expiry, err := ParseHistoryTime(*expires)
+        if err != nil {
+            return fmt.Errorf("bad expiry '%s'", *expires)
+        }
+        if err := limiter.TopUp(flags.Arg(0), amountMB, flags.Arg(2), expiry); err != nil {
+            return err
+        }
+        balance, _ := limiter.GetBalance(flags.Arg(0))
+        fmt.Fprintf(w, "Topped up %d MB for %s, balance %.2f MB.\n", amountMB, flags.Arg(0), balance)
+        return nil
+
+    case "binding":
+        if err := flags.Parse(args[1:]); err != nil || flags.NArg() != 2 || flags.Arg(0) != "reset" {
+            return ErrUsage
+        }
+        store := access.GetGlobalIPBindingStore()
+        if store == nil {
+            return errors.New("IP bindings are not loaded")
+        }
+        if !store.Reset(flags.Arg(1)) {
+            return fmt.Errorf("no IP bindings of %s", flags.Arg(1))
+        }
+        fmt.Fprintf(w, "Removed the IP bindings of %s.\n", flags.Arg(1))
+        return nil
+
+    case "ban":
+        return runBanCommand(args[1:], w)
+
+    case "history":
+        player := flags.String("player", "", "only the traffic of this account")
+        service := flags.String("service", "", "only the traffic on this service")
+        from := flags.String("from", "", "start: unix time, RFC 3339 or a date")
+        to := flags.String("to", "", "end, excluded: unix time, RFC 3339 or a date")
+        resolution := flags.String("resolution", ResolutionHourly, "'hourly' or 'daily'")
+        format := flags.String("format", "json", "'json' or 'csv'")
+        if err := flags.Parse(args[1:]); err != nil || flags.NArg() != 0 {
+            return ErrUsage
+        }
+        if *resolution != ResolutionHourly && *resolution != ResolutionDaily {
+            return fmt.Errorf("unknown resolution '%s'", *resolution)
+        }
+        fromTime, err := ParseHistoryTime(*from)
+        if err != nil {
+            return fmt.Errorf("bad start '%s'", *from)
+        }
+        toTime, err := ParseHistoryTime(*to)
+        if err != nil {
+            return fmt.Errorf("bad end '%s'", *to)
+        }
+        history := GetGlobalHistory()
+        if history == nil {
+            return errors.New("the traffic history is not loaded")
+        }
+        points := history.Query(HistoryQuery{
+            Player:     *player,
+            Service:    *service,
+            From:       fromTime,
+            To:         toTime,
+            Resolution: *resolution,
+        })
+        switch *format {
+        case "json":
+            return WriteHistoryJSON(w, points)
+        case "csv":
+            return WriteHistoryCSV(w, points)
+        default:
+            return fmt.Errorf("unknown format '%s'", *format)
+        }
+    }
+    return ErrUsage
+}
+
+// runBanCommand runs the ban subcommands on the global ban store.
+func runBanCommand(args []string, w io.Writer) error {
+    if len(args) == 0 {
+        return ErrUsage
+    }
+    flags := flag.NewFlagSet("ban "+args[0], flag.ContinueOnError)
+    flags.SetOutput(w)
+    store := access.GetGlobalBanStore()
+
+    switch args[0] {
+    case "list":
+        if err := flags.Parse(args[1:]); err != nil || flags.NArg() != 0 {
+            return ErrUsage
+        }
+        if store == nil {
+            return errors.New("bans are not loaded")
+        }
+        return listBans(store.List(), w)
+
+    case "add":
+        reason := flags.String("reason", "", "reason shown to the player")
+        duration := flags.String("for", "", "length of the ban, e.g. 7d or 12h")
+        expires := flags.String("expires", "", "end of the ban: unix time, RFC 3339 or a date")
+        if err := flags.Parse(args[1:]); err != nil || flags.NArg() != 2 || (*duration != "" && *expires != "") {
+            return ErrUsage
+        }
+        ban := access.Ban{Type: flags.Arg(0), Value: flags.Arg(1), Reason: *reason, Issuer: "console"}
+        if *duration != "" {
+            age, err := parseAge(*duration)
+            if err != nil || age == 0 {
+                return fmt.Errorf("bad length '%s'", *duration)
+            }
+            ban.Expires = time.Now().Add(age).Unix()
+        }
+        if *expires != "" {
+            expiry, err := ParseHistoryTime(*expires)
+            if err != nil || !expiry.After(time.Now()) {
+                return fmt.Errorf("bad expiry '%s'", *expires)
+            }
+            ban.Expires = expiry.Unix()
+        }
+        if store == nil {
+            return errors.New("bans are not loaded")
+        }
+        if err := store.Add(ban); err != nil {
+            return err
+        }
+        if ban.Expires == 0 {
+            fmt.Fprintf(w, "Banned %s %s permanently.\n", flags.Arg(0), flags.Arg(1))
+        } else {
+            fmt.Fprintf(w, "Banned %s %s until %s.\n", flags.Arg(0), flags.Arg(1),
+                time.Unix(ban.Expires, 0).In(location()).Format("2006-01-02 15:04:05"))
+        }
+        return nil
+
+    case "remove":
+        if err := flags.Parse(args[1:]); err != nil || flags.NArg() != 2 {
+            return ErrUsage
+        }
+        if store == nil {
+            return errors.New("bans are not loaded")
+        }
+        if !store.Remove(flags.Arg(0), flags.Arg(1)) {
+            return fmt.Errorf("no ban of %s %s", flags.Arg(0), flags.Arg(1))
+        }
+        fmt.Fprintf(w, "Lifted the ban of %s %s.\n", flags.Arg(0), flags.Arg(1))
+        return nil
+    }
+    return ErrUsage
+}
+
+func listBans(bans []access.Ban, w io.Writer) error {
+    sort.Slice(bans, func(i, j int) bool {
+        if bans[i].Type != bans[j].Type {
+            return bans[i].Type < bans[j].Type
+        }
+        return bans[i].Value < bans[j].Value
+    })
+    tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+    fmt.Fprintln(tw, "TYPE\tVALUE\tUNTIL\tISSUER\tREASON")
+    for _, ban := range bans {
+        until := "permanent"
+        if ban.Expires != 0 {
+            until = time.Unix(ban.Expires, 0).In(location()).Format("2006-01-02 15:04:05")
+        }
+        fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", ban.Type, ban.Value, until, ban.Issuer, ban.Reason)
+    }
+    return tw.Flush()
+}
+
+// parseAge parses a duration, which may be given in days such as "30d".
+func parseAge(s string) (time.Duration, error) {
+    if strings.HasSuffix(s, "d") {
+        n, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+        if err != nil || n < 0 {
+            return 0, fmt.Errorf("bad age '%s'", s)
+        }
+        return time.Duration(n) * 24 * time.Hour, nil
+    }
+    age, err := time.ParseDuration(s)
+    if err != nil || age < 0 {
+        return 0, fmt.Errorf("bad age '%s'", s)
+    }
+    return age, nil
+}
+
+func sortedKeys(stats map[string]UserTrafficData) []string {
+    keys := make([]string, 0, len(stats))
+    for key := range stats {
+        keys = append(keys, key)
+    }
+    sort.Strings(keys)
+    return keys
+}
+
+func formatLimit(limiter TrafficLimiterInterface, key string, userData UserTrafficData, limit float64) string {
+    if userData.Unlimited {
+        return "unlimited"
+    }
+    if balance, prepaid := limiter.GetBalance(key); prepaid {
+        return fmt.Sprintf("%.0f MB left", balance)
+    }
+    return fmt.Sprintf("%.0f MB", limit)
+}
+
+func listAccounts(limiter TrafficLimiterInterface, w io.Writer) error {
+    stats := limiter.GetAllUsersStats()
+    tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+    fmt.Fprintln(tw, "ACCOUNT\tPLAN\tUPLOAD\tDOWNLOAD\tTOTAL\tLIMIT\tUSAGE\tPLAYTIME\tLAST SEEN")
+    for _, key := range sortedKeys(stats) {
+        userData := stats[key]
+        _, limit, percentage, _ := limiter.GetUserInfo(key, 0)
+        plan := userData.Plan
+        if plan == "" {
+            plan = DefaultPlanName
+        }
+        fmt.Fprintf(tw, "%s\t%s\t%.2f MB\t%.2f MB\t%.2f MB\t%s\t%.1f%%\t%dm\t%s\n",
+            key, plan,
+            float64(userData.UploadBytes)/(1024*1024),
+            float64(userData.DownloadBytes)/(1024*1024),
+            float64(userData.UsedBytes)/(1024*1024),
+            formatLimit(limiter, key, userData, limit), percentage,
+            userData.PlaytimeSeconds/60,
+            formatUnix(userData.LastSeen))
+    }
+    return tw.Flush()
+}
+
+func showAccount(limiter TrafficLimiterInterface, key string, w io.Writer) error {
+    userData, exists := limiter.GetAllUsersStats()[key]
+    if !exists {
+        return fmt.Errorf("no account %s", key)
+    }
+    used, limit, percentage, nextReset := limiter.GetUserInfo(key, 0)
+    played, playtimeLimit, _ := limiter.GetPlaytime(key)
+
+    tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+    fmt.Fprintf(tw, "Account:\t%s\n", key)
+    fmt.Fprintf(tw, "Player:\t%s\n", userData.PlayerName)
+    if userData.Service != "" {
+        fmt.Fprintf(tw, "Service:\t%s\n", userData.Service)
+    }
+    plan := userData.Plan
+    if plan == "" {
+        plan = DefaultPlanName
+    }
+    fmt.Fprintf(tw, "Plan:\t%s\n", plan)
+    fmt.Fprintf(tw, "Upload:\t%.2f MB\n", float64(userData.UploadBytes)/(1024*1024))
+    fmt.Fprintf(tw, "Download:\t%.2f MB\n", float64(userData.DownloadBytes)/(1024*1024))
+    fmt.Fprintf(tw, "Total:\t%.2f MB\n", float64(userData.UsedBytes)/(1024*1024))
+    fmt.Fprintf(tw, "Limit:\t%s\n", formatLimit(limiter, key, userData, limit))
+    if userData.CustomLimit {
+        fmt.Fprintf(tw, "Custom limit:\tyes\n")
+    }
+    fmt.Fprintf(tw, "Usage:\t%.2f MB (%.1f%%)\n", used, percentage)
+    if playtimeLimit > 0 {
+        fmt.Fprintf(tw, "Playtime:\t%s / %s\n", played.Round(time.Second), playtimeLimit)
+    } else {
+        fmt.Fprintf(tw, "Playtime:\t%s\n", played.Round(time.Second))
+    }
+    fmt.Fprintf(tw, "Last reset:\t%s\n", formatUnix(userData.LastResetTime))
+    if nextReset.IsZero() {
+        fmt.Fprintf(tw, "Next reset:\tnever\n")
+    } else {
+        fmt.Fprintf(tw, "Next reset:\t%s\n", nextReset.Format("2006-01-02 15:04 MST"))
+    }
+    fmt.Fprintf(tw, "Last seen:\t%s\n", formatUnix(userData.LastSeen))
+    for _, credit := range userData.Credits {
+        expires := "never"
+        if credit.Expires != 0 {
+            expires = formatUnix(credit.Expires)
+        }
+        fmt.Fprintf(tw, "Credit %s:\t%.2f / %.2f MB, %s, expires %s\n", credit.Reference,
+            float64(credit.RemainingBytes)/(1024*1024), float64(credit.AmountBytes)/(1024*1024),
+            formatUnix(credit.Time), expires)
+    }
+    return tw.Flush()
+}
+
+func writeAccountsCSV(stats map[string]UserTrafficData, w io.Writer) error {
+    writer := csv.NewWriter(w)
+    writer.Write([]string{"account", "player", "service", "plan", "upload_bytes", "download_bytes", "used_bytes", //nolint:errcheck
+        "limit_mb", "upload_limit_mb", "download_limit_mb", "unlimited", "prepaid", "playtime_seconds", "last_reset", "last_seen"})
+    for _, key := range sortedKeys(stats) {
+        u := stats[key]
+        writer.Write([]string{ //nolint:errcheck
+            key,
+            u.PlayerName,
+            u.Service,
+            u.Plan,
+            strconv.FormatInt(u.UploadBytes, 10),
+            strconv.FormatInt(u.DownloadBytes, 10),
+            strconv.FormatInt(u.UsedBytes, 10),
+            strconv.FormatInt(u.LimitMB, 10),
+            strconv.FormatInt(u.UploadLimitMB, 10),
+            strconv.FormatInt(u.DownloadLimitMB, 10),
+            strconv.FormatBool(u.Unlimited),
+            strconv.FormatBool(u.Prepaid),
+            strconv.FormatInt(u.PlaytimeSeconds, 10),
+            strconv.FormatInt(u.LastResetTime, 10),
+            strconv.FormatInt(u.LastSeen, 10),
+        })
+    }
+    writer.Flush()
+    return writer.Error()
+}
+
+func formatUnix(unix int64) string {
+    if unix == 0 {
+        return "-"
+    }
+    return time.Unix(unix, 0).In(location()).Format("2006-01-02 15:04")
+}
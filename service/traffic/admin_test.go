@@ -0,0 +1,244 @@
+package traffic
+
+import (
+    "bytes"
+    "errors"
+    "net/netip"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/InRaining/NoDelay/service/access"
+)
+
+// errAny stands for any error but ErrUsage in the tests of RunCommand.
+var errAny = errors.New("any error")
+
+func TestRunCommand(t *testing.T) {
+    for _, tt := range []struct {
+        name    string
+        args    []string
+        wantErr error // ErrUsage, or errAny for another error
+        want    string
+    }{
+        {name: "no command", wantErr: ErrUsage, want: "Usage:"},
+        {name: "unknown command", args: []string{"delete", "Steve"}, wantErr: ErrUsage},
+        {name: "help", args: []string{"help"}, want: "Usage:"},
+        {name: "list", args: []string{"list"}, want: "Steve"},
+        {name: "list with an argument", args: []string{"list", "Steve"}, wantErr: ErrUsage},
+        {name: "unknown flag", args: []string{"list", "--all"}, wantErr: ErrUsage},
+        {name: "show", args: []string{"show", "Steve"}, want: "Steve"},
+        {name: "show without an account", args: []string{"show"}, wantErr: ErrUsage},
+        {name: "show an unknown account", args: []string{"show", "Alex"}, wantErr: errAny},
+        {name: "set-limit", args: []string{"set-limit", "Steve", "2048"}, want: "to 2048 MB"},
+        {name: "set-limit without a limit", args: []string{"set-limit", "Steve"}, wantErr: ErrUsage},
+        {name: "set-limit not a number", args: []string{"set-limit", "Steve", "lots"}, wantErr: errAny},
+        {name: "set-limit of zero", args: []string{"set-limit", "Steve", "0"}, wantErr: errAny},
+        {name: "reset an account", args: []string{"reset", "Steve"}, want: "Reset the traffic of Steve"},
+        {name: "reset all", args: []string{"reset", "--all"}, want: "of 1 accounts"},
+        {name: "reset neither", args: []string{"reset"}, wantErr: ErrUsage},
+        {name: "reset both", args: []string{"reset", "--all", "Steve"}, wantErr: ErrUsage},
+        {name: "reset two accounts", args: []string{"reset", "Steve", "Alex"}, wantErr: ErrUsage},
+        {name: "reset an unknown account", args: []string{"reset", "Alex"}, wantErr: errAny},
+        {name: "cleanup in days", args: []string{"cleanup", "--older-than", "30d"}, want: "Removed 0 accounts"},
+        {name: "cleanup in hours", args: []string{"cleanup", "--older-than=12h"}, want: "Removed 0 accounts"},
+        {name: "cleanup without an age", args: []string{"cleanup"}, wantErr: ErrUsage},
+        {name: "cleanup with a bad age", args: []string{"cleanup", "--older-than", "a month"}, wantErr: errAny},
+        {name: "cleanup with a negative age", args: []string{"cleanup", "--older-than", "-1d"}, wantErr: errAny},
+        {name: "export", args: []string{"export"}, want: `"Steve"`},
+        {name: "export csv", args: []string{"export", "--format", "csv"}, want: "Steve,"},
+        {name: "export xml", args: []string{"export", "--format", "xml"}, wantErr: errAny},
+        {name: "topup without a reference", args: []string{"topup", "Steve", "100"}, wantErr: ErrUsage},
+        {name: "topup not a number", args: []string{"topup", "Steve", "lots", "order-1"}, wantErr: errAny},
+        {name: "topup with a bad expiry", args: []string{"topup", "--expires", "soon", "Steve", "100", "order-1"}, wantErr: errAny},
+        {name: "binding without reset", args: []string{"binding", "Steve"}, wantErr: ErrUsage},
+        {name: "binding with another action", args: []string{"binding", "show", "Steve"}, wantErr: ErrUsage},
+    } {
+        t.Run(tt.name, func(t *testing.T) {
+            tl := NewTrafficLimiter(filepath.Join(t.TempDir(), "TrafficTable.json"))
+            defer tl.Close()
+            tl.PrepareAccount("Steve", "Steve", "", lookupPlan(""))
+
+            var out bytes.Buffer
+            err := RunCommand(tl, tt.args, &out)
+            switch {
+            case tt.wantErr == nil && err != nil:
+                t.Fatalf("error %v", err)
+            case tt.wantErr == errAny && (err == nil || errors.Is(err, ErrUsage)):
+                t.Fatalf("error %v, want an error other than ErrUsage", err)
+            case tt.wantErr == ErrUsage && !errors.Is(err, ErrUsage):
+                t.Fatalf("error %v, want ErrUsage", err)
+            }
+            if !strings.Contains(out.String(), tt.want) {
+                t.Errorf("output %q, want %q in it", out.String(), tt.want)
+            }
+        })
+    }
+}
+
+func TestCleanupCommand(t *testing.T) {
+    file := filepath.Join(t.TempDir(), "TrafficTable.json")
+    tl := NewTrafficLimiter(file)
+    for _, name := range []string{"Steve", "Alex", "Notch", "jeb_"} {
+        tl.PrepareAccount(name, name, "", lookupPlan(""))
+    }
+    tl.mutex.Lock()
+    tl.users["Alex"].LastSeen = time.Now().AddDate(0, 0, -40).Unix()  // expired
+    tl.users["Notch"].LastSeen = time.Now().AddDate(0, 0, -40).Unix() // expired but prepaid
+    tl.users["Notch"].Prepaid = true
+    tl.users["jeb_"].LastSeen = time.Now().AddDate(0, 0, -20).Unix() // within the age
+    tl.mutex.Unlock()
+
+    var out bytes.Buffer
+    if err := RunCommand(tl, []string{"cleanup", "--older-than", "30d"}, &out); err != nil {
+        t.Fatal(err)
+    }
+    if !strings.Contains(out.String(), "Removed 1 accounts") {
+        t.Errorf("output %q, want one account removed", out.String())
+    }
+    tl.Close()
+
+    // the removal is saved
+    tl = NewReadOnlyTrafficLimiter(file)
+    defer tl.Close()
+    stats := tl.GetAllUsersStats()
+    if _, ok := stats["Alex"]; ok {
+        t.Error("the expired record of Alex was kept")
+    }
+    for _, name := range []string{"Steve", "Notch", "jeb_"} {
+        if _, ok := stats[name]; !ok {
+            t.Errorf("the record of %s was removed", name)
+        }
+    }
+}
+
+func TestBanCommand(t *testing.T) {
+    store := access.NewBanStore(filepath.Join(t.TempDir(), "Bans.json"))
+    defer store.Close()
+    access.SetGlobalBanStore(store)
+    defer access.SetGlobalBanStore(nil)
+
+    for _, tt := range []struct {
+        name    string
+        args    []string
+        wantErr error // ErrUsage, or errAny for another error
+        want    string
+    }{
+        {name: "no action", args: []string{"ban"}, wantErr: ErrUsage},
+        {name: "unknown action", args: []string{"ban", "kick", "name", "Steve"}, wantErr: ErrUsage},
+        {name: "add a name", args: []string{"ban", "add", "--reason", "griefing", "name", "Steve"}, want: "permanently"},
+        {name: "add an IP for a day", args: []string{"ban", "add", "--for", "1d", "ip", "192.0.2.0/24"}, want: "until"},
+        {name: "add until a date", args: []string{"ban", "add", "--expires", "2999-01-01", "uuid", "069a79f4-44e9-4726-a5be-fca90e38aaf5"}, want: "until 2999-01-01"},
+        {name: "add both lengths", args: []string{"ban", "add", "--for", "1d", "--expires", "2999-01-01", "name", "Alex"}, wantErr: ErrUsage},
+        {name: "add without a value", args: []string{"ban", "add", "name"}, wantErr: ErrUsage},
+        {name: "add an unknown type", args: []string{"ban", "add", "server", "lobby"}, wantErr: errAny},
+        {name: "add a bad IP", args: []string{"ban", "add", "ip", "192.0.2.300"}, wantErr: errAny},
+        {name: "add a bad length", args: []string{"ban", "add", "--for", "0d", "name", "Alex"}, wantErr: errAny},
+        {name: "add a past expiry", args: []string{"ban", "add", "--expires", "2000-01-01", "name", "Alex"}, wantErr: errAny},
+        {name: "list", args: []string{"ban", "list"}, want: "griefing"},
+        {name: "remove a name in any case", args: []string{"ban", "remove", "name", "STEVE"}, want: "Lifted"},
+        {name: "remove it again", args: []string{"ban", "remove", "name", "Steve"}, wantErr: errAny},
+        {name: "remove without a value", args: []string{"ban", "remove", "ip"}, wantErr: ErrUsage},
+    } {
+        t.Run(tt.name, func(t *testing.T) {
+            var out bytes.Buffer
+            err := RunCommand(nil, tt.args, &out)
+            switch {
+            case tt.wantErr == nil && err != nil:
+                t.Fatalf("error %v", err)
+            case tt.wantErr == errAny && (err == nil || errors.Is(err, ErrUsage)):
+                t.Fatalf("error %v, want an error other than ErrUsage", err)
+            case tt.wantErr == ErrUsage && !errors.Is(err, ErrUsage):
+                t.Fatalf("error %v, want ErrUsage", err)
+            }
+            if !strings.Contains(out.String(), tt.want) {
+                t.Errorf("output %q, want %q in it", out.String(), tt.want)
+            }
+        })
+    }
+
+    if access.CheckBannedPlayer(netip.MustParseAddr("192.0.2.7"), "Steve", "") == nil {
+        t.Error("the IP ban added is not in effect")
+    }
+    if ban := access.CheckBannedPlayer(netip.MustParseAddr("198.51.100.1"), "Steve", ""); ban != nil {
+        t.Errorf("the ban lifted is still in effect: %+v", ban)
+    }
+    if bans := store.List(); len(bans) != 2 {
+        t.Errorf("bans %+v, want the IP and the UUID", bans)
+    }
+}
+
+func TestHistoryCommand(t *testing.T) {
+    withTimezone(t, "Asia/Shanghai")
+    history := NewHistory(filepath.Join(t.TempDir(), "TrafficHistory.json"))
+    defer history.Close()
+    history.Record("Steve", "lobby", 100, 200)
+    history.Record("Alex", "survival", 1, 2)
+    SetGlobalHistory(history)
+    defer SetGlobalHistory(nil)
+
+    for _, tt := range []struct {
+        name    string
+        args    []string
+        wantErr error // ErrUsage, or errAny for another error
+        want    []string
+        notWant string
+    }{
+        {name: "all", args: []string{"history"}, want: []string{`"Steve"`, `"Alex"`}},
+        {name: "player", args: []string{"history", "--player", "steve"}, want: []string{`"upload_bytes":100`}, notWant: "Alex"},
+        {name: "service", args: []string{"history", "--service", "survival"}, want: []string{`"Alex"`}, notWant: "Steve"},
+        {name: "daily csv", args: []string{"history", "--resolution", "daily", "--format", "csv"}, want: []string{"start,time,player", ",Steve,lobby,100,200,300"}},
+        {name: "from the future", args: []string{"history", "--from", "2999-01-01"}, want: []string{"[]"}},
+        {name: "before", args: []string{"history", "--to", "2000-01-01"}, want: []string{"[]"}},
+        {name: "bad time", args: []string{"history", "--from", "yesterday"}, wantErr: errAny},
+        {name: "bad resolution", args: []string{"history", "--resolution", "weekly"}, wantErr: errAny},
+        {name: "bad format", args: []string{"history", "--format", "xml"}, wantErr: errAny},
+        {name: "argument", args: []string{"history", "Steve"}, wantErr: ErrUsage},
+    } {
+        t.Run(tt.name, func(t *testing.T) {
+            var out bytes.Buffer
+            err := RunCommand(nil, tt.args, &out)
+            switch {
+            case tt.wantErr == nil && err != nil:
+                t.Fatalf("error %v", err)
+            case tt.wantErr == errAny && (err == nil || errors.Is(err, ErrUsage)):
+                t.Fatalf("error %v, want an error other than ErrUsage", err)
+            case tt.wantErr == ErrUsage && !errors.Is(err, ErrUsage):
+                t.Fatalf("error %v, want ErrUsage", err)
+            }
+            for _, want := range tt.want {
+                if !strings.Contains(out.String(), want) {
+                    t.Errorf("output %q, want %q in it", out.String(), want)
+                }
+            }
+            if tt.notWant != "" && strings.Contains(out.String(), tt.notWant) {
+                t.Errorf("output %q, want no %q in it", out.String(), tt.notWant)
+            }
+        })
+    }
+}
+
+func TestReadOnlyCommand(t *testing.T) {
+    for _, tt := range []struct {
+        args []string
+        want bool
+    }{
+        {nil, true},
+        {[]string{"help"}, true},
+        {[]string{"list"}, true},
+        {[]string{"show", "Steve"}, true},
+        {[]string{"export", "--format", "csv"}, true},
+        {[]string{"binding", "reset", "Steve"}, true}, // IP bindings are kept apart
+        {[]string{"ban", "add", "name", "Steve"}, true}, // and bans too
+        {[]string{"history", "--format", "csv"}, true},
+        {[]string{"set-limit", "Steve", "100"}, false},
+        {[]string{"reset", "--all"}, false},
+        {[]string{"cleanup", "--older-than", "30d"}, false},
+        {[]string{"topup", "Steve", "100", "order-1"}, false},
+    } {
+        if got := ReadOnlyCommand(tt.args); got != tt.want {
+            t.Errorf("ReadOnlyCommand(%q) = %v, want %v", tt.args, got, tt.want)
+        }
+    }
+}
@@ -0,0 +1,160 @@
+package traffic
+
+import (
+    "errors"
+    "fmt"
+    "log"
+    "sort"
+    "strings"
+    "time"
+
+    "github.com/fatih/color"
+)
+
+var (
+    ErrInvalidTopUp   = errors.New("top-up amount must be positive")
+    ErrDuplicateTopUp = errors.New("top-up reference already used")
+)
+
+func (c *Credit) expired(now time.Time) bool {
+    return c.Expires > 0 && c.Expires <= now.Unix()
+}
+
+// balance returns the remaining bytes of the credits which have not expired,
+// and how many bytes they were bought with.
+func (u *UserTrafficData) balance(now time.Time) (remaining, amount int64) {
+    for _, c := range u.Credits {
+        if !c.expired(now) {
+            remaining += c.RemainingBytes
+            amount += c.AmountBytes
+        }
+    }
+    return
+}
+
+// holdsBalance reports whether the player is prepaid or has credits left,
+// which the retention of records not seen must not drop.
+func (u *UserTrafficData) holdsBalance(now time.Time) bool {
+    remaining, _ := u.balance(now)
+    return u.Prepaid || remaining > 0
+}
+
+// debit takes n bytes from the credits, the first expiring first.
+// Usage beyond the balance is not carried over.
+func (u *UserTrafficData) debit(n int64, now time.Time) {
+    for _, c := range u.Credits {
+        if n <= 0 {
+            return
+        }
+        if c.expired(now) || c.RemainingBytes <= 0 {
+            continue
+        }
+        taken := n
+        if taken > c.RemainingBytes {
+            taken = c.RemainingBytes
+        }
+        c.RemainingBytes -= taken
+        n -= taken
+    }
+}
+
+// warnLowBalanceLocked raises an event once when the balance of a prepaid
+// player falls under their threshold.
+func (tl *TrafficLimiter) warnLowBalanceLocked(key string, userData *UserTrafficData, now time.Time) {
+    if userData.LowBalanceMB <= 0 || userData.LowBalanceWarned {
+        return
+    }
+    remaining, _ := userData.balance(now)
+    if remaining >= userData.LowBalanceMB*1024*1024 {
+        return
+    }
+    userData.LowBalanceWarned = true
+    n := globalNotifier.Load()
+    if n == nil {
+        log.Println(color.HiYellowString("Player %s is running low on traffic balance: %.2f MB left",
+            key, float64(remaining)/(1024*1024)))
+        return
+    }
+    used, limit, percentage := userData.usage(now, 0)
+    n.Emit(&Event{
+        Type:       EventLowBalance,
+        Time:       now.Unix(),
+        Account:    key,
+        Player:     userData.PlayerName,
+        Service:    userData.Service,
+        Plan:       userData.Plan,
+        UsedMB:     used,
+        LimitMB:    limit,
+        Percentage: percentage,
+        BalanceMB:  float64(remaining) / (1024 * 1024),
+    })
+}
+
+// TopUp adds a credit of amountMB to the balance of a player. The reference,
+// such as an order ID, must not have been used for the player before, so that
+// a top-up applied twice is rejected. A zero expires means the expiry of the
+// plan of the player, if any.
+func (tl *TrafficLimiter) TopUp(key string, amountMB int64, reference string, expires time.Time) error {
+    if amountMB <= 0 {
+        return ErrInvalidTopUp
+    }
+    tl.mutex.Lock()
+    defer tl.mutex.Unlock()
+
+    now := time.Now()
+    userData, exists := tl.users[key]
+    if !exists {
+        playerName, service, _ := strings.Cut(key, "@")
+        userData = &UserTrafficData{
+            PlayerName:    playerName,
+            Service:       service,
+            LastResetTime: now.Unix(),
+        }
+        tl.users[key] = userData
+    }
+    for _, c := range userData.Credits {
+        if c.Reference == reference {
+            return fmt.Errorf("%w: %s", ErrDuplicateTopUp, reference)
+        }
+    }
+
+    if expires.IsZero() {
+        if days := lookupPlan(userData.Plan).CreditExpiryDays; days > 0 {
+            expires = now.AddDate(0, 0, days)
+        }
+    }
+    credit := &Credit{
+        Reference:      reference,
+        AmountBytes:    amountMB * 1024 * 1024,
+        RemainingBytes: amountMB * 1024 * 1024,
+        Time:           now.Unix(),
+    }
+    if !expires.IsZero() {
+        credit.Expires = expires.Unix()
+    }
+    userData.Credits = append(userData.Credits, credit)
+    // credits expiring first are used first, those never expiring last
+    sort.SliceStable(userData.Credits, func(i, j int) bool {
+        a, b := userData.Credits[i].Expires, userData.Credits[j].Expires
+        return a != 0 && (b == 0 || a < b)
+    })
+    userData.LowBalanceWarned = false
+    userData.LastSeen = now.Unix()
+    tl.markDirtyLocked(key)
+
+    log.Println(color.HiGreenString("Topped up %d MB of traffic for %s (reference %s)", amountMB, key, reference))
+    return nil
+}
+
+// GetBalance returns the balance of a player, and whether the player is prepaid.
+func (tl *TrafficLimiter) GetBalance(key string) (balanceMB float64, prepaid bool) {
+    tl.mutex.RLock()
+    defer tl.mutex.RUnlock()
+
+    userData, exists := tl.users[key]
+    if !exists {
+        return 0, false
+    }
+    remaining, _ := userData.balance(time.Now())
+    return float64(remaining) / (1024 * 1024), userData.Prepaid
+}
@@ -0,0 +1,53 @@
+package traffic
+
+import (
+    "path/filepath"
+    "testing"
+    "time"
+)
+
+func TestRetentionKeepsBalance(t *testing.T) {
+    file := filepath.Join(t.TempDir(), "TrafficTable.json")
+    tl := NewTrafficLimiter(file)
+    tl.PrepareAccount("Steve", "Steve", "", lookupPlan(""))
+    tl.PrepareAccount("Notch", "Notch", "", lookupPlan(""))
+    if err := tl.TopUp("Alex", 100, "order-1", time.Time{}); err != nil {
+        t.Fatal(err)
+    }
+    // away for longer than the retention of 7 days
+    away := time.Now().AddDate(0, 0, -30).Unix()
+    tl.mutex.Lock()
+    tl.users["Notch"].Prepaid = true
+    for key, userData := range tl.users {
+        userData.LastSeen = away
+        tl.markDirtyLocked(key)
+    }
+    tl.mutex.Unlock()
+    tl.Close()
+
+    check := func(tl *TrafficLimiter, when string) {
+        stats := tl.GetAllUsersStats()
+        if _, ok := stats["Steve"]; ok {
+            t.Errorf("%s: the record of Steve was kept", when)
+        }
+        if _, ok := stats["Notch"]; !ok {
+            t.Errorf("%s: the record of the prepaid Notch was dropped", when)
+        }
+        if balance, _ := tl.GetBalance("Alex"); balance != 100 {
+            t.Errorf("%s: balance of Alex %.2f MB, want 100", when, balance)
+        }
+        if len(stats["Alex"].Credits) != 1 {
+            t.Errorf("%s: top-ups of Alex %+v, want order-1", when, stats["Alex"].Credits)
+        }
+    }
+
+    // on loading
+    tl = NewTrafficLimiter(file)
+    defer tl.Close()
+    check(tl, "loading")
+
+    // by the cleanup
+    tl.PrepareAccount("Steve", "Steve", "", lookupPlan(""))
+    tl.CleanupOldData(time.Now().Add(time.Hour).Unix())
+    check(tl, "cleanup")
+}
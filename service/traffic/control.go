@@ -0,0 +1,130 @@
+package traffic
+
+import (
+    "bytes"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "log"
+    "net"
+    "os"
+    "syscall"
+    "time"
+
+    "github.com/fatih/color"
+)
+
+// ControlSocket is the path of the socket a running NoDelay takes admin
+// commands on, next to the traffic data.
+const ControlSocket = "NoDelay.sock"
+
+const controlTimeout = 30 * time.Second
+
+// ErrNoControl is returned by CallControl when no NoDelay is running.
+var ErrNoControl = errors.New("no NoDelay process is running")
+
+type controlRequest struct {
+    Args []string `json:"args"`
+}
+
+type controlResponse struct {
+    Output string `json:"output"`
+    Error  string `json:"error,omitempty"`
+}
+
+// ControlServer runs the admin commands sent to the control socket
+// on the limiter of the running process.
+type ControlServer struct {
+    path     string
+    listener net.Listener
+    limiter  TrafficLimiterInterface
+}
+
+// ServeControl listens on the control socket at path. A socket left by a
+// process which did not exit cleanly is replaced, but not one in use.
+func ServeControl(path string, limiter TrafficLimiterInterface) (*ControlServer, error) {
+    if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+        conn.Close()
+        return nil, fmt.Errorf("control socket %s is in use by another process", path)
+    }
+    os.Remove(path) //nolint:errcheck
+    listener, err := net.Listen("unix", path)
+    if err != nil {
+        return nil, fmt.Errorf("failed to listen on control socket: %w", err)
+    }
+    // only the user running NoDelay may send commands
+    if err := os.Chmod(path, 0600); err != nil {
+        listener.Close()
+        return nil, fmt.Errorf("failed to protect control socket: %w", err)
+    }
+    s := &ControlServer{path: path, listener: listener, limiter: limiter}
+    go s.serve()
+    return s, nil
+}
+
+func (s *ControlServer) serve() {
+    for {
+        conn, err := s.listener.Accept()
+        if err != nil {
+            if !errors.Is(err, net.ErrClosed) {
+                log.Println(color.HiRedString("Control socket stopped: %v", err))
+            }
+            return
+        }
+        go s.handle(conn)
+    }
+}
+
+func (s *ControlServer) handle(conn net.Conn) {
+    defer conn.Close()
+    conn.SetDeadline(time.Now().Add(controlTimeout)) //nolint:errcheck
+
+    var req controlRequest
+    if err := json.NewDecoder(conn).Decode(&req); err != nil {
+        return
+    }
+    log.Println(color.HiCyanString("Running traffic command from control socket: %v", req.Args))
+    var output bytes.Buffer
+    var resp controlResponse
+    if err := RunCommand(s.limiter, req.Args, &output); err != nil {
+        resp.Error = err.Error()
+    }
+    resp.Output = output.String()
+    json.NewEncoder(conn).Encode(&resp) //nolint:errcheck
+}
+
+// Close stops taking commands and removes the socket.
+func (s *ControlServer) Close() error {
+    err := s.listener.Close()
+    os.Remove(s.path) //nolint:errcheck
+    return err
+}
+
+// CallControl runs an admin command in the NoDelay process listening on
+// the control socket at path, writing its output to w. It returns
+// ErrNoControl when there is no socket or nothing listens on it.
+func CallControl(path string, args []string, w io.Writer) error {
+    conn, err := net.DialTimeout("unix", path, time.Second)
+    if err != nil {
+        if errors.Is(err, os.ErrNotExist) || errors.Is(err, syscall.ECONNREFUSED) {
+            return ErrNoControl
+        }
+        return fmt.Errorf("failed to connect to control socket: %w", err)
+    }
+    defer conn.Close()
+    conn.SetDeadline(time.Now().Add(controlTimeout)) //nolint:errcheck
+
+    if err := json.NewEncoder(conn).Encode(&controlRequest{Args: args}); err != nil {
+        return fmt.Errorf("failed to send command: %w", err)
+    }
+    var resp controlResponse
+    if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+        return fmt.Errorf("failed to read the result of the command: %w", err)
+    }
+    io.WriteString(w, resp.Output) //nolint:errcheck
+    if resp.Error != "" {
+        return errors.New(resp.Error)
+    }
+    return nil
+}
@@ -0,0 +1,487 @@
+package traffic
+
+import (
+    "crypto/sha256"
+    "encoding/csv"
+    "encoding/json"
+    "io"
+    "log"
+    "os"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/InRaining/NoDelay/config"
+
+    "github.com/fatih/color"
+)
+
+const (
+    ResolutionHourly = "hourly"
+    ResolutionDaily  = "daily"
+)
+
+// HistoryPoint is the traffic of a player on a service during an hour or a day.
+type HistoryPoint struct {
+    Player        string `json:"player"`
+    Service       string `json:"service"`
+    Start         int64  `json:"start"` // unix time of the start of the hour or day
+    UploadBytes   int64  `json:"upload_bytes"`
+    DownloadBytes int64  `json:"download_bytes"`
+}
+
+// HistoryQuery selects points of the history. Empty fields select everything.
+type HistoryQuery struct {
+    Player     string
+    Service    string
+    From, To   time.Time // points starting in [From, To)
+    Resolution string    // ResolutionHourly (default) or ResolutionDaily
+}
+
+// TopEntry is the traffic of a player over a time range.
+type TopEntry struct {
+    Player        string `json:"player"`
+    UploadBytes   int64  `json:"upload_bytes"`
+    DownloadBytes int64  `json:"download_bytes"`
+    TotalBytes    int64  `json:"total_bytes"`
+}
+
+type historyKey struct {
+    player  string
+    service string
+    start   int64
+}
+
+type historyUsage struct {
+    upload, download int64
+}
+
+// historyFile is the saved form of the history.
+type historyFile struct {
+    Hourly []HistoryPoint `json:"hourly"`
+    Daily  []HistoryPoint `json:"daily"`
+}
+
+// historyJournalEntry is a line of the journal of the history:
+// the traffic recorded in each hour since the previous line.
+type historyJournalEntry struct {
+    Points []HistoryPoint `json:"points"`
+}
+
+// History records the traffic of players on each service in hourly and daily
+// buckets, kept for the configured retention. Like the traffic records, it is
+// saved in a snapshot, with the traffic recorded since appended to a journal
+// next to it every few seconds.
+type History struct {
+    dataFile string
+    readOnly bool
+    mutex    sync.Mutex
+    hourly   map[historyKey]*historyUsage
+    daily    map[historyKey]*historyUsage
+    pending  map[historyKey]*historyUsage // hourly traffic not in the journal yet
+    dirty    bool                         // changed since the last snapshot
+
+    saveMutex sync.Mutex // serializes the writes to the files
+    journal   journal
+    stopChan  chan struct{}
+}
+
+// NewHistory loads the history from dataFile and its journal,
+// and starts saving it periodically.
+func NewHistory(dataFile string) *History {
+    h := newHistory(dataFile, false)
+    go h.autoSave()
+    return h
+}
+
+// NewReadOnlyHistory loads the history from dataFile and its journal
+// without ever writing them.
+func NewReadOnlyHistory(dataFile string) *History {
+    return newHistory(dataFile, true)
+}
+
+func newHistory(dataFile string, readOnly bool) *History {
+    h := &History{
+        dataFile: dataFile,
+        readOnly: readOnly,
+        hourly:   make(map[historyKey]*historyUsage),
+        daily:    make(map[historyKey]*historyUsage),
+        pending:  make(map[historyKey]*historyUsage),
+        journal:  journal{file: dataFile + ".journal"},
+        stopChan: make(chan struct{}),
+    }
+    h.loadData()
+    return h
+}
+
+func historySettings() (enabled bool, hourly, daily time.Duration) {
+    hourlyDays, dailyDays := 7, 400
+    if settings := config.Config.TrafficLimiter; settings != nil {
+        if settings.History.Disabled {
+            return false, 0, 0
+        }
+        if settings.History.HourlyDays > 0 {
+            hourlyDays = settings.History.HourlyDays
+        }
+        if settings.History.DailyDays > 0 {
+            dailyDays = settings.History.DailyDays
+        }
+    }
+    return true, time.Duration(hourlyDays) * 24 * time.Hour, time.Duration(dailyDays) * 24 * time.Hour
+}
+
+func hourStart(t time.Time) time.Time {
+    t = t.In(location())
+    return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, t.Location())
+}
+
+func (h *History) loadData() {
+    var hash [sha256.Size]byte
+    data, err := os.ReadFile(h.dataFile)
+    if err != nil && !os.IsNotExist(err) {
+        log.Printf("Error reading traffic history file: %v", err)
+        return
+    }
+    if err == nil {
+        hash = sha256.Sum256(data)
+        var saved historyFile
+        if err = json.Unmarshal(data, &saved); err != nil {
+            log.Printf("Error parsing traffic history: %v", err)
+            return
+        }
+        for _, p := range saved.Hourly {
+            h.hourly[historyKey{p.Player, p.Service, p.Start}] = &historyUsage{p.UploadBytes, p.DownloadBytes}
+        }
+        for _, p := range saved.Daily {
+            h.daily[historyKey{p.Player, p.Service, p.Start}] = &historyUsage{p.UploadBytes, p.DownloadBytes}
+        }
+    }
+
+    lines, err := h.journal.read(hash, "traffic history")
+    if err != nil {
+        log.Printf("Error reading traffic history journal: %v", err)
+    }
+    for _, line := range lines {
+        var entry historyJournalEntry
+        if err := json.Unmarshal(line, &entry); err != nil {
+            log.Printf("Error parsing traffic history journal: %v", err)
+            break
+        }
+        for _, p := range entry.Points {
+            add(h.hourly, historyKey{p.Player, p.Service, p.Start}, p.UploadBytes, p.DownloadBytes)
+            add(h.daily, historyKey{p.Player, p.Service, dayStart(time.Unix(p.Start, 0)).Unix()}, p.UploadBytes, p.DownloadBytes)
+        }
+    }
+    if len(lines) > 0 {
+        log.Printf("Replayed %d traffic history journal entries", len(lines))
+        // folded into a snapshot, so that the journal is not replayed again
+        h.dirty = true
+    }
+    h.pruneLocked(time.Now())
+    log.Printf("Loaded traffic history: %d hourly and %d daily records", len(h.hourly), len(h.daily))
+    if !h.readOnly {
+        h.saveData()
+    }
+}
+
+// flushJournal appends the traffic recorded since the last flush to the journal.
+func (h *History) flushJournal() {
+    h.saveMutex.Lock()
+    defer h.saveMutex.Unlock()
+
+    h.mutex.Lock()
+    pending := h.pending
+    h.pending = make(map[historyKey]*historyUsage)
+    h.mutex.Unlock()
+    if len(pending) == 0 {
+        return
+    }
+
+    data, err := json.Marshal(&historyJournalEntry{Points: points(pending)})
+    if err == nil {
+        err = h.journal.append(append(data, '\n'))
+    }
+    if err != nil {
+        log.Printf("Error saving traffic history: %v", err)
+        h.restorePending(pending)
+        return
+    }
+    if h.journal.size >= journalCompactSize {
+        h.snapshotLocked()
+    }
+}
+
+// restorePending puts back the traffic which could not be saved.
+func (h *History) restorePending(pending map[historyKey]*historyUsage) {
+    h.mutex.Lock()
+    for key, usage := range pending {
+        add(h.pending, key, usage.upload, usage.download)
+    }
+    h.dirty = true
+    h.mutex.Unlock()
+}
+
+func (h *History) saveData() {
+    h.saveMutex.Lock()
+    defer h.saveMutex.Unlock()
+    h.snapshotLocked()
+}
+
+// snapshotLocked saves the whole history and empties the journal.
+// saveMutex must be held.
+func (h *History) snapshotLocked() {
+    h.mutex.Lock()
+    if !h.dirty {
+        h.mutex.Unlock()
+        return
+    }
+    h.pruneLocked(time.Now())
+    saved := historyFile{Hourly: points(h.hourly), Daily: points(h.daily)}
+    // in the snapshot from now on
+    pending := h.pending
+    h.pending = make(map[historyKey]*historyUsage)
+    h.dirty = false
+    h.mutex.Unlock()
+
+    data, err := json.Marshal(&saved)
+    if err == nil {
+        // the journal is marked first, so that it isn't replayed over the
+        // snapshot if a crash leaves it behind
+        err = h.journal.mark(sha256.Sum256(data))
+    }
+    if err == nil {
+        err = writeFileAtomic(h.dataFile, data)
+    }
+    if err != nil {
+        log.Printf("Error saving traffic history: %v", err)
+        h.restorePending(pending)
+        return
+    }
+    if err = h.journal.remove(); err != nil {
+        log.Printf("Error removing traffic history journal: %v", err)
+    }
+}
+
+func (h *History) autoSave() {
+    journalTicker := time.NewTicker(5 * time.Second)
+    defer journalTicker.Stop()
+    saveTicker := time.NewTicker(5 * time.Minute)
+    defer saveTicker.Stop()
+    for {
+        select {
+        case <-journalTicker.C:
+            h.flushJournal()
+        case <-saveTicker.C:
+            h.saveData()
+        case <-h.stopChan:
+            return
+        }
+    }
+}
+
+func (h *History) pruneLocked(now time.Time) {
+    _, hourly, daily := historySettings()
+    prunedHourly := prune(h.hourly, now.Add(-hourly))
+    prunedDaily := prune(h.daily, now.Add(-daily))
+    if prunedHourly || prunedDaily {
+        h.dirty = true
+    }
+}
+
+// prune deletes the buckets starting before cutoff, and reports whether there were any.
+func prune(m map[historyKey]*historyUsage, cutoff time.Time) bool {
+    pruned := false
+    for key := range m {
+        if key.start < cutoff.Unix() {
+            delete(m, key)
+            pruned = true
+        }
+    }
+    return pruned
+}
+
+func add(m map[historyKey]*historyUsage, key historyKey, upload, download int64) {
+    usage, ok := m[key]
+    if !ok {
+        usage = new(historyUsage)
+        m[key] = usage
+    }
+    usage.upload += upload
+    usage.download += download
+}
+
+// Record adds the traffic of a player on a service to the current hour and day.
+func (h *History) Record(player, service string, upload, download int64) {
+    if enabled, _, _ := historySettings(); !enabled {
+        return
+    }
+    now := time.Now()
+    h.mutex.Lock()
+    defer h.mutex.Unlock()
+    hour := historyKey{player, service, hourStart(now).Unix()}
+    add(h.hourly, hour, upload, download)
+    add(h.daily, historyKey{player, service, dayStart(now).Unix()}, upload, download)
+    add(h.pending, hour, upload, download)
+    h.dirty = true
+}
+
+func points(m map[historyKey]*historyUsage) []HistoryPoint {
+    result := make([]HistoryPoint, 0, len(m))
+    for key, usage := range m {
+        result = append(result, HistoryPoint{key.player, key.service, key.start, usage.upload, usage.download})
+    }
+    return result
+}
+
+func (q *HistoryQuery) match(key historyKey) bool {
+    return (q.Player == "" || strings.EqualFold(q.Player, key.player)) &&
+        (q.Service == "" || q.Service == key.service) &&
+        (q.From.IsZero() || key.start >= q.From.Unix()) &&
+        (q.To.IsZero() || key.start < q.To.Unix())
+}
+
+// Query returns the points selected by q, ordered by time, player and service.
+func (h *History) Query(q HistoryQuery) []HistoryPoint {
+    h.mutex.Lock()
+    m := h.hourly
+    if q.Resolution == ResolutionDaily {
+        m = h.daily
+    }
+    var result []HistoryPoint
+    for key, usage := range m {
+        if q.match(key) {
+            result = append(result, HistoryPoint{key.player, key.service, key.start, usage.upload, usage.download})
+        }
+    }
+    h.mutex.Unlock()
+
+    sort.Slice(result, func(i, j int) bool {
+        a, b := result[i], result[j]
+        if a.Start != b.Start {
+            return a.Start < b.Start
+        }
+        if a.Player != b.Player {
+            return a.Player < b.Player
+        }
+        return a.Service < b.Service
+    })
+    return result
+}
+
+// Top returns the n players having used the most traffic among the points
+// selected by q, which may select a service. All players are returned if n <= 0.
+func (h *History) Top(q HistoryQuery, n int) []TopEntry {
+    totals := make(map[string]*TopEntry)
+    for _, p := range h.Query(q) {
+        key := strings.ToLower(p.Player)
+        entry, ok := totals[key]
+        if !ok {
+            entry = &TopEntry{Player: p.Player}
+            totals[key] = entry
+        }
+        entry.UploadBytes += p.UploadBytes
+        entry.DownloadBytes += p.DownloadBytes
+        entry.TotalBytes += p.UploadBytes + p.DownloadBytes
+    }
+
+    result := make([]TopEntry, 0, len(totals))
+    for _, entry := range totals {
+        result = append(result, *entry)
+    }
+    sort.Slice(result, func(i, j int) bool {
+        if result[i].TotalBytes != result[j].TotalBytes {
+            return result[i].TotalBytes > result[j].TotalBytes
+        }
+        return result[i].Player < result[j].Player
+    })
+    if n > 0 && len(result) > n {
+        result = result[:n]
+    }
+    return result
+}
+
+// Close saves the history and stops the background saving.
+func (h *History) Close() {
+    if h.readOnly {
+        return
+    }
+    close(h.stopChan)
+    h.saveData()
+    h.saveMutex.Lock()
+    h.journal.close() //nolint:errcheck
+    h.saveMutex.Unlock()
+    color.HiGreen("Traffic history saved.")
+}
+
+// WriteHistoryJSON writes points as a JSON array.
+func WriteHistoryJSON(w io.Writer, points []HistoryPoint) error {
+    if points == nil {
+        points = []HistoryPoint{}
+    }
+    return json.NewEncoder(w).Encode(points)
+}
+
+// WriteHistoryCSV writes points as CSV with a header line. The start of each
+// point is written both as unix time and in the timezone of resets.
+func WriteHistoryCSV(w io.Writer, points []HistoryPoint) error {
+    writer := csv.NewWriter(w)
+    writer.Write([]string{"start", "time", "player", "service", "upload_bytes", "download_bytes", "total_bytes"}) //nolint:errcheck
+    loc := location()
+    for _, p := range points {
+        writer.Write([]string{ //nolint:errcheck
+            strconv.FormatInt(p.Start, 10),
+            time.Unix(p.Start, 0).In(loc).Format(time.RFC3339),
+            p.Player,
+            p.Service,
+            strconv.FormatInt(p.UploadBytes, 10),
+            strconv.FormatInt(p.DownloadBytes, 10),
+            strconv.FormatInt(p.UploadBytes+p.DownloadBytes, 10),
+        })
+    }
+    writer.Flush()
+    return writer.Error()
+}
+
+var globalHistory *History
+
+// SetGlobalHistory sets the history fed by meters.
+func SetGlobalHistory(h *History) {
+    globalHistory = h
+}
+
+// GetGlobalHistory returns the history fed by meters, which may be nil.
+func GetGlobalHistory() *History {
+    return globalHistory
+}
+
+// ParseHistoryTime parses a bound of a history query: unix time,
+// RFC 3339 or a date, which is read in the timezone of resets.
+func ParseHistoryTime(s string) (time.Time, error) {
+    if s == "" {
+        return time.Time{}, nil
+    }
+    if unix, err := strconv.ParseInt(s, 10, 64); err == nil {
+        return time.Unix(unix, 0), nil
+    }
+    if t, err := time.Parse(time.RFC3339, s); err == nil {
+        return t, nil
+    }
+    return time.ParseInLocation("2006-01-02", s, location())
+}
+
+// TopPeriodStart returns the start of the last period of a top-N view:
+// "hour", "day" (default), "week" or "month", counted back from now.
+func TopPeriodStart(period string, now time.Time) (start time.Time, resolution string) {
+    switch period {
+    case "hour":
+        return now.Add(-time.Hour), ResolutionHourly
+    case "week":
+        return dayStart(now).AddDate(0, 0, -6), ResolutionDaily
+    case "month":
+        return dayStart(now).AddDate(0, 0, -29), ResolutionDaily
+    default:
+        return now.Add(-24 * time.Hour), ResolutionHourly
+    }
+}
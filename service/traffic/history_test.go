@@ -0,0 +1,102 @@
+package traffic
+
+import (
+    "crypto/sha256"
+    "encoding/hex"
+    "fmt"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+)
+
+// stopHistory stops the background saving of h as a crash would, saving nothing.
+func stopHistory(h *History) {
+    close(h.stopChan)
+    h.saveMutex.Lock()
+    h.journal.close() //nolint:errcheck
+    h.saveMutex.Unlock()
+}
+
+func checkHistory(t *testing.T, h *History, when string, wantUpload, wantDownload int64) {
+    t.Helper()
+    for _, resolution := range []string{ResolutionHourly, ResolutionDaily} {
+        var upload, download int64
+        for _, p := range h.Query(HistoryQuery{Player: "steve", Resolution: resolution}) {
+            upload += p.UploadBytes
+            download += p.DownloadBytes
+        }
+        if upload != wantUpload || download != wantDownload {
+            t.Errorf("%s: %s traffic %d/%d, want %d/%d", when, resolution, upload, download, wantUpload, wantDownload)
+        }
+    }
+}
+
+func TestHistoryJournal(t *testing.T) {
+    withTimezone(t, "Asia/Shanghai")
+    file := filepath.Join(t.TempDir(), "TrafficHistory.json")
+
+    h := NewHistory(file)
+    h.Record("Steve", "lobby", 100, 1000)
+    h.Record("Steve", "survival", 10, 20)
+    h.flushJournal()
+    h.Record("Steve", "lobby", 1, 2) // lost in the crash
+    stopHistory(h)
+
+    if _, err := os.Stat(file + ".journal"); err != nil {
+        t.Fatalf("no journal: %v", err)
+    }
+    snapshot, _ := os.ReadFile(file)
+    readOnly := NewReadOnlyHistory(file)
+    checkHistory(t, readOnly, "read only", 110, 1020)
+    readOnly.Close()
+    if data, _ := os.ReadFile(file); string(data) != string(snapshot) {
+        t.Error("the read only history changed the snapshot")
+    }
+    if _, err := os.Stat(file + ".journal"); err != nil {
+        t.Errorf("the read only history removed the journal: %v", err)
+    }
+
+    // folded into a snapshot on loading
+    h = NewHistory(file)
+    checkHistory(t, h, "replayed", 110, 1020)
+    if _, err := os.Stat(file + ".journal"); !os.IsNotExist(err) {
+        t.Errorf("journal left after the snapshot: %v", err)
+    }
+    h.Record("Steve", "lobby", 5, 5)
+    h.Close()
+
+    h = NewHistory(file)
+    defer h.Close()
+    checkHistory(t, h, "reloaded", 115, 1025)
+}
+
+func TestHistoryJournalMarked(t *testing.T) {
+    withTimezone(t, "Asia/Shanghai")
+    file := filepath.Join(t.TempDir(), "TrafficHistory.json")
+
+    h := NewHistory(file)
+    h.Record("Steve", "lobby", 100, 1000)
+    h.flushJournal()
+    journal, err := os.ReadFile(file + ".journal")
+    if err != nil {
+        t.Fatal(err)
+    }
+    h.saveData()
+    stopHistory(h)
+
+    // a crash after the snapshot was written and before the journal was
+    // removed leaves the journal marked, with a torn line after later records
+    snapshot, _ := os.ReadFile(file)
+    hash := sha256.Sum256(snapshot)
+    journal = append(journal, `{"snapshot":"`+hex.EncodeToString(hash[:])+`"}`+"\n"...)
+    journal = append(journal, fmt.Sprintf(`{"points":[{"player":"Steve","service":"lobby","start":%d,"upload_bytes":5,"download_bytes":5}]}`+"\n",
+        hourStart(time.Now()).Unix())...)
+    journal = append(journal, `{"points":[{"player":"Ste`...)
+    if err := os.WriteFile(file+".journal", journal, 0644); err != nil {
+        t.Fatal(err)
+    }
+
+    readOnly := NewReadOnlyHistory(file)
+    checkHistory(t, readOnly, "marked", 105, 1005)
+}
@@ -0,0 +1,83 @@
+package traffic
+
+import (
+    "fmt"
+    "net/netip"
+    "strings"
+
+    "github.com/InRaining/NoDelay/config"
+)
+
+// Identities the traffic of a connection may be counted to.
+const (
+    IdentityPlayer = "player"
+    IdentitySNI    = "sni"
+    IdentityIP     = "ip"
+    IdentityCIDR   = "cidr"
+)
+
+// Peer is what is known of the client of a connection.
+type Peer struct {
+    PlayerName string // Minecraft services only
+    SNI        string // TLS connections only
+    Addr       netip.Addr
+}
+
+// ValidateAccounting checks the accounting settings of a service.
+func ValidateAccounting(a config.TrafficAccounting) error {
+    switch a.Identity {
+    case "", IdentityPlayer, IdentitySNI, IdentityIP:
+    case IdentityCIDR:
+        if a.IPv4Prefix < 0 || a.IPv4Prefix > 32 || a.IPv6Prefix < 0 || a.IPv6Prefix > 128 {
+            return fmt.Errorf("bad CIDR prefix lengths %d and %d", a.IPv4Prefix, a.IPv6Prefix)
+        }
+    default:
+        return fmt.Errorf("unknown accounting identity '%s'", a.Identity)
+    }
+    return nil
+}
+
+// Identity returns the name the traffic of a connection to a service is
+// counted to, in place of a player name: the player name, the SNI domain,
+// the client IP or its network. Connections without the identity of the
+// service count to their IP.
+func Identity(s *config.ConfigProxyService, peer Peer) string {
+    identity := s.Accounting.Identity
+    if identity == "" {
+        switch {
+        case peer.PlayerName != "":
+            identity = IdentityPlayer
+        case peer.SNI != "":
+            identity = IdentitySNI
+        default:
+            identity = IdentityIP
+        }
+    }
+
+    switch {
+    case identity == IdentityPlayer && peer.PlayerName != "":
+        return peer.PlayerName
+    case identity == IdentitySNI && peer.SNI != "":
+        return strings.ToLower(peer.SNI)
+    case identity == IdentityCIDR && peer.Addr.IsValid():
+        addr := peer.Addr.Unmap()
+        bits := s.Accounting.IPv6Prefix
+        if bits == 0 {
+            bits = 64
+        }
+        if addr.Is4() {
+            bits = s.Accounting.IPv4Prefix
+            if bits == 0 {
+                bits = 24
+            }
+        }
+        prefix, err := addr.Prefix(bits)
+        if err == nil {
+            return prefix.String()
+        }
+    }
+    if !peer.Addr.IsValid() {
+        return ""
+    }
+    return peer.Addr.Unmap().String()
+}
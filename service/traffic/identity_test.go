@@ -0,0 +1,138 @@
+package traffic
+
+import (
+    "net/netip"
+    "path/filepath"
+    "testing"
+
+    "github.com/InRaining/NoDelay/config"
+)
+
+func TestIdentity(t *testing.T) {
+    for _, tt := range []struct {
+        name       string
+        accounting config.TrafficAccounting
+        peer       Peer
+        want       string
+    }{
+        {name: "player by default", peer: Peer{PlayerName: "Steve", Addr: netip.MustParseAddr("192.0.2.1")}, want: "Steve"},
+        {name: "sni by default", peer: Peer{SNI: "Play.Example.COM", Addr: netip.MustParseAddr("192.0.2.1")}, want: "play.example.com"},
+        {name: "ip by default", peer: Peer{Addr: netip.MustParseAddr("192.0.2.1")}, want: "192.0.2.1"},
+        {
+            name:       "sni",
+            accounting: config.TrafficAccounting{Identity: IdentitySNI},
+            peer:       Peer{SNI: "example.com", Addr: netip.MustParseAddr("192.0.2.1")},
+            want:       "example.com",
+        },
+        {
+            name:       "sni without a TLS handshake",
+            accounting: config.TrafficAccounting{Identity: IdentitySNI},
+            peer:       Peer{Addr: netip.MustParseAddr("192.0.2.1")},
+            want:       "192.0.2.1",
+        },
+        {
+            name:       "ip over sni",
+            accounting: config.TrafficAccounting{Identity: IdentityIP},
+            peer:       Peer{SNI: "example.com", Addr: netip.MustParseAddr("192.0.2.1")},
+            want:       "192.0.2.1",
+        },
+        {
+            name:       "ip over the player",
+            accounting: config.TrafficAccounting{Identity: IdentityIP},
+            peer:       Peer{PlayerName: "Steve", Addr: netip.MustParseAddr("2001:db8::1")},
+            want:       "2001:db8::1",
+        },
+        {
+            name:       "IPv4-mapped ip",
+            accounting: config.TrafficAccounting{Identity: IdentityIP},
+            peer:       Peer{Addr: netip.MustParseAddr("::ffff:192.0.2.1")},
+            want:       "192.0.2.1",
+        },
+        {
+            name:       "cidr",
+            accounting: config.TrafficAccounting{Identity: IdentityCIDR},
+            peer:       Peer{Addr: netip.MustParseAddr("::ffff:192.0.2.77")},
+            want:       "192.0.2.0/24",
+        },
+        {
+            name:       "cidr IPv6",
+            accounting: config.TrafficAccounting{Identity: IdentityCIDR},
+            peer:       Peer{Addr: netip.MustParseAddr("2001:db8:1:2:3::1")},
+            want:       "2001:db8:1:2::/64",
+        },
+        {
+            name:       "cidr with prefix lengths",
+            accounting: config.TrafficAccounting{Identity: IdentityCIDR, IPv4Prefix: 16, IPv6Prefix: 48},
+            peer:       Peer{Addr: netip.MustParseAddr("192.0.2.77")},
+            want:       "192.0.0.0/16",
+        },
+        {name: "no address", accounting: config.TrafficAccounting{Identity: IdentityIP}, want: ""},
+    } {
+        t.Run(tt.name, func(t *testing.T) {
+            s := &config.ConfigProxyService{Name: "web", Accounting: tt.accounting}
+            if got := Identity(s, tt.peer); got != tt.want {
+                t.Errorf("identity %q, want %q", got, tt.want)
+            }
+        })
+    }
+}
+
+func TestValidateAccounting(t *testing.T) {
+    for _, tt := range []struct {
+        accounting config.TrafficAccounting
+        wantErr    bool
+    }{
+        {accounting: config.TrafficAccounting{}},
+        {accounting: config.TrafficAccounting{Identity: IdentitySNI}},
+        {accounting: config.TrafficAccounting{Identity: IdentityCIDR, IPv4Prefix: 32, IPv6Prefix: 128}},
+        {accounting: config.TrafficAccounting{Identity: IdentityCIDR, IPv4Prefix: 33}, wantErr: true},
+        {accounting: config.TrafficAccounting{Identity: IdentityCIDR, IPv6Prefix: -1}, wantErr: true},
+        {accounting: config.TrafficAccounting{Identity: "domain"}, wantErr: true},
+    } {
+        if err := ValidateAccounting(tt.accounting); (err != nil) != tt.wantErr {
+            t.Errorf("%+v: error %v, want error %v", tt.accounting, err, tt.wantErr)
+        }
+    }
+}
+
+func TestIdentityAccounts(t *testing.T) {
+    tl := NewTrafficLimiter(filepath.Join(t.TempDir(), "TrafficTable.json"))
+    defer tl.Close()
+    SetGlobalTrafficLimiter(tl)
+    defer SetGlobalTrafficLimiter(nil)
+    shared := Plan{Name: DefaultPlanName, TrafficPlan: config.TrafficPlan{LimitMB: 1}}
+    perService := Plan{Name: DefaultPlanName, TrafficPlan: config.TrafficPlan{LimitMB: 1, Scope: ScopeService}}
+    sniService := &config.ConfigProxyService{Name: "web", Accounting: config.TrafficAccounting{Identity: IdentitySNI}}
+    ipService := &config.ConfigProxyService{Name: "ssh", Accounting: config.TrafficAccounting{Identity: IdentityIP}}
+
+    // clients of the same domain share its account, whatever the case
+    for _, peer := range []Peer{
+        {SNI: "example.com", Addr: netip.MustParseAddr("192.0.2.1")},
+        {SNI: "EXAMPLE.com", Addr: netip.MustParseAddr("198.51.100.1")},
+    } {
+        key := PrepareAccount(sniService, Identity(sniService, peer), shared)
+        RecordUserTraffic(key, 1000, 0)
+    }
+    // an address counts per service under a scoped plan
+    for _, s := range []*config.ConfigProxyService{ipService, sniService} {
+        key := PrepareAccount(s, Identity(ipService, Peer{Addr: netip.MustParseAddr("192.0.2.1")}), perService)
+        RecordUserTraffic(key, 0, 10)
+    }
+
+    stats := tl.GetAllUsersStats()
+    for key, want := range map[string]int64{
+        "example.com":   2000,
+        "192.0.2.1@ssh": 10,
+        "192.0.2.1@web": 10,
+    } {
+        if stats[key].UsedBytes != want {
+            t.Errorf("%s used %d bytes, want %d", key, stats[key].UsedBytes, want)
+        }
+    }
+    if len(stats) != 3 {
+        t.Errorf("accounts %v, want 3", stats)
+    }
+    if stats["192.0.2.1@web"].Service != "web" {
+        t.Errorf("service of 192.0.2.1@web %q, want web", stats["192.0.2.1@web"].Service)
+    }
+}
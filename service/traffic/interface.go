@@ -1,24 +1,77 @@
 package traffic
 
+import "time"
+
 // UserTrafficData holds the traffic usage data for a single player.
 // It is defined here because it's part of the public interface contract.
 type UserTrafficData struct {
-    PlayerName    string `json:"player_name"`
-    UsedBytes     int64  `json:"used_bytes"`
-    LimitMB       int64  `json:"limit_mb"`
-    LastResetTime int64  `json:"last_reset"`
-    LastSeen      int64  `json:"last_seen"`
+    PlayerName      string `json:"player_name"`
+    Service         string `json:"service,omitempty"` // set when the plan counts each service on its own
+    Plan            string `json:"plan,omitempty"`
+    UsedBytes       int64  `json:"used_bytes"` // upload and download together
+    UploadBytes     int64  `json:"upload_bytes"`
+    DownloadBytes   int64  `json:"download_bytes"`
+    LimitMB         int64  `json:"limit_mb"` // zero when only the directions are limited
+    UploadLimitMB   int64  `json:"upload_limit_mb,omitempty"`
+    DownloadLimitMB int64  `json:"download_limit_mb,omitempty"`
+    Unlimited       bool   `json:"unlimited,omitempty"`
+    CustomLimit     bool   `json:"custom_limit,omitempty"` // LimitMB was set for this player, over the plan
+    LastResetTime   int64  `json:"last_reset"`
+    NextReset       int64  `json:"next_reset,omitempty"` // zero when the plan never resets
+    LastSeen        int64  `json:"last_seen"`
+
+    // PlaytimeSeconds is the time played in the period, counted while
+    // the player has sessions, not limited when PlaytimeLimitMin is zero.
+    PlaytimeSeconds  int64 `json:"playtime_seconds,omitempty"`
+    PlaytimeLimitMin int64 `json:"playtime_limit_min,omitempty"`
+
+    // Notified is the highest threshold of the quota reached in the period.
+    Notified float64 `json:"notified,omitempty"`
+
+    // Window holds the daily usage of plans with a rolling period.
+    Window []*DailyUsage `json:"window,omitempty"`
+
+    // Prepaid players use the balance of their credits instead of limits.
+    Prepaid          bool      `json:"prepaid,omitempty"`
+    Credits          []*Credit `json:"credits,omitempty"` // the first expiring first
+    LowBalanceMB     int64     `json:"low_balance_mb,omitempty"`
+    LowBalanceWarned bool      `json:"low_balance_warned,omitempty"`
+}
+
+// Credit is a top-up of the balance of a prepaid player.
+type Credit struct {
+    Reference      string `json:"reference"` // unique per player, such as an order ID
+    AmountBytes    int64  `json:"amount_bytes"`
+    RemainingBytes int64  `json:"remaining_bytes"`
+    Time           int64  `json:"time"`
+    Expires        int64  `json:"expires,omitempty"` // zero when the credit never expires
+}
+
+// DailyUsage is the traffic used on a day.
+type DailyUsage struct {
+    Day           int64 `json:"day"` // start of the day
+    Bytes         int64 `json:"bytes"`
+    UploadBytes   int64 `json:"upload_bytes"`
+    DownloadBytes int64 `json:"download_bytes"`
+    Playtime      int64 `json:"playtime,omitempty"` // seconds
 }
 
 // TrafficLimiterInterface defines the interface for traffic limiters.
+// The key of a counter is given by AccountKey.
 type TrafficLimiterInterface interface {
-    CanUseTraffic(playerName string, bytes int64, defaultLimitMB int64) bool
-    RecordTraffic(playerName string, bytes int64)
-    GetUserInfo(playerName string) (used, limit float64, percentage float64)
+    PrepareAccount(key, playerName, service string, plan Plan)
+    CanUseTraffic(key string, bytes, limitMB int64) bool
+    RecordTraffic(key string, upload, download int64)
+    GetUserInfo(key string, limitMB int64) (used, limit float64, percentage float64, nextReset time.Time)
     Close()
     GetAllUsersStats() map[string]UserTrafficData
-    ResetUserTraffic(playerName string) bool
-    SetUserLimit(playerName string, limitMB int64) bool
+    ResetUserTraffic(key string) bool
+    SetUserLimit(key string, limitMB int64) bool
+    TopUp(key string, amountMB int64, reference string, expires time.Time) error
+    GetBalance(key string) (balanceMB float64, prepaid bool)
+    StartSession(key string)
+    EndSession(key string)
+    GetPlaytime(key string) (played, limit time.Duration, nextReset time.Time)
     CleanupOldData(cutoffTime int64) bool
     ReloadData()
 }
@@ -28,4 +81,4 @@ var globalTrafficLimiter TrafficLimiterInterface
 // SetGlobalTrafficLimiter sets the global traffic limiter instance.
 func SetGlobalTrafficLimiter(limiter TrafficLimiterInterface) {
     globalTrafficLimiter = limiter
-}
\ No newline at end of file
+}
\ No newline at end of file
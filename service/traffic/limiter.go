@@ -1,31 +1,64 @@
 package traffic
 
 import (
+    "bytes"
     "encoding/json"
     "log"
-    "os"
+    "strings"
     "sync"
     "time"
 
+    "github.com/InRaining/NoDelay/config"
+
     "github.com/fatih/color"
 )
 
 // TrafficLimiter implements the logic for tracking and limiting player traffic.
 type TrafficLimiter struct {
-    dataFile   string
-    users      map[string]*UserTrafficData // key: playerName
-    mutex      sync.RWMutex
-    saveTicker *time.Ticker
-    stopChan   chan struct{}
+    store   Store
+    users   map[string]*UserTrafficData // key: AccountKey
+    dirty   map[string]struct{}         // changed since last saved
+    written map[string][]byte           // records as in the last snapshot, to tell edits of operators
+    playing map[string]*playSession     // accounts with sessions open
+    mutex   sync.RWMutex
+
+    readOnly      bool       // the data is only read, as is
+    saveMutex     sync.Mutex // serializes the writes to the store
+    journalTicker *time.Ticker
+    saveTicker    *time.Ticker
+    stopChan      chan struct{}
 }
 
-// NewTrafficLimiter creates and initializes a new TrafficLimiter.
+// NewTrafficLimiter creates and initializes a new TrafficLimiter
+// keeping its data in dataFile with a JournalStore.
 func NewTrafficLimiter(dataFile string) *TrafficLimiter {
+    return NewTrafficLimiterWithStore(NewJournalStore(dataFile))
+}
+
+// NewReadOnlyTrafficLimiter creates a TrafficLimiter reading the data of
+// dataFile without ever writing it, nor dropping the records of players
+// not seen within the retention. Changes are only kept in memory.
+func NewReadOnlyTrafficLimiter(dataFile string) *TrafficLimiter {
+    return newTrafficLimiter(readOnlyStore{NewJournalStore(dataFile)}, true)
+}
+
+// NewTrafficLimiterWithStore creates and initializes a new TrafficLimiter
+// keeping its data in store.
+func NewTrafficLimiterWithStore(store Store) *TrafficLimiter {
+    return newTrafficLimiter(store, false)
+}
+
+func newTrafficLimiter(store Store, readOnly bool) *TrafficLimiter {
     tl := &TrafficLimiter{
-        dataFile:   dataFile,
-        users:      make(map[string]*UserTrafficData),
-        saveTicker: time.NewTicker(5 * time.Minute),
-        stopChan:   make(chan struct{}),
+        store:         store,
+        readOnly:      readOnly,
+        users:         make(map[string]*UserTrafficData),
+        dirty:         make(map[string]struct{}),
+        written:       make(map[string][]byte),
+        playing:       make(map[string]*playSession),
+        journalTicker: time.NewTicker(5 * time.Second),
+        saveTicker:    time.NewTicker(5 * time.Minute),
+        stopChan:      make(chan struct{}),
     }
 
     tl.loadData()
@@ -35,62 +68,173 @@ func NewTrafficLimiter(dataFile string) *TrafficLimiter {
     return tl
 }
 
+// ReloadData applies the changes made to the saved data by operators.
+// Changes made by the limiter itself are ignored.
 func (tl *TrafficLimiter) ReloadData() {
-    log.Println(color.HiMagentaString("Reloading traffic data from file..."))
-    tl.loadData()
-    log.Println(color.HiMagentaString("Traffic data reloaded successfully."))
-}
+    tl.saveMutex.Lock()
+    defer tl.saveMutex.Unlock()
 
+    external, err := tl.store.External()
+    if err != nil {
+        log.Printf("Error reading traffic data: %v", err)
+        return
+    }
+    if external == nil {
+        // our own save
+        return
+    }
 
-func (tl *TrafficLimiter) loadData() {
+    log.Println(color.HiMagentaString("Reloading traffic data edited outside NoDelay..."))
     tl.mutex.Lock()
-    defer tl.mutex.Unlock()
+    changed := 0
+    for key, userData := range external {
+        data, _ := json.Marshal(userData)
+        if !bytes.Equal(data, tl.written[key]) {
+            tl.users[key] = userData
+            changed++
+        }
+    }
+    for key := range tl.written {
+        if _, ok := external[key]; !ok {
+            delete(tl.users, key)
+            changed++
+        }
+    }
+    tl.mutex.Unlock()
 
-    data, err := os.ReadFile(tl.dataFile)
+    // the journal must not be replayed over the edits
+    tl.snapshotLocked()
+    log.Println(color.HiMagentaString("Traffic data reloaded successfully: %d records changed.", changed))
+}
+
+func (tl *TrafficLimiter) loadData() {
+    users, err := tl.store.Load()
     if err != nil {
-        if !os.IsNotExist(err) {
-            log.Printf("Error reading traffic data file: %v", err)
-        }
+        log.Printf("Error loading traffic data: %v", err)
         return
     }
 
-    var users map[string]*UserTrafficData
-    err = json.Unmarshal(data, &users)
-    if err != nil {
-        log.Printf("Error parsing traffic data: %v", err)
+    tl.mutex.Lock()
+    // Clean up the records of players not seen within the retention
+    now := time.Now()
+    cutoff := retentionCutoff(now)
+    for key, userData := range users {
+        if tl.readOnly || cutoff.IsZero() || userData.LastSeen > cutoff.Unix() || userData.holdsBalance(now) {
+            tl.users[key] = userData
+        }
+    }
+    log.Printf("Loaded traffic data for %d players", len(tl.users))
+    tl.mutex.Unlock()
+    if tl.readOnly {
         return
     }
 
-    // Clean up expired data (data older than 7 days)
-    cutoff := time.Now().AddDate(0, 0, -7).Unix()
-    for _, userData := range users {
-        if userData.LastSeen > cutoff {
-            tl.users[userData.PlayerName] = userData
+    tl.saveMutex.Lock()
+    tl.snapshotLocked()
+    tl.saveMutex.Unlock()
+}
+
+// copyRecord returns a copy of a record which can be used without the lock.
+func copyRecord(userData *UserTrafficData) *UserTrafficData {
+    c := *userData
+    if userData.Window != nil {
+        c.Window = make([]*DailyUsage, len(userData.Window))
+        for i, day := range userData.Window {
+            d := *day
+            c.Window[i] = &d
         }
     }
+    if userData.Credits != nil {
+        c.Credits = make([]*Credit, len(userData.Credits))
+        for i, credit := range userData.Credits {
+            cc := *credit
+            c.Credits[i] = &cc
+        }
+    }
+    return &c
+}
 
-    log.Printf("Loaded traffic data for %d players", len(tl.users))
+func (tl *TrafficLimiter) markDirtyLocked(key string) {
+    tl.dirty[key] = struct{}{}
 }
 
-func (tl *TrafficLimiter) saveData() {
-    tl.mutex.RLock()
-    defer tl.mutex.RUnlock()
+// flushJournal appends the records changed since the last save to the store.
+func (tl *TrafficLimiter) flushJournal() {
+    tl.saveMutex.Lock()
+    defer tl.saveMutex.Unlock()
 
-    data, err := json.MarshalIndent(tl.users, "", "  ")
-    if err != nil {
-        log.Printf("Error marshaling traffic data: %v", err)
+    tl.mutex.Lock()
+    if len(tl.dirty) == 0 {
+        tl.mutex.Unlock()
         return
     }
+    changes := make(map[string]*UserTrafficData, len(tl.dirty))
+    for key := range tl.dirty {
+        if userData, ok := tl.users[key]; ok {
+            changes[key] = copyRecord(userData)
+        } else {
+            changes[key] = nil // deleted
+        }
+    }
+    tl.dirty = make(map[string]struct{})
+    tl.mutex.Unlock()
 
-    err = os.WriteFile(tl.dataFile, data, 0644)
-    if err != nil {
+    if err := tl.store.Append(changes); err != nil {
+        log.Printf("Error saving traffic data: %v", err)
+        tl.mutex.Lock()
+        for key := range changes {
+            tl.markDirtyLocked(key)
+        }
+        tl.mutex.Unlock()
+        return
+    }
+    if tl.store.NeedsSnapshot() {
+        tl.snapshotLocked()
+    }
+}
+
+// snapshotLocked saves all the records. saveMutex must be held.
+func (tl *TrafficLimiter) snapshotLocked() {
+    tl.mutex.Lock()
+    records := make(map[string]*UserTrafficData, len(tl.users))
+    for key, userData := range tl.users {
+        records[key] = copyRecord(userData)
+    }
+    dirty := tl.dirty
+    tl.dirty = make(map[string]struct{})
+    tl.mutex.Unlock()
+
+    if err := tl.store.Snapshot(records); err != nil {
         log.Printf("Error saving traffic data: %v", err)
+        tl.mutex.Lock()
+        for key := range dirty {
+            tl.markDirtyLocked(key)
+        }
+        tl.mutex.Unlock()
+        return
     }
+
+    written := make(map[string][]byte, len(records))
+    for key, userData := range records {
+        written[key], _ = json.Marshal(userData)
+    }
+    tl.mutex.Lock()
+    tl.written = written
+    tl.mutex.Unlock()
+}
+
+func (tl *TrafficLimiter) saveData() {
+    tl.saveMutex.Lock()
+    defer tl.saveMutex.Unlock()
+    tl.snapshotLocked()
 }
 
 func (tl *TrafficLimiter) autoSave() {
     for {
         select {
+        case <-tl.journalTicker.C:
+            tl.accruePlaytime()
+            tl.flushJournal()
         case <-tl.saveTicker.C:
             tl.saveData()
         case <-tl.stopChan:
@@ -106,109 +250,333 @@ func (tl *TrafficLimiter) autoReset() {
     for {
         select {
         case <-ticker.C:
-            tl.checkAndResetDaily()
+            tl.checkAndResetPeriods()
+            if cutoff := retentionCutoff(time.Now()); !cutoff.IsZero() {
+                tl.CleanupOldData(cutoff.Unix())
+            }
         case <-tl.stopChan:
             return
         }
     }
 }
 
-func (tl *TrafficLimiter) checkAndResetDaily() {
+func (tl *TrafficLimiter) checkAndResetPeriods() {
     tl.mutex.Lock()
     defer tl.mutex.Unlock()
 
     now := time.Now()
-    today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
-    todayUnix := today.Unix()
-
     resetCount := 0
-    for _, userData := range tl.users {
-        if userData.LastResetTime < todayUnix {
-            userData.UsedBytes = 0
-            userData.LastResetTime = todayUnix
+    for key, userData := range tl.users {
+        if tl.resetIfDueLocked(userData, now) {
+            tl.markDirtyLocked(key)
             resetCount++
         }
     }
 
     if resetCount > 0 {
-        color.HiCyan("Daily traffic reset: Traffic for %d players has been reset.", resetCount)
+        color.HiCyan("Traffic reset: Traffic for %d players has been reset.", resetCount)
     }
 }
 
-// CanUseTraffic checks if a player can use the specified amount of traffic.
-func (tl *TrafficLimiter) CanUseTraffic(playerName string, bytes int64, defaultLimitMB int64) bool {
+// resetIfDueLocked resets the usage of a player when a new period of their
+// plan has begun, and drops the days which left the window of rolling plans.
+func (tl *TrafficLimiter) resetIfDueLocked(userData *UserTrafficData, now time.Time) bool {
+    schedule := lookupPlan(userData.Plan).ResetSchedule
+    if userData.Prepaid {
+        return tl.resetPlaytimeLocked(userData, schedule, now)
+    }
+    switch schedule.Period {
+    case PeriodNever:
+        userData.NextReset = 0
+        return false
+    case PeriodRolling:
+        return tl.slideWindowLocked(userData, schedule, now)
+    }
+
+    userData.Window = nil
+    start, next := periodBounds(schedule, now)
+    userData.NextReset = next.Unix()
+    if userData.LastResetTime >= start.Unix() {
+        return false
+    }
+    userData.clearUsage()
+    userData.Notified = 0
+    userData.LastResetTime = start.Unix()
+    return true
+}
+
+// resetPlaytimeLocked resets the playtime of a prepaid player by the period
+// of their plan. Their balance never resets, so the traffic is left alone.
+func (tl *TrafficLimiter) resetPlaytimeLocked(userData *UserTrafficData, schedule config.ResetSchedule, now time.Time) bool {
+    switch schedule.Period {
+    case PeriodNever:
+        userData.Window = nil
+        userData.NextReset = 0
+        return false
+    case PeriodRolling:
+        today := dayStart(now)
+        if len(userData.Window) == 0 && userData.PlaytimeSeconds > 0 {
+            userData.Window = []*DailyUsage{{Day: today.Unix(), Playtime: userData.PlaytimeSeconds}}
+        }
+        cutoff := today.AddDate(0, 0, 1-rollingDays(schedule)).Unix()
+        window := userData.Window[:0]
+        userData.PlaytimeSeconds = 0
+        for _, day := range userData.Window {
+            if day.Day >= cutoff {
+                window = append(window, day)
+                userData.PlaytimeSeconds += day.Playtime
+            }
+        }
+        dropped := len(window) != len(userData.Window)
+        userData.Window = window
+        userData.NextReset = 0
+        if len(window) > 0 {
+            userData.NextReset = time.Unix(window[0].Day, 0).In(today.Location()).AddDate(0, 0, rollingDays(schedule)).Unix()
+        }
+        return dropped
+    }
+
+    userData.Window = nil
+    start, next := periodBounds(schedule, now)
+    userData.NextReset = next.Unix()
+    if userData.LastResetTime >= start.Unix() {
+        return false
+    }
+    userData.PlaytimeSeconds = 0
+    userData.LastResetTime = start.Unix()
+    return true
+}
+
+// slideWindowLocked drops the days older than the rolling window, so that
+// the usage of the player is the sum of the days left.
+func (tl *TrafficLimiter) slideWindowLocked(userData *UserTrafficData, schedule config.ResetSchedule, now time.Time) bool {
+    today := dayStart(now)
+    if len(userData.Window) == 0 && (userData.UsedBytes > 0 || userData.PlaytimeSeconds > 0) {
+        // the usage from before the plan became rolling
+        userData.Window = []*DailyUsage{{
+            Day:           today.Unix(),
+            Bytes:         userData.UsedBytes,
+            UploadBytes:   userData.UploadBytes,
+            DownloadBytes: userData.DownloadBytes,
+            Playtime:      userData.PlaytimeSeconds,
+        }}
+    }
+
+    cutoff := today.AddDate(0, 0, 1-rollingDays(schedule)).Unix()
+    window := userData.Window[:0]
+    userData.clearUsage()
+    for _, day := range userData.Window {
+        if day.Day >= cutoff {
+            window = append(window, day)
+            userData.UsedBytes += day.Bytes
+            userData.UploadBytes += day.UploadBytes
+            userData.DownloadBytes += day.DownloadBytes
+            userData.PlaytimeSeconds += day.Playtime
+        }
+    }
+    dropped := len(window) != len(userData.Window)
+    userData.Window = window
+
+    userData.NextReset = 0
+    if len(window) > 0 {
+        // the oldest day leaves the window
+        userData.NextReset = time.Unix(window[0].Day, 0).In(today.Location()).AddDate(0, 0, rollingDays(schedule)).Unix()
+    }
+    return dropped
+}
+
+// PrepareAccount creates the record of a player logging in, or updates its plan.
+func (tl *TrafficLimiter) PrepareAccount(key, playerName, service string, plan Plan) {
     tl.mutex.Lock()
     defer tl.mutex.Unlock()
 
-    userData, exists := tl.users[playerName]
+    now := time.Now()
+    userData, exists := tl.users[key]
     if !exists {
-        // When creating a new user, set the correct limit immediately.
         userData = &UserTrafficData{
             PlayerName:    playerName,
-            UsedBytes:     0,
-            LimitMB:       defaultLimitMB, // Ensure the passed default limit is used.
-            LastResetTime: time.Now().Unix(),
-            LastSeen:      time.Now().Unix(),
+            LastResetTime: now.Unix(),
+        }
+        if start, _ := periodBounds(plan.ResetSchedule, now); !start.IsZero() {
+            userData.LastResetTime = start.Unix()
         }
-        tl.users[playerName] = userData
-        log.Printf("Created new player traffic record: %s (Limit: %d MB)", playerName, defaultLimitMB)
+        tl.users[key] = userData
+        log.Printf("Created new player traffic record: %s (Plan: %s, Limit: %d MB)", key, plan.Name, plan.LimitMB)
     }
 
-    // Update the last seen time.
-    userData.LastSeen = time.Now().Unix()
-
-    // Check if a reset is needed (new day).
-    now := time.Now()
-    today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
-    if userData.LastResetTime < today.Unix() {
-        userData.UsedBytes = 0
-        userData.LastResetTime = today.Unix()
-        log.Printf("Reset daily traffic for player: %s", playerName)
+    if plan.Scope == ScopeService {
+        userData.Service = service
+    }
+    userData.Plan = plan.Name
+    userData.Unlimited = plan.Unlimited
+    if !userData.CustomLimit {
+        userData.LimitMB = plan.LimitMB
     }
+    userData.UploadLimitMB = plan.UploadLimitMB
+    userData.DownloadLimitMB = plan.DownloadLimitMB
+    userData.Prepaid = plan.Prepaid
+    userData.LowBalanceMB = plan.LowBalanceMB
+    userData.PlaytimeLimitMin = plan.PlaytimeLimitMin
+    userData.LastSeen = now.Unix()
+    if tl.resetIfDueLocked(userData, now) {
+        log.Printf("Reset traffic for player: %s", key)
+    }
+    tl.markDirtyLocked(key)
+}
 
-    // If the user's limit is 0, update it to the new default limit.
-    if userData.LimitMB == 0 && defaultLimitMB > 0 {
-        userData.LimitMB = defaultLimitMB
-        log.Printf("Updated player %s limit from 0 to %d MB", playerName, defaultLimitMB)
+// CanUseTraffic checks if a player can use the specified amount of traffic.
+// Players without a record are not limited. A positive limitMB takes the
+// place of the total limit of the player, for connections given their own
+// limit by the ListAPI.
+func (tl *TrafficLimiter) CanUseTraffic(key string, bytes, limitMB int64) bool {
+    tl.mutex.Lock()
+    defer tl.mutex.Unlock()
+
+    userData, exists := tl.users[key]
+    if !exists {
+        return true
     }
 
-    limitBytes := userData.LimitMB * 1024 * 1024
-    canUse := userData.UsedBytes+bytes <= limitBytes
+    now := time.Now()
+    userData.LastSeen = now.Unix()
+    if tl.resetIfDueLocked(userData, now) {
+        log.Printf("Reset traffic for player: %s", key)
+    }
+    tl.markDirtyLocked(key)
+    if userData.Unlimited {
+        return true
+    }
+    if userData.Prepaid {
+        remaining, _ := userData.balance(now)
+        return remaining > 0 && remaining >= bytes
+    }
 
-    return canUse
+    for _, l := range userData.limits(limitMB) {
+        if l.limitMB > 0 && l.used+bytes > l.limitMB*1024*1024 {
+            return false
+        }
+    }
+    return true
 }
 
-// RecordTraffic records the traffic used by a player.
-func (tl *TrafficLimiter) RecordTraffic(playerName string, bytes int64) {
+// RecordTraffic records the traffic used by a player in each direction.
+func (tl *TrafficLimiter) RecordTraffic(key string, upload, download int64) {
     tl.mutex.Lock()
     defer tl.mutex.Unlock()
 
-    userData, exists := tl.users[playerName]
+    userData, exists := tl.users[key]
     if !exists {
         return
     }
 
-    userData.UsedBytes += bytes
-    userData.LastSeen = time.Now().Unix()
+    now := time.Now()
+    userData.UsedBytes += upload + download
+    userData.UploadBytes += upload
+    userData.DownloadBytes += download
+    userData.LastSeen = now.Unix()
+    tl.markDirtyLocked(key)
+    if userData.Prepaid {
+        userData.debit(upload+download, now)
+        tl.warnLowBalanceLocked(key, userData, now)
+        tl.checkThresholdsLocked(key, userData, now)
+        return
+    }
+    if day := userData.windowDay(now); day != nil {
+        day.Bytes += upload + download
+        day.UploadBytes += upload
+        day.DownloadBytes += download
+    }
+    tl.checkThresholdsLocked(key, userData, now)
+}
+
+// windowDay returns the usage of today of a player with a rolling plan,
+// or nil for other plans.
+func (u *UserTrafficData) windowDay(now time.Time) *DailyUsage {
+    if lookupPlan(u.Plan).Period != PeriodRolling {
+        return nil
+    }
+    today := dayStart(now).Unix()
+    n := len(u.Window)
+    if n == 0 || u.Window[n-1].Day != today {
+        u.Window = append(u.Window, &DailyUsage{Day: today})
+        n++
+    }
+    return u.Window[n-1]
+}
+
+// usageLimit is a counter of a player with its limit.
+type usageLimit struct {
+    used    int64
+    limitMB int64 // not limited when zero
 }
 
-// GetUserInfo gets player traffic information.
-func (tl *TrafficLimiter) GetUserInfo(playerName string) (used, limit float64, percentage float64) {
+// limits returns the counters of a player, with limitMB in place of the
+// total limit when positive.
+func (u *UserTrafficData) limits(limitMB int64) [3]usageLimit {
+    if limitMB <= 0 {
+        limitMB = u.LimitMB
+    }
+    return [3]usageLimit{
+        {u.UsedBytes, limitMB},
+        {u.UploadBytes, u.UploadLimitMB},
+        {u.DownloadBytes, u.DownloadLimitMB},
+    }
+}
+
+func (u *UserTrafficData) clearUsage() {
+    u.UsedBytes = 0
+    u.UploadBytes = 0
+    u.DownloadBytes = 0
+    u.PlaytimeSeconds = 0
+}
+
+// GetUserInfo gets player traffic information. The usage is the one of the
+// most used of the total, upload and download limits of the player, or for
+// prepaid players the usage of the credits which have not expired.
+// Unlimited players have no limit, and nextReset is zero when the plan never
+// resets and for prepaid players, whose balance doesn't.
+// A positive limitMB takes the place of the total limit, as for CanUseTraffic.
+func (tl *TrafficLimiter) GetUserInfo(key string, limitMB int64) (used, limit float64, percentage float64, nextReset time.Time) {
     tl.mutex.RLock()
     defer tl.mutex.RUnlock()
 
-    userData, exists := tl.users[playerName]
+    userData, exists := tl.users[key]
     if !exists {
         // If the user does not exist, return 0 without creating a record.
-        return 0, 0, 0
+        return 0, 0, 0, time.Time{}
     }
 
-    used = float64(userData.UsedBytes) / (1024 * 1024) // Convert to MB
-    limit = float64(userData.LimitMB)
-    if limit > 0 {
-        percentage = (used / limit) * 100
+    if userData.NextReset > 0 && !userData.Prepaid {
+        nextReset = time.Unix(userData.NextReset, 0).In(location())
     }
+    used, limit, percentage = userData.usage(time.Now(), limitMB)
+    return used, limit, percentage, nextReset
+}
 
+// usage returns the usage reported by GetUserInfo, in MB.
+func (u *UserTrafficData) usage(now time.Time, limitMB int64) (used, limit float64, percentage float64) {
+    used = float64(u.UsedBytes) / (1024 * 1024) // Convert to MB
+    if u.Unlimited {
+        return used, 0, 0
+    }
+    if u.Prepaid {
+        remaining, amount := u.balance(now)
+        used = float64(amount-remaining) / (1024 * 1024)
+        limit = float64(amount) / (1024 * 1024)
+        if amount > 0 {
+            percentage = used / limit * 100
+        }
+        return used, limit, percentage
+    }
+    for _, l := range u.limits(limitMB) {
+        if l.limitMB <= 0 {
+            continue
+        }
+        lUsed := float64(l.used) / (1024 * 1024)
+        if p := lUsed / float64(l.limitMB) * 100; limit == 0 || p > percentage {
+            used, limit, percentage = lUsed, float64(l.limitMB), p
+        }
+    }
     return used, limit, percentage
 }
 
@@ -218,60 +586,66 @@ func (tl *TrafficLimiter) GetAllUsersStats() map[string]UserTrafficData {
     defer tl.mutex.RUnlock()
 
     stats := make(map[string]UserTrafficData)
-    for playerName, userData := range tl.users {
-        stats[playerName] = *userData
+    for key, userData := range tl.users {
+        stats[key] = *copyRecord(userData)
     }
 
     return stats
 }
 
 // ResetUserTraffic resets the traffic for a specific player.
-func (tl *TrafficLimiter) ResetUserTraffic(playerName string) bool {
+func (tl *TrafficLimiter) ResetUserTraffic(key string) bool {
     tl.mutex.Lock()
     defer tl.mutex.Unlock()
 
-    userData, exists := tl.users[playerName]
+    userData, exists := tl.users[key]
     if !exists {
         return false
     }
 
-    userData.UsedBytes = 0
+    userData.clearUsage()
+    userData.Window = nil
+    userData.Notified = 0
     userData.LastResetTime = time.Now().Unix()
+    tl.markDirtyLocked(key)
     return true
 }
 
-// SetUserLimit sets the traffic limit for a player.
-func (tl *TrafficLimiter) SetUserLimit(playerName string, limitMB int64) bool {
+// SetUserLimit sets the traffic limit for a player, over the limit of their plan.
+func (tl *TrafficLimiter) SetUserLimit(key string, limitMB int64) bool {
     tl.mutex.Lock()
     defer tl.mutex.Unlock()
 
-    userData, exists := tl.users[playerName]
+    userData, exists := tl.users[key]
     if !exists {
+        playerName, service, _ := strings.Cut(key, "@")
         userData = &UserTrafficData{
             PlayerName:    playerName,
-            UsedBytes:     0,
-            LimitMB:       limitMB,
+            Service:       service,
             LastResetTime: time.Now().Unix(),
-            LastSeen:      time.Now().Unix(),
         }
-        tl.users[playerName] = userData
-    } else {
-        userData.LimitMB = limitMB
-        userData.LastSeen = time.Now().Unix()
+        tl.users[key] = userData
     }
+    userData.LimitMB = limitMB
+    userData.CustomLimit = true
+    userData.LastSeen = time.Now().Unix()
+    tl.markDirtyLocked(key)
 
     return true
 }
 
 // CleanupOldData cleans up expired data.
+// The records of prepaid players and of players with a balance are kept.
 func (tl *TrafficLimiter) CleanupOldData(cutoffTime int64) bool {
     tl.mutex.Lock()
     defer tl.mutex.Unlock()
 
+    now := time.Now()
     initialCount := len(tl.users)
-    for playerName, userData := range tl.users {
-        if userData.LastSeen < cutoffTime {
-            delete(tl.users, playerName)
+    for key, userData := range tl.users {
+        if userData.LastSeen < cutoffTime && !userData.holdsBalance(now) {
+            delete(tl.users, key)
+            tl.markDirtyLocked(key)
         }
     }
 
@@ -289,7 +663,13 @@ func (tl *TrafficLimiter) CleanupOldData(cutoffTime int64) bool {
 // Close shuts down the traffic limiter.
 func (tl *TrafficLimiter) Close() {
     close(tl.stopChan)
+    tl.journalTicker.Stop()
     tl.saveTicker.Stop()
     tl.saveData()
-    color.HiGreen("Traffic data saved.")
-}
\ No newline at end of file
+    if err := tl.store.Close(); err != nil {
+        log.Printf("Error closing traffic data: %v", err)
+    }
+    if !tl.readOnly {
+        color.HiGreen("Traffic data saved.")
+    }
+}
\ No newline at end of file
@@ -0,0 +1,125 @@
+package traffic
+
+import (
+    "math"
+    "path/filepath"
+    "testing"
+
+    "github.com/InRaining/NoDelay/config"
+)
+
+const mb = 1024 * 1024
+
+func TestSeparateLimits(t *testing.T) {
+    for _, tt := range []struct {
+        name           string
+        plan           config.TrafficPlan
+        limitMB        int64 // given by the ListAPI
+        upload         int64 // MB
+        download       int64
+        wantAllowed    bool
+        wantUsed       float64 // of the most used limit, in MB
+        wantLimit      float64
+        wantPercentage float64
+    }{
+        {
+            name:        "within every limit",
+            plan:        config.TrafficPlan{LimitMB: 100, UploadLimitMB: 10, DownloadLimitMB: 50},
+            upload:      5,
+            download:    10,
+            wantAllowed: true, wantUsed: 5, wantLimit: 10, wantPercentage: 50,
+        },
+        {
+            name:        "upload over its limit",
+            plan:        config.TrafficPlan{LimitMB: 100, UploadLimitMB: 10, DownloadLimitMB: 50},
+            upload:      11,
+            download:    10,
+            wantAllowed: false, wantUsed: 11, wantLimit: 10, wantPercentage: 110,
+        },
+        {
+            name:        "download over its limit",
+            plan:        config.TrafficPlan{LimitMB: 100, UploadLimitMB: 10, DownloadLimitMB: 50},
+            upload:      1,
+            download:    51,
+            wantAllowed: false, wantUsed: 51, wantLimit: 50, wantPercentage: 102,
+        },
+        {
+            name:        "total over its limit",
+            plan:        config.TrafficPlan{LimitMB: 60, UploadLimitMB: 40, DownloadLimitMB: 40},
+            upload:      30,
+            download:    31,
+            wantAllowed: false, wantUsed: 61, wantLimit: 60, wantPercentage: 61.0 / 60 * 100,
+        },
+        {
+            name:        "only a download limit",
+            plan:        config.TrafficPlan{DownloadLimitMB: 50},
+            upload:      500,
+            download:    25,
+            wantAllowed: true, wantUsed: 25, wantLimit: 50, wantPercentage: 50,
+        },
+        {
+            name:        "the ListAPI replaces the total limit only",
+            plan:        config.TrafficPlan{LimitMB: 10, UploadLimitMB: 30},
+            limitMB:     100,
+            upload:      31,
+            download:    1,
+            wantAllowed: false, wantUsed: 31, wantLimit: 30, wantPercentage: 31.0 / 30 * 100,
+        },
+        {
+            name:        "unlimited",
+            plan:        config.TrafficPlan{Unlimited: true, UploadLimitMB: 10},
+            upload:      20,
+            wantAllowed: true, wantUsed: 20,
+        },
+    } {
+        t.Run(tt.name, func(t *testing.T) {
+            tl := NewTrafficLimiter(filepath.Join(t.TempDir(), "TrafficTable.json"))
+            defer tl.Close()
+            tl.PrepareAccount("Steve", "Steve", "lobby", Plan{Name: DefaultPlanName, TrafficPlan: tt.plan})
+            tl.RecordTraffic("Steve", tt.upload*mb, tt.download*mb)
+
+            if got := tl.CanUseTraffic("Steve", 0, tt.limitMB); got != tt.wantAllowed {
+                t.Errorf("allowed %v, want %v", got, tt.wantAllowed)
+            }
+            used, limit, percentage, _ := tl.GetUserInfo("Steve", tt.limitMB)
+            if used != tt.wantUsed || limit != tt.wantLimit || math.Abs(percentage-tt.wantPercentage) > 1e-9 {
+                t.Errorf("usage %v MB of %v MB (%v%%), want %v MB of %v MB (%v%%)",
+                    used, limit, percentage, tt.wantUsed, tt.wantLimit, tt.wantPercentage)
+            }
+            record := tl.GetAllUsersStats()["Steve"]
+            if record.UploadBytes != tt.upload*mb || record.DownloadBytes != tt.download*mb ||
+                record.UsedBytes != (tt.upload+tt.download)*mb {
+                t.Errorf("counted %d up, %d down and %d in total", record.UploadBytes, record.DownloadBytes, record.UsedBytes)
+            }
+        })
+    }
+}
+
+func TestSeparateLimits_Plan(t *testing.T) {
+    saved := config.Config.TrafficLimiter
+    defer func() { config.Config.TrafficLimiter = saved }()
+    config.Config.TrafficLimiter = &config.TrafficLimiterConfig{
+        TrafficLimitMB: 500,
+        Plans: map[string]*config.TrafficPlan{
+            "uploaders": {UploadLimitMB: 10},
+            "both":      {LimitMB: 100, DownloadLimitMB: 50},
+            "none":      {},
+        },
+    }
+
+    for _, tt := range []struct {
+        plan                        string
+        wantTotal, wantUp, wantDown int64
+    }{
+        // a plan limiting a direction has no total limit but its own
+        {plan: "uploaders", wantUp: 10},
+        {plan: "both", wantTotal: 100, wantDown: 50},
+        {plan: "none", wantTotal: 500},
+    } {
+        p := lookupPlan(tt.plan)
+        if p.LimitMB != tt.wantTotal || p.UploadLimitMB != tt.wantUp || p.DownloadLimitMB != tt.wantDown {
+            t.Errorf("plan %s limits %d, %d and %d MB, want %d, %d and %d",
+                tt.plan, p.LimitMB, p.UploadLimitMB, p.DownloadLimitMB, tt.wantTotal, tt.wantUp, tt.wantDown)
+        }
+    }
+}
@@ -0,0 +1,41 @@
+package traffic
+
+import (
+    "errors"
+    "fmt"
+    "os"
+)
+
+// ErrDataLocked is returned by LockData when another process uses the data.
+var ErrDataLocked = errors.New("traffic data is in use by another process")
+
+// DataLock is held by the process using the traffic data, the running NoDelay
+// or an admin command changing the data offline, so that only one of them
+// writes the data at a time.
+type DataLock struct {
+    file *os.File
+}
+
+// LockData takes the exclusive lock of the traffic data in dataFile,
+// kept in dataFile + ".lock". It returns ErrDataLocked if it is held.
+func LockData(dataFile string) (*DataLock, error) {
+    f, err := os.OpenFile(dataFile+".lock", os.O_RDWR|os.O_CREATE, 0644)
+    if err != nil {
+        return nil, err
+    }
+    if err := lockFile(f); err != nil {
+        f.Close()
+        return nil, err
+    }
+    // for operators wondering who holds it
+    f.Truncate(0) //nolint:errcheck
+    f.WriteAt([]byte(fmt.Sprintf("%d\n", os.Getpid())), 0) //nolint:errcheck
+    return &DataLock{file: f}, nil
+}
+
+// Unlock releases the lock. The lock file is kept, as removing it
+// could let two processes lock different files.
+func (l *DataLock) Unlock() error {
+    unlockFile(l.file) //nolint:errcheck
+    return l.file.Close()
+}
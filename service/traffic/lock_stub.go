@@ -0,0 +1,10 @@
+//go:build wasm
+
+package traffic
+
+import "os"
+
+// files can't be locked, and there is a single process anyway
+func lockFile(f *os.File) error { return nil }
+
+func unlockFile(f *os.File) error { return nil }
@@ -0,0 +1,24 @@
+//go:build !windows && !wasm
+
+package traffic
+
+import (
+    "errors"
+    "os"
+
+    "golang.org/x/sys/unix"
+)
+
+func lockFile(f *os.File) error {
+    lock := unix.Flock_t{Type: unix.F_WRLCK}
+    err := unix.FcntlFlock(f.Fd(), unix.F_SETLK, &lock)
+    if errors.Is(err, unix.EAGAIN) || errors.Is(err, unix.EACCES) {
+        return ErrDataLocked
+    }
+    return err
+}
+
+func unlockFile(f *os.File) error {
+    lock := unix.Flock_t{Type: unix.F_UNLCK}
+    return unix.FcntlFlock(f.Fd(), unix.F_SETLK, &lock)
+}
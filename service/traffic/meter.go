@@ -0,0 +1,103 @@
+package traffic
+
+import (
+    "log"
+    "sync/atomic"
+    "time"
+)
+
+const (
+    meterBatch    = 256 * 1024
+    meterInterval = time.Second
+)
+
+// Meter counts the traffic of a connection of a player into their account
+// and into the history.
+// It is fed by the copy loop, and records the bytes in batches, so that
+// counting costs an atomic addition and the connections are not wrapped.
+type Meter struct {
+    key        string // empty when the traffic is not limited
+    limitMB    int64  // limit given to the connection by the ListAPI, 0 for the one of the account
+    playerName string
+    service    string
+    started    time.Time
+
+    upload    MeterDirection
+    download  MeterDirection
+    lastFlush atomic.Int64 // unix nano
+    exceeded  atomic.Bool
+
+    onExceeded func()
+}
+
+// MeterDirection counts one direction of a connection into its Meter.
+type MeterDirection struct {
+    meter   *Meter
+    pending atomic.Int64
+    total   atomic.Int64
+}
+
+// NewMeter creates the meter of a connection of a player to a service counting
+// into the account key, if not empty. A positive limitMB takes the place of the
+// limit of the account for this connection. onExceeded is called once when
+// the player runs out of traffic, and must close the connection.
+func NewMeter(key, playerName, service string, limitMB int64, onExceeded func()) *Meter {
+    m := &Meter{
+        key:        key,
+        limitMB:    limitMB,
+        playerName: playerName,
+        service:    service,
+        started:    time.Now(),
+        onExceeded: onExceeded,
+    }
+    m.upload.meter = m
+    m.download.meter = m
+    m.lastFlush.Store(m.started.UnixNano())
+    return m
+}
+
+// Upload returns the counter of the bytes from the player to the server.
+func (m *Meter) Upload() *MeterDirection {
+    return &m.upload
+}
+
+// Download returns the counter of the bytes from the server to the player.
+func (m *Meter) Download() *MeterDirection {
+    return &m.download
+}
+
+// Add counts n bytes copied.
+func (d *MeterDirection) Add(n int64) {
+    d.total.Add(n)
+    m := d.meter
+    if d.pending.Add(n) >= meterBatch || time.Now().UnixNano()-m.lastFlush.Load() >= int64(meterInterval) {
+        m.Flush()
+    }
+}
+
+// Flush records the bytes counted since the last flush.
+func (m *Meter) Flush() {
+    upload, download := m.upload.pending.Swap(0), m.download.pending.Swap(0)
+    m.lastFlush.Store(time.Now().UnixNano())
+    if upload == 0 && download == 0 {
+        return
+    }
+    if globalHistory != nil {
+        globalHistory.Record(m.playerName, m.service, upload, download)
+    }
+    if m.key == "" {
+        return
+    }
+    RecordUserTraffic(m.key, upload, download)
+    if !CheckUserTraffic(m.key, 0, m.limitMB) && m.exceeded.CompareAndSwap(false, true) {
+        log.Printf("Traffic limit exceeded for player %s, closing the connection", m.key)
+        m.onExceeded()
+    }
+}
+
+// Close records the remaining bytes when the connection ends.
+func (m *Meter) Close() {
+    m.Flush()
+    log.Printf("Session ended for %s on %s: Upload=%d bytes, Download=%d bytes, Duration=%s",
+        m.playerName, m.service, m.upload.total.Load(), m.download.total.Load(), time.Since(m.started).Round(time.Second))
+}
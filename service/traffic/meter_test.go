@@ -0,0 +1,147 @@
+package traffic
+
+import (
+    "path/filepath"
+    "sync"
+    "sync/atomic"
+    "testing"
+    "time"
+
+    "github.com/InRaining/NoDelay/config"
+)
+
+// withLimiter sets a traffic limiter as the global one for the duration of
+// the test, with a record for Steve limited to limitMB.
+func withLimiter(t *testing.T, limitMB int64) *TrafficLimiter {
+    tl := NewTrafficLimiter(filepath.Join(t.TempDir(), "TrafficTable.json"))
+    tl.PrepareAccount("Steve", "Steve", "lobby", Plan{Name: DefaultPlanName, TrafficPlan: config.TrafficPlan{LimitMB: limitMB}})
+    SetGlobalTrafficLimiter(tl)
+    t.Cleanup(func() {
+        SetGlobalTrafficLimiter(nil)
+        tl.Close()
+    })
+    return tl
+}
+
+func usedBytes(tl *TrafficLimiter, key string) (upload, download int64) {
+    record := tl.GetAllUsersStats()[key]
+    return record.UploadBytes, record.DownloadBytes
+}
+
+func TestMeter_Flush(t *testing.T) {
+    tl := withLimiter(t, 1024)
+    history := NewHistory(filepath.Join(t.TempDir(), "TrafficHistory.json"))
+    defer history.Close()
+    SetGlobalHistory(history)
+    defer SetGlobalHistory(nil)
+
+    m := NewMeter("Steve", "Steve", "lobby", 0, func() { t.Error("the connection was closed") })
+
+    // small writes wait for a batch
+    m.Upload().Add(1000)
+    m.Download().Add(2000)
+    if up, down := usedBytes(tl, "Steve"); up != 0 || down != 0 {
+        t.Fatalf("recorded %d and %d bytes before a batch, want none", up, down)
+    }
+
+    // a full batch in either direction records both
+    m.Download().Add(meterBatch)
+    if up, down := usedBytes(tl, "Steve"); up != 1000 || down != 2000+meterBatch {
+        t.Fatalf("recorded %d and %d bytes after a batch, want 1000 and %d", up, down, 2000+meterBatch)
+    }
+
+    // so does the first write after the interval
+    m.Upload().Add(10)
+    m.lastFlush.Store(time.Now().Add(-meterInterval).UnixNano())
+    m.Upload().Add(10)
+    if up, _ := usedBytes(tl, "Steve"); up != 1020 {
+        t.Fatalf("recorded %d bytes uploaded after the interval, want 1020", up)
+    }
+
+    // and the end of the connection
+    m.Upload().Add(5)
+    m.Close()
+    if up, _ := usedBytes(tl, "Steve"); up != 1025 {
+        t.Fatalf("recorded %d bytes uploaded after the end, want 1025", up)
+    }
+    if m.upload.total.Load() != 1025 || m.download.total.Load() != 2000+meterBatch {
+        t.Errorf("totals %d and %d", m.upload.total.Load(), m.download.total.Load())
+    }
+
+    points := history.Query(HistoryQuery{Player: "Steve"})
+    if len(points) != 1 || points[0].UploadBytes != 1025 || points[0].DownloadBytes != 2000+meterBatch {
+        t.Errorf("history %+v, want the same bytes", points)
+    }
+}
+
+func TestMeter_Exceeded(t *testing.T) {
+    for _, tt := range []struct {
+        name      string
+        limitMB   int64 // given by the ListAPI
+        batches   int   // of meterBatch bytes, uploaded and downloaded in turn
+        wantAfter int   // the batch after which the connection is closed, 0 for never
+    }{
+        {name: "within the limit", batches: 4},
+        {name: "crossing the limit", batches: 8, wantAfter: 5},
+        {name: "limit of the ListAPI", limitMB: 2, batches: 12, wantAfter: 9},
+    } {
+        t.Run(tt.name, func(t *testing.T) {
+            withLimiter(t, 1)
+            var closed atomic.Int32
+            after := 0
+            m := NewMeter("Steve", "Steve", "lobby", tt.limitMB, func() { closed.Add(1) })
+            for i := 1; i <= tt.batches; i++ {
+                d := m.Upload()
+                if i%2 == 0 {
+                    d = m.Download()
+                }
+                d.Add(meterBatch)
+                if after == 0 && closed.Load() > 0 {
+                    after = i
+                }
+            }
+            m.Close()
+            if after != tt.wantAfter {
+                t.Errorf("closed after batch %d, want %d", after, tt.wantAfter)
+            }
+            if closed.Load() > 1 {
+                t.Errorf("closed %d times, want once", closed.Load())
+            }
+        })
+    }
+}
+
+func TestMeter_Concurrent(t *testing.T) {
+    tl := withLimiter(t, 1024)
+    m := NewMeter("Steve", "Steve", "lobby", 0, func() {})
+
+    var wg sync.WaitGroup
+    for _, d := range []*MeterDirection{m.Upload(), m.Download()} {
+        for i := 0; i < 4; i++ {
+            wg.Add(1)
+            go func(d *MeterDirection) {
+                defer wg.Done()
+                for j := 0; j < 1000; j++ {
+                    d.Add(1000)
+                }
+            }(d)
+        }
+    }
+    wg.Wait()
+    m.Close()
+    if up, down := usedBytes(tl, "Steve"); up != 4000000 || down != 4000000 {
+        t.Errorf("recorded %d and %d bytes, want 4000000 each", up, down)
+    }
+}
+
+func TestMeter_NotLimited(t *testing.T) {
+    tl := withLimiter(t, 1)
+    m := NewMeter("", "Steve", "lobby", 0, func() { t.Error("the connection was closed") })
+    for i := 0; i < 8; i++ {
+        m.Download().Add(meterBatch)
+    }
+    m.Close()
+    if _, down := usedBytes(tl, "Steve"); down != 0 {
+        t.Errorf("recorded %d bytes to Steve without a key, want none", down)
+    }
+}
@@ -0,0 +1,351 @@
+package traffic
+
+import (
+    "bytes"
+    "context"
+    "crypto/hmac"
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "io"
+    "log"
+    "net/http"
+    "sort"
+    "strconv"
+    "sync"
+    "sync/atomic"
+    "time"
+
+    "github.com/InRaining/NoDelay/config"
+
+    "github.com/fatih/color"
+)
+
+// Types of events.
+const (
+    EventThreshold  = "threshold"
+    EventLowBalance = "low_balance"
+)
+
+const maxRetryDelay = 5 * time.Minute
+
+// Event is the JSON payload posted to the webhooks.
+type Event struct {
+    ID         string  `json:"id"` // the same for the retries of a delivery
+    Type       string  `json:"type"`
+    Time       int64   `json:"time"`
+    Account    string  `json:"account"` // the key of the counter
+    Player     string  `json:"player"`
+    Service    string  `json:"service,omitempty"`
+    Plan       string  `json:"plan,omitempty"`
+    Threshold  float64 `json:"threshold,omitempty"` // percent of the quota
+    UsedMB     float64 `json:"used_mb"`
+    LimitMB    float64 `json:"limit_mb"`
+    Percentage float64 `json:"percentage"`
+    BalanceMB  float64 `json:"balance_mb,omitempty"` // prepaid players only
+    NextReset  int64   `json:"next_reset,omitempty"`
+}
+
+type delivery struct {
+    webhook *config.WebhookConfig
+    event   *Event
+    body    []byte
+    attempt int
+}
+
+// Notifier logs events and posts them to webhooks, retrying failed
+// deliveries with an exponential backoff. Each webhook has its own queue
+// and worker, so that a webhook down or slow doesn't hold up the others.
+type Notifier struct {
+    mutex      sync.RWMutex
+    settings   config.TrafficNotifyConfig
+    thresholds []float64 // ascending
+    client     *http.Client
+    queueSize  int
+    workers    map[string]*webhookWorker // key: URL
+    retryDelay time.Duration             // of the first retry, doubled for each one after
+    stopChan   chan struct{}
+    closeOnce  sync.Once
+}
+
+// webhookWorker delivers the events of a webhook one after another.
+type webhookWorker struct {
+    queue    chan *delivery
+    stopChan chan struct{} // closed when the webhook is removed
+}
+
+// NewNotifier creates a notifier and starts delivering its events.
+func NewNotifier(settings config.TrafficNotifyConfig) *Notifier {
+    queueSize := settings.QueueSize
+    if queueSize <= 0 {
+        queueSize = 1000
+    }
+    n := &Notifier{
+        client:     &http.Client{},
+        queueSize:  queueSize,
+        workers:    make(map[string]*webhookWorker),
+        retryDelay: time.Second,
+        stopChan:   make(chan struct{}),
+    }
+    n.apply(settings)
+    return n
+}
+
+// apply changes the settings, but the size of the queues. The workers of
+// the webhooks removed stop, dropping their deliveries.
+func (n *Notifier) apply(settings config.TrafficNotifyConfig) {
+    thresholds := append([]float64(nil), settings.Thresholds...)
+    if len(thresholds) == 0 {
+        thresholds = []float64{80, 95, 100}
+    }
+    sort.Float64s(thresholds)
+    if settings.MaxRetries == 0 {
+        settings.MaxRetries = 5
+    }
+
+    n.mutex.Lock()
+    defer n.mutex.Unlock()
+    n.settings = settings
+    n.thresholds = thresholds
+
+    urls := make(map[string]struct{}, len(settings.Webhooks))
+    for _, webhook := range settings.Webhooks {
+        urls[webhook.URL] = struct{}{}
+        if _, exists := n.workers[webhook.URL]; !exists {
+            w := &webhookWorker{
+                queue:    make(chan *delivery, n.queueSize),
+                stopChan: make(chan struct{}),
+            }
+            n.workers[webhook.URL] = w
+            go n.deliverLoop(w)
+        }
+    }
+    for url, w := range n.workers {
+        if _, exists := urls[url]; !exists {
+            close(w.stopChan)
+            delete(n.workers, url)
+        }
+    }
+}
+
+// Thresholds returns the thresholds in ascending order.
+func (n *Notifier) Thresholds() []float64 {
+    n.mutex.RLock()
+    defer n.mutex.RUnlock()
+    return n.thresholds
+}
+
+// Emit logs an event and queues it for each webhook. It does not block:
+// events are dropped when the queue is full.
+func (n *Notifier) Emit(event *Event) {
+    if event.ID == "" {
+        event.ID = newEventID()
+    }
+    if event.Time == 0 {
+        event.Time = time.Now().Unix()
+    }
+    switch event.Type {
+    case EventLowBalance:
+        log.Println(color.HiYellowString("Player %s is running low on traffic balance: %.2f MB left",
+            event.Account, event.BalanceMB))
+    default:
+        log.Println(color.HiYellowString("Player %s has used %.0f%% of their traffic quota: %.2f/%.2f MB",
+            event.Account, event.Threshold, event.UsedMB, event.LimitMB))
+    }
+
+    n.mutex.RLock()
+    defer n.mutex.RUnlock()
+    if len(n.settings.Webhooks) == 0 {
+        return
+    }
+    body, err := json.Marshal(event)
+    if err != nil {
+        log.Println(color.HiRedString("Failed to encode traffic event: %v", err))
+        return
+    }
+    for _, webhook := range n.settings.Webhooks {
+        n.workers[webhook.URL].enqueue(&delivery{webhook: webhook, event: event, body: body})
+    }
+}
+
+func (w *webhookWorker) enqueue(d *delivery) {
+    select {
+    case w.queue <- d:
+    default:
+        log.Println(color.HiRedString("Webhook queue is full, dropping %s event %s for %s",
+            d.event.Type, d.event.ID, d.webhook.URL))
+    }
+}
+
+func (n *Notifier) deliverLoop(w *webhookWorker) {
+    for {
+        select {
+        case d := <-w.queue:
+            n.deliver(w, d)
+        case <-w.stopChan:
+            return
+        case <-n.stopChan:
+            return
+        }
+    }
+}
+
+func (n *Notifier) deliver(w *webhookWorker, d *delivery) {
+    err := n.post(d)
+    if err == nil {
+        return
+    }
+    n.mutex.RLock()
+    maxRetries, retryDelay := n.settings.MaxRetries, n.retryDelay
+    n.mutex.RUnlock()
+    if d.attempt >= maxRetries {
+        log.Println(color.HiRedString("Failed to deliver %s event %s to %s, giving up: %v",
+            d.event.Type, d.event.ID, d.webhook.URL, err))
+        return
+    }
+    delay := retryDelay << d.attempt
+    if delay > maxRetryDelay || delay <= 0 {
+        delay = maxRetryDelay
+    }
+    d.attempt++
+    log.Println(color.HiYellowString("Failed to deliver %s event %s to %s, retrying in %v: %v",
+        d.event.Type, d.event.ID, d.webhook.URL, delay, err))
+    time.AfterFunc(delay, func() {
+        select {
+        case <-n.stopChan:
+        case <-w.stopChan:
+        default:
+            w.enqueue(d)
+        }
+    })
+}
+
+func (n *Notifier) post(d *delivery) error {
+    timeout := 5 * time.Second
+    if d.webhook.TimeoutMs > 0 {
+        timeout = time.Duration(d.webhook.TimeoutMs) * time.Millisecond
+    }
+    ctx, cancel := context.WithTimeout(context.Background(), timeout)
+    defer cancel()
+
+    req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.webhook.URL, bytes.NewReader(d.body))
+    if err != nil {
+        return fmt.Errorf("failed to create HTTP request: %w", err)
+    }
+    req.Header.Set("Content-Type", "application/json")
+    req.Header.Set("X-NoDelay-Event", d.event.Type)
+    req.Header.Set("X-NoDelay-Delivery", d.event.ID)
+    if d.webhook.AuthToken != "" {
+        header := d.webhook.AuthHeader
+        if header == "" {
+            header = "Authorization"
+        }
+        req.Header.Set(header, d.webhook.AuthToken)
+    }
+    if d.webhook.HMACSecret != "" {
+        // signature = hex(HMAC-SHA256(secret, timestamp + "\n" + "POST" + "\n" + body)), as for the ListAPI
+        timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+        mac := hmac.New(sha256.New, []byte(d.webhook.HMACSecret))
+        mac.Write([]byte(timestamp + "\n" + http.MethodPost + "\n"))
+        mac.Write(d.body)
+        req.Header.Set("X-NoDelay-Timestamp", timestamp)
+        req.Header.Set("X-NoDelay-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+    }
+
+    resp, err := n.client.Do(req)
+    if err != nil {
+        return fmt.Errorf("failed to make HTTP request: %w", err)
+    }
+    defer resp.Body.Close()
+    io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+    if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+        return fmt.Errorf("unexpected HTTP status: %s", resp.Status)
+    }
+    return nil
+}
+
+// Close stops delivering events. Queued and retried deliveries are dropped.
+func (n *Notifier) Close() {
+    n.closeOnce.Do(func() {
+        close(n.stopChan)
+    })
+}
+
+func newEventID() string {
+    b := make([]byte, 12)
+    if _, err := rand.Read(b); err != nil {
+        return strconv.FormatInt(time.Now().UnixNano(), 36)
+    }
+    return hex.EncodeToString(b)
+}
+
+var globalNotifier atomic.Pointer[Notifier]
+
+// ConfigureNotifications applies the Notifications settings of the current
+// configuration, keeping the deliveries in progress.
+func ConfigureNotifications() {
+    var settings config.TrafficNotifyConfig
+    if config.Config.TrafficLimiter != nil {
+        settings = config.Config.TrafficLimiter.Notifications
+    }
+    if n := globalNotifier.Load(); n != nil {
+        n.apply(settings)
+        return
+    }
+    globalNotifier.Store(NewNotifier(settings))
+}
+
+// GetNotifier returns the notifier in use, or nil before ConfigureNotifications.
+func GetNotifier() *Notifier {
+    return globalNotifier.Load()
+}
+
+// checkThresholdsLocked emits an event for each threshold of the quota the
+// usage of a player has reached since the last one. Once the usage falls back
+// under a threshold, such as after a reset or a top-up, it fires again.
+func (tl *TrafficLimiter) checkThresholdsLocked(key string, userData *UserTrafficData, now time.Time) {
+    n := globalNotifier.Load()
+    if n == nil || userData.Unlimited {
+        return
+    }
+    thresholds := n.Thresholds()
+    used, limit, percentage := userData.usage(now, 0)
+    if limit <= 0 {
+        return
+    }
+
+    notified := userData.Notified
+    if percentage < notified {
+        notified = 0
+        for _, t := range thresholds {
+            if t <= percentage {
+                notified = t
+            }
+        }
+    }
+    for _, t := range thresholds {
+        if t <= notified || percentage < t {
+            continue
+        }
+        notified = t
+        n.Emit(&Event{
+            Type:       EventThreshold,
+            Time:       now.Unix(),
+            Account:    key,
+            Player:     userData.PlayerName,
+            Service:    userData.Service,
+            Plan:       userData.Plan,
+            Threshold:  t,
+            UsedMB:     used,
+            LimitMB:    limit,
+            Percentage: percentage,
+            NextReset:  userData.NextReset,
+        })
+    }
+    if notified != userData.Notified {
+        userData.Notified = notified
+        tl.markDirtyLocked(key)
+    }
+}
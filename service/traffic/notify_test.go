@@ -0,0 +1,169 @@
+package traffic
+
+import (
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "io"
+    "net/http"
+    "net/http/httptest"
+    "sync/atomic"
+    "testing"
+    "time"
+
+    "github.com/InRaining/NoDelay/config"
+)
+
+type received struct {
+    header http.Header
+    body   []byte
+}
+
+// newWebhook starts a stand-in webhook answering the first failures
+// requests with an error.
+func newWebhook(t *testing.T, failures int32) (*httptest.Server, chan received) {
+    ch := make(chan received, 16)
+    var count atomic.Int32
+    server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        body, _ := io.ReadAll(r.Body)
+        if count.Add(1) <= failures {
+            w.WriteHeader(http.StatusServiceUnavailable)
+            return
+        }
+        ch <- received{r.Header, body}
+    }))
+    t.Cleanup(server.Close)
+    return server, ch
+}
+
+func waitDelivery(t *testing.T, ch chan received) received {
+    select {
+    case r := <-ch:
+        return r
+    case <-time.After(5 * time.Second):
+        t.Fatal("no delivery")
+        return received{}
+    }
+}
+
+func TestNotifierSignsPayload(t *testing.T) {
+    server, ch := newWebhook(t, 0)
+    n := NewNotifier(config.TrafficNotifyConfig{
+        Webhooks: []*config.WebhookConfig{{URL: server.URL, HMACSecret: "secret", AuthToken: "Bearer token"}},
+    })
+    defer n.Close()
+
+    n.Emit(&Event{Type: EventThreshold, Account: "Steve", Player: "Steve", Threshold: 80, UsedMB: 800, LimitMB: 1000, Percentage: 80})
+    r := waitDelivery(t, ch)
+
+    var event Event
+    if err := json.Unmarshal(r.body, &event); err != nil {
+        t.Fatal(err)
+    }
+    if event.Player != "Steve" || event.Threshold != 80 || event.ID == "" || event.Time == 0 {
+        t.Fatalf("unexpected event %+v", event)
+    }
+    if r.header.Get("Authorization") != "Bearer token" {
+        t.Fatalf("unexpected auth header %q", r.header.Get("Authorization"))
+    }
+    mac := hmac.New(sha256.New, []byte("secret"))
+    mac.Write([]byte(r.header.Get("X-NoDelay-Timestamp") + "\nPOST\n"))
+    mac.Write(r.body)
+    if want := "sha256=" + hex.EncodeToString(mac.Sum(nil)); r.header.Get("X-NoDelay-Signature") != want {
+        t.Fatalf("signature %q, want %q", r.header.Get("X-NoDelay-Signature"), want)
+    }
+}
+
+func TestNotifierRetries(t *testing.T) {
+    server, ch := newWebhook(t, 2)
+    n := NewNotifier(config.TrafficNotifyConfig{
+        Webhooks: []*config.WebhookConfig{{URL: server.URL}},
+    })
+    n.retryDelay = 10 * time.Millisecond
+    defer n.Close()
+
+    n.Emit(&Event{Type: EventThreshold, Account: "Alex", Player: "Alex", Threshold: 100})
+    r := waitDelivery(t, ch)
+    if r.header.Get("X-NoDelay-Event") != EventThreshold {
+        t.Fatalf("unexpected event header %q", r.header.Get("X-NoDelay-Event"))
+    }
+}
+
+func TestNotifierWebhooksDeliverIndependently(t *testing.T) {
+    stuck := make(chan struct{})
+    slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        <-stuck
+    }))
+    t.Cleanup(slow.Close)
+    t.Cleanup(func() { close(stuck) })
+    server, ch := newWebhook(t, 0)
+    n := NewNotifier(config.TrafficNotifyConfig{
+        Webhooks: []*config.WebhookConfig{{URL: slow.URL, TimeoutMs: 10000}, {URL: server.URL}},
+    })
+    defer n.Close()
+
+    for i := 0; i < 3; i++ {
+        n.Emit(&Event{Type: EventThreshold, Account: "Steve", Player: "Steve", Threshold: 80})
+    }
+    for i := 0; i < 3; i++ {
+        waitDelivery(t, ch)
+    }
+}
+
+func TestThresholdsFireOncePerPeriod(t *testing.T) {
+    server, ch := newWebhook(t, 0)
+    n := NewNotifier(config.TrafficNotifyConfig{
+        Thresholds: []float64{50, 100},
+        Webhooks:   []*config.WebhookConfig{{URL: server.URL}},
+    })
+    defer n.Close()
+    globalNotifier.Store(n)
+    defer globalNotifier.Store(nil)
+
+    tl := &TrafficLimiter{dirty: make(map[string]struct{})}
+    u := &UserTrafficData{PlayerName: "Steve", LimitMB: 10}
+    now := time.Now()
+    fired := func() []float64 {
+        var thresholds []float64
+        for {
+            select {
+            case r := <-ch:
+                var event Event
+                json.Unmarshal(r.body, &event)
+                thresholds = append(thresholds, event.Threshold)
+            case <-time.After(200 * time.Millisecond):
+                return thresholds
+            }
+        }
+    }
+
+    u.UsedBytes = 6 << 20
+    tl.checkThresholdsLocked("Steve", u, now)
+    tl.checkThresholdsLocked("Steve", u, now)
+    if got := fired(); len(got) != 1 || got[0] != 50 {
+        t.Fatalf("fired %v, want [50]", got)
+    }
+    u.UsedBytes = 11 << 20
+    tl.checkThresholdsLocked("Steve", u, now)
+    if got := fired(); len(got) != 1 || got[0] != 100 {
+        t.Fatalf("fired %v, want [100]", got)
+    }
+    u.UsedBytes = 7 << 20 // days left a rolling window
+    tl.checkThresholdsLocked("Steve", u, now)
+    if got := fired(); len(got) != 0 {
+        t.Fatalf("fired %v, want none", got)
+    }
+    u.UsedBytes = 10 << 20
+    tl.checkThresholdsLocked("Steve", u, now)
+    if got := fired(); len(got) != 1 || got[0] != 100 {
+        t.Fatalf("fired %v, want [100]", got)
+    }
+    u.clearUsage() // a new period
+    u.Notified = 0
+    u.UsedBytes = 10 << 20
+    tl.checkThresholdsLocked("Steve", u, now)
+    if got := fired(); len(got) != 2 {
+        t.Fatalf("fired %v after reset, want [50 100]", got)
+    }
+}
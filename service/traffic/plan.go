@@ -0,0 +1,97 @@
+package traffic
+
+import (
+    "strings"
+
+    "github.com/InRaining/NoDelay/config"
+    "github.com/InRaining/NoDelay/service/access"
+)
+
+const (
+    DefaultPlanName = "default"
+
+    ScopeShared  = "shared"
+    ScopeService = "service"
+)
+
+// Plan is the quota applying to a player.
+type Plan struct {
+    Name string
+    config.TrafficPlan
+}
+
+// ResolvePlan picks the plan of a player on a service: the player's own plan,
+// then the first list containing the player, then the default plan of the
+// service, and at last the global default plan.
+func ResolvePlan(s *config.ConfigProxyService, playerName string) Plan {
+    settings := config.Config.TrafficLimiter
+    name := ""
+    if settings != nil {
+        for player, plan := range settings.PlayerPlans {
+            if strings.EqualFold(player, playerName) {
+                name = plan
+                break
+            }
+        }
+        if name == "" {
+            for _, planList := range settings.PlanLists {
+                if list, err := access.GetTargetList(planList.ListTag); err == nil && list.Has(playerName) {
+                    name = planList.Plan
+                    break
+                }
+            }
+        }
+    }
+    if name == "" && s != nil {
+        name = s.TrafficPlan
+    }
+    if name == "" && settings != nil {
+        name = settings.DefaultPlan
+    }
+    if name == "" {
+        name = DefaultPlanName
+    }
+    return lookupPlan(name)
+}
+
+// lookupPlan returns a configured plan, falling back to the default plan
+// made of TrafficLimitMB. Plans without a Period use the global schedule.
+func lookupPlan(name string) Plan {
+    settings := config.Config.TrafficLimiter
+    if settings == nil {
+        return Plan{Name: DefaultPlanName, TrafficPlan: config.TrafficPlan{LimitMB: 1024}}
+    }
+    if name == "" {
+        name = settings.DefaultPlan
+    }
+    limitMB := int64(1024) // Default to 1GB
+    if settings.TrafficLimitMB > 0 {
+        limitMB = settings.TrafficLimitMB
+    }
+    if plan, ok := settings.Plans[name]; ok {
+        p := Plan{Name: name, TrafficPlan: *plan}
+        if p.LimitMB <= 0 && p.UploadLimitMB <= 0 && p.DownloadLimitMB <= 0 {
+            p.LimitMB = limitMB
+        }
+        if p.Period == "" {
+            p.ResetSchedule = settings.ResetSchedule
+        }
+        if p.Bandwidth == (config.BandwidthLimit{}) {
+            p.Bandwidth = settings.PlayerBandwidth
+        }
+        return p
+    }
+    return Plan{Name: DefaultPlanName, TrafficPlan: config.TrafficPlan{
+        LimitMB:       limitMB,
+        Bandwidth:     settings.PlayerBandwidth,
+        ResetSchedule: settings.ResetSchedule,
+    }}
+}
+
+// AccountKey returns the key of the traffic counter of a player under a plan.
+func AccountKey(plan Plan, s *config.ConfigProxyService, playerName string) string {
+    if plan.Scope == ScopeService && s != nil {
+        return playerName + "@" + s.Name
+    }
+    return playerName
+}
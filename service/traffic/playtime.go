@@ -0,0 +1,176 @@
+package traffic
+
+import (
+    "log"
+    "sync"
+    "time"
+
+    "github.com/InRaining/NoDelay/config"
+)
+
+// playtimeCheckInterval is how often sessions check the playtime left,
+// so that changes of the limit apply to players already playing.
+const playtimeCheckInterval = time.Minute
+
+// playSession counts the playtime of an account while it has sessions open.
+// Sessions open at the same time count once.
+type playSession struct {
+    count int
+    since time.Time // counted up to
+}
+
+// StartSession starts counting the playtime of a player.
+func (tl *TrafficLimiter) StartSession(key string) {
+    tl.mutex.Lock()
+    defer tl.mutex.Unlock()
+
+    session, exists := tl.playing[key]
+    if !exists {
+        session = &playSession{since: time.Now()}
+        tl.playing[key] = session
+    }
+    session.count++
+}
+
+// EndSession stops counting the playtime of a session started with StartSession.
+func (tl *TrafficLimiter) EndSession(key string) {
+    tl.mutex.Lock()
+    defer tl.mutex.Unlock()
+
+    session, exists := tl.playing[key]
+    if !exists {
+        return
+    }
+    tl.accrueLocked(key, session, time.Now())
+    session.count--
+    if session.count <= 0 {
+        delete(tl.playing, key)
+    }
+}
+
+// accrueLocked adds the time played since the last call to the record of a player.
+func (tl *TrafficLimiter) accrueLocked(key string, session *playSession, now time.Time) {
+    userData, exists := tl.users[key]
+    if !exists {
+        session.since = now
+        return
+    }
+    seconds := int64(now.Sub(session.since) / time.Second)
+    if seconds <= 0 {
+        return
+    }
+    session.since = session.since.Add(time.Duration(seconds) * time.Second)
+    userData.PlaytimeSeconds += seconds
+    if day := userData.windowDay(now); day != nil {
+        day.Playtime += seconds
+    }
+    userData.LastSeen = now.Unix()
+    tl.markDirtyLocked(key)
+}
+
+// accruePlaytime adds the time played by the players playing to their records.
+func (tl *TrafficLimiter) accruePlaytime() {
+    tl.mutex.Lock()
+    defer tl.mutex.Unlock()
+
+    now := time.Now()
+    for key, session := range tl.playing {
+        tl.accrueLocked(key, session, now)
+    }
+}
+
+// GetPlaytime gets the time played by a player in the current period and
+// their limit, zero when not limited.
+func (tl *TrafficLimiter) GetPlaytime(key string) (played, limit time.Duration, nextReset time.Time) {
+    tl.mutex.Lock()
+    defer tl.mutex.Unlock()
+
+    userData, exists := tl.users[key]
+    if !exists {
+        return 0, 0, time.Time{}
+    }
+    now := time.Now()
+    if session, ok := tl.playing[key]; ok {
+        tl.accrueLocked(key, session, now)
+    }
+    if tl.resetIfDueLocked(userData, now) {
+        log.Printf("Reset traffic for player: %s", key)
+        tl.markDirtyLocked(key)
+    }
+
+    if userData.NextReset > 0 {
+        nextReset = time.Unix(userData.NextReset, 0).In(location())
+    }
+    played = time.Duration(userData.PlaytimeSeconds) * time.Second
+    limit = time.Duration(userData.PlaytimeLimitMin) * time.Minute
+    return played, limit, nextReset
+}
+
+// GetUserPlaytime gets the time played by a player and their limit.
+func GetUserPlaytime(key string) (played, limit time.Duration, nextReset time.Time) {
+    if globalTrafficLimiter == nil {
+        return 0, 0, time.Time{}
+    }
+    return globalTrafficLimiter.GetPlaytime(key)
+}
+
+// CheckPlaytimeLimit checks the playtime limit for a player upon login.
+// The account must have been prepared with PrepareAccount.
+func CheckPlaytimeLimit(key string) bool {
+    if globalTrafficLimiter == nil || config.Config.TrafficLimiter == nil || !config.Config.TrafficLimiter.EnableTrafficLimit {
+        return true
+    }
+    played, limit, _ := globalTrafficLimiter.GetPlaytime(key)
+    return limit <= 0 || played < limit
+}
+
+// TrackPlaytime counts the playtime of a session of a player until the
+// returned function is called. onExpired is called once when the player
+// runs out of playtime, and must close the connection.
+func TrackPlaytime(key string, onExpired func()) (stop func()) {
+    if globalTrafficLimiter == nil || key == "" {
+        return func() {}
+    }
+    limiter := globalTrafficLimiter
+    limiter.StartSession(key)
+
+    var (
+        mutex   sync.Mutex
+        timer   *time.Timer
+        stopped bool
+    )
+    var check func()
+    check = func() {
+        played, limit, _ := limiter.GetPlaytime(key)
+        next := playtimeCheckInterval
+        if limit > 0 {
+            if played >= limit {
+                log.Printf("Playtime limit exceeded for player %s, closing the connection", key)
+                onExpired()
+                return
+            }
+            if left := limit - played; left < next {
+                next = left
+            }
+        }
+        mutex.Lock()
+        defer mutex.Unlock()
+        if !stopped {
+            timer = time.AfterFunc(next, check)
+        }
+    }
+    check()
+
+    var once sync.Once
+    return func() {
+        once.Do(func() {
+            mutex.Lock()
+            stopped = true
+            if timer != nil {
+                timer.Stop()
+            }
+            mutex.Unlock()
+            limiter.EndSession(key)
+        })
+    }
+}
@@ -0,0 +1,124 @@
+package traffic
+
+import (
+    "path/filepath"
+    "sync/atomic"
+    "testing"
+    "time"
+
+    "github.com/InRaining/NoDelay/config"
+)
+
+func TestPlaytimeReset(t *testing.T) {
+    withTimezone(t, "Asia/Shanghai")
+    config.Config.TrafficLimiter.Plans = map[string]*config.TrafficPlan{
+        "daily":           {Unlimited: true, PlaytimeLimitMin: 60, ResetSchedule: config.ResetSchedule{Period: PeriodDaily}},
+        "never":           {Unlimited: true, PlaytimeLimitMin: 60, ResetSchedule: config.ResetSchedule{Period: PeriodNever}},
+        "prepaid":         {Prepaid: true, PlaytimeLimitMin: 60, ResetSchedule: config.ResetSchedule{Period: PeriodDaily}},
+        "prepaid never":   {Prepaid: true, PlaytimeLimitMin: 60, ResetSchedule: config.ResetSchedule{Period: PeriodNever}},
+        "prepaid rolling": {Prepaid: true, PlaytimeLimitMin: 60, ResetSchedule: config.ResetSchedule{Period: PeriodRolling, RollingDays: 7}},
+    }
+    now := time.Now()
+    yesterday := dayStart(now).AddDate(0, 0, -1).Unix()
+
+    for _, tt := range []struct {
+        plan       string
+        window     []*DailyUsage // of rolling plans
+        wantPlayed time.Duration
+        wantReset  bool // whether the next reset is known
+    }{
+        {plan: "daily", wantPlayed: 0, wantReset: true},
+        {plan: "never", wantPlayed: 50 * time.Minute},
+        {plan: "prepaid", wantPlayed: 0, wantReset: true},
+        {plan: "prepaid never", wantPlayed: 50 * time.Minute},
+        {
+            plan: "prepaid rolling",
+            window: []*DailyUsage{
+                {Day: dayStart(now).AddDate(0, 0, -10).Unix(), Playtime: 40 * 60},
+                {Day: yesterday, Playtime: 10 * 60},
+            },
+            wantPlayed: 10 * time.Minute,
+            wantReset:  true,
+        },
+    } {
+        t.Run(tt.plan, func(t *testing.T) {
+            tl := NewTrafficLimiter(filepath.Join(t.TempDir(), "TrafficTable.json"))
+            defer tl.Close()
+            plan := lookupPlan(tt.plan)
+            tl.PrepareAccount("Steve", "Steve", "lobby", plan)
+            if err := tl.TopUp("Steve", 100, "order-1", time.Time{}); err != nil {
+                t.Fatal(err)
+            }
+            tl.RecordTraffic("Steve", 10*mb, 0)
+
+            // 50 minutes played in the previous period
+            tl.mutex.Lock()
+            userData := tl.users["Steve"]
+            userData.PlaytimeSeconds = 50 * 60
+            userData.LastResetTime = yesterday
+            userData.Window = tt.window
+            tl.mutex.Unlock()
+
+            played, limit, nextReset := tl.GetPlaytime("Steve")
+            if played != tt.wantPlayed || limit != time.Hour {
+                t.Errorf("played %v of %v, want %v of 1h", played, limit, tt.wantPlayed)
+            }
+            if !nextReset.IsZero() != tt.wantReset {
+                t.Errorf("next reset %v, want one %v", nextReset, tt.wantReset)
+            }
+            if plan.Prepaid {
+                // the balance is left alone
+                if balance, _ := tl.GetBalance("Steve"); balance != 90 {
+                    t.Errorf("balance %.2f MB, want 90", balance)
+                }
+                if _, _, _, nextReset := tl.GetUserInfo("Steve", 0); !nextReset.IsZero() {
+                    t.Errorf("next reset of the balance %v, want none", nextReset)
+                }
+            } else if used, _, _, _ := tl.GetUserInfo("Steve", 0); used != 0 && tt.wantReset {
+                t.Errorf("%.2f MB used after the reset, want none", used)
+            }
+        })
+    }
+}
+
+func TestPlaytimeSessions(t *testing.T) {
+    tl := NewTrafficLimiter(filepath.Join(t.TempDir(), "TrafficTable.json"))
+    defer tl.Close()
+    tl.PrepareAccount("Steve", "Steve", "lobby", Plan{Name: DefaultPlanName, TrafficPlan: config.TrafficPlan{
+        Unlimited:        true,
+        PlaytimeLimitMin: 1,
+        ResetSchedule:    config.ResetSchedule{Period: PeriodNever},
+    }})
+
+    // two connections at the same time count once
+    tl.StartSession("Steve")
+    tl.StartSession("Steve")
+    tl.mutex.Lock()
+    tl.playing["Steve"].since = time.Now().Add(-30 * time.Second)
+    tl.mutex.Unlock()
+    if played, _, _ := tl.GetPlaytime("Steve"); played != 30*time.Second {
+        t.Errorf("played %v, want 30s", played)
+    }
+    tl.EndSession("Steve")
+    tl.EndSession("Steve")
+    if len(tl.playing) != 0 {
+        t.Errorf("sessions %v after both ended", tl.playing)
+    }
+
+    // the session is closed once the playtime runs out
+    SetGlobalTrafficLimiter(tl)
+    defer SetGlobalTrafficLimiter(nil)
+    var expired atomic.Int32
+    stop := TrackPlaytime("Steve", func() { expired.Add(1) })
+    if expired.Load() != 0 {
+        t.Fatal("expired with 30s left")
+    }
+    tl.mutex.Lock()
+    tl.users["Steve"].PlaytimeSeconds = 60
+    tl.mutex.Unlock()
+    stop()
+    TrackPlaytime("Steve", func() { expired.Add(1) })()
+    if expired.Load() != 1 {
+        t.Errorf("expired %d times, want once", expired.Load())
+    }
+}
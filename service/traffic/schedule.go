@@ -0,0 +1,121 @@
+package traffic
+
+import (
+    "log"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/InRaining/NoDelay/config"
+
+    "github.com/fatih/color"
+)
+
+const (
+    PeriodDaily   = "daily"
+    PeriodWeekly  = "weekly"
+    PeriodMonthly = "monthly"
+    PeriodRolling = "rolling"
+    PeriodNever   = "never"
+)
+
+var (
+    locationMutex sync.Mutex
+    locationName  string
+    locationCache = time.Local
+)
+
+// location returns the configured timezone of resets.
+func location() *time.Location {
+    name := ""
+    if settings := config.Config.TrafficLimiter; settings != nil {
+        name = settings.Timezone
+    }
+
+    locationMutex.Lock()
+    defer locationMutex.Unlock()
+    if name == locationName {
+        return locationCache
+    }
+    locationName = name
+    locationCache = time.Local
+    if name != "" {
+        loc, err := time.LoadLocation(name)
+        if err != nil {
+            log.Println(color.HiRedString("Traffic limiter: invalid timezone %q, using the local timezone: %v", name, err))
+        } else {
+            locationCache = loc
+        }
+    }
+    return locationCache
+}
+
+// retentionCutoff returns the time before which the records of players
+// not seen are dropped, or zero to keep them forever.
+func retentionCutoff(now time.Time) time.Time {
+    days := 7
+    if settings := config.Config.TrafficLimiter; settings != nil && settings.RetentionDays != 0 {
+        days = settings.RetentionDays
+    }
+    if days < 0 {
+        return time.Time{}
+    }
+    return now.AddDate(0, 0, -days)
+}
+
+func resetWeekday(schedule config.ResetSchedule) time.Weekday {
+    for d := time.Sunday; d <= time.Saturday; d++ {
+        if strings.EqualFold(schedule.ResetWeekday, d.String()) {
+            return d
+        }
+    }
+    return time.Monday
+}
+
+func rollingDays(schedule config.ResetSchedule) int {
+    if schedule.RollingDays > 0 {
+        return schedule.RollingDays
+    }
+    return 30
+}
+
+// monthlyReset returns the reset day of the month of t, moved to the
+// last day of months shorter than the configured day.
+func monthlyReset(schedule config.ResetSchedule, year int, month time.Month, loc *time.Location) time.Time {
+    day := schedule.ResetDay
+    if day < 1 {
+        day = 1
+    }
+    if last := time.Date(year, month+1, 0, 0, 0, 0, 0, loc).Day(); day > last {
+        day = last
+    }
+    return time.Date(year, month, day, 0, 0, 0, 0, loc)
+}
+
+// periodBounds returns the start of the period of a fixed schedule containing t
+// and the next reset. Both are zero for schedules which never reset.
+func periodBounds(schedule config.ResetSchedule, t time.Time) (start, next time.Time) {
+    t = t.In(location())
+    day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+    switch schedule.Period {
+    case PeriodNever, PeriodRolling:
+        return time.Time{}, time.Time{}
+    case PeriodWeekly:
+        start = day.AddDate(0, 0, -((int(day.Weekday())-int(resetWeekday(schedule)))+7)%7)
+        return start, start.AddDate(0, 0, 7)
+    case PeriodMonthly:
+        start = monthlyReset(schedule, t.Year(), t.Month(), t.Location())
+        if t.Before(start) {
+            start = monthlyReset(schedule, t.Year(), t.Month()-1, t.Location())
+        }
+        return start, monthlyReset(schedule, start.Year(), start.Month()+1, t.Location())
+    default:
+        return day, day.AddDate(0, 0, 1)
+    }
+}
+
+// dayStart returns the start of the day containing t, in the timezone of resets.
+func dayStart(t time.Time) time.Time {
+    t = t.In(location())
+    return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
@@ -0,0 +1,261 @@
+package traffic
+
+import (
+    "testing"
+    "time"
+
+    "github.com/InRaining/NoDelay/config"
+)
+
+// withTimezone sets the timezone of resets for the duration of the test.
+func withTimezone(t *testing.T, name string) *time.Location {
+    saved := config.Config.TrafficLimiter
+    t.Cleanup(func() { config.Config.TrafficLimiter = saved })
+    config.Config.TrafficLimiter = &config.TrafficLimiterConfig{Timezone: name}
+    loc, err := time.LoadLocation(name)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return loc
+}
+
+func TestPeriodBounds(t *testing.T) {
+    for _, tt := range []struct {
+        name      string
+        timezone  string
+        schedule  config.ResetSchedule
+        now       string // RFC 3339
+        wantStart string // midnight of the day in the timezone, empty for none
+        wantNext  string
+    }{
+        {
+            name:      "daily",
+            timezone:  "Asia/Shanghai",
+            now:       "2024-03-06T10:00:00+08:00",
+            wantStart: "2024-03-06",
+            wantNext:  "2024-03-07",
+        },
+        {
+            name:      "daily, the day before in UTC",
+            timezone:  "Asia/Shanghai",
+            now:       "2024-03-05T17:00:00Z",
+            wantStart: "2024-03-06",
+            wantNext:  "2024-03-07",
+        },
+        {
+            name:      "daily, end of summer time",
+            timezone:  "Europe/London",
+            schedule:  config.ResetSchedule{Period: PeriodDaily},
+            now:       "2024-10-27T12:00:00Z",
+            wantStart: "2024-10-27",
+            wantNext:  "2024-10-28",
+        },
+        {
+            name:      "weekly on Monday by default",
+            timezone:  "Asia/Shanghai",
+            schedule:  config.ResetSchedule{Period: PeriodWeekly},
+            now:       "2024-03-06T10:00:00+08:00",
+            wantStart: "2024-03-04",
+            wantNext:  "2024-03-11",
+        },
+        {
+            name:      "weekly at the reset",
+            timezone:  "Asia/Shanghai",
+            schedule:  config.ResetSchedule{Period: PeriodWeekly},
+            now:       "2024-03-04T00:00:00+08:00",
+            wantStart: "2024-03-04",
+            wantNext:  "2024-03-11",
+        },
+        {
+            name:      "weekly, already Monday east of UTC",
+            timezone:  "Asia/Shanghai",
+            schedule:  config.ResetSchedule{Period: PeriodWeekly, ResetWeekday: "Monday"},
+            now:       "2024-03-03T20:00:00Z",
+            wantStart: "2024-03-04",
+            wantNext:  "2024-03-11",
+        },
+        {
+            name:      "weekly, still Sunday west of UTC",
+            timezone:  "America/New_York",
+            schedule:  config.ResetSchedule{Period: PeriodWeekly, ResetWeekday: "Monday"},
+            now:       "2024-03-03T20:00:00Z",
+            wantStart: "2024-02-26",
+            wantNext:  "2024-03-04",
+        },
+        {
+            name:      "weekly on Sunday",
+            timezone:  "America/New_York",
+            schedule:  config.ResetSchedule{Period: PeriodWeekly, ResetWeekday: "sunday"},
+            now:       "2024-03-09T23:59:00-05:00",
+            wantStart: "2024-03-03",
+            wantNext:  "2024-03-10",
+        },
+        {
+            name:      "weekly across the start of summer time",
+            timezone:  "America/New_York",
+            schedule:  config.ResetSchedule{Period: PeriodWeekly},
+            now:       "2024-03-10T12:00:00-04:00",
+            wantStart: "2024-03-04",
+            wantNext:  "2024-03-11",
+        },
+        {
+            name:      "monthly on the first by default",
+            timezone:  "Europe/Berlin",
+            schedule:  config.ResetSchedule{Period: PeriodMonthly},
+            now:       "2024-01-01T00:00:00+01:00",
+            wantStart: "2024-01-01",
+            wantNext:  "2024-02-01",
+        },
+        {
+            name:      "monthly, still last month in UTC",
+            timezone:  "Europe/Berlin",
+            schedule:  config.ResetSchedule{Period: PeriodMonthly},
+            now:       "2023-12-31T23:30:00Z",
+            wantStart: "2024-01-01",
+            wantNext:  "2024-02-01",
+        },
+        {
+            name:      "monthly before the reset day",
+            timezone:  "Europe/Berlin",
+            schedule:  config.ResetSchedule{Period: PeriodMonthly, ResetDay: 15},
+            now:       "2024-01-10T12:00:00+01:00",
+            wantStart: "2023-12-15",
+            wantNext:  "2024-01-15",
+        },
+        {
+            name:      "monthly on the 31st in February",
+            timezone:  "Asia/Tokyo",
+            schedule:  config.ResetSchedule{Period: PeriodMonthly, ResetDay: 31},
+            now:       "2024-02-15T12:00:00+09:00",
+            wantStart: "2024-01-31",
+            wantNext:  "2024-02-29",
+        },
+        {
+            name:      "monthly on the 31st, last day of February",
+            timezone:  "Asia/Tokyo",
+            schedule:  config.ResetSchedule{Period: PeriodMonthly, ResetDay: 31},
+            now:       "2024-02-29T00:00:00+09:00",
+            wantStart: "2024-02-29",
+            wantNext:  "2024-03-31",
+        },
+        {
+            name:      "monthly on the 31st in April",
+            timezone:  "Asia/Tokyo",
+            schedule:  config.ResetSchedule{Period: PeriodMonthly, ResetDay: 31},
+            now:       "2024-04-29T23:00:00+09:00",
+            wantStart: "2024-03-31",
+            wantNext:  "2024-04-30",
+        },
+        {
+            name:     "rolling",
+            timezone: "Asia/Tokyo",
+            schedule: config.ResetSchedule{Period: PeriodRolling},
+            now:      "2024-02-15T12:00:00+09:00",
+        },
+        {
+            name:     "never",
+            timezone: "Asia/Tokyo",
+            schedule: config.ResetSchedule{Period: PeriodNever},
+            now:      "2024-02-15T12:00:00+09:00",
+        },
+    } {
+        t.Run(tt.name, func(t *testing.T) {
+            loc := withTimezone(t, tt.timezone)
+            now, err := time.Parse(time.RFC3339, tt.now)
+            if err != nil {
+                t.Fatal(err)
+            }
+            day := func(s string) time.Time {
+                if s == "" {
+                    return time.Time{}
+                }
+                d, err := time.ParseInLocation("2006-01-02", s, loc)
+                if err != nil {
+                    t.Fatal(err)
+                }
+                return d
+            }
+
+            start, next := periodBounds(tt.schedule, now)
+            if !start.Equal(day(tt.wantStart)) || !next.Equal(day(tt.wantNext)) {
+                t.Errorf("bounds %v - %v, want %s - %s", start, next, tt.wantStart, tt.wantNext)
+            }
+        })
+    }
+}
+
+func TestSlideWindow(t *testing.T) {
+    loc := withTimezone(t, "Asia/Tokyo")
+    schedule := config.ResetSchedule{Period: PeriodRolling, RollingDays: 7}
+    day := func(date string) int64 {
+        d, _ := time.ParseInLocation("2006-01-02", date, loc)
+        return d.Unix()
+    }
+    // already the 10th in Tokyo
+    now, _ := time.Parse(time.RFC3339, "2024-03-09T16:30:00Z")
+
+    for _, tt := range []struct {
+        name        string
+        window      []*DailyUsage
+        used        int64 // usage from before the plan became rolling
+        wantDropped bool
+        wantUsed    int64
+        wantNext    string
+    }{
+        {
+            name: "all in the window",
+            window: []*DailyUsage{
+                {Day: day("2024-03-04"), Bytes: 10},
+                {Day: day("2024-03-10"), Bytes: 5},
+            },
+            wantUsed: 15,
+            wantNext: "2024-03-11",
+        },
+        {
+            name: "oldest day left",
+            window: []*DailyUsage{
+                {Day: day("2024-03-03"), Bytes: 100},
+                {Day: day("2024-03-05"), Bytes: 10},
+                {Day: day("2024-03-09"), Bytes: 5},
+            },
+            wantDropped: true,
+            wantUsed:    15,
+            wantNext:    "2024-03-12",
+        },
+        {
+            name: "every day left",
+            window: []*DailyUsage{
+                {Day: day("2024-02-20"), Bytes: 100},
+            },
+            wantDropped: true,
+        },
+        {
+            name:     "usage from before",
+            used:     42,
+            wantUsed: 42,
+            wantNext: "2024-03-17",
+        },
+    } {
+        t.Run(tt.name, func(t *testing.T) {
+            tl := &TrafficLimiter{}
+            u := &UserTrafficData{PlayerName: "Steve", UsedBytes: tt.used, Window: tt.window}
+            for _, d := range tt.window {
+                u.UsedBytes += d.Bytes
+            }
+
+            if dropped := tl.slideWindowLocked(u, schedule, now); dropped != tt.wantDropped {
+                t.Errorf("dropped %v, want %v", dropped, tt.wantDropped)
+            }
+            if u.UsedBytes != tt.wantUsed {
+                t.Errorf("%d bytes used, want %d", u.UsedBytes, tt.wantUsed)
+            }
+            var wantNext int64
+            if tt.wantNext != "" {
+                wantNext = day(tt.wantNext)
+            }
+            if u.NextReset != wantNext {
+                t.Errorf("next reset %v, want %s", time.Unix(u.NextReset, 0).In(loc), tt.wantNext)
+            }
+        })
+    }
+}
@@ -0,0 +1,98 @@
+package traffic
+
+import (
+    "strings"
+    "sync"
+
+    "github.com/InRaining/NoDelay/common/rate"
+    "github.com/InRaining/NoDelay/config"
+)
+
+// bucketPair holds the upload and download buckets of a bandwidth limit.
+type bucketPair struct {
+    limit    config.BandwidthLimit
+    upload   *rate.Bucket
+    download *rate.Bucket
+    refs     int
+}
+
+var (
+    shapingMutex   sync.Mutex
+    globalBuckets  *bucketPair
+    serviceBuckets = make(map[string]*bucketPair)
+    playerBuckets  = make(map[string]*bucketPair) // key: AccountKey and plan
+)
+
+func newBucket(kbps, burstKB float64) *rate.Bucket {
+    if kbps <= 0 {
+        return nil
+    }
+    if burstKB <= 0 {
+        burstKB = kbps
+    }
+    return rate.NewBucket(kbps*1024, burstKB*1024)
+}
+
+// bucketsLocked returns the buckets of limit from m, creating them
+// if they do not exist or were created for another limit.
+func bucketsLocked(m map[string]*bucketPair, key string, limit config.BandwidthLimit) *bucketPair {
+    if pair, ok := m[key]; ok && pair.limit == limit {
+        return pair
+    }
+    pair := &bucketPair{
+        limit:    limit,
+        upload:   newBucket(limit.UploadKBps, limit.UploadBurstKB),
+        download: newBucket(limit.DownloadKBps, limit.DownloadBurstKB),
+    }
+    m[key] = pair
+    return pair
+}
+
+// Shapers returns the upload and download shapers of a connection to a service,
+// taking from the buckets of the player under plan if plan is not nil, of the
+// service and of the whole proxy. release must be called when the connection ends.
+func Shapers(s *config.ConfigProxyService, playerName string, plan *Plan) (upload, download *rate.Shaper, release func()) {
+    var global config.BandwidthLimit
+    if settings := config.Config.TrafficLimiter; settings != nil {
+        global = settings.Bandwidth
+    }
+
+    shapingMutex.Lock()
+    defer shapingMutex.Unlock()
+
+    var uploads, downloads []*rate.Bucket
+    release = func() {}
+    if plan != nil && plan.Bandwidth != (config.BandwidthLimit{}) {
+        key := strings.ToLower(AccountKey(*plan, s, playerName)) + "/" + plan.Name
+        player := bucketsLocked(playerBuckets, key, plan.Bandwidth)
+        player.refs++
+        uploads = append(uploads, player.upload)
+        downloads = append(downloads, player.download)
+
+        var once sync.Once
+        release = func() {
+            once.Do(func() {
+                shapingMutex.Lock()
+                defer shapingMutex.Unlock()
+                // the buckets of players are only kept while they are online
+                if player.refs--; player.refs <= 0 && playerBuckets[key] == player {
+                    delete(playerBuckets, key)
+                }
+            })
+        }
+    }
+    if s.Bandwidth != (config.BandwidthLimit{}) {
+        service := bucketsLocked(serviceBuckets, s.Name, s.Bandwidth)
+        uploads = append(uploads, service.upload)
+        downloads = append(downloads, service.download)
+    }
+    if global != (config.BandwidthLimit{}) {
+        if globalBuckets == nil || globalBuckets.limit != global {
+            globalBuckets = bucketsLocked(make(map[string]*bucketPair), "", global)
+        }
+        uploads = append(uploads, globalBuckets.upload)
+        downloads = append(downloads, globalBuckets.download)
+    }
+
+    return rate.NewShaper(uploads...), rate.NewShaper(downloads...), release
+}
@@ -0,0 +1,112 @@
+package traffic
+
+import (
+    "testing"
+
+    "github.com/InRaining/NoDelay/common/rate"
+    "github.com/InRaining/NoDelay/config"
+)
+
+// withBandwidth sets the bandwidth of the whole proxy and forgets the
+// buckets of earlier tests.
+func withBandwidth(t *testing.T, global config.BandwidthLimit) {
+    saved := config.Config.TrafficLimiter
+    reset := func() {
+        shapingMutex.Lock()
+        globalBuckets = nil
+        serviceBuckets = make(map[string]*bucketPair)
+        playerBuckets = make(map[string]*bucketPair)
+        shapingMutex.Unlock()
+    }
+    t.Cleanup(func() {
+        config.Config.TrafficLimiter = saved
+        reset()
+    })
+    config.Config.TrafficLimiter = &config.TrafficLimiterConfig{Bandwidth: global}
+    reset()
+}
+
+// drained reports whether b has been emptied by a shaper, by taking 1KB
+// that it would have to wait for.
+func drained(b *rate.Bucket) bool {
+    return b.Take(1024) > 0
+}
+
+func TestShapers(t *testing.T) {
+    limit := config.BandwidthLimit{UploadKBps: 8} // 8KB bursts, drained by a single Wait
+    withBandwidth(t, limit)
+    lobby := &config.ConfigProxyService{Name: "lobby", Bandwidth: limit}
+    survival := &config.ConfigProxyService{Name: "survival"}
+    vip := &Plan{Name: "vip", TrafficPlan: config.TrafficPlan{Bandwidth: config.BandwidthLimit{UploadKBps: 8, DownloadKBps: 8}}}
+
+    upload, download, release := Shapers(lobby, "Steve", vip)
+    _, _, release2 := Shapers(lobby, "steve", vip) // the same player on another connection
+    _, _, releaseAlex := Shapers(survival, "Alex", vip)
+    steve, alex := playerBuckets["steve/vip"], playerBuckets["alex/vip"]
+    if steve == nil || alex == nil || steve == alex || steve.refs != 2 {
+        t.Fatalf("player buckets %v, want one for Steve's two connections and one for Alex", playerBuckets)
+    }
+
+    // the upload pays to the player, the service and the whole proxy
+    upload.Wait(8 * 1024)
+    for name, b := range map[string]*rate.Bucket{
+        "player":  steve.upload,
+        "service": serviceBuckets["lobby"].upload,
+        "proxy":   globalBuckets.upload,
+    } {
+        if !drained(b) {
+            t.Errorf("the bucket of the %s was not charged", name)
+        }
+    }
+    if drained(alex.upload) {
+        t.Error("the bucket of another player was charged")
+    }
+    // only the plan limits the download
+    if globalBuckets.download != nil || serviceBuckets["lobby"].download != nil {
+        t.Error("download buckets without a download limit")
+    }
+    download.Wait(8 * 1024)
+    if !drained(steve.download) {
+        t.Error("the download bucket of the player was not charged")
+    }
+
+    // player buckets are dropped with their last connection
+    release()
+    release()
+    if playerBuckets["steve/vip"] != steve {
+        t.Fatal("player buckets dropped while connected")
+    }
+    release2()
+    releaseAlex()
+    if len(playerBuckets) != 0 {
+        t.Errorf("player buckets %v after the players left, want none", playerBuckets)
+    }
+
+    // a changed limit gets new buckets, the same limit keeps them
+    service := serviceBuckets["lobby"]
+    Shapers(lobby, "", nil)
+    if serviceBuckets["lobby"] != service {
+        t.Error("service buckets replaced without a change")
+    }
+    Shapers(&config.ConfigProxyService{Name: "lobby", Bandwidth: config.BandwidthLimit{UploadKBps: 16}}, "", nil)
+    if serviceBuckets["lobby"] == service {
+        t.Error("service buckets kept after the limit changed")
+    }
+
+    // services are scoped per player when the plan is
+    perService := &Plan{Name: "vip", TrafficPlan: config.TrafficPlan{Scope: ScopeService, Bandwidth: limit}}
+    _, _, release = Shapers(lobby, "Steve", perService)
+    if playerBuckets["steve@lobby/vip"] == nil {
+        t.Errorf("player buckets %v, want steve@lobby/vip", playerBuckets)
+    }
+    release()
+}
+
+func TestShapers_Unlimited(t *testing.T) {
+    withBandwidth(t, config.BandwidthLimit{})
+    upload, download, release := Shapers(&config.ConfigProxyService{Name: "lobby"}, "Steve", &Plan{Name: DefaultPlanName})
+    defer release()
+    if upload != nil || download != nil {
+        t.Errorf("shapers %v and %v without any limit, want nil", upload, download)
+    }
+}
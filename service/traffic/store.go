@@ -0,0 +1,358 @@
+package traffic
+
+import (
+    "bufio"
+    "bytes"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "log"
+    "os"
+    "path/filepath"
+    "sync"
+)
+
+// Store persists the traffic records of a TrafficLimiter.
+type Store interface {
+    // Load returns all the records saved.
+    Load() (map[string]*UserTrafficData, error)
+    // Append saves the records changed since the last call. A nil record
+    // means that the record was deleted.
+    Append(changes map[string]*UserTrafficData) error
+    // Snapshot saves all the records, replacing everything saved before.
+    Snapshot(records map[string]*UserTrafficData) error
+    // NeedsSnapshot reports whether Snapshot should be called
+    // before the next periodic snapshot.
+    NeedsSnapshot() bool
+    // External returns the records saved if they were changed by someone
+    // else since the store last read or wrote them, or nil.
+    External() (map[string]*UserTrafficData, error)
+    Close() error
+}
+
+// journalEntry is a line of the journal of a JournalStore.
+type journalEntry struct {
+    Key     string           `json:"key,omitempty"`
+    Record  *UserTrafficData `json:"record,omitempty"`
+    Deleted bool             `json:"deleted,omitempty"`
+}
+
+// journalCompactSize is the size of a journal triggering a snapshot.
+const journalCompactSize = 4 * 1024 * 1024
+
+// journal is an append-only file of JSON lines holding the changes made since
+// the snapshot next to it. Every write is synced, and a torn last line left by
+// a crash is ignored when the journal is read. A line with Snapshot set marks
+// that the lines before it were saved in the snapshot of that hash.
+type journal struct {
+    file string
+    f    *os.File
+    size int64
+}
+
+// journalMark is the line marking a snapshot.
+type journalMark struct {
+    Snapshot string `json:"snapshot,omitempty"`
+}
+
+// read returns the lines written after the mark of the snapshot of hash,
+// leaving out the marks. what names the journal in the logs.
+func (j *journal) read(hash [sha256.Size]byte, what string) ([][]byte, error) {
+    f, err := os.Open(j.file)
+    if err != nil {
+        if os.IsNotExist(err) {
+            return nil, nil
+        }
+        return nil, err
+    }
+    defer f.Close()
+
+    var lines [][]byte
+    var marks []string
+    scanner := bufio.NewScanner(f)
+    scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+    for scanner.Scan() {
+        var mark journalMark
+        if err := json.Unmarshal(scanner.Bytes(), &mark); err != nil {
+            // a crash while appending leaves the last line torn
+            log.Printf("Ignoring the %s journal from line %d: %v", what, len(lines)+1, err)
+            break
+        }
+        lines = append(lines, append([]byte(nil), scanner.Bytes()...))
+        marks = append(marks, mark.Snapshot)
+    }
+    if err := scanner.Err(); err != nil {
+        log.Printf("Error reading %s journal: %v", what, err)
+    }
+
+    // the lines up to the mark of the snapshot are in it already
+    snapshot := hex.EncodeToString(hash[:])
+    start := 0
+    for i := len(marks) - 1; i >= 0; i-- {
+        if marks[i] == snapshot {
+            start = i + 1
+            break
+        }
+    }
+    changes := make([][]byte, 0, len(lines)-start)
+    for i := start; i < len(lines); i++ {
+        if marks[i] == "" {
+            changes = append(changes, lines[i])
+        }
+    }
+    return changes, nil
+}
+
+// append appends data to the journal, opening it if needed, and syncs it.
+func (j *journal) append(data []byte) error {
+    if j.f == nil {
+        f, err := os.OpenFile(j.file, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+        if err != nil {
+            return err
+        }
+        info, err := f.Stat()
+        if err != nil {
+            f.Close()
+            return err
+        }
+        j.f, j.size = f, info.Size()
+    }
+    n, err := j.f.Write(data)
+    j.size += int64(n)
+    if err != nil {
+        return err
+    }
+    return j.f.Sync()
+}
+
+// mark marks the journal, if there is one, with the hash of the snapshot about
+// to be written. Replaying the journal over the new snapshot would bring back
+// the data as it was before it, so after a crash between writing the snapshot
+// and removing the journal, the lines before the mark are skipped.
+func (j *journal) mark(hash [sha256.Size]byte) error {
+    if _, err := os.Stat(j.file); err != nil {
+        return nil
+    }
+    mark, err := json.Marshal(&journalMark{Snapshot: hex.EncodeToString(hash[:])})
+    if err != nil {
+        return err
+    }
+    return j.append(append(mark, '\n'))
+}
+
+// remove removes the journal once its changes are in a snapshot.
+func (j *journal) remove() error {
+    j.close() //nolint:errcheck
+    j.size = 0
+    if err := os.Remove(j.file); err != nil && !os.IsNotExist(err) {
+        return err
+    }
+    return nil
+}
+
+func (j *journal) close() error {
+    if j.f == nil {
+        return nil
+    }
+    err := j.f.Close()
+    j.f = nil
+    return err
+}
+
+// JournalStore keeps a snapshot of all records in a JSON file, which operators
+// may edit, and appends the changes since the snapshot to a journal next to it.
+// Snapshots are written to a temporary file renamed over the old one, so the
+// snapshot is never left half written.
+type JournalStore struct {
+    file string
+
+    mutex    sync.Mutex
+    journal  journal
+    lastHash [sha256.Size]byte // of the snapshot as last read or written
+}
+
+// NewJournalStore creates a store keeping the snapshot in file
+// and the journal in file + ".journal".
+func NewJournalStore(file string) *JournalStore {
+    return &JournalStore{
+        file:    file,
+        journal: journal{file: file + ".journal"},
+    }
+}
+
+func (st *JournalStore) readSnapshotLocked() (map[string]*UserTrafficData, error) {
+    data, err := os.ReadFile(st.file)
+    if err != nil {
+        if os.IsNotExist(err) {
+            return make(map[string]*UserTrafficData), nil
+        }
+        return nil, err
+    }
+    st.lastHash = sha256.Sum256(data)
+
+    records := make(map[string]*UserTrafficData)
+    if len(bytes.TrimSpace(data)) == 0 {
+        return records, nil
+    }
+    if err = json.Unmarshal(data, &records); err != nil {
+        return nil, err
+    }
+    return records, nil
+}
+
+// Load returns the records of the snapshot with the journal replayed over them.
+func (st *JournalStore) Load() (map[string]*UserTrafficData, error) {
+    st.mutex.Lock()
+    defer st.mutex.Unlock()
+
+    records, err := st.readSnapshotLocked()
+    if err != nil {
+        return nil, err
+    }
+
+    lines, err := st.journal.read(st.lastHash, "traffic")
+    if err != nil {
+        return nil, err
+    }
+    replayed := 0
+    for _, line := range lines {
+        var entry journalEntry
+        if err := json.Unmarshal(line, &entry); err != nil {
+            return nil, err
+        }
+        if entry.Deleted {
+            delete(records, entry.Key)
+        } else if entry.Record != nil {
+            records[entry.Key] = entry.Record
+        }
+        replayed++
+    }
+    if replayed > 0 {
+        log.Printf("Replayed %d traffic journal entries", replayed)
+    }
+    return records, nil
+}
+
+// Append writes the changes to the journal and syncs it.
+func (st *JournalStore) Append(changes map[string]*UserTrafficData) error {
+    if len(changes) == 0 {
+        return nil
+    }
+    var buffer bytes.Buffer
+    encoder := json.NewEncoder(&buffer)
+    for key, record := range changes {
+        entry := journalEntry{Key: key, Record: record, Deleted: record == nil}
+        if err := encoder.Encode(&entry); err != nil {
+            return err
+        }
+    }
+
+    st.mutex.Lock()
+    defer st.mutex.Unlock()
+    return st.journal.append(buffer.Bytes())
+}
+
+// NeedsSnapshot reports whether the journal has grown enough to be
+// folded into a snapshot.
+func (st *JournalStore) NeedsSnapshot() bool {
+    st.mutex.Lock()
+    defer st.mutex.Unlock()
+    return st.journal.size >= journalCompactSize
+}
+
+// Snapshot atomically replaces the snapshot with records and empties the journal.
+func (st *JournalStore) Snapshot(records map[string]*UserTrafficData) error {
+    data, err := json.MarshalIndent(records, "", "  ")
+    if err != nil {
+        return err
+    }
+
+    hash := sha256.Sum256(data)
+
+    st.mutex.Lock()
+    defer st.mutex.Unlock()
+    if err = st.journal.mark(hash); err != nil {
+        return err
+    }
+    if err = writeFileAtomic(st.file, data); err != nil {
+        return err
+    }
+    st.lastHash = hash
+    return st.journal.remove()
+}
+
+// External returns the records of the snapshot if the file differs from
+// what the store last read or wrote.
+func (st *JournalStore) External() (map[string]*UserTrafficData, error) {
+    st.mutex.Lock()
+    defer st.mutex.Unlock()
+
+    data, err := os.ReadFile(st.file)
+    if err != nil {
+        if os.IsNotExist(err) {
+            return nil, nil
+        }
+        return nil, err
+    }
+    if sha256.Sum256(data) == st.lastHash {
+        return nil, nil
+    }
+    return st.readSnapshotLocked()
+}
+
+// Close closes the journal.
+func (st *JournalStore) Close() error {
+    st.mutex.Lock()
+    defer st.mutex.Unlock()
+    return st.journal.close()
+}
+
+// writeFileAtomic writes data to a temporary file synced to disk, and then
+// renames it over file, so readers see either the old or the new content.
+func writeFileAtomic(file string, data []byte) (err error) {
+    tmp, err := os.CreateTemp(filepath.Dir(file), filepath.Base(file)+".*.tmp")
+    if err != nil {
+        return err
+    }
+    defer func() {
+        if err != nil {
+            tmp.Close()
+            os.Remove(tmp.Name())
+        }
+    }()
+    if _, err = tmp.Write(data); err != nil {
+        return err
+    }
+    if err = tmp.Sync(); err != nil {
+        return err
+    }
+    if err = tmp.Close(); err != nil {
+        return err
+    }
+    if err = os.Chmod(tmp.Name(), 0644); err != nil {
+        return err
+    }
+    if err = os.Rename(tmp.Name(), file); err != nil {
+        return fmt.Errorf("replace %s: %w", file, err)
+    }
+    return nil
+}
+
+// readOnlyStore loads the records of a store and never writes them.
+type readOnlyStore struct {
+    Store
+}
+
+func (readOnlyStore) Append(map[string]*UserTrafficData) error   { return nil }
+func (readOnlyStore) Snapshot(map[string]*UserTrafficData) error { return nil }
+func (readOnlyStore) NeedsSnapshot() bool                        { return false }
+
+func (readOnlyStore) External() (map[string]*UserTrafficData, error) {
+    return nil, nil
+}
+
+var (
+    _ Store = (*JournalStore)(nil)
+    _ Store = readOnlyStore{}
+)
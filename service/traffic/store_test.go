@@ -0,0 +1,120 @@
+package traffic
+
+import (
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "os"
+    "path/filepath"
+    "testing"
+)
+
+func TestJournalStoreReplay(t *testing.T) {
+    snapshot := map[string]*UserTrafficData{
+        "Steve": {PlayerName: "Steve", UsedBytes: 200},
+        "Alex":  {PlayerName: "Alex", UsedBytes: 50},
+    }
+    snapshotData, _ := json.MarshalIndent(snapshot, "", "  ")
+    hash := sha256.Sum256(snapshotData)
+    mark := `{"snapshot":"` + hex.EncodeToString(hash[:]) + `"}`
+    staleHash := sha256.Sum256([]byte("an older snapshot"))
+    staleMark := `{"snapshot":"` + hex.EncodeToString(staleHash[:]) + `"}`
+
+    for _, tt := range []struct {
+        name    string
+        journal string // lines, empty for no journal
+        want    map[string]int64
+    }{
+        {
+            name: "no journal",
+            want: map[string]int64{"Steve": 200, "Alex": 50},
+        },
+        {
+            name: "changes replayed",
+            journal: `{"key":"Steve","record":{"player_name":"Steve","used_bytes":300}}
+{"key":"Notch","record":{"player_name":"Notch","used_bytes":10}}
+{"key":"Alex","deleted":true}
+`,
+            want: map[string]int64{"Steve": 300, "Notch": 10},
+        },
+        {
+            name: "torn last line",
+            journal: `{"key":"Steve","record":{"player_name":"Steve","used_bytes":300}}
+{"key":"Alex","record":{"player_na`,
+            want: map[string]int64{"Steve": 300, "Alex": 50},
+        },
+        {
+            name: "crash after the snapshot",
+            journal: `{"key":"Steve","record":{"player_name":"Steve","used_bytes":100}}
+{"key":"Notch","deleted":true}
+` + mark + "\n",
+            want: map[string]int64{"Steve": 200, "Alex": 50},
+        },
+        {
+            name: "changes after the mark",
+            journal: `{"key":"Steve","record":{"player_name":"Steve","used_bytes":100}}
+` + mark + `
+{"key":"Alex","record":{"player_name":"Alex","used_bytes":60}}
+`,
+            want: map[string]int64{"Steve": 200, "Alex": 60},
+        },
+        {
+            name: "mark of a snapshot never written",
+            journal: `{"key":"Steve","record":{"player_name":"Steve","used_bytes":300}}
+` + staleMark + `
+{"key":"Alex","record":{"player_name":"Alex","used_bytes":60}}
+`,
+            want: map[string]int64{"Steve": 300, "Alex": 60},
+        },
+    } {
+        t.Run(tt.name, func(t *testing.T) {
+            file := filepath.Join(t.TempDir(), "TrafficTable.json")
+            if err := os.WriteFile(file, snapshotData, 0644); err != nil {
+                t.Fatal(err)
+            }
+            if tt.journal != "" {
+                if err := os.WriteFile(file+".journal", []byte(tt.journal), 0644); err != nil {
+                    t.Fatal(err)
+                }
+            }
+            records, err := NewJournalStore(file).Load()
+            if err != nil {
+                t.Fatal(err)
+            }
+            if len(records) != len(tt.want) {
+                t.Fatalf("loaded %d records, want %d", len(records), len(tt.want))
+            }
+            for key, used := range tt.want {
+                if records[key] == nil || records[key].UsedBytes != used {
+                    t.Errorf("record %s is %+v, want %d bytes used", key, records[key], used)
+                }
+            }
+        })
+    }
+}
+
+func TestJournalStoreSnapshot(t *testing.T) {
+    file := filepath.Join(t.TempDir(), "TrafficTable.json")
+    st := NewJournalStore(file)
+    if err := st.Append(map[string]*UserTrafficData{"Steve": {PlayerName: "Steve", UsedBytes: 100}}); err != nil {
+        t.Fatal(err)
+    }
+    if err := st.Snapshot(map[string]*UserTrafficData{"Steve": {PlayerName: "Steve", UsedBytes: 150}}); err != nil {
+        t.Fatal(err)
+    }
+    if _, err := os.Stat(file + ".journal"); !os.IsNotExist(err) {
+        t.Fatalf("journal left after the snapshot: %v", err)
+    }
+    if err := st.Append(map[string]*UserTrafficData{"Alex": {PlayerName: "Alex", UsedBytes: 5}, "Steve": nil}); err != nil {
+        t.Fatal(err)
+    }
+    st.Close()
+
+    records, err := NewJournalStore(file).Load()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(records) != 1 || records["Alex"] == nil || records["Alex"].UsedBytes != 5 {
+        t.Fatalf("unexpected records %+v", records)
+    }
+}
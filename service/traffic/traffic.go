@@ -1,153 +1,86 @@
 package traffic
 
 import (
-    "fmt"
+    "errors"
     "log"
-    "net"
-    "sync"
-    "syscall"
     "time"
 
     "github.com/InRaining/NoDelay/config"
 )
 
-// CheckUserTrafficByPlayer checks if a player can use the specified amount of traffic.
-func CheckUserTrafficByPlayer(playerName string, bytes int64, defaultLimitMB int64) bool {
+// PrepareAccount applies the plan of a player logging in to a service and
+// returns the key of the traffic counter of the player.
+func PrepareAccount(s *config.ConfigProxyService, playerName string, plan Plan) string {
+    key := AccountKey(plan, s, playerName)
+    if globalTrafficLimiter != nil {
+        globalTrafficLimiter.PrepareAccount(key, playerName, s.Name, plan)
+    }
+    return key
+}
+
+// CheckUserTraffic checks if a player can use the specified amount of traffic.
+// A positive limitMB is the limit given to the connection by the ListAPI.
+func CheckUserTraffic(key string, bytes, limitMB int64) bool {
     if globalTrafficLimiter == nil {
         return true
     }
-    return globalTrafficLimiter.CanUseTraffic(playerName, bytes, defaultLimitMB)
+    return globalTrafficLimiter.CanUseTraffic(key, bytes, limitMB)
 }
 
-// RecordUserTrafficByPlayer records the traffic used by a player.
-func RecordUserTrafficByPlayer(playerName string, bytes int64) {
+// RecordUserTraffic records the traffic used by a player in each direction.
+func RecordUserTraffic(key string, upload, download int64) {
     if globalTrafficLimiter != nil {
-        globalTrafficLimiter.RecordTraffic(playerName, bytes)
+        globalTrafficLimiter.RecordTraffic(key, upload, download)
     }
 }
 
-// GetUserTrafficInfoByPlayer gets player traffic information.
-func GetUserTrafficInfoByPlayer(playerName string) (used, limit float64, percentage float64) {
+// GetUserTrafficInfo gets player traffic information.
+// A positive limitMB is the limit given to the connection by the ListAPI.
+func GetUserTrafficInfo(key string, limitMB int64) (used, limit float64, percentage float64, nextReset time.Time) {
     if globalTrafficLimiter == nil {
-        return 0, 0, 0
+        return 0, 0, 0, time.Time{}
     }
-    return globalTrafficLimiter.GetUserInfo(playerName)
+    return globalTrafficLimiter.GetUserInfo(key, limitMB)
 }
 
-// CheckTrafficLimitByPlayer checks the traffic limit for a player upon login.
-func CheckTrafficLimitByPlayer(s *config.ConfigProxyService, playerName string) bool {
-    // Traffic limit settings are global, not per-service.
-    // Access them from the global config.
-    if globalTrafficLimiter == nil || config.Config.TrafficLimiter == nil || !config.Config.TrafficLimiter.EnableTrafficLimit {
-        return true
-    }
-
-    defaultLimitMB := int64(1024) // Default to 1GB
-    if config.Config.TrafficLimiter.TrafficLimitMB > 0 {
-        defaultLimitMB = config.Config.TrafficLimiter.TrafficLimitMB
-    }
-
-    used, limit, percentage := globalTrafficLimiter.GetUserInfo(playerName)
-
-    // For new players, allow connection and create a record.
-    if used == 0 && limit == 0 {
-        return globalTrafficLimiter.CanUseTraffic(playerName, 0, defaultLimitMB)
-    }
-    
-    if percentage >= 98.0 {
-        log.Printf("Player %s traffic limit exceeded: %.2f MB / %.0f MB (%.1f%%)",
-            playerName, used, limit, percentage)
-        return false
+// GetUserBalance returns the balance of a player, and whether the player is prepaid.
+func GetUserBalance(key string) (balanceMB float64, prepaid bool) {
+    if globalTrafficLimiter == nil {
+        return 0, false
     }
-    
-    return true
-}
-
-// AccurateTrafficMonitorConn is a wrapper for net.Conn to accurately monitor traffic.
-type AccurateTrafficMonitorConn struct {
-    net.Conn
-    playerName      string
-    totalReadBytes  int64
-    totalWriteBytes int64
-    sessionStart    time.Time
-    mutex           sync.Mutex
-    service         *config.ConfigProxyService
+    return globalTrafficLimiter.GetBalance(key)
 }
 
-// NewAccurateTrafficMonitorConn creates a new traffic monitoring connection.
-func NewAccurateTrafficMonitorConn(conn net.Conn, playerName string, s *config.ConfigProxyService) net.Conn {
-    return &AccurateTrafficMonitorConn{
-        Conn:         conn,
-        playerName:   playerName,
-        sessionStart: time.Now(),
-        service:      s,
+// TopUp adds a credit to the balance of a player.
+func TopUp(key string, amountMB int64, reference string, expires time.Time) error {
+    if globalTrafficLimiter == nil {
+        return errors.New("traffic limiter not initialized")
     }
+    return globalTrafficLimiter.TopUp(key, amountMB, reference, expires)
 }
 
-func (tmc *AccurateTrafficMonitorConn) Read(b []byte) (n int, err error) {
-    n, err = tmc.Conn.Read(b)
-    if n > 0 {
-        tmc.mutex.Lock()
-        tmc.totalReadBytes += int64(n)
-        total := tmc.totalReadBytes + tmc.totalWriteBytes
-        tmc.mutex.Unlock()
-
-        RecordUserTrafficByPlayer(tmc.playerName, int64(n))
-
-        // The traffic limit is global, so get it from the global config.
-        if config.Config.TrafficLimiter != nil && !CheckUserTrafficByPlayer(tmc.playerName, 0, config.Config.TrafficLimiter.TrafficLimitMB) {
-            tmc.Close()
-            return 0, fmt.Errorf("traffic limit exceeded for player %s", tmc.playerName)
-        }
-
-        if total%(1024*1024) < int64(n) {
-            log.Printf("Traffic Update: %s - Read: %d bytes, Write: %d bytes, Total: %d bytes",
-                tmc.playerName, tmc.totalReadBytes, tmc.totalWriteBytes, total)
-        }
+// CheckTrafficLimit checks the traffic limit for a player upon login.
+// The account must have been prepared with PrepareAccount. A positive
+// limitMB is the limit given to the connection by the ListAPI, which
+// takes the place of the limit of the account, custom or not.
+func CheckTrafficLimit(key string, limitMB int64) bool {
+    if globalTrafficLimiter == nil || config.Config.TrafficLimiter == nil || !config.Config.TrafficLimiter.EnableTrafficLimit {
+        return true
     }
-    return
-}
-
-func (tmc *AccurateTrafficMonitorConn) Write(b []byte) (n int, err error) {
-    n, err = tmc.Conn.Write(b)
-    if n > 0 {
-        tmc.mutex.Lock()
-        tmc.totalWriteBytes += int64(n)
-        total := tmc.totalReadBytes + tmc.totalWriteBytes
-        tmc.mutex.Unlock()
-
-        RecordUserTrafficByPlayer(tmc.playerName, int64(n))
-
-        // The traffic limit is global, so get it from the global config.
-        if config.Config.TrafficLimiter != nil && !CheckUserTrafficByPlayer(tmc.playerName, 0, config.Config.TrafficLimiter.TrafficLimitMB) {
-            tmc.Close()
-            return 0, fmt.Errorf("traffic limit exceeded for player %s", tmc.playerName)
-        }
-
-        if total%(1024*1024) < int64(n) {
-            log.Printf("Traffic Update: %s - Read: %d bytes, Write: %d bytes, Total: %d bytes",
-                tmc.playerName, tmc.totalReadBytes, tmc.totalWriteBytes, total)
-        }
+    if !globalTrafficLimiter.CanUseTraffic(key, 0, limitMB) {
+        return false
     }
-    return
-}
 
-func (tmc *AccurateTrafficMonitorConn) SyscallConn() (syscall.RawConn, error) {
-    sc, ok := tmc.Conn.(syscall.Conn)
-    if !ok {
-        return nil, fmt.Errorf("underlying connection does not implement syscall.Conn")
+    if _, prepaid := globalTrafficLimiter.GetBalance(key); prepaid {
+        // the balance was checked by CanUseTraffic
+        return true
+    }
+    used, limit, percentage, _ := globalTrafficLimiter.GetUserInfo(key, limitMB)
+    if limit > 0 && percentage >= 98.0 {
+        log.Printf("Player %s traffic limit exceeded: %.2f MB / %.0f MB (%.1f%%)",
+            key, used, limit, percentage)
+        return false
     }
-    return sc.SyscallConn()
-}
-
-func (tmc *AccurateTrafficMonitorConn) Close() error {
-    tmc.mutex.Lock()
-    total := tmc.totalReadBytes + tmc.totalWriteBytes
-    duration := time.Since(tmc.sessionStart)
-    tmc.mutex.Unlock()
-
-    log.Printf("Session ended for %s: Read=%d bytes, Write=%d bytes, Total=%d bytes, Duration=%s",
-        tmc.playerName, tmc.totalReadBytes, tmc.totalWriteBytes, total, duration)
-    return tmc.Conn.Close()
 
+    return true
 }
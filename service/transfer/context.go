@@ -4,6 +4,7 @@ import (
 	"fmt"
 
 	"github.com/InRaining/NoDelay/console"
+	"github.com/InRaining/NoDelay/service/access"
 
 	"github.com/fatih/color"
 	"github.com/zhangyunhao116/fastrand"
@@ -13,12 +14,29 @@ type ConnContext struct {
 	ColoredID      string
 	AdditionalInfo []string
 	Err            error
+	Verdict        access.Verdict // progress through the access policy
+	Upload         Direction
+	Download       Direction
+	closers        []func()
 }
 
 func (c *ConnContext) AttachInfo(info string) {
 	c.AdditionalInfo = append(c.AdditionalInfo, info)
 }
 
+// OnClose registers f to be called when the connection ends.
+func (c *ConnContext) OnClose(f func()) {
+	c.closers = append(c.closers, f)
+}
+
+// Close calls the functions registered by OnClose, the last registered first.
+func (c *ConnContext) Close() {
+	for i := len(c.closers) - 1; i >= 0; i-- {
+		c.closers[i]()
+	}
+	c.closers = nil
+}
+
 func (c *ConnContext) Init() *ConnContext {
 	id := fastrand.Int31()
 	idColor := fastrand.Intn(len(console.ColorList))
@@ -0,0 +1,92 @@
+package transfer
+
+import (
+	"io"
+
+	"github.com/InRaining/NoDelay/common/rate"
+)
+
+// Meter counts the bytes copied in a direction.
+type Meter interface {
+	Add(n int64)
+}
+
+// meterChunk is how many bytes are copied at most between two counts
+// of directions which are metered but not shaped.
+const meterChunk = 64 * 1024
+
+// Direction holds what applies to one direction of a connection.
+// Upload is from the client to the server.
+type Direction struct {
+	Shaper *rate.Shaper // nil when the speed is not limited
+	Meter  Meter        // nil when the traffic is not counted
+}
+
+// Shaped reports whether the speed of the direction is limited.
+func (d Direction) Shaped() bool {
+	return d.Shaper != nil
+}
+
+// chunked reports whether the direction must be copied in chunks,
+// so that each chunk is counted and shaped as it is copied.
+func (d Direction) chunked() bool {
+	return d.Shaper != nil || d.Meter != nil
+}
+
+// copied counts and shapes n bytes just copied.
+func (d Direction) copied(n int64) {
+	if n <= 0 {
+		return
+	}
+	if d.Meter != nil {
+		d.Meter.Add(n)
+	}
+	d.Shaper.Wait(n)
+}
+
+// progress returns the function to call after each write, or nil.
+func (d Direction) progress() func(n int64) {
+	if !d.chunked() {
+		return nil
+	}
+	return d.copied
+}
+
+// writer wraps w so that writes are counted and shaped.
+func (d Direction) writer(w io.Writer) io.Writer {
+	if !d.chunked() {
+		return w
+	}
+	return directionWriter{w, d}
+}
+
+// copy copies src to dst like io.Copy. Counted or shaped directions are
+// copied in chunks by io.CopyN, which keeps the splice path of TCP connections.
+func (d Direction) copy(dst io.Writer, src io.Reader) {
+	if !d.chunked() {
+		io.Copy(dst, src) //nolint:errcheck
+		return
+	}
+	chunk := int64(meterChunk)
+	if d.Shaped() {
+		chunk = d.Shaper.Chunk()
+	}
+	for {
+		n, err := io.CopyN(dst, src, chunk)
+		d.copied(n)
+		if err != nil {
+			return
+		}
+	}
+}
+
+type directionWriter struct {
+	io.Writer
+	direction Direction
+}
+
+func (w directionWriter) Write(p []byte) (n int, err error) {
+	n, err = w.Writer.Write(p)
+	w.direction.copied(int64(n))
+	return
+}
@@ -0,0 +1,60 @@
+package transfer
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/InRaining/NoDelay/common/rate"
+)
+
+// countingMeter records the size of each count.
+type countingMeter []int64
+
+func (m *countingMeter) Add(n int64) {
+	*m = append(*m, n)
+}
+
+func TestDirection_Copy(t *testing.T) {
+	data := bytes.Repeat([]byte("x"), 200*1024+7)
+	for _, tt := range []struct {
+		name      string
+		shaper    *rate.Shaper
+		wantChunk int64
+	}{
+		{name: "metered", wantChunk: meterChunk},
+		{name: "shaped", shaper: rate.NewShaper(rate.NewBucket(1<<30, 16*1024)), wantChunk: 16 * 1024},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var meter countingMeter
+			var dst bytes.Buffer
+			d := Direction{Shaper: tt.shaper, Meter: &meter}
+			d.copy(&dst, bytes.NewReader(data))
+			if !bytes.Equal(dst.Bytes(), data) {
+				t.Fatalf("copied %d bytes, want %d", dst.Len(), len(data))
+			}
+			var total int64
+			for _, n := range meter {
+				if n > tt.wantChunk {
+					t.Errorf("counted %d bytes at once, want at most %d", n, tt.wantChunk)
+				}
+				total += n
+			}
+			if total != int64(len(data)) {
+				t.Errorf("counted %d bytes, want %d", total, len(data))
+			}
+		})
+	}
+
+	// writes through the writer are counted as they are written
+	var meter countingMeter
+	w := Direction{Meter: &meter}.writer(io.Discard)
+	w.Write(data[:100]) //nolint:errcheck
+	w.Write(data[:50])  //nolint:errcheck
+	if len(meter) != 2 || meter[0] != 100 || meter[1] != 50 {
+		t.Errorf("counts %v, want [100 50]", meter)
+	}
+	if w := (Direction{}).writer(io.Discard); w != io.Discard {
+		t.Error("a direction neither metered nor shaped wrapped the writer")
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"sync/atomic"
 
 	"github.com/InRaining/NoDelay/outbound"
+	"github.com/InRaining/NoDelay/service/access"
 )
 
 type Options struct {
@@ -11,5 +12,7 @@ type Options struct {
 	IsTLSHandleNeeded       bool
 	IsMinecraftHandleNeeded bool
 	FlowType                int
+	Policy                  *access.Policy
+	Limiter                 *access.ConnLimiter
 	OnlineCount             atomic.Int32
 }
@@ -27,19 +27,21 @@ type writerOnly struct {
 	io.Writer
 }
 
-func SimpleTransfer(a, b net.Conn, flow int) {
+// SimpleTransfer forwards between the client a and the server b until either
+// side closes. upload applies to the bytes from a to b, download to the others.
+func SimpleTransfer(a, b net.Conn, flow int, upload, download Direction) {
 	//nolint:errcheck
 	switch flow {
 	case FLOW_ORIGIN:
 		go func() {
 			buffer := buf.Get(32 * 1024)
-			io.CopyBuffer(writerOnly{b}, a, buffer)
+			io.CopyBuffer(writerOnly{upload.writer(b)}, a, buffer)
 			buf.Put(buffer)
 			a.Close()
 			b.Close()
 		}()
 		buffer := buf.Get(32 * 1024)
-		io.CopyBuffer(writerOnly{a}, b, buffer)
+		io.CopyBuffer(writerOnly{download.writer(a)}, b, buffer)
 		buf.Put(buffer)
 		a.Close()
 		b.Close()
@@ -56,11 +58,11 @@ func SimpleTransfer(a, b net.Conn, flow int) {
 	case FLOW_AUTO:
 		if osSupportSplice {
 			go func() {
-				io.Copy(b, a)
+				upload.copy(b, a)
 				a.Close()
 				b.Close()
 			}()
-			io.Copy(a, b)
+			download.copy(a, b)
 			a.Close()
 			b.Close()
 			return // TODO: Use MULTIPLE when fail to sendfile or splice
@@ -74,11 +76,11 @@ func SimpleTransfer(a, b net.Conn, flow int) {
 		// bWriter := buf.NewWriter(b)
 
 		go func() {
-			buf.Copy(a, bReader)
+			buf.Copy(a, bReader, download.progress())
 			a.Close()
 			b.Close()
 		}()
-		buf.Copy(b, aReader)
+		buf.Copy(b, aReader, upload.progress())
 		a.Close()
 		b.Close()
 	}
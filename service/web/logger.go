@@ -109,6 +109,16 @@ func StartWebServer() {
     mux.Handle("/", http.FileServer(http.FS(webContent)))
     // "/logs" 路径提供纯文本日志数据
     mux.HandleFunc("/logs", logsApiHandler)
+    // "/stats/hostnames" 路径提供主机名拒绝统计
+    mux.HandleFunc("/stats/hostnames", hostnameStatsHandler)
+    // "/stats/autobans" 路径提供自动封禁列表
+    mux.HandleFunc("/stats/autobans", autoBansHandler)
+    // "/stats/limits" 路径提供连接限制拒绝统计
+    mux.HandleFunc("/stats/limits", limitStatsHandler)
+    // "/stats/traffic/history" 路径提供流量历史查询与导出，需要 WebAPIToken
+    mux.HandleFunc("/stats/traffic/history", requireToken(trafficHistoryHandler))
+    // "/stats/traffic/top" 路径提供流量排行，需要 WebAPIToken
+    mux.HandleFunc("/stats/traffic/top", requireToken(trafficTopHandler))
 
     log.Printf(color.HiCyanString("Starting web log server on http://%s", addr))
 
@@ -127,4 +137,4 @@ func logsApiHandler(w http.ResponseWriter, r *http.Request) {
     }
     w.Header().Set("Content-Type", "text/plain; charset=utf-8")
     fmt.Fprint(w, webLogger.getLogsAsString())
-}
\ No newline at end of file
+}
\ No newline at end of file
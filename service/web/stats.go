@@ -0,0 +1,117 @@
+package web
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/InRaining/NoDelay/config"
+	"github.com/InRaining/NoDelay/service/access"
+	"github.com/InRaining/NoDelay/service/traffic"
+)
+
+// hostnameStatsHandler 提供各服务因主机名被拒绝的连接计数
+func hostnameStatsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(access.GetHostnameStats()) //nolint:errcheck
+}
+
+// autoBansHandler 提供当前生效的自动封禁列表
+func autoBansHandler(w http.ResponseWriter, r *http.Request) {
+	bans := []access.AutoBan{}
+	if tracker := access.GetAbuseTracker(); tracker != nil {
+		bans = tracker.List()
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(bans) //nolint:errcheck
+}
+
+// limitStatsHandler 提供各服务因连接限制被拒绝的次数，按原因分类
+func limitStatsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(access.GetLimitStats()) //nolint:errcheck
+}
+
+// requireToken 要求请求以 Authorization: Bearer <token> 携带 Configuration.WebAPIToken，
+// 未配置令牌时拒绝所有请求
+func requireToken(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var token string
+		if config.Config.Configuration != nil {
+			token = config.Config.Configuration.WebAPIToken
+		}
+		if token == "" {
+			http.Error(w, "Set Configuration.WebAPIToken to enable this endpoint", http.StatusForbidden)
+			return
+		}
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") ||
+			subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// trafficHistoryHandler 按玩家、服务和时间范围查询流量历史，format=csv 时导出CSV
+func trafficHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	history := traffic.GetGlobalHistory()
+	if history == nil {
+		http.Error(w, "Traffic history not initialized", http.StatusServiceUnavailable)
+		return
+	}
+	query := r.URL.Query()
+	from, err := traffic.ParseHistoryTime(query.Get("from"))
+	if err != nil {
+		http.Error(w, "invalid from: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	to, err := traffic.ParseHistoryTime(query.Get("to"))
+	if err != nil {
+		http.Error(w, "invalid to: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	points := history.Query(traffic.HistoryQuery{
+		Player:     query.Get("player"),
+		Service:    query.Get("service"),
+		From:       from,
+		To:         to,
+		Resolution: query.Get("resolution"),
+	})
+
+	if query.Get("format") == "csv" {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", "attachment; filename=traffic-history.csv")
+		traffic.WriteHistoryCSV(w, points) //nolint:errcheck
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	traffic.WriteHistoryJSON(w, points) //nolint:errcheck
+}
+
+// trafficTopHandler 提供最近一段时间（period=hour/day/week/month）流量最多的n名玩家
+func trafficTopHandler(w http.ResponseWriter, r *http.Request) {
+	history := traffic.GetGlobalHistory()
+	if history == nil {
+		http.Error(w, "Traffic history not initialized", http.StatusServiceUnavailable)
+		return
+	}
+	query := r.URL.Query()
+	n, err := strconv.Atoi(query.Get("n"))
+	if err != nil {
+		n = 10
+	}
+	from, resolution := traffic.TopPeriodStart(query.Get("period"), time.Now())
+	top := history.Top(traffic.HistoryQuery{
+		Service:    query.Get("service"),
+		From:       from,
+		Resolution: resolution,
+	}, n)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(top) //nolint:errcheck
+}
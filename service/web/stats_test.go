@@ -0,0 +1,47 @@
+package web
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/InRaining/NoDelay/config"
+)
+
+func TestRequireToken(t *testing.T) {
+	saved := config.Config.Configuration
+	defer func() { config.Config.Configuration = saved }()
+	handler := requireToken(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok")) //nolint:errcheck
+	})
+
+	for _, tt := range []struct {
+		name  string
+		token string
+		auth  string
+		want  int
+	}{
+		{name: "no token configured", auth: "Bearer ", want: http.StatusForbidden},
+		{name: "no header", token: "secret", want: http.StatusUnauthorized},
+		{name: "wrong token", token: "secret", auth: "Bearer guess", want: http.StatusUnauthorized},
+		{name: "not bearer", token: "secret", auth: "Basic secret", want: http.StatusUnauthorized},
+		{name: "prefix of the token", token: "secret", auth: "Bearer sec", want: http.StatusUnauthorized},
+		{name: "token", token: "secret", auth: "Bearer secret", want: http.StatusOK},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			config.Config.Configuration = &config.Configure{WebAPIToken: tt.token}
+			r := httptest.NewRequest(http.MethodGet, "/stats/traffic/history", nil)
+			if tt.auth != "" {
+				r.Header.Set("Authorization", tt.auth)
+			}
+			w := httptest.NewRecorder()
+			handler(w, r)
+			if w.Code != tt.want {
+				t.Errorf("status %d, want %d", w.Code, tt.want)
+			}
+			if tt.want == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") != "Bearer" {
+				t.Error("no WWW-Authenticate challenge")
+			}
+		})
+	}
+}